@@ -1,3 +0,0 @@
-#!/bin/bash
-
-docker build -t gep_lib_build .
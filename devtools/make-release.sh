@@ -6,13 +6,6 @@ set -ex
 
 PFX=""
 
-if [ ! -d "../containers/gepingress/thirdparty" ]
-then
-  echo "you need to build the GEP libraries using containers/gep_lib_build"
-  echo "and copy them to containers/gepingress/thirdparty"
-  exit 1
-fi
-
 pushd $GOPATH/src/github.com/BTrDB/btrdb-server
 dep ensure
 cd btrdbd
@@ -96,7 +89,7 @@ popd
 
 pushd $GOPATH/src/github.com/BTrDB/smartgridstore/tools/gepingress
 go build
-gepingress_ver=`LD_LIBRARY_PATH=thirdparty/Libraries/boost ./gepingress -version`
+gepingress_ver=`./gepingress -version`
 if [[ "$gepingress_ver" != "$target_ver" ]]
 then
   echo "GEP ingress version mismatch - got $gepingress_ver"
@@ -8,9 +8,11 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/BTrDB/btrdb-server/bte"
 	"github.com/BTrDB/smartgridstore/acl"
+	"github.com/BTrDB/smartgridstore/tools/btrdbdu/usage"
 	"github.com/BTrDB/smartgridstore/tools/certutils"
 	"github.com/BTrDB/smartgridstore/tools/manifest"
 	etcd "github.com/coreos/etcd/clientv3"
@@ -295,6 +297,57 @@ func (a *apiProvider) ManifestLsDevs(ctx context.Context, p *ManifestLsDevsParam
 	return rv, nil
 }
 
+func (a *apiProvider) ManifestStatus(ctx context.Context, p *ManifestStatusParams) (*ManifestStatusResponse, error) {
+	u, ok := ctx.Value(UserObject).(*acl.User)
+	if !ok || !u.HasCapability("admin") {
+		return &ManifestStatusResponse{
+			Stat: &Status{
+				Code: bte.Unauthorized,
+				Msg:  "user does not have 'admin' permissions",
+			},
+		}, nil
+	}
+	devs, err := manifest.RetrieveMultipleManifestDevices(ctx, a.ec, p.Deviceidprefix)
+	if err != nil {
+		return &ManifestStatusResponse{
+			Stat: &Status{
+				Code: bte.ManifestError,
+				Msg:  err.Error(),
+			},
+		}, nil
+	}
+	statuses, err := manifest.RetrieveMultipleDeviceStatus(ctx, a.ec, p.Deviceidprefix)
+	if err != nil {
+		return &ManifestStatusResponse{
+			Stat: &Status{
+				Code: bte.ManifestError,
+				Msg:  err.Error(),
+			},
+		}, nil
+	}
+	bydesc := make(map[string]*manifest.DeviceStatus)
+	for _, st := range statuses {
+		bydesc[st.Descriptor] = st
+	}
+	rv := &ManifestStatusResponse{}
+	for _, dev := range devs {
+		d := &DeviceStatus{Deviceid: dev.Descriptor}
+		st, ok := bydesc[dev.Descriptor]
+		if ok {
+			d.Online = true
+			d.Node = st.Node
+			d.State = st.State
+			d.Lastreceived = st.LastReceived
+			d.Lasterror = st.LastError
+			d.Lasterrortime = st.LastErrorTime
+			d.Pointspersecond = st.PointsPerSecond
+			d.Updated = st.Updated
+		}
+		rv.Devices = append(rv.Devices, d)
+	}
+	return rv, nil
+}
+
 func (a *apiProvider) GetAPIKey(ctx context.Context, p *GetAPIKeyParams) (*APIKeyResponse, error) {
 	u, ok := ctx.Value(UserObject).(*acl.User)
 	if !ok {
@@ -344,3 +397,73 @@ func (a *apiProvider) ResetAPIKey(ctx context.Context, p *ResetAPIKeyParams) (*A
 		Apikey: apik,
 	}, nil
 }
+
+func collectionStorage(col string, u usage.Usage, g *usage.Growth) *CollectionStorage {
+	rv := &CollectionStorage{
+		Collection:    col,
+		Hotbytes:      u.HotBytes,
+		Coldbytes:     u.ColdBytes,
+		Points:        u.Points,
+		Streams:       uint32(u.Streams),
+		Bytesperpoint: u.BytesPerPoint(),
+	}
+	if g != nil && col != "" {
+		rv.Growthperday = g.PerDay(col)
+	}
+	return rv
+}
+
+func (a *apiProvider) StorageUsage(ctx context.Context, p *StorageUsageParams) (*StorageUsageResponse, error) {
+	u, ok := ctx.Value(UserObject).(*acl.User)
+	if !ok || !u.HasCapability("admin") {
+		return &StorageUsageResponse{
+			Stat: &Status{
+				Code: bte.Unauthorized,
+				Msg:  "user does not have 'admin' permissions",
+			},
+		}, nil
+	}
+	top, depth, days := 10, 1, 7
+	if p.Top != 0 {
+		top = int(p.Top)
+	}
+	if p.Depth != 0 {
+		depth = int(p.Depth)
+	}
+	if p.Windowdays != 0 {
+		days = int(p.Windowdays)
+	}
+	snaps, err := usage.RetrieveSnapshots(ctx, a.ec)
+	if err != nil {
+		return &StorageUsageResponse{
+			Stat: &Status{
+				Code: bte.ManifestError,
+				Msg:  err.Error(),
+			},
+		}, nil
+	}
+	if len(snaps) == 0 {
+		return &StorageUsageResponse{}, nil
+	}
+	last := snaps[len(snaps)-1]
+	g := usage.NewGrowth(snaps, time.Duration(days)*24*time.Hour)
+	rv := &StorageUsageResponse{
+		Time:         last.Time,
+		Total:        collectionStorage("", last.Total, g),
+		Orphaned:     collectionStorage("", last.Orphaned, nil),
+		Clustertotal: last.Cluster.TotalBytes,
+		Clusterused:  last.Cluster.UsedBytes,
+		Clusteravail: last.Cluster.AvailBytes,
+	}
+	if g != nil {
+		rv.Total.Growthperday = g.TotalPerDay()
+		rv.Clustergrowthperday = g.ClusterPerDay()
+		if full, ok := g.DaysUntilFull(); ok {
+			rv.Daysuntilfull = full
+		}
+	}
+	for _, cu := range usage.Top(last, top, depth) {
+		rv.Collections = append(rv.Collections, collectionStorage(cu.Collection, cu.Usage, g))
+	}
+	return rv, nil
+}
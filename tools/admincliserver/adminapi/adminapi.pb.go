@@ -35,7 +35,7 @@ func (m *ResetAPIKeyParams) Reset()         { *m = ResetAPIKeyParams{} }
 func (m *ResetAPIKeyParams) String() string { return proto.CompactTextString(m) }
 func (*ResetAPIKeyParams) ProtoMessage()    {}
 func (*ResetAPIKeyParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{0}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{0}
 }
 func (m *ResetAPIKeyParams) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ResetAPIKeyParams.Unmarshal(m, b)
@@ -65,7 +65,7 @@ func (m *GetAPIKeyParams) Reset()         { *m = GetAPIKeyParams{} }
 func (m *GetAPIKeyParams) String() string { return proto.CompactTextString(m) }
 func (*GetAPIKeyParams) ProtoMessage()    {}
 func (*GetAPIKeyParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{1}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{1}
 }
 func (m *GetAPIKeyParams) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetAPIKeyParams.Unmarshal(m, b)
@@ -97,7 +97,7 @@ func (m *APIKeyResponse) Reset()         { *m = APIKeyResponse{} }
 func (m *APIKeyResponse) String() string { return proto.CompactTextString(m) }
 func (*APIKeyResponse) ProtoMessage()    {}
 func (*APIKeyResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{2}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{2}
 }
 func (m *APIKeyResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_APIKeyResponse.Unmarshal(m, b)
@@ -143,7 +143,7 @@ func (m *ManifestAddParams) Reset()         { *m = ManifestAddParams{} }
 func (m *ManifestAddParams) String() string { return proto.CompactTextString(m) }
 func (*ManifestAddParams) ProtoMessage()    {}
 func (*ManifestAddParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{3}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{3}
 }
 func (m *ManifestAddParams) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestAddParams.Unmarshal(m, b)
@@ -189,7 +189,7 @@ func (m *ManifestAddResponse) Reset()         { *m = ManifestAddResponse{} }
 func (m *ManifestAddResponse) String() string { return proto.CompactTextString(m) }
 func (*ManifestAddResponse) ProtoMessage()    {}
 func (*ManifestAddResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{4}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{4}
 }
 func (m *ManifestAddResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestAddResponse.Unmarshal(m, b)
@@ -235,7 +235,7 @@ func (m *MetaKeyValue) Reset()         { *m = MetaKeyValue{} }
 func (m *MetaKeyValue) String() string { return proto.CompactTextString(m) }
 func (*MetaKeyValue) ProtoMessage()    {}
 func (*MetaKeyValue) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{5}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{5}
 }
 func (m *MetaKeyValue) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_MetaKeyValue.Unmarshal(m, b)
@@ -280,7 +280,7 @@ func (m *ManifestDelParams) Reset()         { *m = ManifestDelParams{} }
 func (m *ManifestDelParams) String() string { return proto.CompactTextString(m) }
 func (*ManifestDelParams) ProtoMessage()    {}
 func (*ManifestDelParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{6}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{6}
 }
 func (m *ManifestDelParams) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestDelParams.Unmarshal(m, b)
@@ -319,7 +319,7 @@ func (m *ManifestDelResponse) Reset()         { *m = ManifestDelResponse{} }
 func (m *ManifestDelResponse) String() string { return proto.CompactTextString(m) }
 func (*ManifestDelResponse) ProtoMessage()    {}
 func (*ManifestDelResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{7}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{7}
 }
 func (m *ManifestDelResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestDelResponse.Unmarshal(m, b)
@@ -364,7 +364,7 @@ func (m *ManifestDelPrefixParams) Reset()         { *m = ManifestDelPrefixParams
 func (m *ManifestDelPrefixParams) String() string { return proto.CompactTextString(m) }
 func (*ManifestDelPrefixParams) ProtoMessage()    {}
 func (*ManifestDelPrefixParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{8}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{8}
 }
 func (m *ManifestDelPrefixParams) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestDelPrefixParams.Unmarshal(m, b)
@@ -403,7 +403,7 @@ func (m *ManifestDelPrefixResponse) Reset()         { *m = ManifestDelPrefixResp
 func (m *ManifestDelPrefixResponse) String() string { return proto.CompactTextString(m) }
 func (*ManifestDelPrefixResponse) ProtoMessage()    {}
 func (*ManifestDelPrefixResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{9}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{9}
 }
 func (m *ManifestDelPrefixResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestDelPrefixResponse.Unmarshal(m, b)
@@ -448,7 +448,7 @@ func (m *ManifestLsDevsParams) Reset()         { *m = ManifestLsDevsParams{} }
 func (m *ManifestLsDevsParams) String() string { return proto.CompactTextString(m) }
 func (*ManifestLsDevsParams) ProtoMessage()    {}
 func (*ManifestLsDevsParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{10}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{10}
 }
 func (m *ManifestLsDevsParams) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestLsDevsParams.Unmarshal(m, b)
@@ -487,7 +487,7 @@ func (m *ManifestLsDevsResponse) Reset()         { *m = ManifestLsDevsResponse{}
 func (m *ManifestLsDevsResponse) String() string { return proto.CompactTextString(m) }
 func (*ManifestLsDevsResponse) ProtoMessage()    {}
 func (*ManifestLsDevsResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{11}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{11}
 }
 func (m *ManifestLsDevsResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestLsDevsResponse.Unmarshal(m, b)
@@ -533,7 +533,7 @@ func (m *ManifestDevice) Reset()         { *m = ManifestDevice{} }
 func (m *ManifestDevice) String() string { return proto.CompactTextString(m) }
 func (*ManifestDevice) ProtoMessage()    {}
 func (*ManifestDevice) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{12}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{12}
 }
 func (m *ManifestDevice) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ManifestDevice.Unmarshal(m, b)
@@ -567,6 +567,451 @@ func (m *ManifestDevice) GetMetadata() []*MetaKeyValue {
 	return nil
 }
 
+type ManifestStatusParams struct {
+	Deviceidprefix       string   `protobuf:"bytes,1,opt,name=deviceidprefix,proto3" json:"deviceidprefix,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ManifestStatusParams) Reset()         { *m = ManifestStatusParams{} }
+func (m *ManifestStatusParams) String() string { return proto.CompactTextString(m) }
+func (*ManifestStatusParams) ProtoMessage()    {}
+func (*ManifestStatusParams) Descriptor() ([]byte, []int) {
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{13}
+}
+func (m *ManifestStatusParams) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ManifestStatusParams.Unmarshal(m, b)
+}
+func (m *ManifestStatusParams) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ManifestStatusParams.Marshal(b, m, deterministic)
+}
+func (dst *ManifestStatusParams) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ManifestStatusParams.Merge(dst, src)
+}
+func (m *ManifestStatusParams) XXX_Size() int {
+	return xxx_messageInfo_ManifestStatusParams.Size(m)
+}
+func (m *ManifestStatusParams) XXX_DiscardUnknown() {
+	xxx_messageInfo_ManifestStatusParams.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ManifestStatusParams proto.InternalMessageInfo
+
+func (m *ManifestStatusParams) GetDeviceidprefix() string {
+	if m != nil {
+		return m.Deviceidprefix
+	}
+	return ""
+}
+
+type ManifestStatusResponse struct {
+	Stat                 *Status         `protobuf:"bytes,1,opt,name=stat,proto3" json:"stat,omitempty"`
+	Devices              []*DeviceStatus `protobuf:"bytes,2,rep,name=devices,proto3" json:"devices,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *ManifestStatusResponse) Reset()         { *m = ManifestStatusResponse{} }
+func (m *ManifestStatusResponse) String() string { return proto.CompactTextString(m) }
+func (*ManifestStatusResponse) ProtoMessage()    {}
+func (*ManifestStatusResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{14}
+}
+func (m *ManifestStatusResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ManifestStatusResponse.Unmarshal(m, b)
+}
+func (m *ManifestStatusResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ManifestStatusResponse.Marshal(b, m, deterministic)
+}
+func (dst *ManifestStatusResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ManifestStatusResponse.Merge(dst, src)
+}
+func (m *ManifestStatusResponse) XXX_Size() int {
+	return xxx_messageInfo_ManifestStatusResponse.Size(m)
+}
+func (m *ManifestStatusResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ManifestStatusResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ManifestStatusResponse proto.InternalMessageInfo
+
+func (m *ManifestStatusResponse) GetStat() *Status {
+	if m != nil {
+		return m.Stat
+	}
+	return nil
+}
+
+func (m *ManifestStatusResponse) GetDevices() []*DeviceStatus {
+	if m != nil {
+		return m.Devices
+	}
+	return nil
+}
+
+// Times are nanoseconds since the epoch. If online is false no ingress
+// daemon is heartbeating the device and the other fields are empty.
+// lastreceived is when data last arrived, not the time of the data.
+type DeviceStatus struct {
+	Deviceid             string   `protobuf:"bytes,1,opt,name=deviceid,proto3" json:"deviceid,omitempty"`
+	Online               bool     `protobuf:"varint,2,opt,name=online,proto3" json:"online,omitempty"`
+	Node                 string   `protobuf:"bytes,3,opt,name=node,proto3" json:"node,omitempty"`
+	State                string   `protobuf:"bytes,4,opt,name=state,proto3" json:"state,omitempty"`
+	Lastreceived         int64    `protobuf:"varint,5,opt,name=lastreceived,proto3" json:"lastreceived,omitempty"`
+	Lasterror            string   `protobuf:"bytes,6,opt,name=lasterror,proto3" json:"lasterror,omitempty"`
+	Lasterrortime        int64    `protobuf:"varint,7,opt,name=lasterrortime,proto3" json:"lasterrortime,omitempty"`
+	Pointspersecond      float64  `protobuf:"fixed64,8,opt,name=pointspersecond,proto3" json:"pointspersecond,omitempty"`
+	Updated              int64    `protobuf:"varint,9,opt,name=updated,proto3" json:"updated,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeviceStatus) Reset()         { *m = DeviceStatus{} }
+func (m *DeviceStatus) String() string { return proto.CompactTextString(m) }
+func (*DeviceStatus) ProtoMessage()    {}
+func (*DeviceStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{15}
+}
+func (m *DeviceStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeviceStatus.Unmarshal(m, b)
+}
+func (m *DeviceStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeviceStatus.Marshal(b, m, deterministic)
+}
+func (dst *DeviceStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeviceStatus.Merge(dst, src)
+}
+func (m *DeviceStatus) XXX_Size() int {
+	return xxx_messageInfo_DeviceStatus.Size(m)
+}
+func (m *DeviceStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeviceStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeviceStatus proto.InternalMessageInfo
+
+func (m *DeviceStatus) GetDeviceid() string {
+	if m != nil {
+		return m.Deviceid
+	}
+	return ""
+}
+
+func (m *DeviceStatus) GetOnline() bool {
+	if m != nil {
+		return m.Online
+	}
+	return false
+}
+
+func (m *DeviceStatus) GetNode() string {
+	if m != nil {
+		return m.Node
+	}
+	return ""
+}
+
+func (m *DeviceStatus) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *DeviceStatus) GetLastreceived() int64 {
+	if m != nil {
+		return m.Lastreceived
+	}
+	return 0
+}
+
+func (m *DeviceStatus) GetLasterror() string {
+	if m != nil {
+		return m.Lasterror
+	}
+	return ""
+}
+
+func (m *DeviceStatus) GetLasterrortime() int64 {
+	if m != nil {
+		return m.Lasterrortime
+	}
+	return 0
+}
+
+func (m *DeviceStatus) GetPointspersecond() float64 {
+	if m != nil {
+		return m.Pointspersecond
+	}
+	return 0
+}
+
+func (m *DeviceStatus) GetUpdated() int64 {
+	if m != nil {
+		return m.Updated
+	}
+	return 0
+}
+
+// Top is the number of collections, default 10, depth levels deep, default 1.
+// Growth is measured over the last windowdays days, default 7
+type StorageUsageParams struct {
+	Top                  uint32   `protobuf:"varint,1,opt,name=top,proto3" json:"top,omitempty"`
+	Depth                uint32   `protobuf:"varint,2,opt,name=depth,proto3" json:"depth,omitempty"`
+	Windowdays           uint32   `protobuf:"varint,3,opt,name=windowdays,proto3" json:"windowdays,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StorageUsageParams) Reset()         { *m = StorageUsageParams{} }
+func (m *StorageUsageParams) String() string { return proto.CompactTextString(m) }
+func (*StorageUsageParams) ProtoMessage()    {}
+func (*StorageUsageParams) Descriptor() ([]byte, []int) {
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{16}
+}
+func (m *StorageUsageParams) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StorageUsageParams.Unmarshal(m, b)
+}
+func (m *StorageUsageParams) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StorageUsageParams.Marshal(b, m, deterministic)
+}
+func (dst *StorageUsageParams) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StorageUsageParams.Merge(dst, src)
+}
+func (m *StorageUsageParams) XXX_Size() int {
+	return xxx_messageInfo_StorageUsageParams.Size(m)
+}
+func (m *StorageUsageParams) XXX_DiscardUnknown() {
+	xxx_messageInfo_StorageUsageParams.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StorageUsageParams proto.InternalMessageInfo
+
+func (m *StorageUsageParams) GetTop() uint32 {
+	if m != nil {
+		return m.Top
+	}
+	return 0
+}
+
+func (m *StorageUsageParams) GetDepth() uint32 {
+	if m != nil {
+		return m.Depth
+	}
+	return 0
+}
+
+func (m *StorageUsageParams) GetWindowdays() uint32 {
+	if m != nil {
+		return m.Windowdays
+	}
+	return 0
+}
+
+// The usage in the newest btrdbdu snapshot, which was taken at time
+// (nanoseconds since the epoch). Time is zero if there are no snapshots.
+// Daysuntilfull is zero if the cluster is not growing
+type StorageUsageResponse struct {
+	Stat                 *Status              `protobuf:"bytes,1,opt,name=stat,proto3" json:"stat,omitempty"`
+	Time                 int64                `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
+	Total                *CollectionStorage   `protobuf:"bytes,3,opt,name=total,proto3" json:"total,omitempty"`
+	Orphaned             *CollectionStorage   `protobuf:"bytes,4,opt,name=orphaned,proto3" json:"orphaned,omitempty"`
+	Clustertotal         uint64               `protobuf:"varint,5,opt,name=clustertotal,proto3" json:"clustertotal,omitempty"`
+	Clusterused          uint64               `protobuf:"varint,6,opt,name=clusterused,proto3" json:"clusterused,omitempty"`
+	Clusteravail         uint64               `protobuf:"varint,7,opt,name=clusteravail,proto3" json:"clusteravail,omitempty"`
+	Clustergrowthperday  float64              `protobuf:"fixed64,8,opt,name=clustergrowthperday,proto3" json:"clustergrowthperday,omitempty"`
+	Daysuntilfull        float64              `protobuf:"fixed64,9,opt,name=daysuntilfull,proto3" json:"daysuntilfull,omitempty"`
+	Collections          []*CollectionStorage `protobuf:"bytes,10,rep,name=collections,proto3" json:"collections,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *StorageUsageResponse) Reset()         { *m = StorageUsageResponse{} }
+func (m *StorageUsageResponse) String() string { return proto.CompactTextString(m) }
+func (*StorageUsageResponse) ProtoMessage()    {}
+func (*StorageUsageResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{17}
+}
+func (m *StorageUsageResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StorageUsageResponse.Unmarshal(m, b)
+}
+func (m *StorageUsageResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StorageUsageResponse.Marshal(b, m, deterministic)
+}
+func (dst *StorageUsageResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StorageUsageResponse.Merge(dst, src)
+}
+func (m *StorageUsageResponse) XXX_Size() int {
+	return xxx_messageInfo_StorageUsageResponse.Size(m)
+}
+func (m *StorageUsageResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_StorageUsageResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StorageUsageResponse proto.InternalMessageInfo
+
+func (m *StorageUsageResponse) GetStat() *Status {
+	if m != nil {
+		return m.Stat
+	}
+	return nil
+}
+
+func (m *StorageUsageResponse) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *StorageUsageResponse) GetTotal() *CollectionStorage {
+	if m != nil {
+		return m.Total
+	}
+	return nil
+}
+
+func (m *StorageUsageResponse) GetOrphaned() *CollectionStorage {
+	if m != nil {
+		return m.Orphaned
+	}
+	return nil
+}
+
+func (m *StorageUsageResponse) GetClustertotal() uint64 {
+	if m != nil {
+		return m.Clustertotal
+	}
+	return 0
+}
+
+func (m *StorageUsageResponse) GetClusterused() uint64 {
+	if m != nil {
+		return m.Clusterused
+	}
+	return 0
+}
+
+func (m *StorageUsageResponse) GetClusteravail() uint64 {
+	if m != nil {
+		return m.Clusteravail
+	}
+	return 0
+}
+
+func (m *StorageUsageResponse) GetClustergrowthperday() float64 {
+	if m != nil {
+		return m.Clustergrowthperday
+	}
+	return 0
+}
+
+func (m *StorageUsageResponse) GetDaysuntilfull() float64 {
+	if m != nil {
+		return m.Daysuntilfull
+	}
+	return 0
+}
+
+func (m *StorageUsageResponse) GetCollections() []*CollectionStorage {
+	if m != nil {
+		return m.Collections
+	}
+	return nil
+}
+
+// Sizes are in bytes. Growth is zero if there is only one snapshot
+type CollectionStorage struct {
+	Collection           string   `protobuf:"bytes,1,opt,name=collection,proto3" json:"collection,omitempty"`
+	Hotbytes             uint64   `protobuf:"varint,2,opt,name=hotbytes,proto3" json:"hotbytes,omitempty"`
+	Coldbytes            uint64   `protobuf:"varint,3,opt,name=coldbytes,proto3" json:"coldbytes,omitempty"`
+	Points               uint64   `protobuf:"varint,4,opt,name=points,proto3" json:"points,omitempty"`
+	Streams              uint32   `protobuf:"varint,5,opt,name=streams,proto3" json:"streams,omitempty"`
+	Bytesperpoint        float64  `protobuf:"fixed64,6,opt,name=bytesperpoint,proto3" json:"bytesperpoint,omitempty"`
+	Growthperday         float64  `protobuf:"fixed64,7,opt,name=growthperday,proto3" json:"growthperday,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CollectionStorage) Reset()         { *m = CollectionStorage{} }
+func (m *CollectionStorage) String() string { return proto.CompactTextString(m) }
+func (*CollectionStorage) ProtoMessage()    {}
+func (*CollectionStorage) Descriptor() ([]byte, []int) {
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{18}
+}
+func (m *CollectionStorage) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CollectionStorage.Unmarshal(m, b)
+}
+func (m *CollectionStorage) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CollectionStorage.Marshal(b, m, deterministic)
+}
+func (dst *CollectionStorage) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CollectionStorage.Merge(dst, src)
+}
+func (m *CollectionStorage) XXX_Size() int {
+	return xxx_messageInfo_CollectionStorage.Size(m)
+}
+func (m *CollectionStorage) XXX_DiscardUnknown() {
+	xxx_messageInfo_CollectionStorage.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CollectionStorage proto.InternalMessageInfo
+
+func (m *CollectionStorage) GetCollection() string {
+	if m != nil {
+		return m.Collection
+	}
+	return ""
+}
+
+func (m *CollectionStorage) GetHotbytes() uint64 {
+	if m != nil {
+		return m.Hotbytes
+	}
+	return 0
+}
+
+func (m *CollectionStorage) GetColdbytes() uint64 {
+	if m != nil {
+		return m.Coldbytes
+	}
+	return 0
+}
+
+func (m *CollectionStorage) GetPoints() uint64 {
+	if m != nil {
+		return m.Points
+	}
+	return 0
+}
+
+func (m *CollectionStorage) GetStreams() uint32 {
+	if m != nil {
+		return m.Streams
+	}
+	return 0
+}
+
+func (m *CollectionStorage) GetBytesperpoint() float64 {
+	if m != nil {
+		return m.Bytesperpoint
+	}
+	return 0
+}
+
+func (m *CollectionStorage) GetGrowthperday() float64 {
+	if m != nil {
+		return m.Growthperday
+	}
+	return 0
+}
+
 type Status struct {
 	Code                 uint32   `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
 	Msg                  string   `protobuf:"bytes,2,opt,name=msg,proto3" json:"msg,omitempty"`
@@ -579,7 +1024,7 @@ func (m *Status) Reset()         { *m = Status{} }
 func (m *Status) String() string { return proto.CompactTextString(m) }
 func (*Status) ProtoMessage()    {}
 func (*Status) Descriptor() ([]byte, []int) {
-	return fileDescriptor_adminapi_7737aa5836920c8d, []int{13}
+	return fileDescriptor_adminapi_31c95749416d9e22, []int{19}
 }
 func (m *Status) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Status.Unmarshal(m, b)
@@ -627,6 +1072,12 @@ func init() {
 	proto.RegisterType((*ManifestLsDevsParams)(nil), "adminapi.ManifestLsDevsParams")
 	proto.RegisterType((*ManifestLsDevsResponse)(nil), "adminapi.ManifestLsDevsResponse")
 	proto.RegisterType((*ManifestDevice)(nil), "adminapi.ManifestDevice")
+	proto.RegisterType((*ManifestStatusParams)(nil), "adminapi.ManifestStatusParams")
+	proto.RegisterType((*ManifestStatusResponse)(nil), "adminapi.ManifestStatusResponse")
+	proto.RegisterType((*DeviceStatus)(nil), "adminapi.DeviceStatus")
+	proto.RegisterType((*StorageUsageParams)(nil), "adminapi.StorageUsageParams")
+	proto.RegisterType((*StorageUsageResponse)(nil), "adminapi.StorageUsageResponse")
+	proto.RegisterType((*CollectionStorage)(nil), "adminapi.CollectionStorage")
 	proto.RegisterType((*Status)(nil), "adminapi.Status")
 }
 
@@ -647,8 +1098,10 @@ type BTrDBAdminClient interface {
 	ManifestDel(ctx context.Context, in *ManifestDelParams, opts ...grpc.CallOption) (*ManifestDelResponse, error)
 	ManifestDelPrefix(ctx context.Context, in *ManifestDelPrefixParams, opts ...grpc.CallOption) (*ManifestDelPrefixResponse, error)
 	ManifestLsDevs(ctx context.Context, in *ManifestLsDevsParams, opts ...grpc.CallOption) (*ManifestLsDevsResponse, error)
+	ManifestStatus(ctx context.Context, in *ManifestStatusParams, opts ...grpc.CallOption) (*ManifestStatusResponse, error)
 	ResetAPIKey(ctx context.Context, in *ResetAPIKeyParams, opts ...grpc.CallOption) (*APIKeyResponse, error)
 	GetAPIKey(ctx context.Context, in *GetAPIKeyParams, opts ...grpc.CallOption) (*APIKeyResponse, error)
+	StorageUsage(ctx context.Context, in *StorageUsageParams, opts ...grpc.CallOption) (*StorageUsageResponse, error)
 }
 
 type bTrDBAdminClient struct {
@@ -695,6 +1148,15 @@ func (c *bTrDBAdminClient) ManifestLsDevs(ctx context.Context, in *ManifestLsDev
 	return out, nil
 }
 
+func (c *bTrDBAdminClient) ManifestStatus(ctx context.Context, in *ManifestStatusParams, opts ...grpc.CallOption) (*ManifestStatusResponse, error) {
+	out := new(ManifestStatusResponse)
+	err := c.cc.Invoke(ctx, "/adminapi.BTrDBAdmin/ManifestStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *bTrDBAdminClient) ResetAPIKey(ctx context.Context, in *ResetAPIKeyParams, opts ...grpc.CallOption) (*APIKeyResponse, error) {
 	out := new(APIKeyResponse)
 	err := c.cc.Invoke(ctx, "/adminapi.BTrDBAdmin/ResetAPIKey", in, out, opts...)
@@ -713,6 +1175,15 @@ func (c *bTrDBAdminClient) GetAPIKey(ctx context.Context, in *GetAPIKeyParams, o
 	return out, nil
 }
 
+func (c *bTrDBAdminClient) StorageUsage(ctx context.Context, in *StorageUsageParams, opts ...grpc.CallOption) (*StorageUsageResponse, error) {
+	out := new(StorageUsageResponse)
+	err := c.cc.Invoke(ctx, "/adminapi.BTrDBAdmin/StorageUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BTrDBAdminServer is the server API for BTrDBAdmin service.
 type BTrDBAdminServer interface {
 	// Requires Manifest capability
@@ -720,8 +1191,10 @@ type BTrDBAdminServer interface {
 	ManifestDel(context.Context, *ManifestDelParams) (*ManifestDelResponse, error)
 	ManifestDelPrefix(context.Context, *ManifestDelPrefixParams) (*ManifestDelPrefixResponse, error)
 	ManifestLsDevs(context.Context, *ManifestLsDevsParams) (*ManifestLsDevsResponse, error)
+	ManifestStatus(context.Context, *ManifestStatusParams) (*ManifestStatusResponse, error)
 	ResetAPIKey(context.Context, *ResetAPIKeyParams) (*APIKeyResponse, error)
 	GetAPIKey(context.Context, *GetAPIKeyParams) (*APIKeyResponse, error)
+	StorageUsage(context.Context, *StorageUsageParams) (*StorageUsageResponse, error)
 }
 
 func RegisterBTrDBAdminServer(s *grpc.Server, srv BTrDBAdminServer) {
@@ -800,6 +1273,24 @@ func _BTrDBAdmin_ManifestLsDevs_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BTrDBAdmin_ManifestStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ManifestStatusParams)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BTrDBAdminServer).ManifestStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/adminapi.BTrDBAdmin/ManifestStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BTrDBAdminServer).ManifestStatus(ctx, req.(*ManifestStatusParams))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _BTrDBAdmin_ResetAPIKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ResetAPIKeyParams)
 	if err := dec(in); err != nil {
@@ -836,6 +1327,24 @@ func _BTrDBAdmin_GetAPIKey_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BTrDBAdmin_StorageUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StorageUsageParams)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BTrDBAdminServer).StorageUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/adminapi.BTrDBAdmin/StorageUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BTrDBAdminServer).StorageUsage(ctx, req.(*StorageUsageParams))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _BTrDBAdmin_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "adminapi.BTrDBAdmin",
 	HandlerType: (*BTrDBAdminServer)(nil),
@@ -856,6 +1365,10 @@ var _BTrDBAdmin_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ManifestLsDevs",
 			Handler:    _BTrDBAdmin_ManifestLsDevs_Handler,
 		},
+		{
+			MethodName: "ManifestStatus",
+			Handler:    _BTrDBAdmin_ManifestStatus_Handler,
+		},
 		{
 			MethodName: "ResetAPIKey",
 			Handler:    _BTrDBAdmin_ResetAPIKey_Handler,
@@ -864,50 +1377,84 @@ var _BTrDBAdmin_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetAPIKey",
 			Handler:    _BTrDBAdmin_GetAPIKey_Handler,
 		},
+		{
+			MethodName: "StorageUsage",
+			Handler:    _BTrDBAdmin_StorageUsage_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "adminapi.proto",
 }
 
-func init() { proto.RegisterFile("adminapi.proto", fileDescriptor_adminapi_7737aa5836920c8d) }
-
-var fileDescriptor_adminapi_7737aa5836920c8d = []byte{
-	// 587 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x95, 0xcd, 0x6e, 0x13, 0x31,
-	0x10, 0xc7, 0x95, 0xf4, 0x83, 0x64, 0x42, 0xd2, 0xc6, 0x0d, 0x69, 0xba, 0xd0, 0x2a, 0x18, 0x84,
-	0x22, 0x0e, 0x89, 0x14, 0x10, 0x07, 0x0e, 0x48, 0xa9, 0x22, 0x55, 0xa8, 0x14, 0x55, 0x0b, 0x02,
-	0x89, 0x53, 0x4d, 0x3c, 0x8d, 0x56, 0xec, 0x17, 0x6b, 0x27, 0x22, 0x07, 0x2e, 0x1c, 0xb9, 0xf2,
-	0x68, 0xbc, 0x02, 0x0f, 0x82, 0x6c, 0x6f, 0x36, 0xde, 0x24, 0x7c, 0x44, 0xea, 0x6d, 0x6d, 0x8f,
-	0xff, 0xbf, 0xff, 0xd8, 0xe3, 0x59, 0xa8, 0x31, 0x1e, 0x78, 0x21, 0x8b, 0xbd, 0x6e, 0x9c, 0x44,
-	0x32, 0x22, 0xa5, 0xf9, 0xd8, 0xb9, 0x37, 0x8e, 0xa2, 0xb1, 0x8f, 0x3d, 0x16, 0x7b, 0x3d, 0x16,
-	0x86, 0x91, 0x64, 0xd2, 0x8b, 0x42, 0x61, 0xe2, 0xe8, 0x01, 0xd4, 0x5d, 0x14, 0x28, 0x07, 0x97,
-	0x2f, 0xcf, 0x71, 0x76, 0xc9, 0x12, 0x16, 0x08, 0x5a, 0x87, 0xbd, 0xb3, 0xa5, 0xa9, 0xd7, 0x50,
-	0x33, 0x63, 0x17, 0x45, 0x1c, 0x85, 0x02, 0xc9, 0x43, 0xd8, 0x16, 0x92, 0xc9, 0x56, 0xa1, 0x5d,
-	0xe8, 0x54, 0xfa, 0xfb, 0xdd, 0xcc, 0xc0, 0x1b, 0xc9, 0xe4, 0x44, 0xb8, 0x7a, 0x95, 0x34, 0x61,
-	0x97, 0xc5, 0xde, 0x27, 0x9c, 0xb5, 0x8a, 0xed, 0x42, 0xa7, 0xec, 0xa6, 0x23, 0x3a, 0x82, 0xfa,
-	0x05, 0x0b, 0xbd, 0x6b, 0x14, 0x72, 0xc0, 0xb9, 0x81, 0x10, 0x07, 0x4a, 0x1c, 0xa7, 0xde, 0x08,
-	0x3d, 0xae, 0x65, 0xcb, 0x6e, 0x36, 0x26, 0x7d, 0x28, 0x05, 0x28, 0x19, 0x67, 0x92, 0xb5, 0x8a,
-	0xed, 0xad, 0x4e, 0xa5, 0xdf, 0x5c, 0x20, 0x2f, 0x50, 0xb2, 0x73, 0x9c, 0xbd, 0x63, 0xfe, 0x04,
-	0xdd, 0x2c, 0x8e, 0xbe, 0x87, 0x03, 0x0b, 0xb2, 0xa1, 0x73, 0xdb, 0x4c, 0x31, 0x6f, 0x86, 0x3e,
-	0x83, 0xdb, 0x36, 0x92, 0xec, 0xc3, 0x96, 0x4a, 0xd1, 0x78, 0x56, 0x9f, 0xa4, 0x01, 0x3b, 0x53,
-	0xb5, 0x94, 0x6e, 0x35, 0x03, 0xda, 0x5b, 0x64, 0x3d, 0x44, 0xff, 0xdf, 0x59, 0xdb, 0x19, 0x0c,
-	0xd1, 0xbf, 0xc1, 0x0c, 0x06, 0x70, 0x68, 0x3b, 0x49, 0xf0, 0xda, 0xfb, 0x92, 0xfa, 0x79, 0x04,
-	0xb5, 0x79, 0x58, 0xac, 0xe7, 0x53, 0x57, 0x4b, 0xb3, 0x94, 0xc1, 0xd1, 0x8a, 0xc4, 0x86, 0x0e,
-	0x4f, 0x00, 0xc2, 0x49, 0xc0, 0xd1, 0x47, 0x89, 0xc6, 0x63, 0xd5, 0xb5, 0x66, 0xe8, 0x0b, 0x68,
-	0xcc, 0x11, 0xaf, 0xc4, 0x10, 0xa7, 0x62, 0x43, 0x8b, 0x09, 0x34, 0xf3, 0xfb, 0x37, 0xf4, 0xd7,
-	0x87, 0x5b, 0x46, 0x51, 0xa4, 0x35, 0xd7, 0xb2, 0x6a, 0x2e, 0xcb, 0x5d, 0x05, 0xb8, 0xf3, 0x40,
-	0x7a, 0x05, 0xb5, 0xfc, 0xd2, 0x8d, 0x97, 0x75, 0x17, 0x76, 0x8d, 0x4b, 0x42, 0x60, 0x7b, 0x14,
-	0x71, 0xd4, 0xaa, 0x55, 0x57, 0x7f, 0xab, 0x5a, 0x0c, 0xc4, 0x38, 0xbd, 0x70, 0xf5, 0xd9, 0xff,
-	0xbe, 0x03, 0x70, 0xfa, 0x36, 0x19, 0x9e, 0x0e, 0x94, 0x30, 0x41, 0xa8, 0x58, 0xaf, 0x82, 0xdc,
-	0x5d, 0x4d, 0x29, 0x7b, 0x91, 0xce, 0xf1, 0xda, 0xc5, 0xf9, 0x29, 0x52, 0xe7, 0xdb, 0xcf, 0x5f,
-	0x3f, 0x8a, 0x0d, 0xba, 0xd7, 0x9b, 0x3e, 0xed, 0x05, 0x69, 0x00, 0xe3, 0xfc, 0x79, 0xe1, 0xb1,
-	0x8d, 0x19, 0xa2, 0xbf, 0x0e, 0x93, 0x3d, 0x81, 0x75, 0x18, 0xab, 0xdc, 0xd7, 0x63, 0x38, 0xfa,
-	0x0a, 0xf3, 0x35, 0xff, 0xa4, 0xf4, 0xbd, 0x93, 0xfb, 0xeb, 0x61, 0x56, 0x95, 0x3b, 0x0f, 0xfe,
-	0x12, 0x92, 0x81, 0xdb, 0x1a, 0xec, 0xd0, 0x3b, 0x4b, 0x60, 0x53, 0x5e, 0x0a, 0xff, 0x79, 0x71,
-	0xdb, 0xa6, 0xc2, 0xc8, 0xc9, 0xaa, 0xb0, 0x5d, 0xbb, 0x4e, 0xfb, 0x4f, 0xeb, 0x19, 0xf5, 0x58,
-	0x53, 0x0f, 0x29, 0xb1, 0xa9, 0xbe, 0xe0, 0x38, 0x15, 0x0a, 0x79, 0x05, 0x15, 0xab, 0x65, 0xdb,
-	0x07, 0xbb, 0xd2, 0xc9, 0x1d, 0xab, 0x5e, 0xf3, 0xed, 0x3b, 0x7f, 0xa6, 0x89, 0xda, 0x68, 0x3a,
-	0xb3, 0x22, 0x7c, 0x80, 0x72, 0xd6, 0xff, 0xc9, 0xd1, 0x42, 0xe2, 0xec, 0xbf, 0xd5, 0x5b, 0x5a,
-	0x9d, 0xd0, 0xaa, 0x52, 0x1f, 0x5b, 0xda, 0x1f, 0x77, 0xf5, 0x7f, 0xe7, 0xc9, 0xef, 0x00, 0x00,
-	0x00, 0xff, 0xff, 0xbf, 0xe0, 0x86, 0xf4, 0xb1, 0x06, 0x00, 0x00,
+func init() { proto.RegisterFile("adminapi.proto", fileDescriptor_adminapi_31c95749416d9e22) }
+
+var fileDescriptor_adminapi_31c95749416d9e22 = []byte{
+	// 1059 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x57, 0xdd, 0x6e, 0x1b, 0x45,
+	0x14, 0xd6, 0xda, 0xae, 0xe3, 0x1c, 0xc7, 0xf9, 0x99, 0xa4, 0xe9, 0xd6, 0x49, 0xa3, 0x65, 0xa8,
+	0x90, 0xd5, 0x8b, 0xa4, 0x18, 0x04, 0x52, 0x25, 0x90, 0x52, 0x22, 0x55, 0xa8, 0x14, 0x55, 0x53,
+	0x7e, 0x24, 0xc4, 0x45, 0xa7, 0x9e, 0x13, 0x67, 0xc5, 0x7a, 0x67, 0xd9, 0x19, 0x3b, 0xf8, 0x82,
+	0x1b, 0x5e, 0x81, 0x1b, 0x5e, 0x86, 0xa7, 0xe0, 0x15, 0xb8, 0x80, 0xb7, 0x40, 0x33, 0xb3, 0x5e,
+	0xcf, 0xda, 0x6e, 0x82, 0xa5, 0xde, 0xcd, 0xf9, 0x99, 0xf3, 0x9d, 0xdf, 0x3d, 0xb3, 0xb0, 0xcd,
+	0xc5, 0x28, 0x4e, 0x79, 0x16, 0x9f, 0x66, 0xb9, 0xd4, 0x92, 0xb4, 0x66, 0x74, 0xf7, 0x78, 0x28,
+	0xe5, 0x30, 0xc1, 0x33, 0x9e, 0xc5, 0x67, 0x3c, 0x4d, 0xa5, 0xe6, 0x3a, 0x96, 0xa9, 0x72, 0x7a,
+	0x74, 0x1f, 0xf6, 0x18, 0x2a, 0xd4, 0xe7, 0x2f, 0xbf, 0x7c, 0x8e, 0xd3, 0x97, 0x3c, 0xe7, 0x23,
+	0x45, 0xf7, 0x60, 0xe7, 0xd9, 0x02, 0xeb, 0x6b, 0xd8, 0x76, 0x34, 0x43, 0x95, 0xc9, 0x54, 0x21,
+	0x79, 0x08, 0x0d, 0xa5, 0xb9, 0x0e, 0x83, 0x28, 0xe8, 0xb5, 0xfb, 0xbb, 0xa7, 0xa5, 0x03, 0xaf,
+	0x34, 0xd7, 0x63, 0xc5, 0xac, 0x94, 0x1c, 0x42, 0x93, 0x67, 0xf1, 0x4f, 0x38, 0x0d, 0x6b, 0x51,
+	0xd0, 0xdb, 0x64, 0x05, 0x45, 0x07, 0xb0, 0xf7, 0x82, 0xa7, 0xf1, 0x25, 0x2a, 0x7d, 0x2e, 0x84,
+	0x03, 0x21, 0x5d, 0x68, 0x09, 0x9c, 0xc4, 0x03, 0x8c, 0x85, 0x35, 0xbb, 0xc9, 0x4a, 0x9a, 0xf4,
+	0xa1, 0x35, 0x42, 0xcd, 0x05, 0xd7, 0x3c, 0xac, 0x45, 0xf5, 0x5e, 0xbb, 0x7f, 0x38, 0x87, 0x7c,
+	0x81, 0x9a, 0x3f, 0xc7, 0xe9, 0x77, 0x3c, 0x19, 0x23, 0x2b, 0xf5, 0xe8, 0xf7, 0xb0, 0xef, 0x81,
+	0xac, 0xe9, 0xb9, 0xef, 0x4c, 0xad, 0xea, 0x0c, 0xfd, 0x04, 0xb6, 0x7c, 0x48, 0xb2, 0x0b, 0x75,
+	0x13, 0xa2, 0xf3, 0xd9, 0x1c, 0xc9, 0x01, 0xdc, 0x99, 0x18, 0x51, 0x71, 0xd5, 0x11, 0xf4, 0x6c,
+	0x1e, 0xf5, 0x05, 0x26, 0xb7, 0x47, 0xed, 0x47, 0x70, 0x81, 0xc9, 0x3b, 0x8c, 0xe0, 0x1c, 0xee,
+	0xf9, 0x9e, 0xe4, 0x78, 0x19, 0xff, 0x52, 0xf8, 0xf3, 0x01, 0x6c, 0xcf, 0xd4, 0x32, 0xcb, 0x2f,
+	0xbc, 0x5a, 0xe0, 0x52, 0x0e, 0xf7, 0x97, 0x4c, 0xac, 0xe9, 0xe1, 0x09, 0x40, 0x3a, 0x1e, 0x09,
+	0x4c, 0x50, 0xa3, 0xf3, 0xb1, 0xc3, 0x3c, 0x0e, 0xfd, 0x1c, 0x0e, 0x66, 0x10, 0x5f, 0xa9, 0x0b,
+	0x9c, 0xa8, 0x35, 0x5d, 0xcc, 0xe1, 0xb0, 0x7a, 0x7f, 0x4d, 0xff, 0xfa, 0xb0, 0xe1, 0x2c, 0xaa,
+	0xa2, 0xe7, 0x42, 0xaf, 0xe7, 0xca, 0xd8, 0x8d, 0x02, 0x9b, 0x29, 0xd2, 0xd7, 0xb0, 0x5d, 0x15,
+	0xbd, 0xf3, 0xb6, 0xf6, 0xb2, 0xe2, 0xbc, 0x5d, 0x33, 0x2b, 0x19, 0x1c, 0x56, 0xef, 0xaf, 0x99,
+	0x95, 0xc7, 0x8b, 0x59, 0xf1, 0x5c, 0x76, 0x21, 0x17, 0xea, 0x65, 0x4e, 0xfe, 0xa8, 0xc1, 0x96,
+	0x2f, 0xb9, 0x31, 0x25, 0x87, 0xd0, 0x94, 0x69, 0x12, 0xa7, 0x6e, 0x76, 0x5a, 0xac, 0xa0, 0x08,
+	0x81, 0x46, 0x2a, 0x05, 0x86, 0x75, 0xab, 0x6f, 0xcf, 0x66, 0xcc, 0x8c, 0x4b, 0x18, 0x36, 0xdc,
+	0x98, 0x59, 0x82, 0x50, 0xd8, 0x4a, 0xb8, 0xd2, 0x39, 0x0e, 0x30, 0x9e, 0xa0, 0x08, 0xef, 0x44,
+	0x41, 0xaf, 0xce, 0x2a, 0x3c, 0x72, 0x0c, 0x9b, 0x86, 0xc6, 0x3c, 0x97, 0x79, 0xd8, 0xb4, 0xb7,
+	0xe7, 0x0c, 0xf2, 0x10, 0x3a, 0x25, 0xa1, 0xe3, 0x11, 0x86, 0x1b, 0xd6, 0x44, 0x95, 0x49, 0x7a,
+	0xb0, 0x93, 0xc9, 0x38, 0xd5, 0x2a, 0xc3, 0x5c, 0xe1, 0x40, 0xa6, 0x22, 0x6c, 0x45, 0x41, 0x2f,
+	0x60, 0x8b, 0x6c, 0x12, 0xc2, 0xc6, 0x38, 0x13, 0xdc, 0x74, 0xf9, 0xa6, 0xb5, 0x34, 0x23, 0xe9,
+	0x8f, 0x40, 0x5e, 0x69, 0x99, 0xf3, 0x21, 0x7e, 0xab, 0xf8, 0x10, 0x8b, 0x52, 0xee, 0x42, 0x5d,
+	0xcb, 0xcc, 0xa6, 0xa6, 0xc3, 0xcc, 0xd1, 0x44, 0x2a, 0x30, 0xd3, 0x57, 0xc5, 0x94, 0x38, 0xc2,
+	0x0c, 0xd0, 0x75, 0x9c, 0x0a, 0x79, 0x2d, 0xf8, 0x54, 0xd9, 0xcc, 0x74, 0x98, 0xc7, 0xa1, 0x7f,
+	0xd6, 0xe1, 0xc0, 0x37, 0xbf, 0x66, 0xa5, 0x09, 0x34, 0x6c, 0xf4, 0x35, 0xeb, 0xb3, 0x3d, 0x93,
+	0x0f, 0xe1, 0x8e, 0x96, 0x9a, 0x27, 0x16, 0xad, 0xdd, 0x3f, 0x9a, 0x5f, 0xfd, 0x42, 0x26, 0x09,
+	0x0e, 0xcc, 0x76, 0x29, 0x20, 0x99, 0xd3, 0x24, 0x9f, 0x42, 0x4b, 0xe6, 0xd9, 0x15, 0x4f, 0x51,
+	0x84, 0x8d, 0xdb, 0x6f, 0x95, 0xca, 0xa6, 0x90, 0x83, 0x64, 0x6c, 0x52, 0xee, 0x20, 0x4d, 0x21,
+	0x1b, 0xac, 0xc2, 0x23, 0x11, 0xb4, 0x0b, 0x7a, 0xac, 0x50, 0xd8, 0x52, 0x36, 0x98, 0xcf, 0xf2,
+	0xac, 0xf0, 0x09, 0x8f, 0x93, 0x70, 0xa3, 0x62, 0xc5, 0xf2, 0xc8, 0x63, 0xd8, 0x2f, 0xe8, 0x61,
+	0x2e, 0xaf, 0xf5, 0x55, 0x86, 0xb9, 0xe0, 0xd3, 0xa2, 0x9c, 0xab, 0x44, 0xa6, 0x45, 0x4c, 0x8a,
+	0xc7, 0xa9, 0x8e, 0x93, 0xcb, 0x71, 0x92, 0xd8, 0xc2, 0x06, 0xac, 0xca, 0x24, 0x9f, 0x41, 0x7b,
+	0x50, 0x06, 0xa8, 0x42, 0x88, 0xea, 0xb7, 0x45, 0xef, 0xeb, 0xd3, 0x7f, 0x03, 0xd8, 0x5b, 0x52,
+	0x31, 0x55, 0x9f, 0x2b, 0x15, 0xf3, 0xe3, 0x71, 0xcc, 0x74, 0x5d, 0x49, 0xfd, 0x66, 0xaa, 0xed,
+	0x84, 0x9a, 0x60, 0x4b, 0xda, 0xf4, 0xfd, 0x40, 0x26, 0xc2, 0x09, 0xeb, 0x56, 0x38, 0x67, 0x98,
+	0xd9, 0x73, 0xad, 0x6b, 0xeb, 0xd4, 0x60, 0x05, 0x65, 0xfa, 0xd7, 0xcc, 0x0e, 0x1f, 0x29, 0x5b,
+	0x83, 0x0e, 0x9b, 0x91, 0x26, 0x0d, 0xf6, 0x6a, 0x86, 0xb9, 0xd5, 0xb5, 0x05, 0x08, 0x58, 0x95,
+	0x69, 0x4a, 0x50, 0xc9, 0xeb, 0x86, 0x55, 0xaa, 0xf0, 0xe8, 0x29, 0x34, 0x8b, 0xaf, 0x03, 0x81,
+	0xc6, 0xc0, 0x4c, 0xba, 0x6b, 0x7f, 0x7b, 0x36, 0x13, 0x31, 0x52, 0xc3, 0x62, 0x8f, 0x99, 0x63,
+	0xff, 0x9f, 0x26, 0xc0, 0xd3, 0x6f, 0xf2, 0x8b, 0xa7, 0xe7, 0x26, 0x99, 0x04, 0xa1, 0xed, 0x2d,
+	0x7b, 0x72, 0xb4, 0xfc, 0xa5, 0x2e, 0x1f, 0x1a, 0xdd, 0x07, 0x2b, 0x85, 0xb3, 0xe1, 0xa0, 0xdd,
+	0xdf, 0xfe, 0xfa, 0xfb, 0xf7, 0xda, 0x01, 0xdd, 0x39, 0x9b, 0x7c, 0x7c, 0x36, 0x2a, 0x14, 0xb8,
+	0x10, 0x4f, 0x82, 0x47, 0x3e, 0xcc, 0x05, 0x26, 0xab, 0x60, 0xca, 0xcd, 0xbe, 0x0a, 0xc6, 0xdb,
+	0xe2, 0xab, 0x61, 0x04, 0x26, 0x06, 0xe6, 0xd7, 0xea, 0x4b, 0xc1, 0x7e, 0xb8, 0xc9, 0x7b, 0xab,
+	0xc1, 0xbc, 0xe5, 0xdd, 0x7d, 0xff, 0x06, 0x95, 0x12, 0x38, 0xb2, 0xc0, 0x5d, 0x7a, 0x77, 0x01,
+	0xd8, 0xed, 0x07, 0x03, 0xff, 0x33, 0x6c, 0x57, 0x17, 0x27, 0x39, 0x59, 0x36, 0xec, 0xaf, 0xe4,
+	0x6e, 0xf4, 0x36, 0x79, 0x89, 0xfa, 0xc0, 0xa2, 0xde, 0xa3, 0xc4, 0x47, 0x4d, 0x94, 0xc0, 0x89,
+	0x5a, 0x80, 0x2c, 0xda, 0x60, 0x05, 0xa4, 0xbf, 0xef, 0xba, 0xd1, 0xdb, 0xe4, 0x37, 0x43, 0x2a,
+	0xab, 0x63, 0x20, 0x5f, 0x43, 0xdb, 0x7b, 0xfc, 0xfa, 0xb5, 0x5c, 0x7a, 0x13, 0x77, 0xbd, 0xcd,
+	0x5f, 0x7d, 0x08, 0x57, 0xcb, 0x98, 0x9b, 0x8b, 0xee, 0x8d, 0x6b, 0x10, 0x7e, 0x80, 0xcd, 0xf2,
+	0x25, 0x4d, 0xee, 0xcf, 0x4d, 0x3c, 0xfb, 0xdf, 0xd6, 0x43, 0x6b, 0x9d, 0xd0, 0x8e, 0xb1, 0x3e,
+	0xf4, 0x6d, 0xc7, 0xb0, 0xe5, 0x7f, 0xda, 0xc9, 0xb1, 0xff, 0x11, 0x5f, 0xdc, 0x28, 0xdd, 0x93,
+	0xd5, 0xd2, 0x12, 0xe7, 0xc8, 0xe2, 0xdc, 0xa5, 0xbb, 0x06, 0x47, 0x39, 0x8d, 0xb1, 0xd1, 0x78,
+	0x12, 0x3c, 0x7a, 0xd3, 0xb4, 0x3f, 0x0b, 0x1f, 0xfd, 0x37, 0x00, 0x06, 0xae, 0xce, 0x81, 0x66,
+	0x0c, 0x00, 0x00,
 }
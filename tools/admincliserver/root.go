@@ -15,6 +15,7 @@ import (
 	"github.com/BTrDB/smartgridstore/acl"
 	"github.com/BTrDB/smartgridstore/admincli"
 	api "github.com/BTrDB/smartgridstore/tools/apifrontend/cli"
+	storage "github.com/BTrDB/smartgridstore/tools/btrdbdu/cli"
 	mfst "github.com/BTrDB/smartgridstore/tools/manifest/cli"
 	mrplotterconf "github.com/BTrDB/smartgridstore/tools/mr-plotter-conf/cli"
 	etcd "github.com/coreos/etcd/clientv3"
@@ -32,6 +33,7 @@ func GetRootModule(c *etcd.Client, user string) admincli.CLIModule {
 	manifest := mfst.NewManifestCLIModule(c)
 	btrdb := btrdbcli.NewBTrDBCLI(c)
 	api := api.NewFrontendModule(c)
+	storage := storage.NewStorageCLIModule(c)
 	r := &admincli.GenericCLIModule{
 		MChildren: []admincli.CLIModule{
 			mrp,
@@ -39,6 +41,7 @@ func GetRootModule(c *etcd.Client, user string) admincli.CLIModule {
 			manifest,
 			btrdb,
 			api,
+			storage,
 		},
 	}
 	return r
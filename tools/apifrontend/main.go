@@ -265,7 +265,7 @@ func main() {
 	if disable_insecure {
 		insecure_listen = "127.0.0.1:4410"
 	}
-	ProxyGRPC(insecure_listen)
+	api := ProxyGRPC(insecure_listen).(*apiProvider)
 	tlsconfig := ProxyGRPCSecure("0.0.0.0:4411")
 
 	ctx := context.Background()
@@ -276,7 +276,7 @@ func main() {
 	mux.HandleFunc("/v4/swagger.json", func(w http.ResponseWriter, req *http.Request) {
 		io.Copy(w, strings.NewReader(SwaggerJSON))
 	})
-	mux.HandleFunc("/v4/query", queryhandler)
+	mux.HandleFunc("/v4/query", api.queryhandler)
 	gwmux := runtime.NewServeMux()
 	opts := []grpc.DialOption{grpc.WithInsecure()}
 	err := pb.RegisterBTrDBHandlerFromEndpoint(ctx, gwmux, "127.0.0.1:4410", opts)
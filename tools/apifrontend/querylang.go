@@ -7,27 +7,41 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/BTrDB/smartgridstore/acl"
 	"github.com/bcampbell/fuzzytime"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
 	"gopkg.in/yaml.v2"
 )
 
-//Nothing in this file is ready to use yet.
-
 const SELECT = "SELECT"
 const FROM = "FROM"
 
+//QueryErrorTrailer is the HTTP trailer holding the error that ended a query
+//after its results had started to be written. The error is also the last
+//record of the body, so the status code of 200 does not hide it.
+const QueryErrorTrailer = "X-Query-Error"
+
 type Query struct {
 	Window *QueryWindow `yaml:"window"`
 }
 
+//QueryWindow is a query for windows of the given duration from the start
+//time. The windows always start at from, even when the query is answered
+//with an aligned windows query (see useAligned).
 type QueryWindow struct {
 	Fields          []string `yaml:"fields"`
 	Collection      string   `yaml:"collection"`
@@ -36,6 +50,7 @@ type QueryWindow struct {
 	To              string   `yaml:"to"`
 	Window          string   `yaml:"window"`
 	WindowPrecision string   `yaml:"windowPrecision"`
+	Format          string   `yaml:"format"`
 }
 
 type Field struct {
@@ -43,6 +58,32 @@ type Field struct {
 	Name      string
 }
 
+//Value extracts the statistic this field's operation refers to
+func (f Field) Value(sp btrdb.StatPoint) float64 {
+	switch f.Operation {
+	case "MIN":
+		return sp.Min
+	case "MAX":
+		return sp.Max
+	case "COUNT":
+		return float64(sp.Count)
+	}
+	return sp.Mean
+}
+
+//queryColumn is a single output column: one field applied to one stream
+type queryColumn struct {
+	field  Field
+	stream *btrdb.Stream
+	label  string
+	points chan btrdb.StatPoint
+	errc   chan error
+	head   *btrdb.StatPoint
+}
+
+const FormatCSV = "csv"
+const FormatJSON = "json"
+
 //ParseDuration is a little like the existing time.ParseDuration
 //but adds days and years because its really annoying not having that
 func ParseDuration(s string) (*time.Duration, error) {
@@ -78,11 +119,10 @@ func (qw *QueryWindow) ParseFields() ([]Field, error) {
 	for _, e := range qw.Fields {
 		pstart := strings.Index(e, "(")
 		pend := strings.LastIndex(e, ")")
-		fmt.Printf("pstart=%d, pend=%d e=%q", pstart, pend, e)
-		if (pstart + 1) >= (pend - 1) {
+		if pstart < 0 || (pstart+1) >= pend {
 			return nil, fmt.Errorf("invalid field name")
 		}
-		name := e[pstart+1 : pend-1]
+		name := e[pstart+1 : pend]
 		op := e[0:pstart]
 		if !OpAllowed(op) {
 			return nil, fmt.Errorf("invalid operation %q", op)
@@ -106,7 +146,7 @@ func (qw *QueryWindow) ParseProperties() (anns map[string]*string, tags map[stri
 		} else if strings.HasPrefix(pname, "t.") {
 			tags[pname[2:]] = pval
 		} else {
-			return nil, nil, fmt.Errorf("properties must start with p. or t.")
+			return nil, nil, fmt.Errorf("properties must start with a. or t.")
 		}
 	}
 	return anns, tags, nil
@@ -143,6 +183,15 @@ func ParseFuzzyTime(s string) (time.Time, error) {
 	isoformat := dt.ISOFormat()
 	return time.Parse(time.RFC3339, isoformat)
 }
+func (qw *QueryWindow) ParseFormat() (string, error) {
+	switch strings.ToLower(qw.Format) {
+	case "", FormatCSV:
+		return FormatCSV, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return "", fmt.Errorf("unknown format %q, must be csv or json", qw.Format)
+}
 func (qw *QueryWindow) ParseFrom() (time.Time, error) {
 	return ParseFuzzyTime(qw.From)
 }
@@ -154,6 +203,9 @@ func (qw *QueryWindow) ParseWindow() (time.Duration, error) {
 	if err != nil {
 		return 0, fmt.Errorf("malformed duration expression")
 	}
+	if d == nil || *d == 0 {
+		return 0, fmt.Errorf("no window specified")
+	}
 	return *d, nil
 }
 
@@ -174,23 +226,59 @@ func (qw *QueryWindow) ParseWindowPrecision() (int, error) {
 	}
 	//Normal users can specify a duration and we pick the first PW
 	//below that duration
-	d, err := ParseDuration(qw.Window)
-	if err != nil {
+	d, err := ParseDuration(qw.WindowPrecision)
+	if err != nil || d == nil {
 		return 0, fmt.Errorf("malformed duration expression")
 	}
-	rv := uint(0)
-	for time.Duration(1<<rv) <= *d {
+	rv := 0
+	for rv < 48 && time.Duration(1<<uint(rv+1)) <= *d {
 		rv++
 	}
-	rv -= 1
-	if rv >= 48 {
-		return 48, nil
-	}
-	if rv < 0 {
-		return 0, nil
+	return rv, nil
+}
+
+//useAligned returns true if the much cheaper aligned windows query gives the
+//same windows as a windows query. AlignedWindows snaps the start of every
+//window down to a multiple of 2^pw, so that is only the case if the window
+//is exactly 2^pw nanoseconds wide and the range starts and ends on a
+//multiple of it. Otherwise the buckets would be shifted from the ones asked
+//for, so the windows query is used.
+func useAligned(from int64, to int64, window time.Duration, pw int) bool {
+	width := int64(1) << uint(pw)
+	return int64(window) == width && from%width == 0 && to%width == 0
+}
+
+//uniqueLabels adds a positional suffix to labels that are used more than
+//once, e.g. if the same field is selected twice or two streams in the same
+//collection have the same name, so that every column can be told apart
+func uniqueLabels(labels []string) []string {
+	count := make(map[string]int)
+	used := make(map[string]bool)
+	for _, l := range labels {
+		count[l]++
+		used[l] = true
+	}
+	rv := make([]string, len(labels))
+	seen := make(map[string]int)
+	for idx, l := range labels {
+		if count[l] == 1 {
+			rv[idx] = l
+			continue
+		}
+		seen[l]++
+		n := seen[l]
+		label := fmt.Sprintf("%s#%d", l, n)
+		for used[label] {
+			n++
+			label = fmt.Sprintf("%s#%d", l, n)
+		}
+		seen[l] = n
+		used[label] = true
+		rv[idx] = label
 	}
-	return int(rv), nil
+	return rv
 }
+
 func tokenize(q string) []string {
 	rv := []string{}
 	parts := strings.Split(q, " ")
@@ -199,25 +287,55 @@ func tokenize(q string) []string {
 	}
 	return rv
 }
-func queryhandler(w http.ResponseWriter, req *http.Request) {
+func (a *apiProvider) queryhandler(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		w.WriteHeader(405)
 		w.Write([]byte("queries must be POSTed"))
 		return
 	}
+	var u *acl.User
 	user, pass, ok := req.BasicAuth()
-	fmt.Printf("user: %q, pass: %q, ok: %v\n", user, pass, ok)
+	if ok {
+		//Returns false, nil, nil if password is incorrect or user does not exist
+		var authok bool
+		var err error
+		authok, u, err = a.ae.AuthenticateUser(user, pass)
+		if err != nil {
+			logger.Errorf("query authentication error: %v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("could not authenticate user"))
+			return
+		}
+		if !authok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="btrdb"`)
+			w.WriteHeader(401)
+			w.Write([]byte("invalid username or password"))
+			return
+		}
+	} else {
+		var err error
+		u, err = a.ae.GetPublicUser()
+		if err != nil {
+			logger.Errorf("could not resolve public user: %v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("could not resolve public user"))
+			return
+		}
+	}
 	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
 	if err != nil {
-		fmt.Printf("Query error: %v\n", err)
+		logger.Errorf("query error: %v", err)
 		return
 	}
-	fmt.Printf("body was:\n%v\n", string(body))
-	req.Body.Close()
-	doselect(body, w)
+	ctx := context.WithValue(req.Context(), UserKey, u)
+	err = a.doselect(ctx, body, w)
+	if err != nil {
+		logger.Errorf("query error: %v", err)
+	}
 }
 
-func doselect(query []byte, w http.ResponseWriter) error {
+func (a *apiProvider) doselect(ctx context.Context, query []byte, w http.ResponseWriter) error {
 	q := Query{}
 	err := yaml.Unmarshal(query, &q)
 	abort := func(fs string, args ...interface{}) error {
@@ -236,6 +354,9 @@ func doselect(query []byte, w http.ResponseWriter) error {
 	if err != nil {
 		return abort("invalid fields: %v", err)
 	}
+	if len(fields) == 0 {
+		return abort("no fields specified")
+	}
 	collection, isprefix, err := qw.ParseCollection()
 	if err != nil {
 		return abort("invalid collections: %v", err)
@@ -248,6 +369,9 @@ func doselect(query []byte, w http.ResponseWriter) error {
 	if err != nil {
 		return abort("invalid 'to' time: %v", err)
 	}
+	if !to.After(from) {
+		return abort("'to' time must be after 'from' time")
+	}
 	windowDuration, err := qw.ParseWindow()
 	if err != nil {
 		return abort("invalid 'window' duration: %v", err)
@@ -260,7 +384,218 @@ func doselect(query []byte, w http.ResponseWriter) error {
 	if err != nil {
 		return abort("invalid properties: %v", err)
 	}
-	fmt.Printf("\nparsed:\nfields=%v\ncollection=%v\nisprefix=%v\nfrom=%v\nto=%v\nwindowDuration=%v\nwindowPrecision=%v\nanns=%v\ntags=%v\n", fields, collection, isprefix, from, to, windowDuration, windowPrecision, anns, tags)
-	return nil
+	format, err := qw.ParseFormat()
+	if err != nil {
+		return abort("invalid format: %v", err)
+	}
+
+	//Resolve the streams for each field. The field name is matched against
+	//the name tag, in addition to any tags given in the properties
+	columns := []*queryColumn{}
+	for _, f := range fields {
+		ftags := make(map[string]*string)
+		for k, v := range tags {
+			ftags[k] = v
+		}
+		name := f.Name
+		ftags["name"] = &name
+		streams, err := a.downstream.LookupStreams(ctx, collection, isprefix, ftags, anns)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(fmt.Sprintf("could not look up streams: %v", err)))
+			return err
+		}
+		fcols := []*queryColumn{}
+		for _, s := range streams {
+			col, err := s.Collection(ctx)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(fmt.Sprintf("could not look up streams: %v", err)))
+				return err
+			}
+			//Streams the user cannot read are silently omitted, the same
+			//as the LookupStreams endpoint
+			if a.checkPermissionsByCollection(ctx, col, "api", "read") != nil {
+				continue
+			}
+			fcols = append(fcols, &queryColumn{
+				field:  f,
+				stream: s,
+				label:  fmt.Sprintf("%s(%s/%s)", f.Operation, col, f.Name),
+			})
+		}
+		sort.Slice(fcols, func(i, j int) bool {
+			return fcols[i].label < fcols[j].label
+		})
+		columns = append(columns, fcols...)
+	}
+	if len(columns) == 0 {
+		w.WriteHeader(404)
+		w.Write([]byte("no streams matched the query"))
+		return nil
+	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	aligned := useAligned(from.UnixNano(), to.UnixNano(), windowDuration, windowPrecision)
+	for _, c := range columns {
+		if aligned {
+			c.points, _, c.errc = c.stream.AlignedWindows(ctx, from.UnixNano(), to.UnixNano(), uint8(windowPrecision), btrdb.LatestVersion)
+		} else {
+			c.points, _, c.errc = c.stream.Windows(ctx, from.UnixNano(), to.UnixNano(), uint64(windowDuration), uint8(windowPrecision), btrdb.LatestVersion)
+		}
+	}
+
+	var out queryWriter
+	w.Header().Set("Trailer", QueryErrorTrailer)
+	if format == FormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		out = &jsonQueryWriter{w: w}
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+		out = &csvQueryWriter{w: csv.NewWriter(w)}
+	}
+	labels := make([]string, len(columns))
+	for idx, c := range columns {
+		labels[idx] = c.label
+	}
+	labels = uniqueLabels(labels)
+	for idx, c := range columns {
+		c.label = labels[idx]
+	}
+	if err := out.Header(labels); err != nil {
+		return err
+	}
+
+	//Merge the windows from all the columns into rows by time. The windows
+	//from each stream arrive in time order, so we just emit the earliest
+	//pending window time each round
+	row := make([]*float64, len(columns))
+	for {
+		var now int64
+		found := false
+		for _, c := range columns {
+			if c.head == nil && c.points != nil {
+				sp, ok := <-c.points
+				if !ok {
+					c.points = nil
+					if err := <-c.errc; err != nil {
+						qerr := fmt.Errorf("query on %s failed: %v", c.label, err)
+						w.Header().Set(QueryErrorTrailer, qerr.Error())
+						out.Fail(qerr)
+						return qerr
+					}
+					continue
+				}
+				c.head = &sp
+			}
+			if c.head != nil && (!found || c.head.Time < now) {
+				now = c.head.Time
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+		for idx, c := range columns {
+			row[idx] = nil
+			if c.head != nil && c.head.Time == now {
+				v := c.field.Value(*c.head)
+				row[idx] = &v
+				c.head = nil
+			}
+		}
+		if err := out.Row(now, row); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+type queryWriter interface {
+	Header(labels []string) error
+	Row(time int64, values []*float64) error
+	Close() error
+	//Fail ends the output with an error record instead of closing it
+	Fail(err error) error
+}
+
+type csvQueryWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvQueryWriter) Header(labels []string) error {
+	return cw.w.Write(append([]string{"time"}, labels...))
+}
+func (cw *csvQueryWriter) Row(time int64, values []*float64) error {
+	rec := make([]string, len(values)+1)
+	rec[0] = strconv.FormatInt(time, 10)
+	for idx, v := range values {
+		if v != nil {
+			rec[idx+1] = strconv.FormatFloat(*v, 'g', -1, 64)
+		}
+	}
+	return cw.w.Write(rec)
+}
+func (cw *csvQueryWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+//Fail writes a last record of "error" and the message
+func (cw *csvQueryWriter) Fail(err error) error {
+	cw.w.Write([]string{"error", err.Error()})
+	return cw.Close()
+}
+
+//jsonQueryWriter streams an object of the form
+//{"columns":["time",...],"rows":[[t,v,...],...]}
+//with null for windows that have no data, and an "error" member after the
+//rows if the query failed part way
+type jsonQueryWriter struct {
+	w     io.Writer
+	first bool
+}
+
+func (jw *jsonQueryWriter) Header(labels []string) error {
+	hdr, err := json.Marshal(append([]string{"time"}, labels...))
+	if err != nil {
+		return err
+	}
+	jw.first = true
+	_, err = fmt.Fprintf(jw.w, "{\"columns\":%s,\"rows\":[", hdr)
+	return err
+}
+func (jw *jsonQueryWriter) Row(time int64, values []*float64) error {
+	rec := make([]interface{}, len(values)+1)
+	rec[0] = time
+	for idx, v := range values {
+		if v != nil && !math.IsNaN(*v) && !math.IsInf(*v, 0) {
+			rec[idx+1] = *v
+		}
+	}
+	enc, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if !jw.first {
+		if _, err := jw.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	jw.first = false
+	_, err = jw.w.Write(enc)
+	return err
+}
+func (jw *jsonQueryWriter) Close() error {
+	_, err := jw.w.Write([]byte("]}\n"))
+	return err
+}
+func (jw *jsonQueryWriter) Fail(err error) error {
+	msg, jerr := json.Marshal(err.Error())
+	if jerr != nil {
+		return jerr
+	}
+	_, jerr = fmt.Fprintf(jw.w, "],\"error\":%s}\n", msg)
+	return jerr
 }
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUseAligned(t *testing.T) {
+	pw := 30
+	width := int64(1) << uint(pw)
+	for _, c := range []struct {
+		desc     string
+		from, to int64
+		window   time.Duration
+		expected bool
+	}{
+		{"aligned range and power of two window", 4 * width, 10 * width, time.Duration(width), true},
+		{"window is not 2^pw", 4 * width, 10 * width, time.Second, false},
+		{"window is a different power of two", 4 * width, 10 * width, time.Duration(width * 2), false},
+		{"start is not aligned", 4*width + 1, 10 * width, time.Duration(width), false},
+		{"end is not aligned", 4 * width, 10*width - 1, time.Duration(width), false},
+		{"negative aligned start", -2 * width, 2 * width, time.Duration(width), true},
+	} {
+		if got := useAligned(c.from, c.to, c.window, pw); got != c.expected {
+			t.Errorf("%s: expected %v got %v", c.desc, c.expected, got)
+		}
+	}
+}
+
+func TestParseWindowPrecision(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		expected int
+	}{
+		{"", DefaultWindowPrecision},
+		{"12", 12},
+		{"1s", 29},
+		{"1m", 35},
+	} {
+		qw := &QueryWindow{WindowPrecision: c.in}
+		pw, err := qw.ParseWindowPrecision()
+		if err != nil || pw != c.expected {
+			t.Errorf("%q: expected %d got %d (%v)", c.in, c.expected, pw, err)
+		}
+	}
+	qw := &QueryWindow{WindowPrecision: "49"}
+	if _, err := qw.ParseWindowPrecision(); err == nil {
+		t.Errorf("expected an error for a precision above 48")
+	}
+}
+
+func TestUniqueLabels(t *testing.T) {
+	for _, c := range []struct {
+		in       []string
+		expected []string
+	}{
+		{
+			[]string{"MEAN(a/L1MAG)", "MAX(a/L1MAG)"},
+			[]string{"MEAN(a/L1MAG)", "MAX(a/L1MAG)"},
+		},
+		{
+			[]string{"MEAN(a/L1MAG)", "MEAN(a/L1MAG)", "MAX(a/L1MAG)", "MEAN(a/L1MAG)"},
+			[]string{"MEAN(a/L1MAG)#1", "MEAN(a/L1MAG)#2", "MAX(a/L1MAG)", "MEAN(a/L1MAG)#3"},
+		},
+		{
+			//A suffixed label must not collide with a real one
+			[]string{"x", "x", "x#1"},
+			[]string{"x#2", "x#3", "x#1"},
+		},
+	} {
+		got := uniqueLabels(c.in)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%v: expected %v got %v", c.in, c.expected, got)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	qw := &QueryWindow{Fields: []string{"MEAN(L1MAG)", "COUNT(C1ANG)"}}
+	fields, err := qw.ParseFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 2 || fields[0] != (Field{"MEAN", "L1MAG"}) || fields[1] != (Field{"COUNT", "C1ANG"}) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	for _, bad := range []string{"MEAN()", "L1MAG", "MEDIAN(L1MAG)"} {
+		qw := &QueryWindow{Fields: []string{bad}}
+		if _, err := qw.ParseFields(); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestQueryWriterFail(t *testing.T) {
+	v := 1.5
+	qerr := fmt.Errorf("stream went away")
+
+	var jbuf bytes.Buffer
+	jw := &jsonQueryWriter{w: &jbuf}
+	jw.Header([]string{"MEAN(a/L1MAG)"})
+	jw.Row(10, []*float64{&v})
+	jw.Fail(qerr)
+	var res struct {
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+		Error   string          `json:"error"`
+	}
+	if err := json.Unmarshal(jbuf.Bytes(), &res); err != nil {
+		t.Fatalf("failed query is not valid JSON: %v: %s", err, jbuf.String())
+	}
+	if len(res.Rows) != 1 || res.Error != qerr.Error() {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	var cbuf bytes.Buffer
+	cw := &csvQueryWriter{w: csv.NewWriter(&cbuf)}
+	cw.Header([]string{"MEAN(a/L1MAG)"})
+	cw.Row(10, []*float64{&v})
+	cw.Fail(qerr)
+	recs, err := csv.NewReader(&cbuf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := recs[len(recs)-1]
+	if len(recs) != 3 || last[0] != "error" || last[1] != qerr.Error() {
+		t.Fatalf("unexpected records %v", recs)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+const defaultChunk = time.Hour
+const defaultRetries = 3
+
+//copyChunk is a time range of a stream that is copied, and retried, on its
+//own
+type copyChunk struct {
+	s       *Stream
+	start   int64
+	end     int64
+	count   uint64
+	version uint64
+}
+
+//Engine copies streams in chunks with a pool of workers
+type Engine struct {
+	//The number of chunks copied at once
+	Workers int
+	//How many times a failed chunk is tried again
+	Retries int
+	//The width of the chunks in nanoseconds
+	Chunk int64
+
+	bar    *pb.ProgressBar
+	chunks []*copyChunk
+	mu     sync.Mutex
+	//The version of each stream being copied, and the errors of the streams
+	//that failed
+	versions map[*Stream]uint64
+	failed   map[*Stream]error
+}
+
+func NewEngine(workers int, retries int, chunk int64) *Engine {
+	return &Engine{
+		Workers:  workers,
+		Retries:  retries,
+		Chunk:    chunk,
+		versions: make(map[*Stream]uint64),
+		failed:   make(map[*Stream]error),
+	}
+}
+
+//splitRange returns the end of the whole chunks in the range, after which
+//there is a shorter chunk if the width does not divide the range
+func splitRange(start int64, end int64, width int64) int64 {
+	return start + (end-start)/width*width
+}
+
+//Plan splits the range of a stream into chunks with data in them, as of the
+//given version, to be copied by Run. It returns the number of points.
+func (e *Engine) Plan(s *Stream, start int64, end int64, version uint64) (uint64, error) {
+	rv := []*copyChunk{}
+	add := func(wstart int64, wend int64, width int64) error {
+		if wend <= wstart {
+			return nil
+		}
+		csp, _, cerr := s.src.Windows(context.Background(), wstart, wend, uint64(width), 0, version)
+		for sv := range csp {
+			if sv.Count == 0 {
+				continue
+			}
+			rv = append(rv, &copyChunk{s: s, start: sv.Time, end: sv.Time + width, count: sv.Count, version: version})
+		}
+		return <-cerr
+	}
+	whole := splitRange(start, end, e.Chunk)
+	if err := add(start, whole, e.Chunk); err != nil {
+		return 0, err
+	}
+	if err := add(whole, end, end-whole); err != nil {
+		return 0, err
+	}
+	var count uint64
+	for _, c := range rv {
+		count += c.count
+	}
+	e.chunks = append(e.chunks, rv...)
+	e.versions[s] = version
+	return count, nil
+}
+
+//Version returns the version of the stream that was planned
+func (e *Engine) Version(s *Stream) uint64 {
+	return e.versions[s]
+}
+
+//Run copies the planned chunks and returns the errors of the streams that
+//could not be copied
+func (e *Engine) Run() map[*Stream]error {
+	var total int64
+	for _, c := range e.chunks {
+		total += int64(c.count)
+	}
+	e.bar = pb.New64(total).Prefix("copying")
+	e.bar.ShowSpeed = true
+	e.bar.ShowElapsedTime = true
+	e.bar.Start()
+	work := make(chan *copyChunk)
+	wg := sync.WaitGroup{}
+	for i := 0; i < e.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			for c := range work {
+				err := e.copy(c)
+				if err != nil {
+					e.fail(c, err)
+				}
+			}
+			wg.Done()
+		}()
+	}
+	for _, c := range e.chunks {
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+	e.bar.Finish()
+	return e.failed
+}
+
+//copy copies a chunk, trying again if it fails. The range of the chunk is
+//erased before each retry so that no points are inserted twice.
+func (e *Engine) copy(c *copyChunk) error {
+	var err error
+	for attempt := 0; attempt <= e.Retries; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("\nRETRY %d of %s at %s: %v\n", attempt, c.s.desc, time.Unix(0, c.start).UTC().Format(time.RFC3339), err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+			_, err = c.s.dst.DeleteRange(context.Background(), c.start, c.end)
+			if err != nil {
+				continue
+			}
+		}
+		if e.stopped(c.s) {
+			return nil
+		}
+		_, err = Copy(c.s.src, c.s.dst, c.start, c.end, c.version)
+		if err == nil {
+			e.bar.Add64(int64(c.count))
+			return nil
+		}
+	}
+	return err
+}
+
+//stopped returns true if another chunk of the stream has failed
+func (e *Engine) stopped(s *Stream) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failed[s] != nil
+}
+
+func (e *Engine) fail(c *copyChunk, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failed[c.s] == nil {
+		e.failed[c.s] = fmt.Errorf("chunk at %s: %v", time.Unix(0, c.start).UTC().Format(time.RFC3339), err)
+	}
+}
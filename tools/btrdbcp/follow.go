@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//Changed ranges are reported to within 2^changesResolution nanoseconds, about
+//a second. Coarser ranges only mean a few more points are copied again.
+const changesResolution = 30
+
+//FollowState is what follow mode has copied, saved so that it can resume
+//after a restart
+type FollowState struct {
+	mu       sync.Mutex
+	filename string
+	//Keyed by the UUID of the source stream and the destination collection
+	Streams map[string]*StreamState `json:"streams"`
+}
+
+//StreamState is the high-water mark of a source stream: all of its changes
+//up to Version have been copied to the destination stream
+type StreamState struct {
+	SrcUUID       string `json:"src_uuid"`
+	DstCollection string `json:"dst_collection"`
+	DstUUID       string `json:"dst_uuid"`
+	//Zero until the initial copy has finished
+	Version uint64    `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+//LoadState reads the state file, or starts an empty state if there is none
+func LoadState(filename string) (*FollowState, error) {
+	st := &FollowState{filename: filename, Streams: make(map[string]*StreamState)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if st.Streams == nil {
+		st.Streams = make(map[string]*StreamState)
+	}
+	return st, nil
+}
+
+//Stream returns the state of a source stream being copied to the given
+//collection, adding it if it is new
+func (st *FollowState) Stream(srcUUID string, dstCollection string) *StreamState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := srcUUID + "/" + dstCollection
+	ss, ok := st.Streams[key]
+	if !ok {
+		ss = &StreamState{SrcUUID: srcUUID, DstCollection: dstCollection}
+		st.Streams[key] = ss
+	}
+	return ss
+}
+
+//Copied records that the source stream has been copied up to the given
+//version, and saves the state
+func (st *FollowState) Copied(ss *StreamState, version uint64) error {
+	st.mu.Lock()
+	ss.Version = version
+	ss.Updated = time.Now()
+	st.mu.Unlock()
+	return st.Save()
+}
+
+//Save replaces the state file atomically, so a crash leaves either the old
+//or the new state
+func (st *FollowState) Save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(st.filename), filepath.Base(st.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), st.filename)
+}
+
+//Follow checks the source streams for new versions every interval, and
+//copies the ranges that changed between start and end. It does not return.
+func Follow(streams []*Stream, state *FollowState, start int64, end int64, interval time.Duration, n int) {
+	for {
+		next := time.Now().Add(interval)
+		parallel(streams, n, func(s *Stream) error {
+			err := catchUp(s, state, start, end)
+			if err != nil {
+				//The stream is tried again at the next poll
+				fmt.Printf("ERROR following %s: %v\n", s.desc, err)
+			}
+			return err
+		})
+		time.Sleep(time.Until(next))
+	}
+}
+
+//catchUp copies the changes to a source stream since its high-water mark.
+//The changed ranges are erased in the destination before they are copied
+//again, which also carries over deletions. If it fails part way the ranges
+//are erased and copied again at the next attempt.
+func catchUp(s *Stream, state *FollowState, start int64, end int64) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ver, err := s.src.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if ver <= s.state.Version {
+		return nil
+	}
+	crs, _, cerr := s.src.Changes(ctx, s.state.Version, ver, changesResolution)
+	ranges := []v4.ChangedRange{}
+	for cr := range crs {
+		if cr.Start < start {
+			cr.Start = start
+		}
+		if cr.End > end {
+			cr.End = end
+		}
+		if cr.Start < cr.End {
+			ranges = append(ranges, cr)
+		}
+	}
+	if err := <-cerr; err != nil {
+		return err
+	}
+	copied := 0
+	for _, cr := range ranges {
+		_, err := s.dst.DeleteRange(ctx, cr.Start, cr.End)
+		if err != nil {
+			return err
+		}
+		n, err := Copy(s.src, s.dst, cr.Start, cr.End, ver)
+		if err != nil {
+			return err
+		}
+		copied += n
+	}
+	if len(ranges) > 0 {
+		fmt.Printf("%s: copied %d points in %d changed ranges up to version %d\n", s.desc, copied, len(ranges), ver)
+	}
+	return state.Copied(s.state, ver)
+}
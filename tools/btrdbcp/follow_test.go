@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFollowState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdbcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "cfg.yml.state")
+
+	st, err := LoadState(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := st.Stream("a", "mirror/one")
+	//The same source can be copied to two collections
+	b := st.Stream("a", "mirror/two")
+	if a == b || a != st.Stream("a", "mirror/one") {
+		t.Fatalf("streams are not told apart by destination collection")
+	}
+	a.DstUUID = "dst"
+	err = st.Copied(a, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = LoadState(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = st.Stream("a", "mirror/one")
+	if a.Version != 42 || a.DstUUID != "dst" || a.Updated.IsZero() {
+		t.Fatalf("unexpected state %+v", a)
+	}
+	if b := st.Stream("a", "mirror/two"); b.Version != 0 {
+		t.Fatalf("unexpected state %+v", b)
+	}
+
+	err = ioutil.WriteFile(fn, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState(fn); err == nil {
+		t.Fatalf("corrupt state was accepted")
+	}
+}
@@ -8,16 +8,18 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/smartgridstore/tools/streamselect"
 	"github.com/pborman/uuid"
 	v4 "gopkg.in/BTrDB/btrdb.v4"
-	pb "gopkg.in/cheggaaa/pb.v1"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -27,20 +29,55 @@ type StreamConfig struct {
 	Tags          map[string]string
 }
 type Config struct {
-	FromServer    string
-	ToServer      string
-	StartTime     string
+	FromServer string
+	ToServer   string
+	StartTime  string
+	//Optional in follow mode, where it defaults to the end of time
 	EndTime       string
 	AbortIfExists bool
-	Streams       []StreamConfig
+	//How many chunks are copied at once
+	Parallel int
+	//The width of the chunks that are copied, and retried if they fail,
+	//on their own, e.g. 1h
+	Chunk   string
+	Retries int
+	//After copying, the source and destination are compared in windows of
+	//2^VerifyPrecision nanoseconds
+	VerifyPrecision uint8
+	SkipVerify      bool
+	//Where follow mode keeps the version of each source stream that has
+	//been copied, by default the config file name with .state appended
+	StateFile string
+	//How often follow mode checks the source streams for changes
+	PollInterval string
+	//Create the destination streams with the UUIDs of the source streams
+	KeepUUID  bool
+	Streams   []StreamConfig
+	Selectors []SelectorConfig
 }
 type Stream struct {
 	CC string
 	NC string
 	T  map[string]string
+
+	desc string
+	src  *v4.Stream
+	dst  *v4.Stream
+	//Whether the destination stream existed before and may hold data
+	existed bool
+	//The follow state of the stream, nil if not following
+	state *StreamState
 }
 
-func Count(bc *v4.BTrDB, col string, tags map[string]string, start int64, end int64) (uint64, *v4.Stream, error) {
+const defaultParallel = 15
+const defaultPollInterval = 10 * time.Second
+
+//The number of points inserted at a time
+const insertBatch = 2000
+
+//Lookup finds the single stream in the collection with the given (possibly
+//partial) tags
+func Lookup(bc *v4.BTrDB, col string, tags map[string]string) (*v4.Stream, error) {
 	tagopt := make(map[string]*string)
 	tagstr := ""
 	for k, v := range tags {
@@ -50,58 +87,91 @@ func Count(bc *v4.BTrDB, col string, tags map[string]string, start int64, end in
 	}
 	sz, err := bc.LookupStreams(context.Background(), col, false, tagopt, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if len(sz) != 1 {
-		return 0, nil, fmt.Errorf("collection %q with tags %s is ambiguous or incorrect, it matches %d streams", col, tagstr, len(sz))
-	}
-	s := sz[0]
-	csp, _, cerr := s.Windows(context.Background(), start, end, uint64(end-start), 0, 0)
-	sv := <-csp
-	err = <-cerr
-	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("collection %q with tags %s is ambiguous or incorrect, it matches %d streams", col, tagstr, len(sz))
 	}
-	return sv.Count, s, nil
+	return sz[0], nil
 }
-func Query(bc *v4.BTrDB, col string, tags map[string]string, start int64, end int64) chan v4.RawPoint {
-	tagopt := make(map[string]*string)
-	tagstr := ""
-	for k, v := range tags {
-		vv := v
-		tagopt[k] = &vv
-		tagstr = tagstr + fmt.Sprintf("%q=%q,", k, v)
+
+//Copy copies the points of the source stream between start and end, as of
+//the given version, into the destination stream, and returns the number of
+//points copied
+func Copy(src *v4.Stream, dst *v4.Stream, start int64, end int64, version uint64) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sv, _, cerr := src.RawValues(ctx, start, end, version)
+	buf := make([]v4.RawPoint, 0, insertBatch)
+	total := 0
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		err := dst.Insert(context.Background(), buf)
+		if err != nil {
+			return err
+		}
+		total += len(buf)
+		buf = buf[:0]
+		return nil
 	}
-	sz, err := bc.LookupStreams(context.Background(), col, false, tagopt, nil)
-	if err != nil {
-		panic(err)
+	for v := range sv {
+		buf = append(buf, v)
+		if len(buf) >= insertBatch {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
 	}
-	if len(sz) != 1 {
-		//We expect this to be caught when doing the count
-		panic("too many result streams")
+	if err := <-cerr; err != nil {
+		return total, err
 	}
-	s := sz[0]
-	sv, _, cerr := s.RawValues(context.Background(), start, end, 0)
-	go func() {
-		err := <-cerr
-		if err != nil {
-			ee := v4.ToCodedError(err)
-			fmt.Printf("ERROR %#v\n", ee)
-		}
-	}()
-	return sv
+	return total, flush()
+}
+
+//parallel calls fn for each stream, with at most n calls at once, and
+//returns the number of calls that failed
+func parallel(streams []*Stream, n int, fn func(s *Stream) error) int {
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	failed := 0
+	sem := make(chan struct{}, n)
+	for _, s := range streams {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(s *Stream) {
+			if fn(s) != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+			<-sem
+			wg.Done()
+		}(s)
+	}
+	wg.Wait()
+	return failed
 }
 
 func main() {
-	streams := []Stream{}
-	cfg := Config{}
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: btrdbcp <config>\n")
+	follow := flag.Bool("follow", false, "after copying, keep checking the source streams for changes and copy them")
+	dryRun := flag.Bool("dry-run", false, "list the streams that would be copied and where to, without copying")
+	flag.Usage = func() {
+		fmt.Printf("Usage: btrdbcp [--follow] [--dry-run] <config>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	cfgdata, err := ioutil.ReadFile(os.Args[1])
+	cfgfile := flag.Arg(0)
+	streams := []*Stream{}
+	cfg := Config{}
+	cfgdata, err := ioutil.ReadFile(cfgfile)
 	if err != nil {
-		fmt.Printf("Could not read config file %q: %v\n", os.Args[1], err)
+		fmt.Printf("Could not read config file %q: %v\n", cfgfile, err)
 		os.Exit(1)
 	}
 	err = yaml.Unmarshal(cfgdata, &cfg)
@@ -109,10 +179,6 @@ func main() {
 		fmt.Printf("Could not parse config file: %v\n", err)
 		os.Exit(1)
 	}
-	if len(cfg.Streams) > 20 {
-		fmt.Printf("We don't support doing more than 20 streams concurrently\n")
-		os.Exit(1)
-	}
 	for idx, s := range cfg.Streams {
 		if s.SrcCollection == "" {
 			fmt.Printf("Missing srccollection field on stream %d\n", idx)
@@ -122,25 +188,72 @@ func main() {
 			fmt.Printf("Missing dstcollection field on stream %d\n", idx)
 			os.Exit(1)
 		}
-		streams = append(streams, Stream{
-			CC: s.SrcCollection,
-			NC: s.DstCollection,
-			T:  s.Tags,
+		tagstr := ""
+		for k, v := range s.Tags {
+			tagstr = tagstr + fmt.Sprintf("%q=%q,", k, v)
+		}
+		streams = append(streams, &Stream{
+			CC:   s.SrcCollection,
+			NC:   s.DstCollection,
+			T:    s.Tags,
+			desc: fmt.Sprintf("%s/%s", s.SrcCollection, tagstr),
 		})
 	}
+	for idx, sel := range cfg.Selectors {
+		if err := checkSelector(sel); err != nil {
+			fmt.Printf("Bad selector %d: %v\n", idx, err)
+			os.Exit(1)
+		}
+	}
+	if len(cfg.Streams) == 0 && len(cfg.Selectors) == 0 {
+		fmt.Printf("No streams or selectors specified\n")
+		os.Exit(1)
+	}
+	if cfg.Parallel <= 0 {
+		cfg.Parallel = defaultParallel
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = defaultRetries
+	}
+	if cfg.VerifyPrecision == 0 {
+		cfg.VerifyPrecision = defaultVerifyPrecision
+	}
+	if cfg.VerifyPrecision > 62 {
+		fmt.Printf("The verify precision must be at most 62\n")
+		os.Exit(1)
+	}
+	chunk := defaultChunk
+	if cfg.Chunk != "" {
+		chunk, err = time.ParseDuration(cfg.Chunk)
+		if err != nil || chunk <= 0 {
+			fmt.Printf("Could not parse chunk %q\n", cfg.Chunk)
+			os.Exit(1)
+		}
+	}
+	pollInterval := defaultPollInterval
+	if cfg.PollInterval != "" {
+		pollInterval, err = time.ParseDuration(cfg.PollInterval)
+		if err != nil || pollInterval <= 0 {
+			fmt.Printf("Could not parse poll interval %q\n", cfg.PollInterval)
+			os.Exit(1)
+		}
+	}
 
 	starttimet, err := time.Parse(time.RFC3339, cfg.StartTime)
 	if err != nil {
 		fmt.Printf("Could not parse start time %q: %v\n", cfg.StartTime, err)
 		os.Exit(1)
 	}
-	endtimet, err := time.Parse(time.RFC3339, cfg.EndTime)
-	if err != nil {
-		fmt.Printf("Could not parse end time %q: %v\n", cfg.EndTime, err)
-		os.Exit(1)
-	}
 	starttime := starttimet.UnixNano()
-	endtime := endtimet.UnixNano()
+	endtime := int64(v4.MaximumTime)
+	if cfg.EndTime != "" || !*follow {
+		endtimet, err := time.Parse(time.RFC3339, cfg.EndTime)
+		if err != nil {
+			fmt.Printf("Could not parse end time %q: %v\n", cfg.EndTime, err)
+			os.Exit(1)
+		}
+		endtime = endtimet.UnixNano()
+	}
 	var from, to *v4.BTrDB
 	if os.Getenv("FROM_API_KEY") != "" {
 		from, err = v4.ConnectAuth(context.Background(), os.Getenv("FROM_API_KEY"), cfg.FromServer)
@@ -151,6 +264,42 @@ func main() {
 		fmt.Printf("Could not connect to FromServer: %v\n", err)
 		os.Exit(1)
 	}
+
+	for _, s := range streams {
+		s.src, err = Lookup(from, s.CC, s.T)
+		if err != nil {
+			fmt.Printf("ABORT, when looking up %s, error:\n %v\n", s.desc, err)
+			os.Exit(1)
+		}
+		//The destination gets all the tags, not just the ones used to find
+		//the stream
+		s.T, err = s.src.Tags(context.Background())
+		if err != nil {
+			fmt.Printf("ABORT, when looking up %s, error:\n %v\n", s.desc, err)
+			os.Exit(1)
+		}
+	}
+	for _, sel := range cfg.Selectors {
+		sz, err := Select(from, sel)
+		if err != nil {
+			fmt.Printf("ABORT, when selecting %s, error:\n %v\n", sel.SrcPrefix, err)
+			os.Exit(1)
+		}
+		if len(sz) == 0 {
+			fmt.Printf("WARNING: no streams under %s match %v\n", sel.SrcPrefix, sel.Tags)
+		}
+		streams = append(streams, sz...)
+	}
+	err = checkDestinations(streams)
+	if err != nil {
+		fmt.Printf("ABORT: %v\n", err)
+		os.Exit(1)
+	}
+	if *dryRun {
+		printPlan(streams, cfg.KeepUUID)
+		return
+	}
+
 	if os.Getenv("TO_API_KEY") != "" {
 		to, err = v4.ConnectAuth(context.Background(), os.Getenv("TO_API_KEY"), cfg.ToServer)
 	} else {
@@ -161,111 +310,197 @@ func main() {
 		os.Exit(1)
 	}
 
-	streamcounts := []uint64{}
-	streamshz := []*v4.Stream{}
-	bars := []*pb.ProgressBar{}
-	wg := sync.WaitGroup{}
+	var state *FollowState
+	if *follow {
+		if cfg.StateFile == "" {
+			cfg.StateFile = cfgfile + ".state"
+		}
+		state, err = LoadState(cfg.StateFile)
+		if err != nil {
+			fmt.Printf("Could not load state: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	for _, s := range streams {
-		tagstr := ""
-		for k, v := range s.T {
-			tagstr = tagstr + fmt.Sprintf("%q=%q,", k, v)
+		if state != nil {
+			s.state = state.Stream(s.src.UUID().String(), s.NC)
 		}
-		streamdesc := fmt.Sprintf("%s/%s", s.CC, tagstr)
-		cnt, st, err := Count(from, s.CC, s.T, starttime, endtime)
+		err = prepare(to, s, cfg.AbortIfExists, cfg.KeepUUID)
 		if err != nil {
-			fmt.Printf("ABORT, when counting %s, error:\n %v\n", streamdesc, err)
+			fmt.Printf("ABORT, when creating %s, error:\n %v\n", s.desc, err)
 			os.Exit(1)
 		}
-		fmt.Printf("%s has %d points\n", streamdesc, cnt)
-		streamcounts = append(streamcounts, cnt)
-		streamshz = append(streamshz, st)
-		bars = append(bars, pb.New(int(cnt)).Prefix(streamdesc))
-		wg.Add(1)
 	}
-	pool, err := pb.StartPool(bars...)
-	if err != nil {
-		panic(err)
+	if state != nil {
+		err = state.Save()
+		if err != nil {
+			fmt.Printf("ABORT: could not save state: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	deststreams := []*v4.Stream{}
-	for idx, s := range streams {
-		tagstr := ""
-		for k, v := range s.T {
-			tagstr = tagstr + fmt.Sprintf("%q=%q,", k, v)
+
+	//In follow mode, streams that were copied before are brought up to date
+	//by following their changes instead
+	initial := []*Stream{}
+	for _, s := range streams {
+		if s.state == nil || s.state.Version == 0 {
+			initial = append(initial, s)
 		}
-		streamdesc := fmt.Sprintf("%s/%s", s.CC, tagstr)
-		hz := streamshz[idx]
-		uu := uuid.NewRandom()
-		tags, err := hz.Tags(context.Background())
+	}
+	engine := NewEngine(cfg.Parallel, cfg.Retries, int64(chunk))
+	for _, s := range initial {
+		ver, err := s.src.Version(context.Background())
 		if err != nil {
-			panic(err)
+			fmt.Printf("ABORT, when counting %s, error:\n %v\n", s.desc, err)
+			os.Exit(1)
 		}
-		anns, _, err := hz.CachedAnnotations(context.Background())
+		cnt, err := engine.Plan(s, starttime, endtime, ver)
 		if err != nil {
-			panic(err)
+			fmt.Printf("ABORT, when counting %s, error:\n %v\n", s.desc, err)
+			os.Exit(1)
 		}
-		v4stream, err := to.Create(context.Background(), uu, s.NC, tags, anns)
-		if err != nil {
-			cerr := v4.ToCodedError(err)
-			if cerr.Code == bte.StreamExists {
-				if cfg.AbortIfExists {
-					fmt.Printf("ABORT: stream %s already exists\n", streamdesc)
-					os.Exit(2)
-				} else {
-					panic("Have not implemented erasing dest streams yet")
-					/* if the stream already exists you can use logic like this to erase the destination before copying
-					sz, err := iconn.LookupStreams(context.Background(), s.NC, false, v4.OptKV("name", s.N, "unit", s.U), nil)
-								if err != nil {
-									panic(err)
-								}
-								if len(sz) != 1 {
-									panic("bad stream length")
-								}
-
-								v4stream := sz[0]
-								_, err = v4stream.DeleteRange(context.Background(), AllowedStart, AllowedEnd)
-								if err != nil {
-									panic(err)
-								}
-					*/
-				}
-			} else {
-				fmt.Printf("ABORT: unexpected error %v\n", cerr)
+		fmt.Printf("%s has %d points\n", s.desc, cnt)
+		//The destination may hold part of an earlier copy
+		if s.existed {
+			_, err := s.dst.DeleteRange(context.Background(), starttime, endtime)
+			if err != nil {
+				fmt.Printf("ABORT, when erasing %s, error:\n %v\n", s.desc, err)
 				os.Exit(1)
 			}
 		}
-		deststreams = append(deststreams, v4stream)
+	}
+	failures := engine.Run()
+	copied := []*Stream{}
+	for _, s := range initial {
+		if err, failed := failures[s]; failed {
+			fmt.Printf("ERROR copying %s: %v\n", s.desc, err)
+			continue
+		}
+		copied = append(copied, s)
 	}
 
-	for sidx, s := range streams {
-		go func(idx int, s Stream) {
-			v4stream := deststreams[idx]
-			sv := Query(from, s.CC, s.T, starttime, endtime)
-			buf := make([]v4.RawPoint, 0, 2000)
-			for v := range sv {
-				buf = append(buf, v)
-				if len(buf) >= 2000 {
-					err := v4stream.Insert(context.Background(), buf)
-					if err != nil {
-						fmt.Printf("got error %v\n", err)
-					}
-					buf = buf[:0]
-					// err = v4stream.Flush(context.Background())
-					// if err != nil {
-					// 	fmt.Printf("got error %v\n", err)
-					// }
-				}
-				bars[idx].Increment()
+	var mu sync.Mutex
+	mismatched := 0
+	if !cfg.SkipVerify {
+		fmt.Printf("verifying %d streams\n", len(copied))
+	}
+	failed := len(initial) - len(copied)
+	failed += parallel(copied, cfg.Parallel, func(s *Stream) error {
+		if !cfg.SkipVerify {
+			mz, err := Verify(s, starttime, endtime, cfg.VerifyPrecision, engine.Version(s))
+			if err != nil {
+				fmt.Printf("ERROR verifying %s: %v\n", s.desc, err)
+				return err
 			}
-			if len(buf) > 0 {
-				err := v4stream.Insert(context.Background(), buf)
-				if err != nil {
-					fmt.Printf("got error %v\n", err)
-				}
+			if len(mz) > 0 {
+				reportMismatches(&mu, s, mz)
+				mu.Lock()
+				mismatched++
+				mu.Unlock()
+				return fmt.Errorf("%d windows differ", len(mz))
 			}
-			bars[idx].Finish()
-			wg.Done()
-		}(sidx, s)
+		}
+		if state != nil {
+			return state.Copied(s.state, engine.Version(s))
+		}
+		return nil
+	})
+	if mismatched > 0 {
+		fmt.Printf("ABORT: %d streams differ between the source and the destination\n", mismatched)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		fmt.Printf("ABORT: %d streams could not be copied\n", failed)
+		os.Exit(1)
+	}
+	if !*follow {
+		return
+	}
+	fmt.Printf("following %d streams\n", len(streams))
+	Follow(streams, state, starttime, endtime, pollInterval, cfg.Parallel)
+}
+
+//prepare finds or creates the destination stream
+func prepare(to *v4.BTrDB, s *Stream, abortIfExists bool, keepUUID bool) error {
+	if s.state != nil && s.state.DstUUID != "" {
+		//The destination was created by an earlier run
+		s.dst = to.StreamFromUUID(uuid.Parse(s.state.DstUUID))
+		s.existed = true
+		return nil
+	}
+	anns, _, err := s.src.CachedAnnotations(context.Background())
+	if err != nil {
+		return err
+	}
+	uu := uuid.NewRandom()
+	if keepUUID {
+		uu = s.src.UUID()
+	}
+	s.dst, err = to.Create(context.Background(), uu, s.NC, s.T, anns)
+	if err != nil {
+		cerr := v4.ToCodedError(err)
+		if cerr.Code != bte.StreamExists {
+			return fmt.Errorf("unexpected error %v", cerr)
+		}
+		if abortIfExists {
+			fmt.Printf("ABORT: stream %s already exists\n", s.desc)
+			os.Exit(2)
+		}
+		//Erase the destination before copying
+		s.dst, err = Lookup(to, s.NC, s.T)
+		if err != nil {
+			return err
+		}
+		s.existed = true
+	}
+	if s.state != nil {
+		s.state.DstUUID = s.dst.UUID().String()
+	}
+	return nil
+}
+
+//checkDestinations returns an error if two streams would be copied to the
+//same destination
+func checkDestinations(streams []*Stream) error {
+	seen := make(map[string]*Stream)
+	for _, s := range streams {
+		key := streamselect.Describe(s.NC, s.T)
+		if prev, ok := seen[key]; ok {
+			return fmt.Errorf("both %s and %s would be copied to %s", prev.desc, s.desc, key)
+		}
+		seen[key] = s
+	}
+	return nil
+}
+
+//printPlan lists where each stream would be copied
+func printPlan(streams []*Stream, keepUUID bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE\tDESTINATION\tUUID\n")
+	for _, s := range streams {
+		uu := "new"
+		if keepUUID {
+			uu = s.src.UUID().String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.desc, streamselect.Describe(s.NC, s.T), uu)
+	}
+	tw.Flush()
+	fmt.Printf("%d streams would be copied\n", len(streams))
+}
+
+//The number of differing windows that are listed for each stream
+const maxReported = 10
+
+func reportMismatches(mu *sync.Mutex, s *Stream, mz []Mismatch) {
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Printf("MISMATCH in %s, %d windows differ:\n", s.desc, len(mz))
+	for i, m := range mz {
+		if i == maxReported {
+			fmt.Printf("  ... and %d more\n", len(mz)-maxReported)
+			break
+		}
+		fmt.Printf("  %s\n", m)
 	}
-	wg.Wait()
-	pool.Stop()
 }
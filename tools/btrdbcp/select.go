@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/BTrDB/smartgridstore/tools/streamselect"
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//SelectorConfig selects every stream in a collection tree whose tags match
+//the patterns, and copies it to the same place under another prefix
+type SelectorConfig struct {
+	//The streams in this collection and the collections below it
+	SrcPrefix string
+	//Replaces SrcPrefix in the destination collections
+	DstPrefix string
+	//Patterns the tags must match, using path.Match syntax, e.g. "L?MAG"
+	//or "*". A stream without one of the tags is not selected.
+	Tags map[string]string
+}
+
+//checkSelector returns an error if the selector is incomplete or has a bad
+//pattern
+func checkSelector(sel SelectorConfig) error {
+	if strings.Trim(sel.SrcPrefix, "/") == "" {
+		return fmt.Errorf("missing srcprefix field")
+	}
+	if strings.Trim(sel.DstPrefix, "/") == "" {
+		return fmt.Errorf("missing dstprefix field")
+	}
+	return streamselect.CheckPatterns(sel.Tags)
+}
+
+//Select finds the streams chosen by a selector, sorted by collection and
+//tags
+func Select(bc *v4.BTrDB, sel SelectorConfig) ([]*Stream, error) {
+	sz, err := streamselect.Lookup(context.Background(), bc, sel.SrcPrefix, true, sel.Tags)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*Stream, 0, len(sz))
+	for _, s := range sz {
+		dst, ok := streamselect.Rewrite(s.Collection, sel.SrcPrefix, sel.DstPrefix)
+		if !ok {
+			//Lookup only returns streams in the tree
+			return nil, fmt.Errorf("stream %s is not under %q", s.Desc, sel.SrcPrefix)
+		}
+		rv = append(rv, &Stream{
+			CC:   s.Collection,
+			NC:   dst,
+			T:    s.Tags,
+			desc: s.Desc,
+			src:  s.Stream,
+		})
+	}
+	return rv, nil
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import "testing"
+
+func TestCheckSelector(t *testing.T) {
+	good := SelectorConfig{SrcPrefix: "sub1", DstPrefix: "mirror/sub1", Tags: map[string]string{"name": "L*"}}
+	if err := checkSelector(good); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []SelectorConfig{
+		{SrcPrefix: "/", DstPrefix: "mirror"},
+		{SrcPrefix: "sub1"},
+		{SrcPrefix: "sub1", DstPrefix: "mirror", Tags: map[string]string{"name": "L[1"}},
+	} {
+		if err := checkSelector(bad); err == nil {
+			t.Errorf("%+v was accepted", bad)
+		}
+	}
+}
+
+func TestCheckDestinations(t *testing.T) {
+	a := &Stream{NC: "mirror/sub1", T: map[string]string{"name": "L1MAG"}, desc: "a"}
+	b := &Stream{NC: "mirror/sub1", T: map[string]string{"name": "L2MAG"}, desc: "b"}
+	if err := checkDestinations([]*Stream{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	c := &Stream{NC: "mirror/sub1", T: map[string]string{"name": "L1MAG"}, desc: "c"}
+	if err := checkDestinations([]*Stream{a, b, c}); err == nil {
+		t.Fatalf("two streams with the same destination were accepted")
+	}
+}
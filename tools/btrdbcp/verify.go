@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//The default verification windows are 2^40 ns, about 18 minutes
+const defaultVerifyPrecision = 40
+
+//Means are summed in a different order in the destination, so they are
+//compared to within this relative error
+const meanTolerance = 1e-9
+
+//Mismatch is a window whose statistics differ between the source and the
+//destination. A window missing on one side has a zero count.
+type Mismatch struct {
+	Start int64
+	End   int64
+	Src   v4.StatPoint
+	Dst   v4.StatPoint
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s to %s: source count=%d min=%g mean=%g max=%g, destination count=%d min=%g mean=%g max=%g",
+		time.Unix(0, m.Start).UTC().Format(time.RFC3339Nano), time.Unix(0, m.End).UTC().Format(time.RFC3339Nano),
+		m.Src.Count, m.Src.Min, m.Src.Mean, m.Src.Max, m.Dst.Count, m.Dst.Min, m.Dst.Mean, m.Dst.Max)
+}
+
+//alignedRange returns the part of the range made of whole windows of 2^pw
+//nanoseconds. It is empty if there are none.
+func alignedRange(start int64, end int64, pw uint8) (int64, int64) {
+	width := int64(1) << pw
+	floor := func(t int64) int64 {
+		if t < 0 && t%width != 0 {
+			return t - t%width - width
+		}
+		return t - t%width
+	}
+	astart := floor(start)
+	if astart < start {
+		astart += width
+	}
+	aend := floor(end)
+	if aend < astart {
+		return start, start
+	}
+	return astart, aend
+}
+
+//equalStats returns true if two windows have the same statistics
+func equalStats(a v4.StatPoint, b v4.StatPoint) bool {
+	if a.Count != b.Count {
+		return false
+	}
+	if a.Count == 0 {
+		return true
+	}
+	if a.Min != b.Min || a.Max != b.Max {
+		return false
+	}
+	return math.Abs(a.Mean-b.Mean) <= meanTolerance*math.Max(math.Abs(a.Mean), math.Abs(b.Mean))
+}
+
+//compareWindows returns the windows that differ, given the windows of the
+//source and destination in time order, each of the given width
+func compareWindows(src []v4.StatPoint, dst []v4.StatPoint, width int64) []Mismatch {
+	rv := []Mismatch{}
+	i, j := 0, 0
+	for i < len(src) || j < len(dst) {
+		var s, d v4.StatPoint
+		switch {
+		case j == len(dst) || (i < len(src) && src[i].Time < dst[j].Time):
+			s = src[i]
+			d.Time = s.Time
+			i++
+		case i == len(src) || dst[j].Time < src[i].Time:
+			d = dst[j]
+			s.Time = d.Time
+			j++
+		default:
+			s, d = src[i], dst[j]
+			i++
+			j++
+		}
+		if !equalStats(s, d) {
+			rv = append(rv, Mismatch{Start: s.Time, End: s.Time + width, Src: s, Dst: d})
+		}
+	}
+	return rv
+}
+
+func collectStats(csp chan v4.StatPoint, cerr chan error) ([]v4.StatPoint, error) {
+	rv := []v4.StatPoint{}
+	for sp := range csp {
+		rv = append(rv, sp)
+	}
+	return rv, <-cerr
+}
+
+//Verify compares the source stream, as of the given version, with the
+//destination in windows of 2^pw nanoseconds. The parts of the range that
+//are not whole windows are compared as a window each.
+func Verify(s *Stream, start int64, end int64, pw uint8, version uint64) ([]Mismatch, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//The last points inserted may not be visible yet
+	err := s.dst.Flush(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rv := []Mismatch{}
+	astart, aend := alignedRange(start, end, pw)
+	if astart < aend {
+		csp, _, cerr := s.src.AlignedWindows(ctx, astart, aend, pw, version)
+		src, err := collectStats(csp, cerr)
+		if err != nil {
+			return nil, err
+		}
+		csp, _, cerr = s.dst.AlignedWindows(ctx, astart, aend, pw, v4.LatestVersion)
+		dst, err := collectStats(csp, cerr)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, compareWindows(src, dst, int64(1)<<pw)...)
+	}
+	for _, edge := range [][2]int64{{start, astart}, {aend, end}} {
+		if edge[1] <= edge[0] {
+			continue
+		}
+		width := edge[1] - edge[0]
+		csp, _, cerr := s.src.Windows(ctx, edge[0], edge[1], uint64(width), 0, version)
+		src, err := collectStats(csp, cerr)
+		if err != nil {
+			return nil, err
+		}
+		csp, _, cerr = s.dst.Windows(ctx, edge[0], edge[1], uint64(width), 0, v4.LatestVersion)
+		dst, err := collectStats(csp, cerr)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, compareWindows(src, dst, width)...)
+	}
+	return rv, nil
+}
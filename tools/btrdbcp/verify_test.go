@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"testing"
+
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+)
+
+func TestSplitRange(t *testing.T) {
+	if e := splitRange(100, 1050, 100); e != 1000 {
+		t.Fatalf("expected whole chunks to end at 1000, got %d", e)
+	}
+	if e := splitRange(100, 1100, 100); e != 1100 {
+		t.Fatalf("expected whole chunks to end at 1100, got %d", e)
+	}
+	if e := splitRange(100, 150, 100); e != 100 {
+		t.Fatalf("expected no whole chunks, got %d", e)
+	}
+}
+
+func TestAlignedRange(t *testing.T) {
+	for _, c := range []struct {
+		start, end   int64
+		astart, aend int64
+	}{
+		{0, 64, 0, 64},
+		{1, 130, 16, 128},
+		{-20, 20, -16, 16},
+		{-32, -1, -32, -16},
+		{1, 15, 1, 1},
+		{17, 40, 32, 32},
+	} {
+		astart, aend := alignedRange(c.start, c.end, 4)
+		if astart != c.astart || aend != c.aend {
+			t.Errorf("[%d, %d): expected [%d, %d) got [%d, %d)", c.start, c.end, c.astart, c.aend, astart, aend)
+		}
+	}
+}
+
+func stat(t int64, min float64, mean float64, max float64, count uint64) v4.StatPoint {
+	return v4.StatPoint{Time: t, Min: min, Mean: mean, Max: max, Count: count}
+}
+
+func TestCompareWindows(t *testing.T) {
+	src := []v4.StatPoint{
+		stat(0, 1, 2, 3, 10),
+		stat(10, 1, 2, 3, 10),
+		stat(20, 1, 0.1+0.2, 3, 10),
+		stat(30, 1, 2, 3, 10),
+	}
+	dst := []v4.StatPoint{
+		stat(0, 1, 2, 3, 10),
+		//A point is missing
+		stat(10, 1, 2, 3, 9),
+		//Summed in another order
+		stat(20, 1, 0.3, 3, 10),
+		//Not in the source at all
+		stat(40, 5, 5, 5, 1),
+	}
+	mz := compareWindows(src, dst, 10)
+	if len(mz) != 3 {
+		t.Fatalf("expected 3 mismatches got %v", mz)
+	}
+	if mz[0].Start != 10 || mz[0].End != 20 || mz[0].Dst.Count != 9 {
+		t.Fatalf("unexpected mismatch %v", mz[0])
+	}
+	if mz[1].Start != 30 || mz[1].Dst.Count != 0 || mz[1].Src.Count != 10 {
+		t.Fatalf("unexpected mismatch %v", mz[1])
+	}
+	if mz[2].Start != 40 || mz[2].Src.Count != 0 || mz[2].Dst.Count != 1 {
+		t.Fatalf("unexpected mismatch %v", mz[2])
+	}
+	if !equalStats(stat(0, 0, 0, 0, 0), stat(0, 1, 1, 1, 0)) {
+		t.Fatalf("empty windows should be equal")
+	}
+	if equalStats(stat(0, 1, 2, 3, 5), stat(0, 1, 2, 3.5, 5)) {
+		t.Fatalf("windows with different maxima should differ")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/admincli"
+	"github.com/BTrDB/smartgridstore/tools/btrdbdu/usage"
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+const noSnapshots = "There are no storage snapshots. Run btrdbdu with --snapshot to take one"
+
+var etcdConn *etcd.Client
+
+//NewStorageCLIModule returns the module that shows the storage usage saved
+//by btrdbdu
+func NewStorageCLIModule(c *etcd.Client) admincli.CLIModule {
+	etcdConn = c
+	return &admincli.GenericCLIModule{
+		MName:  "storage",
+		MHint:  "show storage utilisation and growth",
+		MUsage: "\nThe figures come from the snapshots saved by btrdbdu --snapshot\n",
+		MChildren: []admincli.CLIModule{
+			&admincli.GenericCLIModule{
+				MName:     "summary",
+				MHint:     "shows the total usage, growth and projected time until full",
+				MUsage:    " [windowdays]\nGrowth is measured over the last windowdays days, by default 7\n",
+				MRun:      summary,
+				MRunnable: true,
+			},
+			&admincli.GenericCLIModule{
+				MName:     "top",
+				MHint:     "shows the largest collections and their growth",
+				MUsage:    " [n] [depth] [windowdays]\nShows the n (default 10) largest collections depth (default 1) levels deep\n",
+				MRun:      top,
+				MRunnable: true,
+			},
+			&admincli.GenericCLIModule{
+				MName:     "history",
+				MHint:     "lists the saved snapshots",
+				MUsage:    "",
+				MRun:      history,
+				MRunnable: true,
+			},
+		},
+	}
+}
+
+//parseArgs parses optional positive integer arguments into the given
+//defaults
+func parseArgs(args []string, defaults ...*int) bool {
+	if len(args) > len(defaults) {
+		return false
+	}
+	for i, a := range args {
+		v, err := strconv.Atoi(a)
+		if err != nil || v <= 0 {
+			return false
+		}
+		*defaults[i] = v
+	}
+	return true
+}
+
+func window(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func gb(b float64) string {
+	return fmt.Sprintf("%.2f GB", b/(1024*1024*1024))
+}
+
+//load returns the snapshots, or false if there are none or there was an
+//error, which has been written to out
+func load(ctx context.Context, out io.Writer) ([]*usage.Snapshot, bool) {
+	snaps, err := usage.RetrieveSnapshots(ctx, etcdConn)
+	if err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return nil, false
+	}
+	if len(snaps) == 0 {
+		fmt.Fprintln(out, noSnapshots)
+		return nil, false
+	}
+	return snaps, true
+}
+
+func summary(ctx context.Context, out io.Writer, args ...string) bool {
+	days := 7
+	if !parseArgs(args, &days) {
+		return false
+	}
+	snaps, ok := load(ctx, out)
+	if !ok {
+		return true
+	}
+	last := snaps[len(snaps)-1]
+	fmt.Fprintf(out, "snapshot taken %s (%s ago)\n", time.Unix(0, last.Time).UTC().Format(time.RFC3339),
+		time.Since(time.Unix(0, last.Time)).Round(time.Minute))
+	fmt.Fprintf(out, "streams:   %d with %d points\n", last.Total.Streams, last.Total.Points)
+	fmt.Fprintf(out, "hot:       %s\n", gb(float64(last.Total.HotBytes)))
+	fmt.Fprintf(out, "cold:      %s\n", gb(float64(last.Total.ColdBytes)))
+	fmt.Fprintf(out, "per point: %.2f bytes\n", last.Total.BytesPerPoint())
+	fmt.Fprintf(out, "orphaned:  %s in %d deleted streams\n", gb(float64(last.Orphaned.Bytes())), last.Orphaned.Streams)
+	if last.Cluster.TotalBytes != 0 {
+		fmt.Fprintf(out, "cluster:   %s used, %s available of %s raw\n", gb(float64(last.Cluster.UsedBytes)),
+			gb(float64(last.Cluster.AvailBytes)), gb(float64(last.Cluster.TotalBytes)))
+	}
+	g := usage.NewGrowth(snaps, window(days))
+	if g == nil {
+		fmt.Fprintln(out, "growth:    needs at least two snapshots taken at different times")
+		return true
+	}
+	fmt.Fprintf(out, "growth:    %s/day over the last %.1f days, %s/day raw\n", gb(g.TotalPerDay()), g.Days(), gb(g.ClusterPerDay()))
+	full, ok := g.DaysUntilFull()
+	if ok {
+		fmt.Fprintf(out, "full in:   %.0f days (%s)\n", full,
+			time.Unix(0, last.Time).Add(time.Duration(full*float64(24*time.Hour))).UTC().Format("2006-01-02"))
+	} else {
+		fmt.Fprintln(out, "full in:   never at the current rate")
+	}
+	return true
+}
+
+func top(ctx context.Context, out io.Writer, args ...string) bool {
+	n, depth, days := 10, 1, 7
+	if !parseArgs(args, &n, &depth, &days) {
+		return false
+	}
+	snaps, ok := load(ctx, out)
+	if !ok {
+		return true
+	}
+	last := snaps[len(snaps)-1]
+	g := usage.NewGrowth(snaps, window(days))
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tSIZE\tHOT\tCOLD\tSTREAMS\tB/POINT\tGROWTH/DAY")
+	for _, cu := range usage.Top(last, n, depth) {
+		growth := "-"
+		if g != nil {
+			growth = gb(g.PerDay(cu.Collection))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%.2f\t%s\n", cu.Collection, gb(float64(cu.Bytes())),
+			gb(float64(cu.HotBytes)), gb(float64(cu.ColdBytes)), cu.Streams, cu.BytesPerPoint(), growth)
+	}
+	tw.Flush()
+	return true
+}
+
+func history(ctx context.Context, out io.Writer, args ...string) bool {
+	if len(args) != 0 {
+		return false
+	}
+	snaps, ok := load(ctx, out)
+	if !ok {
+		return true
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tSIZE\tPOINTS\tSTREAMS\tRAW USED\tRAW AVAILABLE")
+	for _, s := range snaps {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", time.Unix(0, s.Time).UTC().Format(time.RFC3339),
+			gb(float64(s.Total.Bytes())), s.Total.Points, s.Total.Streams,
+			gb(float64(s.Cluster.UsedBytes)), gb(float64(s.Cluster.AvailBytes)))
+	}
+	tw.Flush()
+	return true
+}
@@ -10,12 +10,13 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
-	"math"
 	"os"
 	"sort"
-	"strings"
+	"time"
 
 	"github.com/BTrDB/btrdb"
+	"github.com/BTrDB/smartgridstore/tools/btrdbdu/usage"
+	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/immesys/go-ceph/rados"
 	"github.com/pborman/uuid"
 	"github.com/urfave/cli"
@@ -52,6 +53,34 @@ func main() {
 			Value: "",
 			Usage: "raw details csv file",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "report format: text, json or csv",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Value: "",
+			Usage: "report file, instead of stdout",
+		},
+		cli.IntFlag{
+			Name:  "depth",
+			Value: 0,
+			Usage: "only report collections this many levels deep, 0 for all",
+		},
+		cli.BoolFlag{
+			Name:  "streams",
+			Usage: "also report each stream",
+		},
+		cli.BoolFlag{
+			Name:  "snapshot",
+			Usage: "save the usage to etcd (at $ETCD_ENDPOINT) for the admin console",
+		},
+		cli.IntFlag{
+			Name:  "keep",
+			Value: usage.DefaultKeep,
+			Usage: "how many snapshots to keep in etcd",
+		},
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -59,13 +88,17 @@ func main() {
 	}
 }
 
-type usageType struct {
-	totalHotSize  uint64
-	totalColdSize uint64
-	totalPoints   uint64
+type objectUsage struct {
+	hot  uint64
+	cold uint64
 }
 
 func run(c *cli.Context) error {
+	format := c.GlobalString("format")
+	if format != "text" && format != "json" && format != "csv" {
+		fmt.Printf("unknown output format %q\n", format)
+		os.Exit(1)
+	}
 	db, err := btrdb.Connect(context.Background(), c.GlobalString("btrdb"))
 	if err != nil {
 		fmt.Printf("could not connect to btrdb: %v\n", err)
@@ -87,133 +120,123 @@ func run(c *cli.Context) error {
 	}
 	defer conn.Shutdown()
 
-	hotctx, err := conn.OpenIOContext(c.GlobalString("hot"))
-	if err != nil {
-		fmt.Printf("could not open hot pool %q: %v\n", c.GlobalString("hot"), err)
-		os.Exit(1)
-	}
-	hotctx2, err := conn.OpenIOContext(c.GlobalString("hot"))
-	if err != nil {
-		fmt.Printf("could not open hot pool %q: %v\n", c.GlobalString("hot"), err)
-		os.Exit(1)
-	}
-	coldctx, err := conn.OpenIOContext(c.GlobalString("data"))
-	if err != nil {
-		fmt.Printf("could not open cold pool %q: %v\n", c.GlobalString("data"), err)
-		os.Exit(1)
-	}
-	coldctx2, err := conn.OpenIOContext(c.GlobalString("data"))
-	if err != nil {
-		fmt.Printf("could not open cold pool %q: %v\n", c.GlobalString("data"), err)
-		os.Exit(1)
-	}
-
 	//-----------
-	usage := make(map[[16]byte]*usageType)
-	clusage := make(map[string]*usageType)
-	clmap := make(map[string][][]byte)
+	objects := make(map[[16]byte]*objectUsage)
 	cnt := 0
-	totalhot := uint64(0)
-	totalcold := uint64(0)
-	updateclusage := func(uuid []byte, coldsize uint64, hotsize uint64) {
-		str := db.StreamFromUUID(uuid)
-		col, err := str.Collection(context.Background())
+	scan := func(pool string, add func(ou *objectUsage, size uint64)) {
+		listctx, err := conn.OpenIOContext(pool)
 		if err != nil {
-			if btrdb.ToCodedError(err).Code == 404 {
-				return
-			}
-			fmt.Printf("btrdb error: %v\n", err)
+			fmt.Printf("could not open pool %q: %v\n", pool, err)
 			os.Exit(1)
 		}
-		csp, _, cerr := str.AlignedWindows(context.Background(), 0, (1<<61)-1, 61, 0)
-		sv := <-csp
-		err = <-cerr
+		statctx, err := conn.OpenIOContext(pool)
 		if err != nil {
-			fmt.Printf("could not count stream: %v\n", err)
+			fmt.Printf("could not open pool %q: %v\n", pool, err)
 			os.Exit(1)
 		}
-
-		parts := strings.Split(col, "/")
-		for i := 1; i <= len(parts); i++ {
-			subcol := strings.Join(parts[:i], "/")
-			if clusage[subcol] == nil {
-				clusage[subcol] = &usageType{}
+		listctx.ListObjects(func(oid string) {
+			cnt++
+			if cnt%3000 == 0 {
+				fmt.Fprintf(os.Stderr, "\rscanned %d k objects  ", cnt/1000)
 			}
-			clusage[subcol].totalColdSize += coldsize
-			clusage[subcol].totalHotSize += hotsize
-			clusage[subcol].totalPoints += sv.Count
-		}
-		clmap[col] = append(clmap[col], uuid)
-		arr := [16]byte{}
-		copy(arr[:], uuid[:])
-		usage[arr].totalPoints = sv.Count
-	}
-	hotctx.ListObjects(func(oid string) {
-		cnt++
-		if cnt%3000 == 0 {
-			fmt.Printf("\rscanned %d k objects  ", cnt)
-		}
-		uu, ok := extractUuid(oid)
-		if !ok {
-			return // non stream object
+			uu, ok := extractUuid(oid)
+			if !ok {
+				return // non stream object
+			}
+			stats, err := statctx.Stat(oid)
+			if err != nil {
+				fmt.Printf("ceph error: %v\n", err)
+				os.Exit(1)
+			}
+			if objects[uu] == nil {
+				objects[uu] = &objectUsage{}
+			}
+			add(objects[uu], stats.Size)
+		})
+	}
+	scan(c.GlobalString("hot"), func(ou *objectUsage, size uint64) { ou.hot += size })
+	scan(c.GlobalString("data"), func(ou *objectUsage, size uint64) { ou.cold += size })
+	fmt.Fprintf(os.Stderr, "\rscanned %d objects of %d streams\n", cnt, len(objects))
+
+	cluster := usage.Capacity{}
+	cstat, err := conn.GetClusterStats()
+	if err != nil {
+		fmt.Printf("could not get ceph cluster stats: %v\n", err)
+		os.Exit(1)
+	}
+	cluster.TotalBytes = cstat.Kb * 1024
+	cluster.UsedBytes = cstat.Kb_used * 1024
+	cluster.AvailBytes = cstat.Kb_avail * 1024
+
+	//Each stream is looked up once, after its objects have been added up
+	streams := []*usage.StreamUsage{}
+	orphaned := usage.Usage{}
+	done := 0
+	for uu, ou := range objects {
+		done++
+		if done%100 == 0 {
+			fmt.Fprintf(os.Stderr, "\rcounted %d of %d streams  ", done, len(objects))
 		}
-		stats, err := hotctx2.Stat(oid)
+		su, err := lookupStream(db, uu[:])
 		if err != nil {
-			fmt.Printf("ceph error: %v\n", err)
+			fmt.Printf("btrdb error: %v\n", err)
 			os.Exit(1)
 		}
-		if usage[uu] == nil {
-			usage[uu] = &usageType{}
+		u := usage.Usage{HotBytes: ou.hot, ColdBytes: ou.cold, Streams: 1}
+		if su == nil {
+			orphaned.Add(u)
+			continue
 		}
-		usage[uu].totalHotSize += stats.Size
-		updateclusage(uu[:], 0, stats.Size)
-		totalhot += stats.Size
-	})
-	coldctx.ListObjects(func(oid string) {
-		cnt++
-		if cnt%1000 == 0 {
-			fmt.Printf("\rscanned %d k objects  ", cnt)
-		}
-		uu, ok := extractUuid(oid)
-		if !ok {
-			fmt.Printf("skipping %q\n", oid)
-			return // non stream object
+		u.Points = su.Points
+		su.Usage = u
+		streams = append(streams, su)
+	}
+	fmt.Fprintf(os.Stderr, "\rcounted %d streams, %d were deleted\n", len(streams), orphaned.Streams)
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Collection != streams[j].Collection {
+			return streams[i].Collection < streams[j].Collection
 		}
-		stats, err := coldctx2.Stat(oid)
+		return streams[i].Name < streams[j].Name
+	})
+	snap := usage.NewSnapshot(time.Now().UnixNano(), streams, orphaned, cluster)
+
+	//------
+	out := os.Stdout
+	if fname := c.GlobalString("out"); fname != "" {
+		out, err = os.Create(fname)
 		if err != nil {
-			fmt.Printf("ceph error: %v\n", err)
+			fmt.Printf("could not create output file: %v\n", err)
 			os.Exit(1)
 		}
-		if usage[uu] == nil {
-			usage[uu] = &usageType{}
-		}
-		usage[uu].totalColdSize += stats.Size
-		updateclusage(uu[:], stats.Size, 0)
-		totalcold += stats.Size
-	})
+		defer out.Close()
+	}
+	var perStream []*usage.StreamUsage
+	if c.GlobalBool("streams") {
+		perStream = streams
+	}
+	depth := c.GlobalInt("depth")
+	switch format {
+	case "text":
+		err = usage.WriteText(out, snap, perStream, depth)
+	case "json":
+		err = usage.WriteJSON(out, snap, perStream, depth)
+	case "csv":
+		err = usage.WriteCSV(out, snap, perStream, depth)
+	}
+	if err != nil {
+		fmt.Printf("could not write report: %v\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("\ncomplete\n")
-	// for uu, rec := range usage {
-	// 	struu := uuid.UUID(uu[:]).String()
-	// 	fmt.Printf("%s %6.2f %6.2f\n", struu, float64(rec.totalColdSize)/(1024*1024), float64(rec.totalHotSize)/(1024*1024))
-	// }
-	cols := []string{}
-	for col, _ := range clusage {
-		cols = append(cols, col)
-	}
-	sort.Strings(cols)
-	fmt.Printf("Collection size summary:\n")
-	fmt.Printf("      HOT      COLD    PTS    /1MP Collection prefix\n")
-	for _, col := range cols {
-		rec := clusage[col]
-		permp := (float64(rec.totalHotSize+rec.totalColdSize) / (1024 * 1024)) / (float64(rec.totalPoints) / 1e6)
-		fmt.Printf("%8.2fM %8.2fM %5dM %6.2fM %s\n", float64(rec.totalHotSize)/(1024*1024), float64(rec.totalColdSize)/(1024*1024), int(math.Ceil(float64(rec.totalPoints)/1e6)), permp, col)
-	}
-	fmt.Printf("=========\n")
-	fmt.Printf("Total hot object size : %.2f MB\n", float64(totalhot)/(1024*1024))
-	fmt.Printf("Total cold object size: %.2f MB\n", float64(totalcold)/(1024*1024))
+	if c.GlobalBool("snapshot") {
+		err = saveSnapshot(snap, c.GlobalInt("keep"))
+		if err != nil {
+			fmt.Printf("could not save snapshot to etcd: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "saved snapshot to etcd\n")
+	}
 
-	//------
 	csvoutfile := c.GlobalString("csvout")
 	if csvoutfile == "" {
 		return nil
@@ -224,14 +247,64 @@ func run(c *cli.Context) error {
 		os.Exit(1)
 	}
 	f.Write([]byte("uuid, hotsize, coldsize, points\n"))
-
-	for uu, rec := range usage {
-		f.Write([]byte(fmt.Sprintf("%s,%d,%d,%d\n", uuid.UUID(uu[:]).String(), rec.totalHotSize, rec.totalColdSize, rec.totalPoints)))
+	for _, su := range streams {
+		f.Write([]byte(fmt.Sprintf("%s,%d,%d,%d\n", su.UUID, su.HotBytes, su.ColdBytes, su.Points)))
 	}
 	f.Close()
 	return nil
 }
 
+//lookupStream returns the collection, name and number of points of a
+//stream, or nil if the stream has been deleted
+func lookupStream(db *btrdb.BTrDB, uu []byte) (*usage.StreamUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	str := db.StreamFromUUID(uu)
+	col, err := str.Collection(ctx)
+	if err != nil {
+		if btrdb.ToCodedError(err).Code == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tags, err := str.Tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//The whole time range is four windows of 2^60 ns
+	csp, _, cerr := str.AlignedWindows(ctx, btrdb.MinimumTime, btrdb.MaximumTime, 60, 0)
+	var points uint64
+	for sv := range csp {
+		points += sv.Count
+	}
+	if err := <-cerr; err != nil {
+		return nil, err
+	}
+	return &usage.StreamUsage{
+		UUID:       uuid.UUID(uu).String(),
+		Collection: col,
+		Name:       tags["name"],
+		Usage:      usage.Usage{Points: points},
+	}, nil
+}
+
+func saveSnapshot(snap *usage.Snapshot, keep int) error {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if len(etcdEndpoint) == 0 {
+		etcdEndpoint = "http://etcd:2379"
+	}
+	etcdClient, err := etcd.New(etcd.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return usage.SaveSnapshot(ctx, etcdClient, snap, keep)
+}
+
 func extractUuid(oid string) ([16]byte, bool) {
 	if len(oid) < 32 {
 		return [16]byte{}, false
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package usage
+
+import (
+	"sort"
+	"time"
+)
+
+//DefaultGrowthWindow is how far back growth is measured by default
+const DefaultGrowthWindow = 7 * 24 * time.Hour
+
+const day = float64(24 * time.Hour)
+
+//Growth is the change in usage between two snapshots
+type Growth struct {
+	From *Snapshot
+	To   *Snapshot
+}
+
+//NewGrowth compares the newest snapshot with the newest one taken at least
+//window before it, or with the oldest snapshot if none are that old. The
+//snapshots must be oldest first, as RetrieveSnapshots returns them.
+//Snapshots taken at the same time as the newest one are skipped, as no time
+//passed between them. It returns nil if there are no two snapshots to
+//compare.
+func NewGrowth(snaps []*Snapshot, window time.Duration) *Growth {
+	if len(snaps) < 2 {
+		return nil
+	}
+	to := snaps[len(snaps)-1]
+	var from *Snapshot
+	for _, s := range snaps[:len(snaps)-1] {
+		if s.Time >= to.Time {
+			continue
+		}
+		if from == nil || s.Time <= to.Time-int64(window) {
+			from = s
+		}
+	}
+	if from == nil {
+		return nil
+	}
+	return &Growth{From: from, To: to}
+}
+
+//Days is the time between the snapshots
+func (g *Growth) Days() float64 {
+	return float64(g.To.Time-g.From.Time) / day
+}
+
+//perDay is zero if no time passed between the snapshots, rather than
+//infinite
+func (g *Growth) perDay(from uint64, to uint64) float64 {
+	days := g.Days()
+	if days <= 0 {
+		return 0
+	}
+	return (float64(to) - float64(from)) / days
+}
+
+//PerDay is how many bytes a collection grew by per day. A collection that
+//is new or was deleted grew from or to zero.
+func (g *Growth) PerDay(col string) float64 {
+	var from, to uint64
+	if cu := g.From.Collection(col); cu != nil {
+		from = cu.Bytes()
+	}
+	if cu := g.To.Collection(col); cu != nil {
+		to = cu.Bytes()
+	}
+	return g.perDay(from, to)
+}
+
+//TotalPerDay is how many bytes all the streams grew by per day
+func (g *Growth) TotalPerDay() float64 {
+	return g.perDay(g.From.Total.Bytes(), g.To.Total.Bytes())
+}
+
+//ClusterPerDay is how many raw bytes of the ceph cluster were used per day
+func (g *Growth) ClusterPerDay() float64 {
+	return g.perDay(g.From.Cluster.UsedBytes, g.To.Cluster.UsedBytes)
+}
+
+//DaysUntilFull projects when the cluster will be full if it keeps growing
+//at the same rate. It returns false if the cluster is not growing or its
+//capacity is not known.
+func (g *Growth) DaysUntilFull() (float64, bool) {
+	rate := g.ClusterPerDay()
+	if rate <= 0 || g.To.Cluster.TotalBytes == 0 {
+		return 0, false
+	}
+	return float64(g.To.Cluster.AvailBytes) / rate, true
+}
+
+//Top returns the n largest collections that are depth levels deep, largest
+//first. All the collections are returned if n is zero.
+func Top(snap *Snapshot, n int, depth int) []*CollectionUsage {
+	rv := []*CollectionUsage{}
+	for _, cu := range snap.Collections {
+		if cu.Depth() == depth {
+			rv = append(rv, cu)
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Bytes() > rv[j].Bytes()
+	})
+	if n > 0 && len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
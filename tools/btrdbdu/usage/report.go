@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+//MB formats a number of bytes in MiB, which is what the text reports use
+func MB(b uint64) string {
+	return fmt.Sprintf("%.2fM", float64(b)/(1024*1024))
+}
+
+//filter returns the collections no deeper than depth, or all of them if
+//depth is zero
+func filter(cols []*CollectionUsage, depth int) []*CollectionUsage {
+	if depth <= 0 {
+		return cols
+	}
+	rv := []*CollectionUsage{}
+	for _, cu := range cols {
+		if cu.Depth() <= depth {
+			rv = append(rv, cu)
+		}
+	}
+	return rv
+}
+
+func textLine(w io.Writer, u Usage, label string) error {
+	_, err := fmt.Fprintf(w, "%9s %9s %6dM %8.2f %5d %s\n", MB(u.HotBytes), MB(u.ColdBytes),
+		int(math.Ceil(float64(u.Points)/1e6)), u.BytesPerPoint(), u.Streams, label)
+	return err
+}
+
+//WriteText writes a du style summary of the snapshot, with one line per
+//collection no deeper than depth, and one line per stream if streams is
+//not nil
+func WriteText(w io.Writer, snap *Snapshot, streams []*StreamUsage, depth int) error {
+	fmt.Fprintf(w, "Collection size summary at %s:\n", time.Unix(0, snap.Time).UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "      HOT      COLD     PTS  B/POINT  STRM Collection prefix\n")
+	for _, cu := range filter(snap.Collections, depth) {
+		if err := textLine(w, cu.Usage, cu.Collection); err != nil {
+			return err
+		}
+	}
+	if streams != nil {
+		fmt.Fprintf(w, "\nStream size summary:\n")
+		fmt.Fprintf(w, "      HOT      COLD     PTS  B/POINT  STRM Stream\n")
+		for _, s := range streams {
+			if err := textLine(w, s.Usage, fmt.Sprintf("%s/%s %s", s.Collection, s.Name, s.UUID)); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(w, "=========\n")
+	fmt.Fprintf(w, "Total hot object size : %s\n", MB(snap.Total.HotBytes))
+	fmt.Fprintf(w, "Total cold object size: %s\n", MB(snap.Total.ColdBytes))
+	fmt.Fprintf(w, "Total points          : %d in %d streams\n", snap.Total.Points, snap.Total.Streams)
+	_, err := fmt.Fprintf(w, "Orphaned objects      : %s hot, %s cold in %d deleted streams\n",
+		MB(snap.Orphaned.HotBytes), MB(snap.Orphaned.ColdBytes), snap.Orphaned.Streams)
+	if err != nil {
+		return err
+	}
+	if snap.Cluster.TotalBytes != 0 {
+		_, err = fmt.Fprintf(w, "Cluster raw capacity  : %s used, %s available of %s\n",
+			MB(snap.Cluster.UsedBytes), MB(snap.Cluster.AvailBytes), MB(snap.Cluster.TotalBytes))
+	}
+	return err
+}
+
+//WriteJSON writes the snapshot, and the streams if they are not nil, as a
+//single JSON object
+func WriteJSON(w io.Writer, snap *Snapshot, streams []*StreamUsage, depth int) error {
+	report := struct {
+		Snapshot
+		Collections []*CollectionUsage `json:"collections"`
+		Streams     []*StreamUsage     `json:"streams,omitempty"`
+	}{
+		Snapshot:    *snap,
+		Collections: filter(snap.Collections, depth),
+		Streams:     streams,
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+//WriteCSV writes a row per collection no deeper than depth, and a row per
+//stream if streams is not nil. The kind column tells them apart.
+func WriteCSV(w io.Writer, snap *Snapshot, streams []*StreamUsage, depth int) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "collection", "name", "uuid", "hot_bytes", "cold_bytes", "points", "streams", "bytes_per_point"})
+	row := func(kind string, col string, name string, uu string, u Usage) {
+		cw.Write([]string{kind, col, name, uu,
+			strconv.FormatUint(u.HotBytes, 10),
+			strconv.FormatUint(u.ColdBytes, 10),
+			strconv.FormatUint(u.Points, 10),
+			strconv.Itoa(u.Streams),
+			strconv.FormatFloat(u.BytesPerPoint(), 'f', 3, 64),
+		})
+	}
+	for _, cu := range filter(snap.Collections, depth) {
+		row("collection", cu.Collection, "", "", cu.Usage)
+	}
+	for _, s := range streams {
+		row("stream", s.Collection, s.Name, s.UUID, s.Usage)
+	}
+	row("orphaned", "", "", "", snap.Orphaned)
+	row("total", "", "", "", snap.Total)
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package usage aggregates the storage used by BTrDB streams up the
+//collection tree, and keeps snapshots of it in etcd so that growth can be
+//tracked between runs of btrdbdu
+package usage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/ugorji/go/codec"
+)
+
+const snapshotpath = "btrdbdu/snapshot/"
+
+//DefaultKeep is the number of snapshots kept in etcd by default
+const DefaultKeep = 100
+
+var mp codec.Handle = &codec.MsgpackHandle{}
+
+//Usage is the storage used by one or more streams
+type Usage struct {
+	HotBytes  uint64 `codec:"hot" json:"hot_bytes"`
+	ColdBytes uint64 `codec:"cold" json:"cold_bytes"`
+	Points    uint64 `codec:"points" json:"points"`
+	Streams   int    `codec:"streams" json:"streams"`
+}
+
+//Add adds the usage of other streams to this one
+func (u *Usage) Add(o Usage) {
+	u.HotBytes += o.HotBytes
+	u.ColdBytes += o.ColdBytes
+	u.Points += o.Points
+	u.Streams += o.Streams
+}
+
+//Bytes is the total of the hot and cold bytes
+func (u Usage) Bytes() uint64 {
+	return u.HotBytes + u.ColdBytes
+}
+
+//BytesPerPoint is zero if there are no points
+func (u Usage) BytesPerPoint() float64 {
+	if u.Points == 0 {
+		return 0
+	}
+	return float64(u.Bytes()) / float64(u.Points)
+}
+
+//StreamUsage is the storage used by a single stream
+type StreamUsage struct {
+	UUID       string `codec:"uuid" json:"uuid"`
+	Collection string `codec:"collection" json:"collection"`
+	Name       string `codec:"name" json:"name"`
+	Usage
+}
+
+//CollectionUsage is the storage used by the streams in a collection and all
+//the collections below it
+type CollectionUsage struct {
+	Collection string `codec:"collection" json:"collection"`
+	Usage
+}
+
+//Depth is the number of parts of the collection, e.g. 2 for "a/b"
+func (cu *CollectionUsage) Depth() int {
+	return len(strings.Split(cu.Collection, "/"))
+}
+
+//Snapshot is the storage used at a point in time. Times are in nanoseconds
+//since the epoch.
+type Snapshot struct {
+	Time  int64 `codec:"time" json:"time"`
+	Total Usage `codec:"total" json:"total"`
+	//The objects of streams that no longer exist
+	Orphaned    Usage              `codec:"orphaned" json:"orphaned"`
+	Cluster     Capacity           `codec:"cluster" json:"cluster"`
+	Collections []*CollectionUsage `codec:"collections" json:"collections"`
+}
+
+//Capacity is the raw space in the ceph cluster, which includes the replicas
+//of every object so it is not comparable to the usage of the streams
+type Capacity struct {
+	TotalBytes uint64 `codec:"total" json:"total_bytes"`
+	UsedBytes  uint64 `codec:"used" json:"used_bytes"`
+	AvailBytes uint64 `codec:"avail" json:"avail_bytes"`
+}
+
+//Aggregate adds the usage of each stream to its collection and every
+//collection above it, like du. The collections are sorted by name.
+func Aggregate(streams []*StreamUsage) []*CollectionUsage {
+	cols := make(map[string]*CollectionUsage)
+	for _, s := range streams {
+		parts := strings.Split(s.Collection, "/")
+		for i := 1; i <= len(parts); i++ {
+			col := strings.Join(parts[:i], "/")
+			cu, ok := cols[col]
+			if !ok {
+				cu = &CollectionUsage{Collection: col}
+				cols[col] = cu
+			}
+			cu.Add(s.Usage)
+		}
+	}
+	rv := make([]*CollectionUsage, 0, len(cols))
+	for _, cu := range cols {
+		rv = append(rv, cu)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Collection < rv[j].Collection
+	})
+	return rv
+}
+
+//NewSnapshot aggregates the usage of the streams into a snapshot at the
+//given time
+func NewSnapshot(t int64, streams []*StreamUsage, orphaned Usage, cluster Capacity) *Snapshot {
+	snap := &Snapshot{
+		Time:        t,
+		Orphaned:    orphaned,
+		Cluster:     cluster,
+		Collections: Aggregate(streams),
+	}
+	for _, s := range streams {
+		snap.Total.Add(s.Usage)
+	}
+	return snap
+}
+
+//Collection returns the usage of a collection in the snapshot, or nil
+func (s *Snapshot) Collection(col string) *CollectionUsage {
+	idx := sort.Search(len(s.Collections), func(i int) bool {
+		return s.Collections[i].Collection >= col
+	})
+	if idx < len(s.Collections) && s.Collections[idx].Collection == col {
+		return s.Collections[idx]
+	}
+	return nil
+}
+
+//The collections of a snapshot are split into parts of at most this many
+//encoded bytes, as etcd refuses values larger than 1.5 MiB
+const maxPartBytes = 512 * 1024
+
+//snapshotHeader is what is stored under the key of a snapshot, without the
+//collections. They are stored in Parts keys below it, under a generation
+//that is new every time the snapshot is saved, so that overwriting a
+//snapshot does not change the parts of the header a reader has.
+type snapshotHeader struct {
+	Snapshot
+	Gen   int64 `codec:"gen"`
+	Parts int   `codec:"parts"`
+}
+
+func getEtcdSnapshotKey(t int64) string {
+	return fmt.Sprintf("%s%020d", snapshotpath, t)
+}
+
+func getEtcdSnapshotGenPrefix(t int64, gen int64) string {
+	return fmt.Sprintf("%s/%020d/", getEtcdSnapshotKey(t), gen)
+}
+
+func getEtcdSnapshotPartKey(t int64, gen int64, part int) string {
+	return fmt.Sprintf("%s%06d", getEtcdSnapshotGenPrefix(t, gen), part)
+}
+
+//encodeSnapshot returns the header of the snapshot and its collections,
+//split into parts small enough to be stored in etcd and keyed by where
+//they are stored for the given generation
+func encodeSnapshot(snap *Snapshot, gen int64) ([]byte, map[string][]byte, error) {
+	parts := make(map[string][]byte)
+	var part []*CollectionUsage
+	size := 0
+	flush := func() error {
+		var buf []byte
+		err := codec.NewEncoderBytes(&buf, mp).Encode(part)
+		if err != nil {
+			return err
+		}
+		parts[getEtcdSnapshotPartKey(snap.Time, gen, len(parts))] = buf
+		part = nil
+		size = 0
+		return nil
+	}
+	for _, cu := range snap.Collections {
+		var buf []byte
+		err := codec.NewEncoderBytes(&buf, mp).Encode(cu)
+		if err != nil {
+			return nil, nil, err
+		}
+		if size > 0 && size+len(buf) > maxPartBytes {
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		}
+		part = append(part, cu)
+		size += len(buf)
+	}
+	if len(part) > 0 {
+		if err := flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	hdr := snapshotHeader{Snapshot: *snap, Gen: gen, Parts: len(parts)}
+	hdr.Collections = nil
+	var buf []byte
+	err := codec.NewEncoderBytes(&buf, mp).Encode(&hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, parts, nil
+}
+
+//decodeSnapshot reassembles a snapshot from its header and the values
+//below it, keyed by etcd key. Parts of other generations are ignored.
+func decodeSnapshot(header []byte, parts map[string][]byte) (*Snapshot, error) {
+	hdr := &snapshotHeader{}
+	err := codec.NewDecoderBytes(header, mp).Decode(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if len(hdr.Collections) > 0 {
+		return nil, fmt.Errorf("collections in the header")
+	}
+	for i := 0; i < hdr.Parts; i++ {
+		p, ok := parts[getEtcdSnapshotPartKey(hdr.Time, hdr.Gen, i)]
+		if !ok {
+			return nil, fmt.Errorf("part %d of %d is missing", i, hdr.Parts)
+		}
+		var cols []*CollectionUsage
+		err = codec.NewDecoderBytes(p, mp).Decode(&cols)
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %v", i, err)
+		}
+		hdr.Collections = append(hdr.Collections, cols...)
+	}
+	return &hdr.Snapshot, nil
+}
+
+//SaveSnapshot writes the snapshot to etcd and deletes the oldest snapshots
+//so that at most keep are left. The header of the snapshot is written after
+//its parts, so a snapshot is not seen until it is complete.
+func SaveSnapshot(ctx context.Context, etcdClient *etcd.Client, snap *Snapshot, keep int) error {
+	gen := time.Now().UnixNano()
+	header, parts, err := encodeSnapshot(snap, gen)
+	if err != nil {
+		return err
+	}
+	key := getEtcdSnapshotKey(snap.Time)
+	for k, p := range parts {
+		_, err = etcdClient.Put(ctx, k, string(p))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = etcdClient.Put(ctx, key, string(header))
+	if err != nil {
+		return err
+	}
+	//The parts of an earlier snapshot with the same time can go once the
+	//header no longer refers to them
+	resp, err := etcdClient.Get(ctx, key+"/", etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		if strings.HasPrefix(string(kv.Key), getEtcdSnapshotGenPrefix(snap.Time, gen)) {
+			continue
+		}
+		_, err = etcdClient.Delete(ctx, string(kv.Key))
+		if err != nil {
+			return err
+		}
+	}
+	keys, err := snapshotKeys(ctx, etcdClient)
+	if err != nil {
+		return err
+	}
+	for len(keys) > keep {
+		//The header goes first, so a snapshot that is partly deleted is
+		//not seen
+		_, err = etcdClient.Delete(ctx, keys[0])
+		if err != nil {
+			return err
+		}
+		_, err = etcdClient.Delete(ctx, keys[0]+"/", etcd.WithPrefix())
+		if err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+//snapshotKeys returns the keys of the headers of the snapshots in etcd,
+//oldest first
+func snapshotKeys(ctx context.Context, etcdClient *etcd.Client) ([]string, error) {
+	resp, err := etcdClient.Get(ctx, snapshotpath, etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if !strings.Contains(key[len(snapshotpath):], "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+//RetrieveSnapshots returns the snapshots in etcd, oldest first. Each
+//snapshot is fetched separately, so that the whole history does not have to
+//fit in one response.
+func RetrieveSnapshots(ctx context.Context, etcdClient *etcd.Client) ([]*Snapshot, error) {
+	keys, err := snapshotKeys(ctx, etcdClient)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*Snapshot, 0, len(keys))
+	for _, key := range keys {
+		//One Get sees the header and its parts as of the same revision
+		resp, err := etcdClient.Get(ctx, key, etcd.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		var header []byte
+		parts := make(map[string][]byte)
+		for _, kv := range resp.Kvs {
+			if string(kv.Key) == key {
+				header = kv.Value
+			} else {
+				parts[string(kv.Key)] = kv.Value
+			}
+		}
+		if header == nil {
+			//Deleted since the keys were listed
+			continue
+		}
+		snap, err := decodeSnapshot(header, parts)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt snapshot %q: %v", key, err)
+		}
+		rv = append(rv, snap)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Time < rv[j].Time
+	})
+	return rv, nil
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package usage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+func stream(col string, name string, hot uint64, cold uint64, points uint64) *StreamUsage {
+	return &StreamUsage{
+		UUID:       col + "/" + name,
+		Collection: col,
+		Name:       name,
+		Usage:      Usage{HotBytes: hot, ColdBytes: cold, Points: points, Streams: 1},
+	}
+}
+
+func testSnapshot() (*Snapshot, []*StreamUsage) {
+	streams := []*StreamUsage{
+		stream("sub/a/pmu1", "L1MAG", 100, 1000, 100),
+		stream("sub/a/pmu1", "L2MAG", 100, 3000, 200),
+		stream("sub/b", "freq", 50, 0, 0),
+		stream("other", "x", 0, 500, 10),
+	}
+	return NewSnapshot(1000, streams, Usage{HotBytes: 7, Streams: 1}, Capacity{}), streams
+}
+
+func TestAggregate(t *testing.T) {
+	snap, _ := testSnapshot()
+	expected := []struct {
+		col     string
+		bytes   uint64
+		points  uint64
+		streams int
+	}{
+		{"other", 500, 10, 1},
+		{"sub", 4250, 300, 3},
+		{"sub/a", 4200, 300, 2},
+		{"sub/a/pmu1", 4200, 300, 2},
+		{"sub/b", 50, 0, 1},
+	}
+	if len(snap.Collections) != len(expected) {
+		t.Fatalf("expected %d collections got %d", len(expected), len(snap.Collections))
+	}
+	for i, e := range expected {
+		cu := snap.Collections[i]
+		if cu.Collection != e.col || cu.Bytes() != e.bytes || cu.Points != e.points || cu.Streams != e.streams {
+			t.Errorf("expected %v got %+v", e, cu)
+		}
+	}
+	if snap.Total.Bytes() != 4750 || snap.Total.Points != 310 || snap.Total.Streams != 4 {
+		t.Fatalf("unexpected total %+v", snap.Total)
+	}
+	if snap.Collection("sub/a").HotBytes != 200 {
+		t.Fatalf("unexpected usage of sub/a: %+v", snap.Collection("sub/a"))
+	}
+	if snap.Collection("sub/c") != nil {
+		t.Fatalf("found a collection that does not exist")
+	}
+	if bpp := snap.Collection("sub/a").BytesPerPoint(); bpp != 14 {
+		t.Fatalf("expected 14 bytes per point got %v", bpp)
+	}
+	if bpp := snap.Collection("sub/b").BytesPerPoint(); bpp != 0 {
+		t.Fatalf("expected 0 bytes per point without points got %v", bpp)
+	}
+}
+
+func TestSnapshotEncoding(t *testing.T) {
+	snap, _ := testSnapshot()
+	header, parts, err := encodeSnapshot(snap, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 {
+		t.Fatalf("expected one part got %d", len(parts))
+	}
+	decoded, err := decodeSnapshot(header, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Time != snap.Time || decoded.Total != snap.Total || decoded.Orphaned != snap.Orphaned {
+		t.Fatalf("expected %+v got %+v", snap, decoded)
+	}
+	if len(decoded.Collections) != len(snap.Collections) || *decoded.Collections[1] != *snap.Collections[1] {
+		t.Fatalf("collections differ after decoding")
+	}
+	if _, err := decodeSnapshot(header, nil); err == nil {
+		t.Fatalf("snapshot with a missing part was accepted")
+	}
+
+	//While a snapshot is overwritten both generations of parts are in
+	//etcd, each header only uses its own
+	header2, parts2, err := encodeSnapshot(snap, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, p := range parts2 {
+		parts[k] = p
+	}
+	for _, h := range [][]byte{header, header2} {
+		decoded, err = decodeSnapshot(h, parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.Collections) != len(snap.Collections) {
+			t.Fatalf("expected %d collections got %d", len(snap.Collections), len(decoded.Collections))
+		}
+	}
+	if _, err := decodeSnapshot(header2, map[string][]byte{}); err == nil {
+		t.Fatalf("snapshot with the parts of another generation was accepted")
+	}
+
+	//Collections are never in the header
+	var old []byte
+	err = codec.NewEncoderBytes(&old, mp).Encode(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeSnapshot(old, nil); err == nil {
+		t.Fatalf("snapshot with collections in the header was accepted")
+	}
+}
+
+func TestSnapshotParts(t *testing.T) {
+	var streams []*StreamUsage
+	for i := 0; i < 20000; i++ {
+		streams = append(streams, stream(fmt.Sprintf("site%03d/substation/pmu%05d", i%300, i), "L1MAG", 1, 2, 3))
+	}
+	snap := NewSnapshot(1000, streams, Usage{}, Capacity{})
+	header, parts, err := encodeSnapshot(snap, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected the collections to be split, got %d parts", len(parts))
+	}
+	for k, p := range parts {
+		if len(p) > maxPartBytes+64 {
+			t.Fatalf("part %s is %d bytes", k, len(p))
+		}
+	}
+	decoded, err := decodeSnapshot(header, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Collections) != len(snap.Collections) {
+		t.Fatalf("expected %d collections got %d", len(snap.Collections), len(decoded.Collections))
+	}
+	for i, cu := range decoded.Collections {
+		if *cu != *snap.Collections[i] {
+			t.Fatalf("collection %d: expected %+v got %+v", i, snap.Collections[i], cu)
+		}
+	}
+	if cu := decoded.Collection("site007/substation"); cu == nil || cu.Streams != 67 {
+		t.Fatalf("unexpected usage of site007/substation: %+v", cu)
+	}
+}
+
+func TestReports(t *testing.T) {
+	snap, streams := testSnapshot()
+
+	buf := &bytes.Buffer{}
+	err := WriteText(buf, snap, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	if !strings.Contains(text, " sub\n") || strings.Contains(text, "sub/a") {
+		t.Fatalf("expected only top level collections:\n%s", text)
+	}
+
+	buf.Reset()
+	err = WriteCSV(buf, snap, streams, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	//A header, 4 collections, 4 streams, orphaned and total
+	if len(lines) != 11 {
+		t.Fatalf("expected 11 lines got %d:\n%s", len(lines), buf.String())
+	}
+	if lines[4] != "collection,sub/b,,,50,0,0,1,0.000" {
+		t.Fatalf("unexpected row %q", lines[4])
+	}
+	if lines[5] != "stream,sub/a/pmu1,L1MAG,sub/a/pmu1/L1MAG,100,1000,100,1,11.000" {
+		t.Fatalf("unexpected row %q", lines[5])
+	}
+
+	buf.Reset()
+	err = WriteJSON(buf, snap, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := struct {
+		Total       Usage              `json:"total"`
+		Collections []*CollectionUsage `json:"collections"`
+		Streams     []*StreamUsage     `json:"streams"`
+	}{}
+	err = json.Unmarshal(buf.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collections) != 5 || report.Streams != nil || report.Total != snap.Total {
+		t.Fatalf("unexpected report %s", buf.String())
+	}
+}
+
+func TestGrowth(t *testing.T) {
+	days := func(d int) int64 {
+		return int64(d) * int64(24*time.Hour)
+	}
+	snaps := []*Snapshot{}
+	for i, d := range []int{0, 3, 9, 10} {
+		streams := []*StreamUsage{
+			stream("sub/a", "x", 0, uint64(1000*d), 0),
+			stream("sub/b", "y", 0, 500, 0),
+		}
+		if i == 3 {
+			streams = append(streams, stream("new", "z", 0, 100, 0))
+		}
+		snaps = append(snaps, NewSnapshot(days(d), streams, Usage{}, Capacity{
+			TotalBytes: 100000,
+			UsedBytes:  uint64(3000 * d),
+			AvailBytes: 100000 - uint64(3000*d),
+		}))
+	}
+	if NewGrowth(snaps[:1], DefaultGrowthWindow) != nil {
+		t.Fatalf("expected no growth from a single snapshot")
+	}
+	g := NewGrowth(snaps, DefaultGrowthWindow)
+	//Day 3 is the newest snapshot at least a week before day 10
+	if g.From != snaps[1] || g.To != snaps[3] || g.Days() != 7 {
+		t.Fatalf("compared the wrong snapshots: %d to %d", g.From.Time, g.To.Time)
+	}
+	if r := g.PerDay("sub/a"); r != 1000 {
+		t.Fatalf("expected sub/a to grow by 1000 per day got %v", r)
+	}
+	if r := g.PerDay("sub/b"); r != 0 {
+		t.Fatalf("expected sub/b not to grow got %v", r)
+	}
+	if r := g.PerDay("new"); r != 100.0/7 {
+		t.Fatalf("expected new to grow from zero got %v", r)
+	}
+	if r := g.ClusterPerDay(); r != 3000 {
+		t.Fatalf("expected the cluster to grow by 3000 per day got %v", r)
+	}
+	full, ok := g.DaysUntilFull()
+	if !ok || full != 70000.0/3000 {
+		t.Fatalf("unexpected projection %v %v", full, ok)
+	}
+	//The oldest snapshot is used if none are old enough
+	g = NewGrowth(snaps, 30*24*time.Hour)
+	if g.From != snaps[0] {
+		t.Fatalf("expected the oldest snapshot to be used")
+	}
+	//Snapshots taken at the same time as the newest are not compared with
+	//it
+	same := &Snapshot{Time: snaps[3].Time}
+	g = NewGrowth(append(snaps[:3:3], same, snaps[3]), DefaultGrowthWindow)
+	if g.From != snaps[1] || g.To != snaps[3] {
+		t.Fatalf("compared the wrong snapshots: %d to %d", g.From.Time, g.To.Time)
+	}
+	if NewGrowth([]*Snapshot{same, snaps[3]}, DefaultGrowthWindow) != nil {
+		t.Fatalf("expected no growth between snapshots taken at the same time")
+	}
+	g = &Growth{From: same, To: snaps[3]}
+	if r := g.TotalPerDay(); r != 0 {
+		t.Fatalf("expected no growth without time between the snapshots got %v", r)
+	}
+	g = &Growth{From: snaps[1], To: &Snapshot{Time: days(4), Cluster: Capacity{TotalBytes: 1, UsedBytes: 1}}}
+	if _, ok := g.DaysUntilFull(); ok {
+		t.Fatalf("a shrinking cluster should never be full")
+	}
+
+	top := Top(snaps[3], 2, 1)
+	if len(top) != 2 || top[0].Collection != "sub" || top[1].Collection != "new" {
+		t.Fatalf("unexpected top collections %v", top)
+	}
+	top = Top(snaps[3], 0, 2)
+	if len(top) != 2 || top[0].Collection != "sub/a" || top[1].Collection != "sub/b" {
+		t.Fatalf("unexpected top collections %v", top)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+//points returns the number of points, or windows, in the chunk
+func (c *chunk) points() int64 {
+	var rv int64
+	for _, pts := range c.Raw {
+		rv += int64(len(pts))
+	}
+	for _, pts := range c.Stat {
+		rv += int64(len(pts))
+	}
+	return rv
+}
+
+//streams returns the number of streams in the chunk
+func (c *chunk) streams() int {
+	if c.Raw != nil {
+		return len(c.Raw)
+	}
+	return len(c.Stat)
+}
+
+func (c *chunk) time(stream int, idx int) int64 {
+	if c.Raw != nil {
+		return c.Raw[stream][idx].Time
+	}
+	return c.Stat[stream][idx].Time
+}
+
+func (c *chunk) length(stream int) int {
+	if c.Raw != nil {
+		return len(c.Raw[stream])
+	}
+	return len(c.Stat[stream])
+}
+
+//rows merges the streams by time. For every distinct time, fn is called
+//with the index of the point at that time in each stream, or -1 if the
+//stream has no point at that time. The slice is reused between calls.
+func (c *chunk) rows(fn func(t int64, idx []int) error) error {
+	n := c.streams()
+	next := make([]int, n)
+	idx := make([]int, n)
+	for {
+		first := true
+		var t int64
+		for i := 0; i < n; i++ {
+			if next[i] < c.length(i) && (first || c.time(i, next[i]) < t) {
+				t = c.time(i, next[i])
+				first = false
+			}
+		}
+		if first {
+			return nil
+		}
+		for i := 0; i < n; i++ {
+			idx[i] = -1
+			if next[i] < c.length(i) && c.time(i, next[i]) == t {
+				idx[i] = next[i]
+				next[i]++
+			}
+		}
+		err := fn(t, idx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//statValues returns the min, mean, max and count of a window
+func (c *chunk) statValues(stream int, idx int) [4]float64 {
+	sp := c.Stat[stream][idx]
+	return [4]float64{sp.Min, sp.Mean, sp.Max, float64(sp.Count)}
+}
+
+//The names of the values of a window, in the order of statValues
+var statNames = [4]string{"min", "mean", "max", "count"}
+
+func formatTime(t int64, format string) string {
+	if format == TimeUnixNs {
+		return strconv.FormatInt(t, 10)
+	}
+	return time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+}
+
+func formatValue(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
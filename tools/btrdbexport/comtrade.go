@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The largest timestamp the standard allows in an ASCII data file
+const maxComtradeTimestamp = 9999999999
+
+//comtradeWriter writes a 2013 revision COMTRADE record with an ASCII data
+//file, which keeps the full precision of the values. The timestamps are in
+//nanoseconds from the start of the export, multiplied by the smallest
+//timemult that keeps them within ten digits, so exports longer than ten
+//seconds lose some time resolution. The .dat file is written as the chunks
+//arrive and the .cfg file, which needs the number of samples and the range
+//of each channel, when it is closed.
+type comtradeWriter struct {
+	cfg      *Config
+	base     string
+	f        *os.File
+	w        *bufio.Writer
+	start    int64
+	timemult int64
+	channels []*comtradeChannel
+	samples  int64
+}
+
+type comtradeChannel struct {
+	id   string
+	unit string
+	min  float64
+	max  float64
+	seen bool
+}
+
+func newComtradeWriter(cfg *Config, streams []*exportStream, start int64, end int64) (exportWriter, error) {
+	f, err := os.Create(cfg.Output + ".dat")
+	if err != nil {
+		return nil, err
+	}
+	cw := &comtradeWriter{
+		cfg:      cfg,
+		base:     cfg.Output,
+		f:        f,
+		w:        bufio.NewWriterSize(f, 1024*1024),
+		start:    start,
+		timemult: (end - start + maxComtradeTimestamp - 1) / maxComtradeTimestamp,
+	}
+	if cw.timemult < 1 {
+		cw.timemult = 1
+	}
+	for _, es := range streams {
+		id := strings.Replace(es.Column, ",", "_", -1)
+		if cfg.Mode == ModeRaw {
+			cw.channels = append(cw.channels, &comtradeChannel{id: id, unit: es.Tags["unit"]})
+			continue
+		}
+		for _, n := range statNames {
+			unit := es.Tags["unit"]
+			if n == "count" {
+				unit = ""
+			}
+			cw.channels = append(cw.channels, &comtradeChannel{id: id + ":" + n, unit: unit})
+		}
+	}
+	return cw, nil
+}
+
+func (cw *comtradeWriter) WriteChunk(c *chunk) error {
+	values := make([]float64, len(cw.channels))
+	return c.rows(func(t int64, idx []int) error {
+		ch := 0
+		for i, k := range idx {
+			if c.Raw != nil {
+				values[ch] = math.NaN()
+				if k >= 0 {
+					values[ch] = c.Raw[i][k].Value
+				}
+				ch++
+				continue
+			}
+			sv := [4]float64{math.NaN(), math.NaN(), math.NaN(), math.NaN()}
+			if k >= 0 {
+				sv = c.statValues(i, k)
+			}
+			copy(values[ch:], sv[:])
+			ch += len(sv)
+		}
+		cw.samples++
+		line := make([]string, 0, 2+len(values))
+		line = append(line, strconv.FormatInt(cw.samples, 10), strconv.FormatInt((t-cw.start)/cw.timemult, 10))
+		for i, v := range values {
+			line = append(line, formatValue(v))
+			cw.channels[i].observe(v)
+		}
+		_, err := cw.w.WriteString(strings.Join(line, ",") + "\r\n")
+		return err
+	})
+}
+
+func (ch *comtradeChannel) observe(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if !ch.seen || v < ch.min {
+		ch.min = v
+	}
+	if !ch.seen || v > ch.max {
+		ch.max = v
+	}
+	ch.seen = true
+}
+
+func (cw *comtradeWriter) Close() ([]string, error) {
+	err := cw.w.Flush()
+	if cerr := cw.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(cw.base+".cfg", []byte(cw.config()), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return []string{cw.base + ".cfg", cw.base + ".dat"}, nil
+}
+
+//config returns the contents of the .cfg file. The times are in UTC.
+func (cw *comtradeWriter) config() string {
+	lines := []string{
+		fmt.Sprintf("%s,%s,2013", clean(cw.cfg.Station), clean(cw.cfg.Device)),
+		fmt.Sprintf("%d,%dA,0D", len(cw.channels), len(cw.channels)),
+	}
+	for i, ch := range cw.channels {
+		lines = append(lines, fmt.Sprintf("%d,%s,,,%s,1,0,0,%s,%s,1,1,P",
+			i+1, ch.id, clean(ch.unit), formatValue(ch.min), formatValue(ch.max)))
+	}
+	start := time.Unix(0, cw.start).UTC()
+	stamp := start.Format("02/01/2006,15:04:05.000000000")
+	lines = append(lines,
+		formatValue(cw.cfg.LineFreq),
+		"0",
+		fmt.Sprintf("0,%d", cw.samples),
+		stamp,
+		stamp,
+		"ASCII",
+		strconv.FormatInt(cw.timemult, 10),
+		"+0h00,+0h00",
+		"0,0",
+	)
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+//clean makes a string safe to use as a field of the .cfg file
+func clean(s string) string {
+	return strings.Replace(s, ",", "_", -1)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"os"
+	"strconv"
+)
+
+//csvWriter writes a single CSV file. In the long layout there is a row per
+//point of each stream, and in the wide layout a row per distinct time with a
+//column per stream (or four per stream for windows).
+type csvWriter struct {
+	filename   string
+	f          *os.File
+	buf        *bufio.Writer
+	w          *csv.Writer
+	streams    []*exportStream
+	wide       bool
+	timeformat string
+}
+
+func newCSVWriter(cfg *Config, streams []*exportStream) (exportWriter, error) {
+	filename := cfg.Output + ".csv"
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriterSize(f, 1024*1024)
+	cw := &csvWriter{
+		filename:   filename,
+		f:          f,
+		buf:        buf,
+		w:          csv.NewWriter(buf),
+		streams:    streams,
+		wide:       cfg.Layout == LayoutWide,
+		timeformat: cfg.TimeFormat,
+	}
+	header := []string{"time"}
+	switch {
+	case cw.wide && cfg.Mode == ModeRaw:
+		for _, es := range streams {
+			header = append(header, es.Column)
+		}
+	case cw.wide:
+		for _, es := range streams {
+			for _, n := range statNames {
+				header = append(header, es.Column+":"+n)
+			}
+		}
+	case cfg.Mode == ModeRaw:
+		header = append(header, "uuid", "collection", "name", "value")
+	default:
+		header = append(header, "uuid", "collection", "name")
+		header = append(header, statNames[:]...)
+	}
+	err = cw.w.Write(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) WriteChunk(c *chunk) error {
+	err := c.rows(func(t int64, idx []int) error {
+		ts := formatTime(t, cw.timeformat)
+		if cw.wide {
+			return cw.w.Write(cw.wideRow(c, ts, idx))
+		}
+		for i, k := range idx {
+			if k < 0 {
+				continue
+			}
+			es := cw.streams[i]
+			row := []string{ts, es.UUID, es.Collection, es.Tags["name"]}
+			if c.Raw != nil {
+				row = append(row, formatValue(c.Raw[i][k].Value))
+			} else {
+				sv := c.statValues(i, k)
+				row = append(row, formatValue(sv[0]), formatValue(sv[1]), formatValue(sv[2]), strconv.FormatUint(c.Stat[i][k].Count, 10))
+			}
+			err := cw.w.Write(row)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvWriter) wideRow(c *chunk, ts string, idx []int) []string {
+	row := []string{ts}
+	for i, k := range idx {
+		switch {
+		case c.Raw != nil && k < 0:
+			row = append(row, "")
+		case c.Raw != nil:
+			row = append(row, formatValue(c.Raw[i][k].Value))
+		case k < 0:
+			row = append(row, "", "", "", "")
+		default:
+			sv := c.statValues(i, k)
+			row = append(row, formatValue(sv[0]), formatValue(sv[1]), formatValue(sv[2]), strconv.FormatUint(c.Stat[i][k].Count, 10))
+		}
+	}
+	return row
+}
+
+func (cw *csvWriter) Close() ([]string, error) {
+	cw.w.Flush()
+	err := cw.w.Error()
+	if err == nil {
+		err = cw.buf.Flush()
+	}
+	if cerr := cw.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []string{cw.filename}, nil
+}
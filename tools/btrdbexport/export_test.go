@@ -0,0 +1,241 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins/comtrade"
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+)
+
+func rp(t int64, v float64) v4.RawPoint {
+	return v4.RawPoint{Time: t, Value: v}
+}
+
+func sp(t int64, min float64, mean float64, max float64, count uint64) v4.StatPoint {
+	return v4.StatPoint{Time: t, Min: min, Mean: mean, Max: max, Count: count}
+}
+
+func testStreams() []*exportStream {
+	return []*exportStream{
+		{UUID: "4b6b3e40-0000-0000-0000-000000000001", Collection: "sub/pmu1", Tags: map[string]string{"name": "L1MAG", "unit": "V"}, Column: "sub/pmu1/L1MAG"},
+		{UUID: "4b6b3e40-0000-0000-0000-000000000002", Collection: "sub/pmu1", Tags: map[string]string{"name": "C1MAG", "unit": "A"}, Column: "sub/pmu1/C1MAG"},
+	}
+}
+
+func testConfig(t *testing.T, dir string, cfg *Config) *Config {
+	cfg.FromServer = "localhost:4410"
+	cfg.StartTime = "2021-01-10T08:00:00Z"
+	cfg.EndTime = "2021-01-10T09:00:00Z"
+	cfg.Output = filepath.Join(dir, "export")
+	cfg.Streams = []StreamConfig{{SrcCollection: "sub/pmu1"}}
+	_, _, _, _, err := checkConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRows(t *testing.T) {
+	c := &chunk{Raw: [][]v4.RawPoint{
+		{rp(1, 1), rp(3, 3), rp(4, 4)},
+		{},
+		{rp(2, 20), rp(3, 30)},
+	}}
+	var times []int64
+	var rows [][]int
+	err := c.rows(func(t int64, idx []int) error {
+		times = append(times, t)
+		rows = append(rows, append([]int{}, idx...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{0, -1, -1}, {-1, -1, 0}, {1, -1, 1}, {2, -1, -1}}
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, rows)
+	}
+	for i := range rows {
+		if times[i] != int64(i+1) {
+			t.Fatalf("unexpected times %v", times)
+		}
+		for j := range rows[i] {
+			if rows[i][j] != expected[i][j] {
+				t.Fatalf("expected %v got %v", expected, rows)
+			}
+		}
+	}
+	if c.points() != 5 {
+		t.Fatalf("expected 5 points got %d", c.points())
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfg := &Config{Mode: ModeWindows, Window: "7m", Chunk: "1h"}
+	cfg.StartTime = "2021-01-10T08:00:00Z"
+	cfg.EndTime = "2021-01-10T09:00:00Z"
+	cfg.Output = "export"
+	cfg.Streams = []StreamConfig{{SrcCollection: "sub/pmu1"}}
+	_, _, window, chunkw, err := checkConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window != int64(7*time.Minute) || chunkw != int64(56*time.Minute) {
+		t.Fatalf("the chunks should hold whole windows, got %d %d", window, chunkw)
+	}
+	if cfg.Format != FormatCSV || cfg.Layout != LayoutLong || cfg.LineFreq != 60 {
+		t.Fatalf("unexpected defaults %+v", cfg)
+	}
+	cfg.Streams = []StreamConfig{{SrcPrefix: "sub/", Tags: map[string]string{"name": "L?MAG"}}}
+	if _, _, _, _, err := checkConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	badtags := map[string]string{"name": "L[1"}
+	for i, mutate := range []func(c *Config){
+		func(c *Config) { c.Mode = "stats" },
+		func(c *Config) { c.Mode = ModeWindows },
+		func(c *Config) { c.Format = "xlsx" },
+		func(c *Config) { c.Layout = "tall" },
+		func(c *Config) { c.StartTime = "2021-01-10T10:00:00Z" },
+		func(c *Config) { c.Output = "" },
+		func(c *Config) { c.Streams = nil },
+		func(c *Config) { c.Streams = []StreamConfig{{Tags: map[string]string{"name": "L1MAG"}}} },
+		func(c *Config) { c.Streams = []StreamConfig{{SrcCollection: "sub/pmu1", SrcPrefix: "sub"}} },
+		func(c *Config) { c.Streams = []StreamConfig{{SrcPrefix: "sub", Tags: badtags}} },
+	} {
+		bad := &Config{StartTime: cfg.StartTime, EndTime: cfg.EndTime, Output: "export", Streams: cfg.Streams}
+		mutate(bad)
+		if _, _, _, _, err := checkConfig(bad); err == nil {
+			t.Errorf("bad config %d was accepted", i)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdbexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	streams := testStreams()
+
+	cfg := testConfig(t, dir, &Config{TimeFormat: TimeUnixNs})
+	w, err := newCSVWriter(cfg, streams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteChunk(&chunk{Raw: [][]v4.RawPoint{{rp(1, 1.5), rp(2, 2.5)}, {rp(2, 7)}}})
+	w.WriteChunk(&chunk{Raw: [][]v4.RawPoint{{rp(3, 3.5)}, {}}})
+	files, err := w.Close()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected files %v %v", files, err)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,uuid,collection,name,value\n" +
+		"1,4b6b3e40-0000-0000-0000-000000000001,sub/pmu1,L1MAG,1.5\n" +
+		"2,4b6b3e40-0000-0000-0000-000000000001,sub/pmu1,L1MAG,2.5\n" +
+		"2,4b6b3e40-0000-0000-0000-000000000002,sub/pmu1,C1MAG,7\n" +
+		"3,4b6b3e40-0000-0000-0000-000000000001,sub/pmu1,L1MAG,3.5\n"
+	if string(data) != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, data)
+	}
+
+	cfg = testConfig(t, dir, &Config{Layout: LayoutWide, Mode: ModeWindows, Window: "1s"})
+	w, err = newCSVWriter(cfg, streams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2021, 1, 10, 8, 0, 0, 0, time.UTC).UnixNano()
+	w.WriteChunk(&chunk{Stat: [][]v4.StatPoint{{sp(t0, 1, 2, 3, 10)}, {sp(t0+1e9, 4, 5, 6, 20)}}})
+	files, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "time,sub/pmu1/L1MAG:min,sub/pmu1/L1MAG:mean,sub/pmu1/L1MAG:max,sub/pmu1/L1MAG:count," +
+		"sub/pmu1/C1MAG:min,sub/pmu1/C1MAG:mean,sub/pmu1/C1MAG:max,sub/pmu1/C1MAG:count\n" +
+		"2021-01-10T08:00:00Z,1,2,3,10,,,,\n" +
+		"2021-01-10T08:00:01Z,,,,,4,5,6,20\n"
+	if string(data) != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, data)
+	}
+}
+
+//TestComtrade reads the export back with the importer's parser
+func TestComtrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdbexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	streams := testStreams()
+	cfg := testConfig(t, dir, &Config{Format: FormatComtrade, Station: "SUB,1", Device: "pmu1"})
+	t0 := time.Date(2021, 1, 10, 8, 0, 0, 0, time.UTC).UnixNano()
+	t1 := time.Date(2021, 1, 10, 9, 0, 0, 0, time.UTC).UnixNano()
+	w, err := newComtradeWriter(cfg, streams, t0, t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//An hour needs a time multiplier of 361 to fit the timestamps in ten
+	//digits, so the times are multiples of that
+	times := []int64{t0 + 361, t0 + 361*2000, t0 + 361*9972299000}
+	w.WriteChunk(&chunk{Raw: [][]v4.RawPoint{{rp(times[0], 120.125), rp(times[1], -0.1)}, {rp(times[1], 5)}}})
+	w.WriteChunk(&chunk{Raw: [][]v4.RawPoint{{}, {rp(times[2], 1e-7)}}})
+	files, err := w.Close()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("unexpected files %v %v", files, err)
+	}
+
+	cf, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.Close()
+	ccfg, err := comtrade.ParseConfig(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ccfg.Station != "SUB_1" || ccfg.RevYear != 2013 || len(ccfg.Analog) != 2 || ccfg.Samples() != 3 ||
+		ccfg.TimeMult != 361 || ccfg.TimeUnit != time.Nanosecond || ccfg.Start.UnixNano() != t0 {
+		t.Fatalf("unexpected config %+v", ccfg)
+	}
+	ch := ccfg.Analog[0]
+	if ch.ID != "sub/pmu1/L1MAG" || ch.Unit != "V" || ch.Min != -0.1 || ch.Max != 120.125 {
+		t.Fatalf("unexpected channel %+v", ch)
+	}
+	df, err := os.Open(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	data, err := comtrade.ReadData(ccfg, df)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tm := range times {
+		if data.Times[i] != tm {
+			t.Fatalf("expected times %v got %v", times, data.Times)
+		}
+	}
+	l1, c1 := data.Analog[0], data.Analog[1]
+	if l1[0] != 120.125 || l1[1] != -0.1 || !math.IsNaN(l1[2]) || !math.IsNaN(c1[0]) || c1[1] != 5 || c1[2] != 1e-7 {
+		t.Fatalf("unexpected values %v %v", l1, c1)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/streamselect"
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+	pb "gopkg.in/cheggaaa/pb.v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//StreamConfig selects streams the same way as btrdbcp. With SrcCollection
+//the (possibly partial) tags must identify exactly one stream in the
+//collection. With SrcPrefix every stream in the collection and the
+//collections below it whose tags match is exported. The tags may be
+//patterns, using path.Match syntax, e.g. "L?MAG".
+type StreamConfig struct {
+	SrcCollection string
+	SrcPrefix     string
+	Tags          map[string]string
+}
+
+type Config struct {
+	FromServer string
+	StartTime  string
+	EndTime    string
+	//raw (the default) or windows
+	Mode string
+	//The width of the windows, e.g. 1m
+	Window string
+	//How much time is queried and written at a time, e.g. 10m. This bounds
+	//the memory used.
+	Chunk string
+	//csv (the default), parquet or comtrade
+	Format string
+	//long (the default) or wide, for CSV
+	Layout string
+	//rfc3339 (the default) or unix_ns, for CSV
+	TimeFormat string
+	//The files are named after this, e.g. export.csv and export.json
+	Output string
+	//The station and recording device of COMTRADE files, and the nominal
+	//line frequency
+	Station  string
+	Device   string
+	LineFreq float64
+	Streams  []StreamConfig
+}
+
+const (
+	ModeRaw     = "raw"
+	ModeWindows = "windows"
+)
+
+const (
+	FormatCSV      = "csv"
+	FormatParquet  = "parquet"
+	FormatComtrade = "comtrade"
+)
+
+const (
+	LayoutLong = "long"
+	LayoutWide = "wide"
+)
+
+const (
+	TimeRFC3339 = "rfc3339"
+	TimeUnixNs  = "unix_ns"
+)
+
+const defaultChunk = 10 * time.Minute
+
+//exportStream is a stream being exported, as described in the sidecar file
+type exportStream struct {
+	stream      *v4.Stream
+	UUID        string            `json:"uuid"`
+	Collection  string            `json:"collection"`
+	Tags        map[string]string `json:"tags"`
+	Annotations map[string]string `json:"annotations"`
+	//Column is what the stream is called in the wide CSV layout and in
+	//COMTRADE files
+	Column string `json:"column"`
+}
+
+//sidecar is the metadata written next to the data
+type sidecar struct {
+	Server    string          `json:"server"`
+	StartTime time.Time       `json:"start_time"`
+	EndTime   time.Time       `json:"end_time"`
+	Mode      string          `json:"mode"`
+	Window    string          `json:"window,omitempty"`
+	Format    string          `json:"format"`
+	Layout    string          `json:"layout,omitempty"`
+	Files     []string        `json:"files"`
+	Streams   []*exportStream `json:"streams"`
+}
+
+//chunk is the data of every stream over part of the time range. Raw is set
+//in the raw mode and Stat in the windows mode, with one slice per stream.
+type chunk struct {
+	Raw  [][]v4.RawPoint
+	Stat [][]v4.StatPoint
+}
+
+//exportWriter writes the chunks to the output files
+type exportWriter interface {
+	WriteChunk(c *chunk) error
+	//Close finishes the files and returns their names
+	Close() ([]string, error)
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Printf("Usage: btrdbexport <config>\n")
+		os.Exit(1)
+	}
+	cfgdata, err := ioutil.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Printf("Could not read config file %q: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+	cfg := &Config{}
+	err = yaml.Unmarshal(cfgdata, cfg)
+	if err != nil {
+		fmt.Printf("Could not parse config file: %v\n", err)
+		os.Exit(1)
+	}
+	starttime, endtime, window, chunkw, err := checkConfig(cfg)
+	if err != nil {
+		fmt.Printf("Bad config: %v\n", err)
+		os.Exit(1)
+	}
+
+	var from *v4.BTrDB
+	if os.Getenv("FROM_API_KEY") != "" {
+		from, err = v4.ConnectAuth(context.Background(), os.Getenv("FROM_API_KEY"), cfg.FromServer)
+	} else {
+		from, err = v4.Connect(context.Background(), cfg.FromServer)
+	}
+	if err != nil {
+		fmt.Printf("Could not connect to FromServer: %v\n", err)
+		os.Exit(1)
+	}
+
+	streams, err := resolve(from, cfg.Streams)
+	if err != nil {
+		fmt.Printf("ABORT: %v\n", err)
+		os.Exit(1)
+	}
+	err = os.MkdirAll(filepath.Dir(cfg.Output), 0755)
+	if err != nil {
+		fmt.Printf("Could not create output directory: %v\n", err)
+		os.Exit(1)
+	}
+	var w exportWriter
+	switch cfg.Format {
+	case FormatCSV:
+		w, err = newCSVWriter(cfg, streams)
+	case FormatParquet:
+		w, err = newParquetWriter(cfg, streams)
+	case FormatComtrade:
+		w, err = newComtradeWriter(cfg, streams, starttime, endtime)
+	}
+	if err != nil {
+		fmt.Printf("Could not create output: %v\n", err)
+		os.Exit(1)
+	}
+
+	nchunks := (endtime - starttime + chunkw - 1) / chunkw
+	bar := pb.New64(nchunks).Prefix("chunks")
+	bar.Start()
+	var total int64
+	for t := starttime; t < endtime; t += chunkw {
+		end := t + chunkw
+		if end > endtime {
+			end = endtime
+		}
+		c, err := query(streams, cfg.Mode, t, end, window)
+		if err != nil {
+			fmt.Printf("\nABORT: could not query %s to %s: %v\n", time.Unix(0, t).UTC(), time.Unix(0, end).UTC(), err)
+			os.Exit(1)
+		}
+		err = w.WriteChunk(c)
+		if err != nil {
+			fmt.Printf("\nABORT: could not write: %v\n", err)
+			os.Exit(1)
+		}
+		total += c.points()
+		bar.Increment()
+	}
+	files, err := w.Close()
+	if err != nil {
+		fmt.Printf("ABORT: could not write: %v\n", err)
+		os.Exit(1)
+	}
+	bar.Finish()
+
+	sc := &sidecar{
+		Server:    cfg.FromServer,
+		StartTime: time.Unix(0, starttime).UTC(),
+		EndTime:   time.Unix(0, endtime).UTC(),
+		Mode:      cfg.Mode,
+		Format:    cfg.Format,
+		Files:     files,
+		Streams:   streams,
+	}
+	if cfg.Mode == ModeWindows {
+		sc.Window = cfg.Window
+	}
+	if cfg.Format == FormatCSV {
+		sc.Layout = cfg.Layout
+	}
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(cfg.Output+".json", data, 0644)
+	if err != nil {
+		fmt.Printf("ABORT: could not write metadata: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("exported %d %s from %d streams to %v\n", total, map[string]string{ModeRaw: "points", ModeWindows: "windows"}[cfg.Mode], len(streams), append(files, cfg.Output+".json"))
+}
+
+//checkConfig fills in the defaults and returns the time range, window width
+//and chunk width
+func checkConfig(cfg *Config) (int64, int64, int64, int64, error) {
+	fail := func(format string, args ...interface{}) (int64, int64, int64, int64, error) {
+		return 0, 0, 0, 0, fmt.Errorf(format, args...)
+	}
+	if len(cfg.Streams) == 0 {
+		return fail("no streams specified")
+	}
+	for idx, s := range cfg.Streams {
+		if s.SrcCollection == "" && strings.Trim(s.SrcPrefix, "/") == "" {
+			return fail("missing srccollection or srcprefix field on stream %d", idx)
+		}
+		if s.SrcCollection != "" && s.SrcPrefix != "" {
+			return fail("stream %d has both srccollection and srcprefix", idx)
+		}
+		if err := streamselect.CheckPatterns(s.Tags); err != nil {
+			return fail("stream %d: %v", idx, err)
+		}
+	}
+	if cfg.Output == "" {
+		return fail("no output specified")
+	}
+	starttimet, err := time.Parse(time.RFC3339, cfg.StartTime)
+	if err != nil {
+		return fail("could not parse start time %q: %v", cfg.StartTime, err)
+	}
+	endtimet, err := time.Parse(time.RFC3339, cfg.EndTime)
+	if err != nil {
+		return fail("could not parse end time %q: %v", cfg.EndTime, err)
+	}
+	starttime, endtime := starttimet.UnixNano(), endtimet.UnixNano()
+	if endtime <= starttime {
+		return fail("the end time must be after the start time")
+	}
+	chunkw := int64(defaultChunk)
+	if cfg.Chunk != "" {
+		d, err := time.ParseDuration(cfg.Chunk)
+		if err != nil || d <= 0 {
+			return fail("bad chunk %q", cfg.Chunk)
+		}
+		chunkw = int64(d)
+	}
+	var window int64
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeRaw
+	case ModeRaw:
+	case ModeWindows:
+		d, err := time.ParseDuration(cfg.Window)
+		if err != nil || d <= 0 {
+			return fail("bad window %q", cfg.Window)
+		}
+		window = int64(d)
+		//Chunks hold whole windows
+		chunkw -= chunkw % window
+		if chunkw == 0 {
+			chunkw = window
+		}
+	default:
+		return fail("unknown mode %q, must be raw or windows", cfg.Mode)
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = FormatCSV
+	case FormatCSV, FormatParquet, FormatComtrade:
+	default:
+		return fail("unknown format %q, must be csv, parquet or comtrade", cfg.Format)
+	}
+	switch cfg.Layout {
+	case "":
+		cfg.Layout = LayoutLong
+	case LayoutLong, LayoutWide:
+	default:
+		return fail("unknown layout %q, must be long or wide", cfg.Layout)
+	}
+	switch cfg.TimeFormat {
+	case "":
+		cfg.TimeFormat = TimeRFC3339
+	case TimeRFC3339, TimeUnixNs:
+	default:
+		return fail("unknown time format %q, must be rfc3339 or unix_ns", cfg.TimeFormat)
+	}
+	if cfg.LineFreq == 0 {
+		cfg.LineFreq = 60
+	}
+	return starttime, endtime, window, chunkw, nil
+}
+
+//resolve looks up the streams and their metadata. A stream chosen by more
+//than one StreamConfig is exported once.
+func resolve(bc *v4.BTrDB, scs []StreamConfig) ([]*exportStream, error) {
+	rv := make([]*exportStream, 0, len(scs))
+	columns := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, sc := range scs {
+		tagstr := ""
+		for k, v := range sc.Tags {
+			tagstr = tagstr + fmt.Sprintf("%q=%q,", k, v)
+		}
+		var sz []*streamselect.Selected
+		var err error
+		if sc.SrcPrefix != "" {
+			sz, err = streamselect.Lookup(context.Background(), bc, sc.SrcPrefix, true, sc.Tags)
+			if err != nil {
+				return nil, err
+			}
+			if len(sz) == 0 {
+				return nil, fmt.Errorf("no streams under %q match tags %s", sc.SrcPrefix, tagstr)
+			}
+		} else {
+			sz, err = streamselect.Lookup(context.Background(), bc, sc.SrcCollection, false, sc.Tags)
+			if err != nil {
+				return nil, err
+			}
+			if len(sz) != 1 {
+				return nil, fmt.Errorf("collection %q with tags %s is ambiguous or incorrect, it matches %d streams", sc.SrcCollection, tagstr, len(sz))
+			}
+		}
+		for _, sel := range sz {
+			uu := sel.Stream.UUID().String()
+			if seen[uu] {
+				continue
+			}
+			seen[uu] = true
+			anns, _, err := sel.Stream.CachedAnnotations(context.Background())
+			if err != nil {
+				return nil, err
+			}
+			es := &exportStream{
+				stream:      sel.Stream,
+				UUID:        uu,
+				Collection:  sel.Collection,
+				Tags:        sel.Tags,
+				Annotations: anns,
+				Column:      sel.Collection + "/" + sel.Tags["name"],
+			}
+			columns[es.Column]++
+			rv = append(rv, es)
+		}
+	}
+	//Streams that differ only in tags other than the name
+	for _, es := range rv {
+		if columns[es.Column] > 1 {
+			es.Column += "#" + es.UUID[:8]
+		}
+	}
+	return rv, nil
+}
+
+//query reads the data of every stream between start and end
+func query(streams []*exportStream, mode string, start int64, end int64, window int64) (*chunk, error) {
+	rv := &chunk{}
+	for _, es := range streams {
+		if mode == ModeRaw {
+			pts := []v4.RawPoint{}
+			pc, _, ec := es.stream.RawValues(context.Background(), start, end, v4.LatestVersion)
+			for p := range pc {
+				pts = append(pts, p)
+			}
+			if err := <-ec; err != nil {
+				return nil, fmt.Errorf("%s: %v", es.Column, err)
+			}
+			rv.Raw = append(rv.Raw, pts)
+			continue
+		}
+		pts := []v4.StatPoint{}
+		pc, _, ec := es.stream.Windows(context.Background(), start, end, uint64(window), 0, v4.LatestVersion)
+		for p := range pc {
+			pts = append(pts, p)
+		}
+		if err := <-ec; err != nil {
+			return nil, fmt.Errorf("%s: %v", es.Column, err)
+		}
+		rv.Stat = append(rv.Stat, pts)
+	}
+	return rv, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+//parquetRaw is a row of a raw export. The time is in nanoseconds since the
+//epoch.
+type parquetRaw struct {
+	Time       int64   `parquet:"name=time, type=INT64"`
+	UUID       string  `parquet:"name=uuid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Collection string  `parquet:"name=collection, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Name       string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value      float64 `parquet:"name=value, type=DOUBLE"`
+}
+
+//parquetStat is a row of a windowed export
+type parquetStat struct {
+	Time       int64   `parquet:"name=time, type=INT64"`
+	UUID       string  `parquet:"name=uuid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Collection string  `parquet:"name=collection, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Name       string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Min        float64 `parquet:"name=min, type=DOUBLE"`
+	Mean       float64 `parquet:"name=mean, type=DOUBLE"`
+	Max        float64 `parquet:"name=max, type=DOUBLE"`
+	Count      int64   `parquet:"name=count, type=INT64"`
+}
+
+//parquetWriter writes a single Parquet file in the long layout, compressed
+//with snappy. Each chunk is written as it arrives, so only the current row
+//group is held in memory.
+type parquetWriter struct {
+	filename string
+	fw       source.ParquetFile
+	pw       *writer.ParquetWriter
+	streams  []*exportStream
+}
+
+func newParquetWriter(cfg *Config, streams []*exportStream) (exportWriter, error) {
+	filename := cfg.Output + ".parquet"
+	fw, err := local.NewLocalFileWriter(filename)
+	if err != nil {
+		return nil, err
+	}
+	var schema interface{} = new(parquetRaw)
+	if cfg.Mode == ModeWindows {
+		schema = new(parquetStat)
+	}
+	pw, err := writer.NewParquetWriter(fw, schema, 4)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	pw.RowGroupSize = 128 * 1024 * 1024
+	pw.PageSize = 1024 * 1024
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{filename: filename, fw: fw, pw: pw, streams: streams}, nil
+}
+
+func (pw *parquetWriter) WriteChunk(c *chunk) error {
+	return c.rows(func(t int64, idx []int) error {
+		for i, k := range idx {
+			if k < 0 {
+				continue
+			}
+			es := pw.streams[i]
+			var row interface{}
+			if c.Raw != nil {
+				row = parquetRaw{Time: t, UUID: es.UUID, Collection: es.Collection, Name: es.Tags["name"],
+					Value: c.Raw[i][k].Value}
+			} else {
+				sp := c.Stat[i][k]
+				row = parquetStat{Time: t, UUID: es.UUID, Collection: es.Collection, Name: es.Tags["name"],
+					Min: sp.Min, Mean: sp.Mean, Max: sp.Max, Count: int64(sp.Count)}
+			}
+			err := pw.pw.Write(row)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (pw *parquetWriter) Close() ([]string, error) {
+	err := pw.pw.WriteStop()
+	if cerr := pw.fw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []string{pw.filename}, nil
+}
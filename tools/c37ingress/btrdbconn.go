@@ -10,10 +10,13 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 	"github.com/pborman/uuid"
 
 	btrdb "gopkg.in/BTrDB/btrdb.v4"
@@ -25,6 +28,52 @@ type Inserter struct {
 	streamcache      map[streamkey]*btrdb.Stream
 	db               *btrdb.BTrDB
 	workq            chan []*DataFrame
+	//The annotations last written to each stream
+	annset  map[streamkey]map[string]string
+	opts    *DeviceOptions
+	metrics *metrics.Device
+
+	//Inserts are made with ctx, which is cancelled when Close gives up
+	ctx    context.Context
+	cancel func()
+	//Closed when the worker exits
+	done chan struct{}
+	//Readings of the current batch that have not been inserted yet
+	buffered int64
+	//Readings that could not be inserted
+	failed int64
+	//Streams whose latest annotations could not be written
+	annfailed map[streamkey]bool
+}
+
+//ShutdownReport summarizes what could not be written when a device was
+//stopped
+type ShutdownReport struct {
+	//Readings that were still being inserted when the flush deadline passed
+	Unflushed int64
+	//Readings whose insert failed
+	Failed int64
+	//Streams whose annotations were not written
+	Annotations int
+}
+
+func (r *ShutdownReport) Add(o *ShutdownReport) {
+	r.Unflushed += o.Unflushed
+	r.Failed += o.Failed
+	r.Annotations += o.Annotations
+}
+
+//Clean is true if nothing was lost
+func (r *ShutdownReport) Clean() bool {
+	return r.Unflushed == 0 && r.Failed == 0 && r.Annotations == 0
+}
+
+func (r *ShutdownReport) String() string {
+	if r.Clean() {
+		return "all data was written"
+	}
+	return fmt.Sprintf("%d readings unflushed, %d failed, %d streams with unwritten annotations",
+		r.Unflushed, r.Failed, r.Annotations)
 }
 type streamkey struct {
 	Collection string
@@ -32,14 +81,20 @@ type streamkey struct {
 	Unit       string
 }
 
-func NewInserter(db *btrdb.BTrDB, prefix string) *Inserter {
+func NewInserter(db *btrdb.BTrDB, prefix string, opts *DeviceOptions, dm *metrics.Device) *Inserter {
 	prefix = strings.TrimSuffix(prefix, "/")
 	rv := Inserter{
 		CollectionPrefix: prefix,
 		streamcache:      make(map[streamkey]*btrdb.Stream),
 		db:               db,
 		workq:            make(chan []*DataFrame),
+		annset:           make(map[streamkey]map[string]string),
+		opts:             opts,
+		metrics:          dm,
+		done:             make(chan struct{}),
+		annfailed:        make(map[streamkey]bool),
 	}
+	rv.ctx, rv.cancel = context.WithCancel(context.Background())
 	go rv.worker()
 	return &rv
 }
@@ -50,13 +105,134 @@ func (ins *Inserter) ProcessBatch(df map[uint16][]*DataFrame) {
 	}
 }
 
+//Close waits for the batch being inserted to finish, or for ctx to expire
+//in which case the inserts are abandoned. ProcessBatch must not be called
+//afterwards.
+func (ins *Inserter) Close(ctx context.Context) *ShutdownReport {
+	//Only failures from here on are reported, earlier ones were logged
+	failedBefore := atomic.LoadInt64(&ins.failed)
+	close(ins.workq)
+	select {
+	case <-ins.done:
+	case <-ctx.Done():
+		ins.cancel()
+		select {
+		case <-ins.done:
+		case <-time.After(time.Second):
+		}
+	}
+	rv := &ShutdownReport{
+		Unflushed: atomic.LoadInt64(&ins.buffered),
+		Failed:    atomic.LoadInt64(&ins.failed) - failedBefore,
+	}
+	select {
+	case <-ins.done:
+		//annfailed is only safe to read once the worker has exited
+		rv.Annotations = len(ins.annfailed)
+	default:
+	}
+	return rv
+}
+
 func (ins *Inserter) mkc(d *PMUData) string {
 	return fmt.Sprintf("%s/%d_%s", ins.CollectionPrefix, d.IDCODE, d.STN)
 }
+
+//cfg3Annotations returns the annotations common to every stream of a PMU
+//configured with CFG-3, or nil if the PMU was configured with CFG-1/2
+func cfg3Annotations(pm *PMUData) map[string]string {
+	if pm.Config == nil || pm.Config.CFG3 == nil {
+		return nil
+	}
+	e3 := pm.Config.CFG3
+	rv := map[string]string{
+		"station":        pm.STN,
+		"g_pmu_id":       e3.GlobalPMUID(),
+		"window_us":      strconv.Itoa(int(e3.WINDOW)),
+		"group_delay_us": strconv.Itoa(int(e3.GRP_DLY)),
+		"fnom":           strconv.FormatFloat(FreqFieldToHz(pm.Config.FNOM), 'f', -1, 64),
+		"cfgcnt":         strconv.Itoa(int(pm.Config.CFGCNT)),
+	}
+	if svc := e3.ServiceClass(); svc != "" {
+		rv["svc_class"] = svc
+	}
+	//The standard uses infinity to mean unspecified
+	for k, v := range map[string]float32{"pmu_lat": e3.PMU_LAT, "pmu_lon": e3.PMU_LON, "pmu_elev": e3.PMU_ELEV} {
+		fv := float64(v)
+		if !math.IsInf(fv, 0) && !math.IsNaN(fv) {
+			rv[k] = strconv.FormatFloat(fv, 'f', -1, 32)
+		}
+	}
+	return rv
+}
+
+func phasorAnnotations(pm *PMUData, phi int) map[string]string {
+	rv := cfg3Annotations(pm)
+	if rv == nil {
+		return nil
+	}
+	ps := &pm.Config.CFG3.PHSCALE[phi]
+	rv["phasor_component"] = ps.ComponentName()
+	rv["phasor_scale"] = strconv.FormatFloat(float64(ps.Scale), 'g', -1, 32)
+	rv["phasor_angle_adjustment_rad"] = strconv.FormatFloat(float64(ps.AngleAdjustment), 'g', -1, 32)
+	rv["phasor_flags"] = fmt.Sprintf("0x%04x", ps.Flags)
+	return rv
+}
+
+func analogAnnotations(pm *PMUData, ani int) map[string]string {
+	rv := cfg3Annotations(pm)
+	if rv == nil {
+		return nil
+	}
+	as := &pm.Config.CFG3.ANSCALE[ani]
+	rv["analog_scale"] = strconv.FormatFloat(float64(as.Scale), 'g', -1, 32)
+	rv["analog_offset"] = strconv.FormatFloat(float64(as.Offset), 'g', -1, 32)
+	return rv
+}
+
+func sameAnnotations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (ins *Inserter) setAnnotations(stream *btrdb.Stream, ann map[string]string) error {
+	_, aver, err := stream.Annotations(ins.ctx)
+	if err != nil {
+		return err
+	}
+	changes := make(map[string]*string)
+	for k, v := range ann {
+		vc := v
+		changes[k] = &vc
+	}
+	return stream.CompareAndSetAnnotation(ins.ctx, aver, changes)
+}
+
 func (ins *Inserter) worker() {
+	defer close(ins.done)
 	for {
 		buf := make(map[streamkey][]btrdb.RawPoint)
-		data := <-ins.workq
+		anns := make(map[streamkey]map[string]string)
+		//annotate records the annotations for a stream once per batch
+		annotate := func(sk streamkey, gen func() map[string]string) {
+			if _, ok := anns[sk]; ok {
+				return
+			}
+			if a := gen(); a != nil {
+				anns[sk] = a
+			}
+		}
+		data, ok := <-ins.workq
+		if !ok {
+			return
+		}
 		if len(data) == 0 {
 			continue
 		}
@@ -70,25 +246,69 @@ func (ins *Inserter) worker() {
 					Unit:       "STAT"}
 				buf[skStats] = append(buf[skStats],
 					btrdb.RawPoint{Time: ts, Value: float64(pm.STAT)})
-				if pm.STAT&0x8000 != 0 {
-					//STAT field says drop this data
-					continue
-				}
+				annotate(skStats, func() map[string]string { return cfg3Annotations(pm) })
 				skTQ := streamkey{Name: "TIMEQUAL",
 					Collection: ins.mkc(pm),
 					Unit:       "TQ"}
+				annotate(skTQ, func() map[string]string { return cfg3Annotations(pm) })
 				buf[skTQ] = append(buf[skTQ],
 					btrdb.RawPoint{Time: ts, Value: float64(d.TimeQual)})
 
+				if ins.opts.DecodeStat {
+					for ci := range StatConditions {
+						c := &StatConditions[ci]
+						sk := streamkey{Name: c.Stream,
+							Collection: ins.mkc(pm),
+							Unit:       "bool"}
+						annotate(sk, func() map[string]string { return ins.opts.Quality.Annotations(c) })
+						v := 0.0
+						if c.Test(pm.STAT, d.TimeQual) {
+							v = 1
+						}
+						buf[sk] = append(buf[sk], btrdb.RawPoint{Time: ts, Value: v})
+					}
+					for ci := range StatCodes {
+						c := &StatCodes[ci]
+						sk := streamkey{Name: c.Stream,
+							Collection: ins.mkc(pm),
+							Unit:       "code"}
+						annotate(sk, func() map[string]string {
+							return map[string]string{"meaning": c.Meaning, "bits": c.Bits, "codes": c.Codes}
+						})
+						buf[sk] = append(buf[sk],
+							btrdb.RawPoint{Time: ts, Value: float64(c.Extract(pm.STAT, d.TimeQual))})
+					}
+				}
+
+				drop, flag := ins.opts.Quality.Evaluate(pm.STAT, d.TimeQual)
+				if drop {
+					//The policy says drop the measurements in this sample
+					ins.metrics.Rejected(2 + 2*len(pm.PHASOR_MAG) + len(pm.ANALOG) + len(pm.DIGITAL))
+					continue
+				}
+				if ins.opts.Quality.HasFlags() {
+					skFlagged := streamkey{Name: "QUALITY_FLAGGED",
+						Collection: ins.mkc(pm),
+						Unit:       "bool"}
+					annotate(skFlagged, func() map[string]string { return ins.opts.Quality.FlaggedAnnotations() })
+					fv := 0.0
+					if flag {
+						fv = 1
+					}
+					buf[skFlagged] = append(buf[skFlagged], btrdb.RawPoint{Time: ts, Value: fv})
+				}
+
 				skFreq := streamkey{Name: "FREQ",
 					Collection: ins.mkc(pm),
 					Unit:       "Hz"}
+				annotate(skFreq, func() map[string]string { return cfg3Annotations(pm) })
 				buf[skFreq] = append(buf[skFreq],
 					btrdb.RawPoint{Time: ts, Value: pm.FREQ})
 
 				skDFreq := streamkey{Name: "DFREQ",
 					Collection: ins.mkc(pm),
 					Unit:       "ROCOF"}
+				annotate(skDFreq, func() map[string]string { return cfg3Annotations(pm) })
 				buf[skDFreq] = append(buf[skDFreq],
 					btrdb.RawPoint{Time: ts, Value: pm.DFREQ})
 
@@ -104,20 +324,24 @@ func (ins *Inserter) worker() {
 					}
 					if math.IsNaN(pm.PHASOR_MAG[phi]) {
 						fmt.Printf("WARN, device %d issues NaN magnitude\n", pm.IDCODE)
+						ins.metrics.Rejected(2)
 						continue
 					}
 					if math.IsNaN(pm.PHASOR_ANG[phi]) {
 						fmt.Printf("WARN, device %d issues NaN angle\n", pm.IDCODE)
+						ins.metrics.Rejected(2)
 						continue
 					}
 					skphmag := streamkey{Name: fmt.Sprintf("PH%dMAG %s", phi, ph),
 						Collection: ins.mkc(pm),
 						Unit:       unit}
+					annotate(skphmag, func() map[string]string { return phasorAnnotations(pm, phi) })
 					buf[skphmag] = append(buf[skphmag],
 						btrdb.RawPoint{Time: ts, Value: pm.PHASOR_MAG[phi]})
 					skphang := streamkey{Name: fmt.Sprintf("PH%dANG %s", phi, ph),
 						Collection: ins.mkc(pm),
 						Unit:       "degrees"}
+					annotate(skphang, func() map[string]string { return phasorAnnotations(pm, phi) })
 					buf[skphang] = append(buf[skphang],
 						btrdb.RawPoint{Time: ts, Value: pm.PHASOR_ANG[phi]})
 				}
@@ -128,11 +352,13 @@ func (ins *Inserter) worker() {
 					}
 					if math.IsNaN(pm.ANALOG[ani]) {
 						fmt.Printf("WARN, device %d issues NaN analog channel\n", pm.IDCODE)
+						ins.metrics.Rejected(1)
 						continue
 					}
 					ska := streamkey{Name: nm,
 						Collection: ins.mkc(pm),
 						Unit:       "analog"}
+					annotate(ska, func() map[string]string { return analogAnnotations(pm, ani) })
 					buf[ska] = append(buf[ska],
 						btrdb.RawPoint{Time: ts, Value: pm.ANALOG[ani]})
 				}
@@ -140,11 +366,15 @@ func (ins *Inserter) worker() {
 					skd := streamkey{Name: fmt.Sprintf("DG%d", dgi),
 						Collection: ins.mkc(pm),
 						Unit:       "digital"}
+					annotate(skd, func() map[string]string { return cfg3Annotations(pm) })
 					buf[skd] = append(buf[skd],
 						btrdb.RawPoint{Time: ts, Value: float64(pm.DIGITAL[dgi])})
 				}
 			}
 		} //end for over data
+		for _, dat := range buf {
+			atomic.AddInt64(&ins.buffered, int64(len(dat)))
+		}
 		total := 0
 		for sk, dat := range buf {
 			ins.cachemu.Lock()
@@ -175,13 +405,31 @@ func (ins *Inserter) worker() {
 					ins.cachemu.Unlock()
 				}
 			}
+			if ann, ok := anns[sk]; ok && !sameAnnotations(ins.annset[sk], ann) {
+				err := ins.setAnnotations(stream, ann)
+				if err != nil {
+					fmt.Printf("Stream uuid=%s col=%s name=%s failed to set annotations: %v\n", stream.UUID().String(), sk.Collection, sk.Name, err)
+					ins.annfailed[sk] = true
+				} else {
+					ins.annset[sk] = ann
+					delete(ins.annfailed, sk)
+				}
+			}
 			total += len(dat)
-			err := stream.Insert(context.Background(), dat)
+			insertStart := time.Now()
+			err := stream.Insert(ins.ctx, dat)
+			metrics.ObserveLatency("insert", time.Since(insertStart))
 			if err != nil {
 				fmt.Printf("Stream uuid=%s col=%s name=%s insert error (ignoring): %v\n", stream.UUID().String(), sk.Collection, sk.Name, err)
+				ins.metrics.Dropped(len(dat))
+				atomic.AddInt64(&ins.failed, int64(len(dat)))
+			} else {
+				ins.metrics.Inserted(len(dat))
 			}
+			atomic.AddInt64(&ins.buffered, -int64(len(dat)))
 		}
 		now := time.Now()
+		metrics.ObserveLatency("batch", now.Sub(then))
 		fmt.Printf("Batch of %d readings processed in %.2f ms\n", total, float64(now.Sub(then)/time.Microsecond)/1000.0)
 	}
 }
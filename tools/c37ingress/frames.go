@@ -40,6 +40,8 @@ type Config12Frame struct {
 	NUM_PMU   uint16
 	Entries   []*Config12Entry
 	DATA_RATE uint16
+	//Which configuration frame type this was read from
+	CFGTYPE SYNC_TYPE
 }
 type Config12Entry struct {
 	STN     string
@@ -56,10 +58,256 @@ type Config12Entry struct {
 	DGUNIT  []uint32
 	FNOM    uint16
 	CFGCNT  uint16
+	//Only present if this entry was read from a CFG-3 frame
+	CFG3 *Config3Entry
+}
+
+//Config3Entry holds the fields that are only present in a CFG-3 frame.
+//A CFG-3 frame is otherwise decoded into the same Config12Frame structure
+//(with PHUNIT and ANUNIT left empty) so that data frames can be read in the
+//same way regardless of the configuration frame type.
+type Config3Entry struct {
+	G_PMU_ID  [16]byte
+	PHSCALE   []PhasorScale
+	ANSCALE   []AnalogScale
+	PMU_LAT   float32
+	PMU_LON   float32
+	PMU_ELEV  float32
+	SVC_CLASS byte
+	WINDOW    int32
+	GRP_DLY   int32
+}
+
+type PhasorScale struct {
+	//Bit mapped flags describing modifications applied to the phasor
+	Flags uint16
+	//User designated phasor type (not specified by the standard)
+	UserType uint8
+	//Bit 3 is set for current phasors, bits 0-2 identify the component
+	Component uint8
+	//Scale factor for integer phasors
+	Scale float32
+	//Phasor angle adjustment in radians
+	AngleAdjustment float32
+}
+
+type AnalogScale struct {
+	Scale  float32
+	Offset float32
+}
+
+func (ps *PhasorScale) IsVoltage() bool {
+	return ps.Component&0x8 == 0
+}
+
+var phasorComponents = []string{"zero sequence", "positive sequence", "negative sequence", "reserved", "phase A", "phase B", "phase C", "reserved"}
+
+//ComponentName returns the human readable phase or sequence component
+func (ps *PhasorScale) ComponentName() string {
+	return phasorComponents[ps.Component&0x7]
+}
+
+//ServiceClass returns "M" or "P", or "" if it was not specified
+func (e *Config3Entry) ServiceClass() string {
+	if e.SVC_CLASS == 'M' || e.SVC_CLASS == 'P' {
+		return string([]byte{e.SVC_CLASS})
+	}
+	return ""
+}
+
+func (e *Config3Entry) GlobalPMUID() string {
+	return fmt.Sprintf("%x", e.G_PMU_ID[:])
+}
+
+//Config3Assembler collects the continuation frames of a CFG-3 frame until
+//the whole configuration is available
+type Config3Assembler struct {
+	next    uint16
+	payload []byte
+}
+
+//CFG-3 continuation index values with special meaning
+const CONT_IDX_ONLY = 0
+const CONT_IDX_LAST = 0xFFFF
+
+//Add adds the body of a CFG-3 frame (everything following the common header
+//excluding the checksum). It returns the complete configuration payload
+//once the last frame has been received, and nil otherwise
+func (a *Config3Assembler) Add(body []byte) ([]byte, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("CFG-3 frame too short")
+	}
+	contidx := binary.BigEndian.Uint16(body[0:2])
+	switch {
+	case contidx == CONT_IDX_ONLY:
+		a.next = 0
+		a.payload = nil
+		return body[2:], nil
+	case contidx == 1:
+		a.payload = append([]byte{}, body[2:]...)
+		a.next = 2
+		return nil, nil
+	case contidx == CONT_IDX_LAST:
+		if a.next == 0 {
+			return nil, fmt.Errorf("CFG-3 final continuation frame without a first frame")
+		}
+		rv := append(a.payload, body[2:]...)
+		a.next = 0
+		a.payload = nil
+		return rv, nil
+	case contidx == a.next:
+		a.payload = append(a.payload, body[2:]...)
+		a.next++
+		return nil, nil
+	}
+	expected := a.next
+	a.next = 0
+	a.payload = nil
+	return nil, fmt.Errorf("CFG-3 continuation frame %d out of sequence (expected %d)", contidx, expected)
+}
+
+//readName reads a CFG-3 variable length name, a length byte followed by
+//that many bytes of UTF-8
+func readName(r io.Reader) (string, error) {
+	var ln uint8
+	err := binary.Read(r, binary.BigEndian, &ln)
+	if err != nil {
+		return "", err
+	}
+	barr := make([]byte, ln)
+	_, err = io.ReadFull(r, barr)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(barr, "\x00 ")), nil
+}
+
+//ReadConfig3Frame parses a complete (reassembled) CFG-3 payload, the data
+//following CONT_IDX in the first frame up to the checksum of the last frame
+func ReadConfig3Frame(payload []byte) (*Config12Frame, error) {
+	rv := &Config12Frame{CFGTYPE: SYNC_TYPE_CFG3}
+	r := bytes.NewReader(payload)
+	err := binary.Read(r, binary.BigEndian, &rv.TIME_BASE)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(r, binary.BigEndian, &rv.NUM_PMU)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(rv.NUM_PMU); i++ {
+		e := &Config12Entry{CFG3: &Config3Entry{}}
+		e3 := e.CFG3
+		e.STN, err = readName(r)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(r, binary.BigEndian, &e.IDCODE)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(r, e3.G_PMU_ID[:])
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range []*uint16{&e.FORMAT, &e.PHNMR, &e.ANNMR, &e.DGNMR} {
+			err = binary.Read(r, binary.BigEndian, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for phni := 0; phni < int(e.PHNMR); phni++ {
+			nm, err := readName(r)
+			if err != nil {
+				return nil, err
+			}
+			e.PHCHNAM = append(e.PHCHNAM, nm)
+		}
+		for annmri := 0; annmri < int(e.ANNMR); annmri++ {
+			nm, err := readName(r)
+			if err != nil {
+				return nil, err
+			}
+			e.ANCHNAM = append(e.ANCHNAM, nm)
+		}
+		for dgnmri := 0; dgnmri < int(e.DGNMR); dgnmri++ {
+			for bit := 0; bit < 16; bit++ {
+				nm, err := readName(r)
+				if err != nil {
+					return nil, err
+				}
+				e.DGCHNAM = append(e.DGCHNAM, nm)
+			}
+		}
+		for phni := 0; phni < int(e.PHNMR); phni++ {
+			ps := PhasorScale{}
+			var flags [4]byte
+			_, err = io.ReadFull(r, flags[:])
+			if err != nil {
+				return nil, err
+			}
+			ps.Flags = binary.BigEndian.Uint16(flags[0:2])
+			ps.UserType = flags[2]
+			ps.Component = flags[3]
+			err = binary.Read(r, binary.BigEndian, &ps.Scale)
+			if err != nil {
+				return nil, err
+			}
+			err = binary.Read(r, binary.BigEndian, &ps.AngleAdjustment)
+			if err != nil {
+				return nil, err
+			}
+			e3.PHSCALE = append(e3.PHSCALE, ps)
+		}
+		for annmri := 0; annmri < int(e.ANNMR); annmri++ {
+			as := AnalogScale{}
+			err = binary.Read(r, binary.BigEndian, &as)
+			if err != nil {
+				return nil, err
+			}
+			e3.ANSCALE = append(e3.ANSCALE, as)
+		}
+		for dgnmri := 0; dgnmri < int(e.DGNMR); dgnmri++ {
+			var unit uint32
+			err = binary.Read(r, binary.BigEndian, &unit)
+			if err != nil {
+				return nil, err
+			}
+			e.DGUNIT = append(e.DGUNIT, unit)
+		}
+		for _, f := range []*float32{&e3.PMU_LAT, &e3.PMU_LON, &e3.PMU_ELEV} {
+			err = binary.Read(r, binary.BigEndian, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		e3.SVC_CLASS, err = r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range []*int32{&e3.WINDOW, &e3.GRP_DLY} {
+			err = binary.Read(r, binary.BigEndian, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range []*uint16{&e.FNOM, &e.CFGCNT} {
+			err = binary.Read(r, binary.BigEndian, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rv.Entries = append(rv.Entries, e)
+	}
+	err = binary.Read(r, binary.BigEndian, &rv.DATA_RATE)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
 }
 
 func ReadConfig12Frame(ch *CommonHeader, r io.Reader) (*Config12Frame, error) {
-	rv := &Config12Frame{}
+	rv := &Config12Frame{CFGTYPE: ch.SyncType()}
 	subr := io.LimitReader(r, int64(ch.FRAMESIZE)-CommonHeaderLength-2)
 	err := binary.Read(subr, binary.BigEndian, &rv.TIME_BASE)
 	if err != nil {
@@ -281,6 +529,19 @@ type PMUData struct {
 
 	DIGITAL_NAMES []string
 	DIGITAL       []int
+
+	//The configuration this sample was decoded with
+	Config *Config12Entry
+}
+
+//MeasurementCount is the number of values in the frame: frequency, ROCOF,
+//phasor magnitudes and angles, analogs and digitals for every PMU
+func (d *DataFrame) MeasurementCount() int {
+	total := 0
+	for _, pm := range d.Data {
+		total += 2 + 2*len(pm.PHASOR_MAG) + len(pm.ANALOG) + len(pm.DIGITAL)
+	}
+	return total
 }
 
 func (d *DataFrame) PrettyDump() {
@@ -414,6 +675,69 @@ func ReadPhasor(format uint16, unit uint32, r io.Reader) (mag float64, ang float
 		}
 	}
 }
+//ReadPhasor3 reads a phasor described by a CFG-3 frame. The scale factor
+//is only applied to integer phasors, floating point phasors are already in
+//engineering units. The angle adjustment is recorded in the stream
+//annotations rather than applied.
+func ReadPhasor3(format uint16, ps *PhasorScale, r io.Reader) (mag float64, ang float64, isvolt bool, err error) {
+	isvolt = ps.IsVoltage()
+	var vals [2]float64
+	if format&2 == 0 {
+		//16 bit integer
+		var raw [2]int16
+		err = binary.Read(r, binary.BigEndian, &raw)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if format&1 == 0 {
+			vals[0] = float64(raw[0]) * float64(ps.Scale)
+			vals[1] = float64(raw[1]) * float64(ps.Scale)
+		} else {
+			//The magnitude is unsigned, the angle is in radians * 10^4
+			vals[0] = float64(uint16(raw[0])) * float64(ps.Scale)
+			vals[1] = float64(raw[1]) * 1e-4
+		}
+	} else {
+		//32 bit float
+		var raw [2]float32
+		err = binary.Read(r, binary.BigEndian, &raw)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		vals[0] = float64(raw[0])
+		vals[1] = float64(raw[1])
+	}
+	if format&1 == 0 {
+		//Rectangular coordinates
+		phase := math.Atan2(vals[1], vals[0])
+		degrees := (phase / (2 * math.Pi)) * 360
+		return math.Hypot(vals[1], vals[0]), degrees, isvolt, nil
+	}
+	//Polar coordinates
+	degrees := (vals[1] / (2 * math.Pi)) * 360
+	return vals[0], degrees, isvolt, nil
+}
+
+//ReadAnalog3 reads an analog value described by a CFG-3 frame. Like
+//phasors, the scale and offset are only applied to integer values
+func ReadAnalog3(format uint16, as *AnalogScale, r io.Reader) (float64, error) {
+	if format&4 == 0 {
+		//16 bit integer
+		var rv int16
+		err := binary.Read(r, binary.BigEndian, &rv)
+		if err != nil {
+			return 0, err
+		}
+		return float64(rv)*float64(as.Scale) + float64(as.Offset), nil
+	}
+	//32 bit float
+	var rv float32
+	err := binary.Read(r, binary.BigEndian, &rv)
+	if err != nil {
+		return 0, err
+	}
+	return float64(rv), nil
+}
 func ReadAnalog(format uint16, unit uint32, r io.Reader) (float64, error) {
 	//TODO analog scaling
 	if format&4 == 0 {
@@ -506,8 +830,16 @@ func ReadDataFrame(ch *CommonHeader, cfg *Config12Frame, r io.Reader) (*DataFram
 		entry := cfg.Entries[pmu]
 		d.STN = entry.STN
 		d.IDCODE = entry.IDCODE
+		d.Config = entry
 		for phi := 0; phi < int(entry.PHNMR); phi++ {
-			mag, ang, isvolt, err := ReadPhasor(entry.FORMAT, entry.PHUNIT[phi], r)
+			var mag, ang float64
+			var isvolt bool
+			var err error
+			if entry.CFG3 != nil {
+				mag, ang, isvolt, err = ReadPhasor3(entry.FORMAT, &entry.CFG3.PHSCALE[phi], r)
+			} else {
+				mag, ang, isvolt, err = ReadPhasor(entry.FORMAT, entry.PHUNIT[phi], r)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -527,7 +859,13 @@ func ReadDataFrame(ch *CommonHeader, cfg *Config12Frame, r io.Reader) (*DataFram
 		}
 		d.DFREQ = rocof
 		for anni := 0; anni < int(entry.ANNMR); anni++ {
-			val, err := ReadAnalog(entry.FORMAT, entry.ANUNIT[anni], r)
+			var val float64
+			var err error
+			if entry.CFG3 != nil {
+				val, err = ReadAnalog3(entry.FORMAT, &entry.CFG3.ANSCALE[anni], r)
+			} else {
+				val, err = ReadAnalog(entry.FORMAT, entry.ANUNIT[anni], r)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func writeName(b *bytes.Buffer, name string) {
+	b.WriteByte(byte(len(name)))
+	b.WriteString(name)
+}
+
+//config3Payload builds a CFG-3 payload for one PMU with a single phasor and
+//a single analog channel
+func config3Payload(idcode uint16, cfgcnt uint16) []byte {
+	b := &bytes.Buffer{}
+	w := func(v interface{}) {
+		binary.Write(b, binary.BigEndian, v)
+	}
+	w(uint32(1000000))
+	w(uint16(1))
+	writeName(b, "STATION")
+	w(idcode)
+	b.Write(bytes.Repeat([]byte{0xAB}, 16))
+	w([]uint16{0x000F, 1, 1, 0})
+	writeName(b, "VA")
+	writeName(b, "FREQ")
+	b.Write([]byte{0, 1, 0, 4})
+	w([]float32{1.5, 0.25})
+	w([]float32{2, -1})
+	w([]float32{37.87, -122.26, 52})
+	b.WriteByte('P')
+	w([]int32{100, 200})
+	w([]uint16{0, cfgcnt})
+	w(uint16(30))
+	return b.Bytes()
+}
+
+//config3Frames splits a CFG-3 payload into n frame bodies with the right
+//continuation indices
+func config3Frames(payload []byte, n int) [][]byte {
+	rv := [][]byte{}
+	sz := (len(payload) + n - 1) / n
+	for i := 0; i < n; i++ {
+		end := (i + 1) * sz
+		if end > len(payload) {
+			end = len(payload)
+		}
+		idx := uint16(i + 1)
+		if n == 1 {
+			idx = CONT_IDX_ONLY
+		} else if i == n-1 {
+			idx = CONT_IDX_LAST
+		}
+		body := make([]byte, 2, 2+end-i*sz)
+		binary.BigEndian.PutUint16(body, idx)
+		rv = append(rv, append(body, payload[i*sz:end]...))
+	}
+	return rv
+}
+
+func TestReadConfig3Frame(t *testing.T) {
+	cfg, err := ReadConfig3Frame(config3Payload(7, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CFGTYPE != SYNC_TYPE_CFG3 || cfg.NUM_PMU != 1 || cfg.DATA_RATE != 30 {
+		t.Fatalf("unexpected frame %+v", cfg)
+	}
+	e := cfg.Entries[0]
+	if e.STN != "STATION" || e.IDCODE != 7 || e.CFGCNT != 3 || e.FORMAT != 0x000F {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if len(e.PHCHNAM) != 1 || e.PHCHNAM[0] != "VA" || len(e.ANCHNAM) != 1 || e.ANCHNAM[0] != "FREQ" {
+		t.Fatalf("unexpected channel names %v %v", e.PHCHNAM, e.ANCHNAM)
+	}
+	e3 := e.CFG3
+	if e3.PHSCALE[0].Scale != 1.5 || e3.PHSCALE[0].ComponentName() != "phase A" || !e3.PHSCALE[0].IsVoltage() {
+		t.Fatalf("unexpected phasor scale %+v", e3.PHSCALE[0])
+	}
+	if e3.ANSCALE[0].Scale != 2 || e3.ANSCALE[0].Offset != -1 {
+		t.Fatalf("unexpected analog scale %+v", e3.ANSCALE[0])
+	}
+	if e3.ServiceClass() != "P" || e3.WINDOW != 100 || e3.GRP_DLY != 200 || e3.PMU_ELEV != 52 {
+		t.Fatalf("unexpected CFG-3 fields %+v", e3)
+	}
+	payload := config3Payload(7, 3)
+	if _, err := ReadConfig3Frame(payload[:len(payload)-5]); err == nil {
+		t.Fatalf("expected an error for a truncated payload")
+	}
+}
+
+func TestConfig3AssemblerInOrder(t *testing.T) {
+	payload := config3Payload(7, 3)
+	for _, n := range []int{1, 2, 4} {
+		a := &Config3Assembler{}
+		var got []byte
+		for i, body := range config3Frames(payload, n) {
+			rv, err := a.Add(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i != n-1 && rv != nil {
+				t.Fatalf("%d frames: payload returned after frame %d", n, i)
+			}
+			got = rv
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%d frames: reassembled payload differs", n)
+		}
+	}
+}
+
+func TestConfig3AssemblerMissingFrame(t *testing.T) {
+	payload := config3Payload(7, 3)
+	frames := config3Frames(payload, 4)
+	a := &Config3Assembler{}
+	if _, err := a.Add(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Add(frames[2]); err == nil {
+		t.Fatalf("expected an error for a missing continuation frame")
+	}
+	//The rest of the broken configuration is discarded
+	if _, err := a.Add(frames[3]); err == nil {
+		t.Fatalf("expected an error for the last frame without a first frame")
+	}
+	//and a retransmission is assembled from scratch
+	var got []byte
+	for _, body := range frames {
+		rv, err := a.Add(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = rv
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("retransmitted payload differs")
+	}
+	if _, err := a.Add([]byte{0}); err == nil {
+		t.Fatalf("expected an error for a short frame")
+	}
+}
+
+func TestReplacesConfig(t *testing.T) {
+	cfg3, err := ReadConfig3Frame(config3Payload(7, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := func(cfgcnt uint16) *Config12Frame {
+		return &Config12Frame{
+			CFGTYPE: SYNC_TYPE_CFG2,
+			NUM_PMU: 1,
+			Entries: []*Config12Entry{{IDCODE: 7, CFGCNT: cfgcnt}},
+		}
+	}
+	if !replacesConfig(nil, cfg2(3)) || !replacesConfig(nil, cfg3) {
+		t.Fatalf("any configuration should be used when there is none")
+	}
+	if !replacesConfig(cfg2(3), cfg3) {
+		t.Fatalf("CFG-3 should replace CFG-2")
+	}
+	if !replacesConfig(cfg2(3), cfg2(4)) {
+		t.Fatalf("CFG-2 should replace CFG-2")
+	}
+	if replacesConfig(cfg3, cfg2(3)) {
+		t.Fatalf("CFG-2 with the same CFGCNT should not replace CFG-3")
+	}
+	if !replacesConfig(cfg3, cfg2(4)) {
+		t.Fatalf("CFG-2 with a new CFGCNT should replace CFG-3")
+	}
+}
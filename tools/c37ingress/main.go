@@ -11,23 +11,44 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BTrDB/smartgridstore/tools"
 	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 	etcd "github.com/coreos/etcd/clientv3"
-	"github.com/pborman/uuid"
 	btrdb "gopkg.in/BTrDB/btrdb.v4"
 )
 
+//FlushTimeout is how long a stopped device is given to write the data it
+//already received. Kubernetes kills a pod 30 seconds after SIGTERM by
+//default.
+const FlushTimeout = 20 * time.Second
+
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "-version" {
 		fmt.Printf("%d.%d.%d\n", tools.VersionMajor, tools.VersionMinor, tools.VersionPatch)
 		os.Exit(0)
 	}
 	fmt.Printf("Booting c37 ingress version %d.%d.%d\n", tools.VersionMajor, tools.VersionMinor, tools.VersionPatch)
+	metrics.Serve()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigc
+		fmt.Printf("Received %s, shutting down\n", sig)
+		cancel()
+		sig = <-sigc
+		fmt.Printf("Received %s again, exiting without flushing\n", sig)
+		os.Exit(1)
+	}()
 
 	manifest.SetEtcdKeyPrefix("")
 
@@ -45,6 +66,8 @@ func main() {
 		log.Fatalf("Error: %v", err)
 	}
 	defer etcdConn.Close()
+	status := manifest.NewStatusReporter(etcdConn, manifest.NodeName())
+	status.Start(ctx)
 	log.Println("Connecting to BTrDB...")
 	btrdbconn, err := btrdb.Connect(context.Background(), btrdb.EndpointsFromEnv()...)
 	if err != nil {
@@ -62,94 +85,86 @@ func main() {
 	}()
 	log.Println("Connected")
 
-	ourid := uuid.NewRandom().String()
-	ourctx := context.Background()
-	//Get the lock table
-devloop:
-	for {
-		const dprefix = "c37-118.pdc."
-		time.Sleep(5 * time.Second)
-		devs, err := manifest.RetrieveMultipleManifestDevices(context.Background(), etcdConn, dprefix)
-		if err != nil {
-			panic(err)
+	var summarymu sync.Mutex
+	summary := &ShutdownReport{}
+	lm := manifest.NewLockManager(etcdConn, "c37-118.pdc.", manifest.NewNodeID(), func(ctx context.Context, d *manifest.ManifestDevice) {
+		identifier := d.Descriptor
+		connstring := strings.SplitN(identifier, ".", 3)[2]
+		fmt.Printf("[global] identified pdc %q\n", connstring)
+		//connstring looks like PREFIX@IDCODE@HOST:PORT, where HOST:PORT
+		//may instead be a transport URL (see ParseTransport)
+		parts := strings.SplitN(connstring, "@", 3)
+		if len(parts) != 3 {
+			fmt.Printf("Invalid connection string %q\n", connstring)
+			return
 		}
-		ltable, err := manifest.GetLockTable(context.Background(), etcdConn, dprefix)
-
-		us, min2, locked := parseLTable(ltable, ourid)
-		if us > min2 && min2 != -1 {
-			//Do not start doing a new device if we are not doing a small number
-			//of devices
-			continue
-		}
-		fmt.Printf("We have a total of %d devices locked\n", us)
-		// We need to start a device
-		for _, d := range devs {
-			if locked[d.Descriptor] {
-				continue
-			}
-			identifier := d.Descriptor
-			connstring := strings.SplitN(identifier, ".", 3)[2]
-			fmt.Printf("[global] identified pdc %q\n", connstring)
-			//connstring looks like PREFIX@IDCODE@HOST:PORT
-			parts := strings.SplitN(connstring, "@", 3)
-			if len(parts) != 3 {
-				fmt.Printf("Invalid connection string %q\n", connstring)
-				continue
-			}
-			prefix := parts[0]
-			idcode, err := strconv.ParseInt(parts[1], 10, 64)
-			if err != nil {
-				fmt.Printf("Invalid connection string %q\n", connstring)
-				continue
-			}
-			gotlock, err := manifest.ObtainDeviceLock(ourctx, etcdConn, d, ourid, dprefix)
-			if err != nil {
-				panic(err)
-			}
-			if gotlock {
-				fmt.Printf("We locked a device and started processing\n")
-				go process(btrdbconn, int(idcode), prefix, parts[2])
-				continue devloop
-			} else {
-				fmt.Printf("we failed to lock\n")
-			}
-		}
-	}
-}
-
-func parseLTable(t map[string][]string, ourid string) (int, int, map[string]bool) {
-	min := -1
-	min2 := -1
-	us := 0
-	locked := make(map[string]bool)
-	for k, v := range t {
-		if len(v) <= min || min == -1 {
-			min2 = min
-			min = len(v)
+		prefix := parts[0]
+		idcode, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid connection string %q\n", connstring)
+			return
 		}
-		if k == ourid {
-			us = len(v)
+		transport, err := ParseTransport(parts[2])
+		if err != nil {
+			fmt.Printf("Invalid connection string %q: %v\n", connstring, err)
+			return
 		}
-		for _, vi := range v {
-			locked[vi] = true
+		opts, err := ParseDeviceOptions(d.Metadata)
+		if err != nil {
+			fmt.Printf("Invalid metadata for %q: %v\n", connstring, err)
+			return
 		}
+		fmt.Printf("We locked a device and started processing\n")
+		hb := status.Device(identifier)
+		report := process(ctx, btrdbconn, int(idcode), prefix, transport, opts, hb)
+		hb.Remove()
+		summarymu.Lock()
+		summary.Add(report)
+		summarymu.Unlock()
+	})
+	lm.Run(ctx)
+	//Run only returns once every device has been flushed
+	lm.Release()
+	if summary.Clean() {
+		fmt.Printf("Shutdown complete: %s\n", summary)
+	} else {
+		fmt.Printf("CRITICAL: shutdown lost data: %s\n", summary)
 	}
-	return us, min2, locked
 }
-func process(db *btrdb.BTrDB, idcode int, prefix string, target string) {
-	inserter := NewInserter(db, prefix)
 
-	p := CreatePMU(target, uint16(idcode))
+//process inserts data from the device until ctx is cancelled, the data
+//that was already received is inserted (within FlushTimeout) before it
+//returns
+func process(ctx context.Context, db *btrdb.BTrDB, idcode int, prefix string, transport *Transport, opts *DeviceOptions, hb *manifest.DeviceHeartbeat) *ShutdownReport {
+	p := CreatePMU(ctx, transport, uint16(idcode), opts, hb)
+	inserter := NewInserter(db, prefix, opts, p.metrics)
 
 	for {
 		then := time.Now()
+		var stopped bool
+		select {
+		case <-p.Stopped():
+			stopped = true
+		default:
+		}
 		dat, drained := p.GetBatch()
 		inserter.ProcessBatch(dat)
 
 		if drained {
+			if stopped {
+				fctx, fcancel := context.WithTimeout(context.Background(), FlushTimeout)
+				report := inserter.Close(fctx)
+				fcancel()
+				fmt.Printf("[%s] stopped processing: %s\n", p.nickname, report)
+				p.metrics.Forget()
+				return report
+			}
 			delta := then.Add(30 * time.Second).Sub(time.Now())
 			if delta > 0 {
-				time.Sleep(delta)
+				select {
+				case <-time.After(delta):
+				case <-p.Stopped():
+				}
 			}
 		}
 	}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//DeviceOptions are the per-device settings, taken from the metadata of the
+//device in the manifest (set with `manifest add <descriptor> key=value`)
+type DeviceOptions struct {
+	//Request CFG-3 rather than CFG-2 from the device. Set with config=cfg3
+	PreferCFG3 bool
+	//Write the STAT and time quality conditions to their own streams as
+	//well as the raw STAT and TIMEQUAL streams. Disable with stat_streams=raw
+	DecodeStat bool
+	//What to do with samples that have each STAT condition. Set with
+	//quality.<condition>=keep|flag|drop e.g. quality.sync_lost=flag
+	Quality QualityPolicy
+}
+
+const qualityKeyPrefix = "quality."
+
+func ParseDeviceOptions(metadata map[string]string) (*DeviceOptions, error) {
+	rv := &DeviceOptions{
+		DecodeStat: true,
+		Quality:    DefaultQualityPolicy(),
+	}
+	switch strings.ToLower(metadata["config"]) {
+	case "", "cfg2":
+	case "cfg3":
+		rv.PreferCFG3 = true
+	default:
+		return nil, fmt.Errorf("invalid config %q, must be cfg2 or cfg3", metadata["config"])
+	}
+	switch strings.ToLower(metadata["stat_streams"]) {
+	case "", "decoded":
+	case "raw":
+		rv.DecodeStat = false
+	default:
+		return nil, fmt.Errorf("invalid stat_streams %q, must be decoded or raw", metadata["stat_streams"])
+	}
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, qualityKeyPrefix) {
+			continue
+		}
+		cond := strings.TrimPrefix(k, qualityKeyPrefix)
+		if lookupStatCondition(cond) == nil {
+			return nil, fmt.Errorf("unknown quality condition %q", cond)
+		}
+		act, err := ParseQualityAction(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Quality[cond] = act
+	}
+	return rv, nil
+}
@@ -12,23 +12,33 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 )
 
 const QueueSize = 16000
 const MaxBatch = 1000
 
+//CFG3Timeout is how long a device that is sending data may take to answer
+//a request for CFG-3 before we fall back to CFG-2
+const CFG3Timeout = 15 * time.Second
+
 type PMU struct {
+	//parent stops the PMU for good, ctx only the current connection
+	parent    context.Context
 	ctx       context.Context
+	stopped   chan struct{}
 	ctxcancel func()
-	address   string
+	transport *Transport
 	id        uint16
 	nickname  string
-	conn      *net.TCPConn
-	br        *bufio.Reader
+	//Commands are written here. It is nil if the device is purely
+	//spontaneous and cannot be sent commands
+	cmd io.Writer
 
 	currentconfig *Config12Frame
 
@@ -39,27 +49,55 @@ type PMU struct {
 	output   map[uint16]chan *DataFrame
 
 	packedUGAChannels bool
+
+	//Request CFG-3 rather than CFG-2 from the device
+	preferCFG3 bool
+	//Set if the device did not respond to the CFG-3 request on this
+	//connection
+	cfg3fallback  bool
+	cfg3requested time.Time
+	cfg3asm       map[uint16]*Config3Assembler
+
+	metrics *metrics.Device
+	status  *manifest.DeviceHeartbeat
 }
 
-func CreatePMU(address string, id uint16) *PMU {
+//CreatePMU starts connecting to the device in the background, it keeps
+//reconnecting until ctx is cancelled
+func CreatePMU(ctx context.Context, transport *Transport, id uint16, opts *DeviceOptions, hb *manifest.DeviceHeartbeat) *PMU {
 	rv := &PMU{
-		address:  address,
-		nickname: fmt.Sprintf("%d@%s", id, address),
-		id:       id,
-		cfgs:     make(map[uint16]*Config12Frame),
-		output:   make(map[uint16]chan *DataFrame),
+		parent:     ctx,
+		stopped:    make(chan struct{}),
+		transport:  transport,
+		nickname:   fmt.Sprintf("%d@%s", id, transport),
+		id:         id,
+		cfgs:       make(map[uint16]*Config12Frame),
+		output:     make(map[uint16]chan *DataFrame),
+		preferCFG3: opts.PreferCFG3,
+		status:     hb,
 	}
+	rv.metrics = metrics.ForDevice(rv.nickname)
+	metrics.QueueDepth(rv.nickname, rv.queueDepth)
 	go rv.dialloop()
 	return rv
 }
 
 func (p *PMU) dialloop() {
+	defer close(p.stopped)
 	for {
 		fmt.Printf("[%s] beginning dial\n", p.nickname)
+		p.status.Connecting()
 		err := p.dial()
 		fmt.Printf("[%s] fatal error: %v\n", p.nickname, err)
-		time.Sleep(10 * time.Second)
+		p.status.Disconnected(err)
+		select {
+		case <-p.parent.Done():
+			fmt.Printf("[%s] stopped\n", p.nickname)
+			return
+		case <-time.After(10 * time.Second):
+		}
 		fmt.Printf("[%s] backoff over, reconnecting\n", p.nickname)
+		p.metrics.Reconnected()
 	}
 }
 
@@ -70,42 +108,92 @@ func (p *PMU) dial() (err error) {
 			err = fmt.Errorf("[%s] panic: %v", p.nickname, r)
 		}
 	}()
-	p.ctx, p.ctxcancel = context.WithCancel(context.Background())
-	addr, err := net.ResolveTCPAddr("tcp", p.address)
-	if err != nil {
-		return err
-	}
-	conn, err := net.DialTCP("tcp", nil, addr)
+	p.ctx, p.ctxcancel = context.WithCancel(p.parent)
+	defer p.ctxcancel()
+	sources, closer, err := p.connect()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("[%s] dial succeeded\n", p.nickname)
+	defer closer()
+	fmt.Printf("[%s] connection established (%s)\n", p.nickname, p.transport.Mode)
+	p.status.Connected()
 
-	p.conn = conn
-	p.br = bufio.NewReader(p.conn)
+	//The device may have been upgraded or replaced while we were
+	//disconnected, so ask for CFG-3 again and discard partial frames
+	p.cfg3fallback = false
+	p.cfg3asm = make(map[uint16]*Config3Assembler)
 	p.initialConfigure()
-	return p.process()
+	return p.process(sources)
 }
 
-func (p *PMU) process() error {
+type rawFrame struct {
+	ch   *CommonHeader
+	rest []byte
+}
+
+//process reads frames from all of the sources (there is more than one
+//when config and data arrive on different channels) and handles them one
+//at a time
+func (p *PMU) process(sources []*bufio.Reader) error {
+	rawc := make(chan rawFrame, 100)
+	errc := make(chan error, len(sources))
+	for _, src := range sources {
+		go func(r *bufio.Reader) {
+			for {
+				ch, rest, err := p.readRawFrame(r)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if ch == nil {
+					continue
+				}
+				select {
+				case rawc <- rawFrame{ch: ch, rest: rest}:
+				case <-p.ctx.Done():
+					return
+				}
+			}
+		}(src)
+	}
 	for {
-		ch, framez, err := p.readFrame()
-		if err != nil {
+		var rf rawFrame
+		select {
+		case err := <-errc:
 			fmt.Printf("[%s] frame read error: %v\n", p.nickname, err)
-			p.conn.Close()
+			return err
+		case rf = <-rawc:
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		ch := rf.ch
+		framez, err := p.decodeFrame(ch, rf.rest)
+		if err != nil {
+			fmt.Printf("[%s] frame decode error: %v\n", p.nickname, err)
 			return err
 		}
-		_ = ch
 		for _, frame := range framez {
 			cfg, ok := frame.(*Config12Frame)
 			if ok {
 				p.cfgmu.Lock()
-				p.cfgs[ch.IDCODE] = cfg
+				existing := p.cfgs[ch.IDCODE]
+				replace := replacesConfig(existing, cfg)
+				if replace {
+					p.cfgs[ch.IDCODE] = cfg
+				}
 				p.cfgmu.Unlock()
+				if replace && existing != nil && existing.CFGTYPE == SYNC_TYPE_CFG3 && cfg.CFGTYPE != SYNC_TYPE_CFG3 {
+					//The configuration changed, get the CFG-3 version of it
+					p.sendCommand(CMD_SEND_CFG3)
+				}
 				p.sendStartCommand()
 			}
 			dat, ok := frame.(*DataFrame)
 			if ok {
+				//Points are counted as received here rather than when they
+				//are inserted, so that a stalled BTrDB shows as a backlog
+				p.metrics.Received(dat.MeasurementCount())
+				p.status.Data(dat.MeasurementCount())
 				p.outputmu.RLock()
 				ochan, ok := p.output[dat.IDCODE]
 				p.outputmu.RUnlock()
@@ -119,12 +207,30 @@ func (p *PMU) process() error {
 				case ochan <- dat:
 				default:
 					fmt.Printf("[%s] WARNING QUEUE OVERFLOW. DROPPING DATA FROM %d\n", p.nickname, dat.IDCODE)
+					p.metrics.Dropped(dat.MeasurementCount())
 				}
 			}
 		}
 	}
 }
 
+//Stopped is closed once the PMU has disconnected for good, no more data
+//is queued after that
+func (p *PMU) Stopped() <-chan struct{} {
+	return p.stopped
+}
+
+//queueDepth is the number of data frames waiting to be inserted
+func (p *PMU) queueDepth() float64 {
+	p.outputmu.RLock()
+	defer p.outputmu.RUnlock()
+	total := 0
+	for _, ch := range p.output {
+		total += len(ch)
+	}
+	return float64(total)
+}
+
 func (p *PMU) GetBatch() (map[uint16][]*DataFrame, bool) {
 	fulldrain := true
 	chanz := make(map[uint16]chan *DataFrame)
@@ -155,49 +261,57 @@ func (p *PMU) GetBatch() (map[uint16][]*DataFrame, bool) {
 	return rv, fulldrain
 }
 
-func (p *PMU) initialConfigure() {
-	{
-		c := &CommandFrame{}
-		c.IDCODE = p.id
-		c.SetSOCToNow()
-		c.FRACSEC = 0
-		c.SetSyncType(SYNC_TYPE_CMD)
-		c.FRAMESIZE = CommonHeaderLength + 4
-		c.CMD = uint16(CMD_SEND_CFG2)
-		err := WriteChecksummedFrame(c, p.conn)
-		if err != nil {
-			panic(err)
-		}
+//replacesConfig returns true if cfg should be used instead of the existing
+//configuration. Some devices send unsolicited CFG-2 frames, these must not
+//replace the richer CFG-3 configuration unless the configuration has
+//changed since, in which case the CFG-3 frame no longer describes the data
+func replacesConfig(existing *Config12Frame, cfg *Config12Frame) bool {
+	if existing == nil || existing.CFGTYPE != SYNC_TYPE_CFG3 || cfg.CFGTYPE == SYNC_TYPE_CFG3 {
+		return true
 	}
-	{
-		c := &CommandFrame{}
-		c.IDCODE = p.id
-		c.SetSOCToNow()
-		c.FRACSEC = 0
-		c.SetSyncType(SYNC_TYPE_CMD)
-		c.FRAMESIZE = CommonHeaderLength + 4
-		c.CMD = uint16(CMD_TURN_ON_TX)
-		err := WriteChecksummedFrame(c, p.conn)
-		if err != nil {
-			panic(err)
+	if len(existing.Entries) != len(cfg.Entries) {
+		return true
+	}
+	for i, e := range existing.Entries {
+		if e.IDCODE != cfg.Entries[i].IDCODE || e.CFGCNT != cfg.Entries[i].CFGCNT {
+			return true
 		}
 	}
+	return false
+}
+
+func (p *PMU) initialConfigure() {
+	if p.preferCFG3 && !p.cfg3fallback {
+		p.cfg3requested = time.Now()
+		p.sendCommand(CMD_SEND_CFG3)
+	} else {
+		p.sendCommand(CMD_SEND_CFG2)
+	}
+	p.sendCommand(CMD_TURN_ON_TX)
 	fmt.Printf("[%s] completed initial configuration commands\n", p.nickname)
 }
 
-func (p *PMU) sendStartCommand() {
+func (p *PMU) sendCommand(cmd CMD_WORD) {
+	if p.cmd == nil {
+		return
+	}
 	c := &CommandFrame{}
 	c.IDCODE = p.id
 	c.SetSOCToNow()
+	c.FRACSEC = 0
 	c.SetSyncType(SYNC_TYPE_CMD)
 	c.FRAMESIZE = CommonHeaderLength + 4
-	c.CMD = uint16(CMD_TURN_ON_TX)
-	err := WriteChecksummedFrame(c, p.conn)
+	c.CMD = uint16(cmd)
+	err := WriteChecksummedFrame(c, p.cmd)
 	if err != nil {
 		panic(err)
 	}
 }
 
+func (p *PMU) sendStartCommand() {
+	p.sendCommand(CMD_TURN_ON_TX)
+}
+
 func (p *PMU) ConfigFor(idcode uint16) (*Config12Frame, error) {
 	p.cfgmu.Lock()
 	cfg, ok := p.cfgs[idcode]
@@ -207,8 +321,9 @@ func (p *PMU) ConfigFor(idcode uint16) (*Config12Frame, error) {
 	}
 	return cfg, nil
 }
-func (p *PMU) readFrame() (*CommonHeader, []Frame, error) {
-	r := p.br
+//readRawFrame reads the next frame from r and verifies its checksum. It
+//returns a nil header for frames that should be ignored
+func (p *PMU) readRawFrame(r *bufio.Reader) (*CommonHeader, []byte, error) {
 	initialByte, err := r.ReadByte()
 	if err != nil {
 		return nil, nil, err
@@ -217,6 +332,9 @@ func (p *PMU) readFrame() (*CommonHeader, []Frame, error) {
 	for initialByte != 0xAA {
 		skipped++
 		initialByte, err = r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	if skipped != 0 {
 		fmt.Printf("[%s] SYNC LOSS DETECTED, SKIPPED %d BYTES RESYNCING\n", p.nickname, skipped)
@@ -237,6 +355,11 @@ func (p *PMU) readFrame() (*CommonHeader, []Frame, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if int(ch.FRAMESIZE) < CommonHeaderLength+2 {
+		fmt.Printf("[%s] SYNC LOSS DETECTED, INVALID FRAME SIZE %d\n", p.nickname, ch.FRAMESIZE)
+		p.metrics.Rejected(1)
+		return nil, nil, nil
+	}
 
 	rest := make([]byte, int(ch.FRAMESIZE)-CommonHeaderLength)
 	_, err = io.ReadFull(r, rest)
@@ -250,50 +373,93 @@ func (p *PMU) readFrame() (*CommonHeader, []Frame, error) {
 	if expectedchk != int(realchk) {
 		fmt.Printf("[%s] frame checksum failure type=%d, got=%x expected=%x\n", p.nickname, ch.SyncType(), realchk, expectedchk)
 		//the spec says silently ignore frames with bad checksums
-		return ch, nil, nil
+		p.metrics.Rejected(1)
+		return nil, nil, nil
 	}
+	return ch, rest, nil
+}
+
+//decodeFrame decodes a frame read by readRawFrame. rest is the frame
+//following the common header, including the checksum
+func (p *PMU) decodeFrame(ch *CommonHeader, rest []byte) ([]Frame, error) {
 	if ch.SyncType() == SYNC_TYPE_CFG2 {
 		cfg2, err := ReadConfig12Frame(ch, bytes.NewBuffer(rest))
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		return ch, []Frame{cfg2}, nil
+		return []Frame{cfg2}, nil
 	}
 	if ch.SyncType() == SYNC_TYPE_DATA {
 		cfg, _ := p.ConfigFor(ch.IDCODE)
 		if cfg == nil {
 			fmt.Printf("[%s] dropping data frame: no config\n", p.nickname)
-			return ch, nil, nil
+			p.metrics.Rejected(1)
+			if p.preferCFG3 && !p.cfg3fallback && time.Since(p.cfg3requested) > CFG3Timeout {
+				//The device is sending data but has not answered our request
+				//for CFG-3 in time, so it probably does not support it. Data
+				//frames normally arrive while a multi-frame CFG-3 is still
+				//being sent, so we do not give up on the first one.
+				fmt.Printf("[%s] no CFG-3 received, falling back to CFG-2\n", p.nickname)
+				p.cfg3fallback = true
+				p.sendCommand(CMD_SEND_CFG2)
+			}
+			return nil, nil
 		}
 		dat, err := ReadDataFrame(ch, cfg, bytes.NewBuffer(rest))
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		if p.packedUGAChannels {
 			datz, err := p.unpackUGAChannels(dat)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
 			rv := []Frame{}
 			for _, e := range datz {
 				rv = append(rv, e)
 			}
-			return ch, rv, nil
+			return rv, nil
 		}
-		return ch, []Frame{dat}, nil
+		return []Frame{dat}, nil
 	}
 	if ch.SyncType() == SYNC_TYPE_CFG1 {
 		cfg1, err := ReadConfig12Frame(ch, bytes.NewBuffer(rest))
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		return ch, []Frame{cfg1}, nil
+		return []Frame{cfg1}, nil
 	}
 	if ch.SyncType() == SYNC_TYPE_CFG3 {
-		fmt.Printf("[%s] WARN got CFG3 which is not supported\n", p.nickname)
-		return ch, nil, nil
+		asm, ok := p.cfg3asm[ch.IDCODE]
+		if !ok {
+			asm = &Config3Assembler{}
+			p.cfg3asm[ch.IDCODE] = asm
+		}
+		payload, err := asm.Add(rest[:len(rest)-2])
+		if err != nil {
+			//A lost continuation frame is not fatal, the device will send
+			//the configuration again if we ask for it
+			fmt.Printf("[%s] WARN discarding CFG-3: %v\n", p.nickname, err)
+			if !p.cfg3fallback {
+				p.cfg3requested = time.Now()
+				p.sendCommand(CMD_SEND_CFG3)
+			}
+			return nil, nil
+		}
+		if payload == nil {
+			return nil, nil
+		}
+		cfg3, err := ReadConfig3Frame(payload)
+		if err != nil {
+			return nil, err
+		}
+		return []Frame{cfg3}, nil
+	}
+	if ch.SyncType() == SYNC_TYPE_HEADER {
+		//Header frames are free text, we have no use for them
+		return nil, nil
 	}
-	return ch, nil, fmt.Errorf("Unknown frame type")
+	return nil, fmt.Errorf("Unknown frame type")
 }
 
 //This function is specifically for UGA devices that break the standard
@@ -336,6 +502,7 @@ func (p *PMU) unpackUGAChannels(src *DataFrame) ([]*DataFrame, error) {
 		rv[0].UTCUnixNanos = src.UTCUnixNanos
 		dt.IDCODE = pmu.IDCODE
 		dt.STN = pmu.STN
+		dt.Config = pmu.Config
 		dt.STAT = pmu.STAT
 		dt.FREQ = pmu.FREQ
 		dt.DFREQ = pmu.DFREQ
@@ -367,6 +534,7 @@ func (p *PMU) unpackUGAChannels(src *DataFrame) ([]*DataFrame, error) {
 			df.UTCUnixNanos = src.UTCUnixNanos + int64((other+1)*sampleOffsetNanos)
 			dt.IDCODE = pmu.IDCODE
 			dt.STN = pmu.STN
+			dt.Config = pmu.Config
 			dt.STAT = pmu.STAT
 			dt.FREQ = pmu.FREQ
 			dt.DFREQ = pmu.DFREQ
@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//StatCondition is a single boolean condition decoded from the STAT word
+//or the time quality flags (the top byte of FRACSEC), as defined in
+//IEEE C37.118.2-2011. Each condition is written to its own stream, and
+//can be given its own gating policy.
+type StatCondition struct {
+	//Used as the policy key in the device metadata, e.g. quality.sync_lost
+	Name string
+	//The name of the stream the decoded condition is written to
+	Stream string
+	//Which bits the condition is decoded from, for the annotations
+	Bits    string
+	Meaning string
+	Test    func(stat uint16, tq uint8) bool
+}
+
+//StatCode is a multi-bit field decoded from STAT or the time quality flags
+type StatCode struct {
+	Stream  string
+	Bits    string
+	Meaning string
+	Codes   string
+	Extract func(stat uint16, tq uint8) int
+}
+
+var StatConditions = []StatCondition{
+	{"data_error", "STAT_DATA_ERROR", "STAT[15:14]=11",
+		"PMU error, do not use values",
+		func(stat uint16, tq uint8) bool { return stat>>14 == 3 }},
+	{"pmu_error", "STAT_PMU_ERROR", "STAT[15:14]=01",
+		"PMU error, no information about data",
+		func(stat uint16, tq uint8) bool { return stat>>14 == 1 }},
+	{"test_mode", "STAT_TEST_MODE", "STAT[15:14]=10",
+		"PMU in test mode or absent data tags have been inserted",
+		func(stat uint16, tq uint8) bool { return stat>>14 == 2 }},
+	{"sync_lost", "STAT_SYNC_LOST", "STAT[13]",
+		"PMU is not synchronized to a time source",
+		func(stat uint16, tq uint8) bool { return stat&(1<<13) != 0 }},
+	{"sorting", "STAT_SORT_BY_ARRIVAL", "STAT[12]",
+		"Data is sorted by arrival rather than by timestamp",
+		func(stat uint16, tq uint8) bool { return stat&(1<<12) != 0 }},
+	{"trigger", "STAT_TRIGGER", "STAT[11]",
+		"PMU trigger detected",
+		func(stat uint16, tq uint8) bool { return stat&(1<<11) != 0 }},
+	{"config_change", "STAT_CONFIG_CHANGE", "STAT[10]",
+		"Configuration will change within the next minute",
+		func(stat uint16, tq uint8) bool { return stat&(1<<10) != 0 }},
+	{"data_modified", "STAT_DATA_MODIFIED", "STAT[9]",
+		"Data has been modified by a post processing device",
+		func(stat uint16, tq uint8) bool { return stat&(1<<9) != 0 }},
+	{"unlocked_time", "STAT_UNLOCKED", "STAT[5:4]!=00",
+		"PMU has been unlocked from its time source for 10 seconds or more",
+		func(stat uint16, tq uint8) bool { return (stat>>4)&3 != 0 }},
+	{"clock_failure", "TQ_CLOCK_FAILURE", "TQ[3:0]=1111",
+		"Clock failure, time is not reliable",
+		func(stat uint16, tq uint8) bool { return tq&0xF == 0xF }},
+	{"leap_second", "TQ_LEAP_SECOND_PENDING", "TQ[4]",
+		"A leap second is pending",
+		func(stat uint16, tq uint8) bool { return tq&(1<<4) != 0 }},
+	{"leap_second_occurred", "TQ_LEAP_SECOND_OCCURRED", "TQ[5]",
+		"A leap second has occurred",
+		func(stat uint16, tq uint8) bool { return tq&(1<<5) != 0 }},
+}
+
+var StatCodes = []StatCode{
+	{"STAT_UNLOCKED_TIME", "STAT[5:4]",
+		"How long the PMU has been unlocked from its time source",
+		"0=locked or <10s, 1=<100s, 2=<1000s, 3=>1000s",
+		func(stat uint16, tq uint8) int { return int(stat>>4) & 3 }},
+	{"STAT_PMU_TIME_QUALITY", "STAT[8:6]",
+		"Maximum time error of the PMU",
+		"0=not used, 1=<100ns, 2=<1us, 3=<10us, 4=<100us, 5=<1ms, 6=<10ms, 7=>10ms or unknown",
+		func(stat uint16, tq uint8) int { return int(stat>>6) & 7 }},
+	{"STAT_TRIGGER_REASON", "STAT[3:0]",
+		"Reason for the PMU trigger, only valid while STAT_TRIGGER is set",
+		"0=manual, 1=magnitude low, 2=magnitude high, 3=phase angle diff, 4=frequency high or low, 5=df/dt high, 7=digital, 8-15=user defined",
+		func(stat uint16, tq uint8) int { return int(stat) & 0xF }},
+	{"TQ_TIME_QUALITY", "TQ[3:0]",
+		"Message time quality",
+		"0=locked to UTC, 1=<1ns, 2=<10ns, 3=<100ns, 4=<1us, 5=<10us, 6=<100us, 7=<1ms, 8=<10ms, 9=<100ms, 10=<1s, 11=<10s, 15=clock failure",
+		func(stat uint16, tq uint8) int { return int(tq) & 0xF }},
+}
+
+type QualityAction int
+
+const (
+	//Keep the sample, the condition is only recorded in its STAT stream
+	QualityKeep QualityAction = iota
+	//Keep the sample but mark it in the QUALITY_FLAGGED stream
+	QualityFlag
+	//Drop the measurements in the sample, the STAT streams are still written
+	QualityDrop
+)
+
+func (a QualityAction) String() string {
+	switch a {
+	case QualityKeep:
+		return "keep"
+	case QualityFlag:
+		return "flag"
+	case QualityDrop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+func ParseQualityAction(s string) (QualityAction, error) {
+	switch strings.ToLower(s) {
+	case "keep":
+		return QualityKeep, nil
+	case "flag":
+		return QualityFlag, nil
+	case "drop":
+		return QualityDrop, nil
+	}
+	return QualityKeep, fmt.Errorf("invalid quality action %q, must be keep, flag or drop", s)
+}
+
+//QualityPolicy maps the name of a StatCondition to the action taken when
+//the condition is present
+type QualityPolicy map[string]QualityAction
+
+//The default matches the historical behavior, which dropped any sample
+//with STAT bit 15 set
+func DefaultQualityPolicy() QualityPolicy {
+	return QualityPolicy{
+		"data_error": QualityDrop,
+		"test_mode":  QualityDrop,
+	}
+}
+
+//Evaluate returns whether the measurements in a sample should be dropped,
+//and whether a kept sample should be flagged
+func (qp QualityPolicy) Evaluate(stat uint16, tq uint8) (drop bool, flag bool) {
+	for _, c := range StatConditions {
+		act := qp[c.Name]
+		if act == QualityKeep || !c.Test(stat, tq) {
+			continue
+		}
+		if act == QualityDrop {
+			return true, false
+		}
+		flag = true
+	}
+	return false, flag
+}
+
+//HasFlags returns true if any condition is set to QualityFlag, in which
+//case the QUALITY_FLAGGED stream is written
+func (qp QualityPolicy) HasFlags() bool {
+	for _, act := range qp {
+		if act == QualityFlag {
+			return true
+		}
+	}
+	return false
+}
+
+//Annotations returns the annotations describing a condition's stream
+func (qp QualityPolicy) Annotations(c *StatCondition) map[string]string {
+	return map[string]string{
+		"meaning": c.Meaning,
+		"bits":    c.Bits,
+		"policy":  qp[c.Name].String(),
+	}
+}
+
+func (qp QualityPolicy) FlaggedAnnotations() map[string]string {
+	flagged := []string{}
+	for _, c := range StatConditions {
+		if qp[c.Name] == QualityFlag {
+			flagged = append(flagged, c.Name)
+		}
+	}
+	return map[string]string{
+		"meaning":    "Sample was kept but one of the flagged conditions was present",
+		"conditions": strings.Join(flagged, ","),
+	}
+}
+
+func lookupStatCondition(name string) *StatCondition {
+	for idx := range StatConditions {
+		if StatConditions[idx].Name == name {
+			return &StatConditions[idx]
+		}
+	}
+	return nil
+}
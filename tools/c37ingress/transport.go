@@ -0,0 +1,236 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type TransportMode int
+
+const (
+	//We dial the PDC over TCP and exchange commands, config and data on
+	//that connection
+	TransportTCP TransportMode = iota
+	//Data (and config) arrive as UDP datagrams, unicast or multicast.
+	//Commands are sent by UDP if a PDC address is given, otherwise the
+	//device must be configured to transmit spontaneously
+	TransportUDP
+	//We dial the PDC over TCP for commands and config, and data arrives
+	//over UDP
+	TransportTCPUDP
+	//The device dials us over TCP, after which it behaves like TransportTCP
+	TransportListen
+)
+
+func (m TransportMode) String() string {
+	switch m {
+	case TransportTCP:
+		return "tcp"
+	case TransportUDP:
+		return "udp"
+	case TransportTCPUDP:
+		return "tcp+udp"
+	case TransportListen:
+		return "listen"
+	}
+	return "unknown"
+}
+
+//If no UDP data arrives in this time, we assume the link is down and
+//reconnect. Spontaneous devices send config at least once a minute
+const UDPReadTimeout = 2 * time.Minute
+
+//Transport describes how to communicate with a device. It is parsed from
+//the HOST:PORT portion of the manifest descriptor, which may be one of
+//
+//  host:port or tcp://host:port
+//  udp://bindaddr:port[?pdc=host:port][&iface=eth0]
+//  tcp+udp://host:port?udp=bindaddr:port[&iface=eth0]
+//  listen://bindaddr:port
+//
+//For udp modes, if bindaddr is a multicast group the group is joined on
+//the given interface (or the system default)
+type Transport struct {
+	Mode TransportMode
+	//The address we dial (tcp, tcp+udp) or send UDP commands to (udp)
+	Remote string
+	//The address we listen on for UDP data or TCP connections
+	Local string
+	//The interface used to join a multicast group
+	Interface string
+	raw       string
+}
+
+func (t *Transport) String() string {
+	return t.raw
+}
+
+func ParseTransport(target string) (*Transport, error) {
+	rv := &Transport{raw: target}
+	if !strings.Contains(target, "://") {
+		rv.Mode = TransportTCP
+		rv.Remote = target
+		return rv, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing address in %q", target)
+	}
+	q := u.Query()
+	rv.Interface = q.Get("iface")
+	switch u.Scheme {
+	case "tcp":
+		rv.Mode = TransportTCP
+		rv.Remote = u.Host
+	case "udp":
+		rv.Mode = TransportUDP
+		rv.Local = u.Host
+		rv.Remote = q.Get("pdc")
+	case "tcp+udp":
+		rv.Mode = TransportTCPUDP
+		rv.Remote = u.Host
+		rv.Local = q.Get("udp")
+		if rv.Local == "" {
+			return nil, fmt.Errorf("tcp+udp transport requires a udp=bindaddr:port parameter")
+		}
+	case "listen":
+		rv.Mode = TransportListen
+		rv.Local = u.Host
+	default:
+		return nil, fmt.Errorf("unknown transport %q", u.Scheme)
+	}
+	return rv, nil
+}
+
+//connect establishes the channels to the device according to the
+//transport. It sets p.cmd and returns the readers that frames will arrive
+//on, and a function that closes everything
+func (p *PMU) connect() ([]*bufio.Reader, func(), error) {
+	t := p.transport
+	closers := []io.Closer{}
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	sources := []*bufio.Reader{}
+	p.cmd = nil
+	if t.Mode == TransportTCP || t.Mode == TransportTCPUDP {
+		addr, err := net.ResolveTCPAddr("tcp", t.Remote)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Printf("[%s] dial succeeded\n", p.nickname)
+		closers = append(closers, conn)
+		p.cmd = conn
+		sources = append(sources, bufio.NewReader(conn))
+	}
+	if t.Mode == TransportListen {
+		l, err := net.Listen("tcp", t.Local)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Printf("[%s] waiting for device to connect on %s\n", p.nickname, t.Local)
+		//Unblock Accept if we are told to stop
+		go func() {
+			<-p.ctx.Done()
+			l.Close()
+		}()
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Printf("[%s] accepted connection from %s\n", p.nickname, conn.RemoteAddr())
+		closers = append(closers, conn)
+		p.cmd = conn
+		sources = append(sources, bufio.NewReader(conn))
+	}
+	if t.Mode == TransportUDP || t.Mode == TransportTCPUDP {
+		conn, err := listenUDP(t.Local, t.Interface)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, conn)
+		if t.Mode == TransportUDP && t.Remote != "" {
+			raddr, err := net.ResolveUDPAddr("udp", t.Remote)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			p.cmd = &udpCommandWriter{conn: conn, addr: raddr}
+		}
+		sources = append(sources, bufio.NewReaderSize(&datagramReader{conn: conn, buf: make([]byte, 65536)}, 65536))
+	}
+	return sources, closeAll, nil
+}
+
+func listenUDP(local string, iface string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	if laddr.IP != nil && laddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if iface != "" {
+			ifi, err = net.InterfaceByName(iface)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return net.ListenMulticastUDP("udp", ifi, laddr)
+	}
+	return net.ListenUDP("udp", laddr)
+}
+
+//udpCommandWriter sends each command frame as a datagram to the PDC
+type udpCommandWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (w *udpCommandWriter) Write(b []byte) (int, error) {
+	return w.conn.WriteToUDP(b, w.addr)
+}
+
+//datagramReader presents a sequence of datagrams as a stream so that the
+//same frame reader can be used for TCP and UDP. Unlike reading the UDP
+//socket directly, a datagram is never truncated by a short read buffer
+type datagramReader struct {
+	conn    *net.UDPConn
+	buf     []byte
+	pending []byte
+}
+
+func (d *datagramReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		d.conn.SetReadDeadline(time.Now().Add(UDPReadTimeout))
+		n, _, err := d.conn.ReadFromUDP(d.buf)
+		if err != nil {
+			return 0, err
+		}
+		d.pending = d.buf[:n]
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
@@ -8,19 +8,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
-	btrdb "gopkg.in/BTrDB/btrdb.v4"
+	"github.com/BTrDB/smartgridstore/tools/manifest"
 )
 
 //Driver definition
 type FNETAscii struct {
 	inserter *gen2ingress.Inserter
-	prefix   string
 }
 
 func (fn *FNETAscii) DIDPrefix() string {
@@ -33,138 +35,119 @@ func (fn *FNETAscii) SetConn(in *gen2ingress.Inserter) {
 	fn.inserter = in
 }
 
-func (fn *FNETAscii) HandleDevice(descriptor string) {
-	//Format: fnet.ascii.client/collection/prefix@ip:port
-Note this wont work for multiple devices. fn cannot have state as a multi-device driver
+func (fn *FNETAscii) HandleDevice(ctx context.Context, descriptor string) error {
+	//Format: fnet.ascii.client/collection/prefix@ip:port[?rate=10]
 	suffix := strings.TrimPrefix(descriptor, fn.DIDPrefix())
-	parts := strings.Split(suffix, "@")
-	//Remove starting slash
-	prefix := strings.TrimPrefix(parts[0], "/")
-	fn.prefix = prefix
-	target := parts[1]
-	gen2ingress.DialLoop(target, fn.processDevice)
-}
-
-func (fn *FNETAscii) processDevice(conn *net.TCPConn, r *bufio.Reader) error {
-	sync := func() error {
-		for {
-			pa, err := r.Peek(1)
-			if err != nil {
-				return err
-			}
-			if pa[0] == 0x01 {
-				return nil
-			}
-			_, err = r.ReadByte()
-			if err != nil {
-				return err
+	parts := strings.SplitN(suffix, "@", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("descriptor is malformed")
+	}
+	collection := strings.TrimPrefix(parts[0], "/")
+	collection = strings.TrimSuffix(collection, "/")
+	if len(collection) == 0 {
+		return fmt.Errorf("device missing collection")
+	}
+	afterAtParts := strings.SplitN(parts[1], "?", 2)
+	target := afterAtParts[0]
+	_, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("host:port is malformed")
+	}
+	rate := DefaultFrameRate
+	if len(afterAtParts) == 2 {
+		params, err := url.ParseQuery(afterAtParts[1])
+		if err != nil {
+			return fmt.Errorf("descriptor parameters are malformed")
+		}
+		if r := params.Get("rate"); r != "" {
+			rate, err = strconv.Atoi(r)
+			if err != nil || rate <= 0 {
+				return fmt.Errorf("rate must be a positive integer")
 			}
 		}
 	}
 
+	//All per-device state lives in the device, the driver is shared
+	device := &FNETDevice{
+		descriptor: descriptor,
+		inserter:   fn.inserter,
+		collection: collection,
+		rate:       rate,
+	}
+	gen2ingress.DialLoop(ctx, target, descriptor, device.process)
+	return nil
+}
+
+type FNETDevice struct {
+	descriptor string
+	inserter   *gen2ingress.Inserter
+	collection string
+	rate       int
+}
+
+func (d *FNETDevice) process(ctx context.Context, conn *net.TCPConn, r *bufio.Reader) error {
+	shortform := manifest.GetDescriptorShortForm(d.descriptor)
+	hb := gen2ingress.Status(d.descriptor)
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	lastBadFrameNotification := time.Time{}
+	accumulatedBadFrames := 0
+	annotated := make(map[string]bool)
+	lastUnit := -1
 	for {
-		sync()
-		frame, err := r.ReadString(0)
+		raw, err := ReadFrame(r)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
-		if frame[54] != 0x00 {
-			fmt.Printf("skipping bad frame\n")
-			continue
+		frame, err := ParseFrame(raw)
+		var records []gen2ingress.InsertRecord
+		if err == nil {
+			records, err = frame.Records(d.collection, d.rate)
 		}
-
-		var fUnitID int
-		var fDateMonth int
-		var fDateDay int
-		var fDateYear int
-		var fTimeHour int
-		var fTimeMinute int
-		var fTimeSecond int
-		var fConvNum int
-		var fFirstFreq float64
-		var fFinalFreq float64
-		var fVoltage float64
-		var fAngle float64
-
-		//Extract the fields
-		nscanned, err := fmt.Sscanf(string(frame[1:54]),
-			"%3d %2d%2d%2d %2d%2d%2d %2d %f %f %f %f",
-			&fUnitID, &fDateMonth, &fDateDay, &fDateYear,
-			&fTimeHour, &fTimeMinute, &fTimeSecond,
-			&fConvNum, &fFirstFreq, &fFinalFreq,
-			&fVoltage, &fAngle)
-		if nscanned != 12 || err != nil {
-			fmt.Printf("skipping bad frame\n")
-			continue
-		}
-		//Mon Jan 2 15:04:05 MST 2006
-		//RFC3339     = "2006-01-02T15:04:05Z07:00"
-		ts, err := time.Parse("06-01-02 15-04-05", fmt.Sprintf("%02d-%02d-%02d %02d-%02d-%02d",
-			fDateYear, fDateMonth, fDateDay, fTimeHour, fTimeMinute, fTimeSecond))
 		if err != nil {
-			fmt.Printf("skipping bad frame: bad timestamp\n")
+			accumulatedBadFrames++
+			if time.Since(lastBadFrameNotification) > 30*time.Second {
+				fmt.Printf("[%s] skipping bad frame: %v (repeated %d times)\n", shortform, err, accumulatedBadFrames)
+				hb.Error(err)
+				lastBadFrameNotification = time.Now()
+				accumulatedBadFrames = 0
+			}
 			continue
 		}
-		//TODO add subsecond part to timestamp
-		tsnano := ts.UnixNano()
-		dat := []gen2ingress.InsertRecord{}
-		dat = append(dat, &gen2ingress.StructInsertRecord{
-			FData:       []btrdb.RawPoint{{Time: tsnano, Value: fVoltage}},
-			FName:       "Voltage",
-			FCollection: fn.prefix,
-			FUnit:       "Volts",
-		})
-		dat = append(dat, &gen2ingress.StructInsertRecord{
-			FData:       []btrdb.RawPoint{{Time: tsnano, Value: fAngle}},
-			FName:       "Angle",
-			FCollection: fn.prefix,
-			FUnit:       "Radians",
-		})
-		dat = append(dat, &gen2ingress.StructInsertRecord{
-			FData:       []btrdb.RawPoint{{Time: tsnano, Value: fFinalFreq}},
-			FName:       "FinalFreq",
-			FCollection: fn.prefix,
-			FUnit:       "Hz",
-		})
-		//First freq is an overloaded field
-		doffreq := !(fTimeSecond == 0 && fConvNum <= 2)
-		if fTimeSecond == 0 {
-			if fConvNum == 0 {
-				//Latitutde
-				dat = append(dat, &gen2ingress.StructInsertRecord{
-					FData:       []btrdb.RawPoint{{Time: tsnano, Value: fFirstFreq}},
-					FName:       "Latitude",
-					FCollection: fn.prefix,
-					FUnit:       "Degrees",
-				})
-			}
-			if fConvNum == 1 {
-				//Longitude
-				dat = append(dat, &gen2ingress.StructInsertRecord{
-					FData:       []btrdb.RawPoint{{Time: tsnano, Value: fFirstFreq}},
-					FName:       "Longitude",
-					FCollection: fn.prefix,
-					FUnit:       "Degrees",
-				})
+		if frame.UnitID != lastUnit {
+			if lastUnit != -1 {
+				fmt.Printf("[%s] unit id changed from %d to %d\n", shortform, lastUnit, frame.UnitID)
 			}
-			if fConvNum == 2 {
-				//Satellite count
-				dat = append(dat, &gen2ingress.StructInsertRecord{
-					FData:       []btrdb.RawPoint{{Time: tsnano, Value: fFirstFreq}},
-					FName:       "Satellites",
-					FCollection: fn.prefix,
-					FUnit:       "Count",
-				})
+			lastUnit = frame.UnitID
+			annotated = make(map[string]bool)
+		}
+		for i := range records {
+			records[i].Descriptor = d.descriptor
+			if !annotated[records[i].Name] {
+				records[i].AnnotationChanges = map[string]string{
+					"unitid": strconv.Itoa(frame.UnitID),
+					"rate":   strconv.Itoa(d.rate),
+				}
+				annotated[records[i].Name] = true
 			}
 		}
-		if doffreq {
-			dat = append(dat, &gen2ingress.StructInsertRecord{
-				FData:       []btrdb.RawPoint{{Time: tsnano, Value: fFirstFreq}},
-				FName:       "FirstFreq",
-				FCollection: fn.prefix,
-				FUnit:       "Hz",
-			})
+		d.inserter.ProcessBatch(records)
+		points := 0
+		for _, ir := range records {
+			points += len(ir.Data)
 		}
-		fn.inserter.ProcessBatch(dat)
+		hb.Data(points)
 	}
 }
+
+func main() {
+	gen2ingress.Gen2Ingress(&FNETAscii{})
+	fmt.Printf("this should not have happened :/\n")
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+)
+
+//TestEndToEnd feeds the driver over TCP and checks what lands in the sink
+func TestEndToEnd(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("noise\x01 692 052110 142259  9 60.0043 60.0043 120.7570 2.1863\x00"))
+		c.Write([]byte("\x01 692 052110 142300  0 35.9300 60.0044 120.7571 2.1864\x00"))
+		c.Write([]byte("\x01 692 052110 142300  1 bad 60.0045 120.7572 2.1865\x00"))
+		c.Write([]byte("\x01 692 052110 142300  2 11.0000 60.0046 120.7573 2.1866\x00"))
+		time.Sleep(10 * time.Second)
+	}()
+
+	sink := gen2ingress.NewMemorySink()
+	ins, err := gen2ingress.NewInserter(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &FNETDevice{
+		descriptor: "fnet.ascii.client/test/fdr@" + ln.Addr().String(),
+		inserter:   ins,
+		collection: "test/fdr",
+		rate:       DefaultFrameRate,
+	}
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.process(ctx, conn, bufio.NewReader(conn))
+	}()
+
+	expected := map[string]int{"Voltage": 3, "Angle": 3, "FinalFreq": 3, "FirstFreq": 1, "Latitude": 1, "Satellites": 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ok := true
+		for name, n := range expected {
+			s := sink.Stream("test/fdr", name)
+			if s == nil || len(s.Points()) != n {
+				ok = false
+			}
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			for _, s := range sink.Streams() {
+				t.Logf("%s/%s: %v", s.Collection, s.Name, s.Points())
+			}
+			t.Fatalf("timed out waiting for data")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if len(sink.Streams()) != len(expected) {
+		t.Fatalf("expected %d streams, got %d", len(expected), len(sink.Streams()))
+	}
+	lat := sink.Stream("test/fdr", "Latitude")
+	if lat.Unit != "Degrees" || lat.Points()[0].Value != 35.93 {
+		t.Fatalf("unexpected latitude %s %v", lat.Unit, lat.Points())
+	}
+	if lat.Points()[0].Time != time.Date(2010, 5, 21, 14, 23, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("unexpected latitude time %v", lat.Points())
+	}
+	v := sink.Stream("test/fdr", "Voltage")
+	ann := v.Annotations()
+	if ann["unitid"] != "692" || ann["rate"] != "10" {
+		t.Fatalf("unexpected annotations %v", ann)
+	}
+	//The inserter has several workers, so points may arrive out of order
+	first := v.Points()[0]
+	for _, p := range v.Points() {
+		if p.Time < first.Time {
+			first = p
+		}
+	}
+	if first.Time != time.Date(2010, 5, 21, 14, 22, 59, 900000000, time.UTC).UnixNano() {
+		t.Fatalf("unexpected first voltage time %v", first)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//The frame format is described in specs.pdf. A frame is a 0x01, then
+//space delimited ASCII fields, then a 0x00:
+//
+// 0x01 UNIT MMDDYY HHMMSS CONV FIRSTFREQ FINALFREQ VOLTAGE ANGLE 0x00
+//
+//The spec says frames are fixed length (55 bytes) but we split on spaces
+//so that a wider field doesn't throw everything off.
+const frameStart = 0x01
+const frameEnd = 0x00
+
+//Anything longer than this without a terminator is not a frame
+const maxFrameLength = 128
+
+//The FDR sends ten frames a second, and the conversion number is the
+//index of the frame within the second
+const DefaultFrameRate = 10
+
+type Frame struct {
+	UnitID int
+	//Second resolution, the conversion number holds the rest
+	Time      time.Time
+	ConvNum   int
+	FirstFreq float64
+	FinalFreq float64
+	Voltage   float64
+	Angle     float64
+}
+
+//ParseFrame parses a frame, including the start and end bytes
+func ParseFrame(frame []byte) (*Frame, error) {
+	if len(frame) < 2 || frame[0] != frameStart || frame[len(frame)-1] != frameEnd {
+		return nil, fmt.Errorf("frame is not delimited")
+	}
+	fields := strings.Fields(string(frame[1 : len(frame)-1]))
+	if len(fields) != 8 {
+		return nil, fmt.Errorf("expected 8 fields, got %d", len(fields))
+	}
+	f := &Frame{}
+	var err error
+	f.UnitID, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad unit id %q", fields[0])
+	}
+	if len(fields[1]) != 6 || len(fields[2]) != 6 {
+		return nil, fmt.Errorf("bad timestamp %q %q", fields[1], fields[2])
+	}
+	//The date is MMDDYY and the time is HHMMSS UTC
+	f.Time, err = time.Parse("010206 150405", fields[1]+" "+fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp %q %q", fields[1], fields[2])
+	}
+	f.ConvNum, err = strconv.Atoi(fields[3])
+	if err != nil || f.ConvNum < 0 {
+		return nil, fmt.Errorf("bad conversion number %q", fields[3])
+	}
+	vals := []*float64{&f.FirstFreq, &f.FinalFreq, &f.Voltage, &f.Angle}
+	for i, v := range vals {
+		*v, err = strconv.ParseFloat(fields[4+i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value %q", fields[4+i])
+		}
+	}
+	return f, nil
+}
+
+//Timestamp reconstructs the full resolution timestamp in nanoseconds
+func (f *Frame) Timestamp(rate int) (int64, error) {
+	if f.ConvNum >= rate {
+		return 0, fmt.Errorf("conversion number %d is too large for %d frames per second", f.ConvNum, rate)
+	}
+	return f.Time.UnixNano() + int64(f.ConvNum)*int64(time.Second)/int64(rate), nil
+}
+
+//The first frames of every minute carry the location in the FirstFreq
+//field instead of the frequency
+func (f *Frame) firstFreqMeaning() (name string, unit string) {
+	if f.Time.Second() == 0 {
+		switch f.ConvNum {
+		case 0:
+			return "Latitude", "Degrees"
+		case 1:
+			return "Longitude", "Degrees"
+		case 2:
+			return "Satellites", "Count"
+		}
+	}
+	return "FirstFreq", "Hz"
+}
+
+//Records converts the frame into insert records for the given collection
+func (f *Frame) Records(collection string, rate int) ([]gen2ingress.InsertRecord, error) {
+	ts, err := f.Timestamp(rate)
+	if err != nil {
+		return nil, err
+	}
+	rec := func(name string, unit string, value float64) gen2ingress.InsertRecord {
+		return gen2ingress.InsertRecord{
+			Data:       []btrdb.RawPoint{{Time: ts, Value: value}},
+			Name:       name,
+			Collection: collection,
+			Unit:       unit,
+		}
+	}
+	ffname, ffunit := f.firstFreqMeaning()
+	return []gen2ingress.InsertRecord{
+		rec("Voltage", "Volts", f.Voltage),
+		rec("Angle", "Radians", f.Angle),
+		rec("FinalFreq", "Hz", f.FinalFreq),
+		rec(ffname, ffunit, f.FirstFreq),
+	}, nil
+}
+
+//ReadFrame returns the next frame, including the start and end bytes.
+//Anything between frames is skipped.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		//Sync to the start byte
+		for {
+			b, err := r.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] == frameStart {
+				break
+			}
+			r.ReadByte()
+		}
+		frame := []byte{}
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			frame = append(frame, b)
+			if b == frameEnd || len(frame) > maxFrameLength {
+				break
+			}
+		}
+		if frame[len(frame)-1] != frameEnd {
+			//No terminator, resync
+			continue
+		}
+		//If a frame was truncated, the start of the next frame is in here
+		start := bytes.LastIndexByte(frame, frameStart)
+		return frame[start:], nil
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+)
+
+type corpusCase struct {
+	line   int
+	err    bool
+	time   time.Time
+	ffname string
+	rate   int
+	frame  []byte
+}
+
+func loadCorpus(t *testing.T) []corpusCase {
+	dat, err := ioutil.ReadFile("testdata/frames.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := []corpusCase{}
+	for i, line := range strings.Split(string(dat), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "|", 3)
+		if len(parts) != 3 {
+			t.Fatalf("corpus line %d is malformed", i+1)
+		}
+		c := corpusCase{line: i + 1}
+		c.rate, err = strconv.Atoi(parts[1])
+		if err != nil {
+			t.Fatalf("corpus line %d has a bad rate", i+1)
+		}
+		c.frame = append([]byte{frameStart}, parts[2]...)
+		c.frame = append(c.frame, frameEnd)
+		if parts[0] == "err" {
+			c.err = true
+		} else {
+			exp := strings.Fields(parts[0])
+			if len(exp) != 2 {
+				t.Fatalf("corpus line %d has a bad expectation", i+1)
+			}
+			c.time, err = time.Parse(time.RFC3339Nano, exp[0])
+			if err != nil {
+				t.Fatalf("corpus line %d has a bad expected time: %v", i+1, err)
+			}
+			c.ffname = exp[1]
+		}
+		rv = append(rv, c)
+	}
+	return rv
+}
+
+func TestParseCorpus(t *testing.T) {
+	for _, c := range loadCorpus(t) {
+		f, err := ParseFrame(c.frame)
+		var records []gen2ingress.InsertRecord
+		if err == nil {
+			records, err = f.Records("test/fdr", c.rate)
+		}
+		if c.err {
+			if err == nil {
+				t.Errorf("line %d: expected an error", c.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("line %d: unexpected error %v", c.line, err)
+			continue
+		}
+		if len(records) != 4 {
+			t.Errorf("line %d: expected 4 records, got %d", c.line, len(records))
+			continue
+		}
+		for i, name := range []string{"Voltage", "Angle", "FinalFreq", c.ffname} {
+			r := records[i]
+			if r.Name != name || r.Collection != "test/fdr" {
+				t.Errorf("line %d: expected record %d to be test/fdr %s, got %s %s", c.line, i, name, r.Collection, r.Name)
+			}
+			if len(r.Data) != 1 || r.Data[0].Time != c.time.UnixNano() {
+				t.Errorf("line %d: expected time %s got %s", c.line, c.time.Format(time.RFC3339Nano), time.Unix(0, r.Data[0].Time).UTC().Format(time.RFC3339Nano))
+			}
+		}
+	}
+}
+
+func TestSpecExample(t *testing.T) {
+	f, err := ParseFrame([]byte("\x01 692 052110 142255  3 60.0043 60.0043 120.7570 2.1863\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := Frame{
+		UnitID:    692,
+		Time:      time.Date(2010, 5, 21, 14, 22, 55, 0, time.UTC),
+		ConvNum:   3,
+		FirstFreq: 60.0043,
+		FinalFreq: 60.0043,
+		Voltage:   120.757,
+		Angle:     2.1863,
+	}
+	if *f != exp {
+		t.Fatalf("expected %+v got %+v", exp, *f)
+	}
+	recs, err := f.Records("fdr", DefaultFrameRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := map[string]string{"Voltage": "Volts", "Angle": "Radians", "FinalFreq": "Hz", "FirstFreq": "Hz"}
+	values := map[string]float64{"Voltage": 120.757, "Angle": 2.1863, "FinalFreq": 60.0043, "FirstFreq": 60.0043}
+	for _, r := range recs {
+		if r.Unit != units[r.Name] || r.Data[0].Value != values[r.Name] {
+			t.Errorf("unexpected record %s: %s %v", r.Name, r.Unit, r.Data[0].Value)
+		}
+	}
+}
+
+func TestReadFrameResync(t *testing.T) {
+	corpus := loadCorpus(t)
+	stream := &bytes.Buffer{}
+	expected := [][]byte{}
+	stream.WriteString("garbage before the first frame")
+	for i, c := range corpus {
+		switch i % 4 {
+		case 1:
+			//Line noise between frames
+			stream.WriteString("\r\n\xff\xfe")
+		case 2:
+			//A frame cut off by a reconnect upstream
+			stream.Write(c.frame[:len(c.frame)/2])
+		case 3:
+			//Junk that never terminates
+			stream.WriteByte(frameStart)
+			stream.Write(bytes.Repeat([]byte{'x'}, maxFrameLength+10))
+		}
+		stream.Write(c.frame)
+		expected = append(expected, c.frame)
+	}
+	r := bufio.NewReader(stream)
+	for i, exp := range expected {
+		f, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(f, exp) {
+			t.Fatalf("frame %d: expected %q got %q", i, exp, f)
+		}
+	}
+	_, err := ReadFrame(r)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
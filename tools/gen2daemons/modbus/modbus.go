@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//Driver definition
+type ModbusTCP struct {
+	inserter *gen2ingress.Inserter
+}
+
+func (mb *ModbusTCP) DIDPrefix() string {
+	return "modbus.tcp."
+}
+func (mb *ModbusTCP) InitiatesConnections() bool {
+	return true
+}
+func (mb *ModbusTCP) SetConn(in *gen2ingress.Inserter) {
+	mb.inserter = in
+}
+
+func (mb *ModbusTCP) HandleDevice(ctx context.Context, descriptor string) error {
+	return fmt.Errorf("the register map is in the manifest, use HandleManifestDevice")
+}
+
+func (mb *ModbusTCP) HandleManifestDevice(ctx context.Context, md *manifest.ManifestDevice) error {
+	//Format: modbus.tcp.ip:port[?unit=1], see ParseDeviceConfig
+	cfg, err := ParseDeviceConfig(mb.DIDPrefix(), md)
+	if err != nil {
+		return err
+	}
+	device := &ModbusDevice{
+		descriptor: md.Descriptor,
+		inserter:   mb.inserter,
+		cfg:        cfg,
+		reads:      PlanReads(cfg.Registers),
+	}
+	fmt.Printf("[%s] polling %d registers of unit %d with %d requests\n", manifest.GetDescriptorShortForm(md.Descriptor), len(cfg.Registers), cfg.UnitID, len(device.reads))
+	gen2ingress.DialLoop(ctx, cfg.Target, md.Descriptor, device.process)
+	return nil
+}
+
+type ModbusDevice struct {
+	descriptor string
+	inserter   *gen2ingress.Inserter
+	cfg        *DeviceConfig
+	reads      []*Read
+}
+
+//process polls the device until ctx is cancelled or the connection fails.
+//A read that times out abandons the connection and DialLoop reconnects.
+func (d *ModbusDevice) process(ctx context.Context, conn *net.TCPConn, r *bufio.Reader) error {
+	shortform := manifest.GetDescriptorShortForm(d.descriptor)
+	hb := gen2ingress.Status(d.descriptor)
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	client := NewClient(conn, r, d.cfg.UnitID, d.cfg.Timeout)
+	lastExceptionNotification := time.Time{}
+	accumulatedExceptions := 0
+	annotated := make(map[string]bool)
+	next := make([]time.Time, len(d.reads))
+	now := time.Now()
+	for i := range next {
+		next[i] = now
+	}
+	for {
+		earliest := next[0]
+		for _, t := range next[1:] {
+			if t.Before(earliest) {
+				earliest = t
+			}
+		}
+		if wait := time.Until(earliest); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		var records []gen2ingress.InsertRecord
+		now := time.Now()
+		for i, rd := range d.reads {
+			if next[i].After(now) {
+				continue
+			}
+			//If the device is too slow for the period, skip the polls we
+			//missed rather than bursting to catch up
+			for !next[i].After(now) {
+				next[i] = next[i].Add(rd.Period)
+			}
+			t := time.Now()
+			words, err := client.ReadRegisters(rd.Function, rd.Address, rd.Count)
+			if _, ok := err.(*ExceptionError); ok {
+				//The device is fine, the register map is probably wrong
+				accumulatedExceptions++
+				if time.Since(lastExceptionNotification) > 30*time.Second {
+					fmt.Printf("[%s] reading %d registers at %d: %v (repeated %d times)\n", shortform, rd.Count, rd.Address, err, accumulatedExceptions)
+					hb.Error(err)
+					lastExceptionNotification = time.Now()
+					accumulatedExceptions = 0
+				}
+				continue
+			}
+			if err != nil {
+				d.insert(records, hb)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			for _, reg := range rd.Registers {
+				ir := gen2ingress.InsertRecord{
+					Data:       []btrdb.RawPoint{{Time: t.UnixNano(), Value: reg.Decode(words[reg.Address-rd.Address:])}},
+					Name:       reg.Name,
+					Collection: d.cfg.Collection,
+					Unit:       reg.Unit,
+					Descriptor: d.descriptor,
+				}
+				if !annotated[reg.Name] {
+					ir.AnnotationChanges = annotations(d.cfg, reg)
+					annotated[reg.Name] = true
+				}
+				records = append(records, ir)
+			}
+		}
+		d.insert(records, hb)
+	}
+}
+
+func (d *ModbusDevice) insert(records []gen2ingress.InsertRecord, hb *manifest.DeviceHeartbeat) {
+	if len(records) == 0 {
+		return
+	}
+	d.inserter.ProcessBatch(records)
+	hb.Data(len(records))
+}
+
+//annotations record where the value of a stream comes from
+func annotations(cfg *DeviceConfig, reg *Register) map[string]string {
+	table := "holding"
+	if reg.Function == FuncReadInputRegisters {
+		table = "input"
+	}
+	wordorder := "big"
+	if reg.LittleEndianWords {
+		wordorder = "little"
+	}
+	return map[string]string{
+		"unitid":    strconv.Itoa(int(cfg.UnitID)),
+		"table":     table,
+		"address":   strconv.Itoa(int(reg.Address)),
+		"type":      reg.Type.Name,
+		"wordorder": wordorder,
+		"scale":     strconv.FormatFloat(reg.Scale, 'g', -1, 64),
+		"offset":    strconv.FormatFloat(reg.Offset, 'g', -1, 64),
+		"period":    reg.Period.String(),
+	}
+}
+
+func main() {
+	gen2ingress.Gen2Ingress(&ModbusTCP{})
+	fmt.Printf("this should not have happened :/\n")
+}
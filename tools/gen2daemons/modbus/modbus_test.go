@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+)
+
+//TestEndToEnd polls the simulated device and checks what lands in the sink,
+//then hangs the device and checks that the connection is abandoned
+func TestEndToEnd(t *testing.T) {
+	sim, err := NewSimServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	sim.SetFloat32(FuncReadHoldingRegisters, 0, 120.5)
+	sim.Set(FuncReadHoldingRegisters, 2, 600)
+	sim.Set(FuncReadInputRegisters, 10, 0xFFF6)
+
+	md := &manifest.ManifestDevice{
+		Descriptor: "modbus.tcp." + sim.Addr(),
+		Metadata:   map[string]string{"collection": "test/meter", "period": "50ms", "timeout": "200ms"},
+		Streams: map[string]*manifest.ManifestDeviceStream{
+			"Voltage":     {Metadata: map[string]string{"address": "0", "type": "float32", "unit": "V"}},
+			"Frequency":   {Metadata: map[string]string{"address": "2", "scale": "0.1", "unit": "Hz"}},
+			"Temperature": {Metadata: map[string]string{"address": "10", "table": "input", "type": "int16", "offset": "20"}},
+			//Not mapped on the device, which must not stop the others
+			"Missing": {Metadata: map[string]string{"address": "500"}},
+		},
+	}
+	cfg, err := ParseDeviceConfig("modbus.tcp.", md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := gen2ingress.NewMemorySink()
+	ins, err := gen2ingress.NewInserter(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &ModbusDevice{
+		descriptor: md.Descriptor,
+		inserter:   ins,
+		cfg:        cfg,
+		reads:      PlanReads(cfg.Registers),
+	}
+	if len(dev.reads) != 3 {
+		t.Fatalf("expected the holding registers to be read together, got %d reads", len(dev.reads))
+	}
+	conn, err := net.DialTCP("tcp", nil, mustResolve(t, sim.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.process(ctx, conn, bufio.NewReader(conn))
+	}()
+
+	expected := map[string]float64{"Voltage": 120.5, "Frequency": 60, "Temperature": 10}
+	waitFor(t, sink, expected, 3)
+	for name, v := range expected {
+		for _, p := range sink.Stream("test/meter", name).Points() {
+			if p.Value != v {
+				t.Fatalf("expected %s to be %v, got %v", name, v, p.Value)
+			}
+		}
+	}
+	if sink.Stream("test/meter", "Missing") != nil {
+		t.Fatalf("unmapped register produced data")
+	}
+	v := sink.Stream("test/meter", "Voltage")
+	ann := v.Annotations()
+	if v.Unit != "V" || ann["address"] != "0" || ann["type"] != "float32" || ann["table"] != "holding" {
+		t.Fatalf("unexpected stream %s %v", v.Unit, ann)
+	}
+
+	sim.SetStalled(true)
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hung device was not detected")
+	}
+
+	//What DialLoop would do after the backoff
+	sim.SetStalled(false)
+	before := len(sink.Stream("test/meter", "Voltage").Points())
+	conn, err = net.DialTCP("tcp", nil, mustResolve(t, sim.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		done <- dev.process(ctx, conn, bufio.NewReader(conn))
+	}()
+	waitFor(t, sink, map[string]float64{"Voltage": 0}, before+3)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if sim.Connections() != 2 {
+		t.Fatalf("expected 2 connections, got %d", sim.Connections())
+	}
+}
+
+func mustResolve(t *testing.T, addr string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+//waitFor waits until each stream has at least n points
+func waitFor(t *testing.T, sink *gen2ingress.MemorySink, streams map[string]float64, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ok := true
+		for name := range streams {
+			s := sink.Stream("test/meter", name)
+			if s == nil || len(s.Points()) < n {
+				ok = false
+			}
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, s := range sink.Streams() {
+				t.Logf("%s/%s: %v", s.Collection, s.Name, s.Points())
+			}
+			t.Fatalf("timed out waiting for data")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
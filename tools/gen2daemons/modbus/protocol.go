@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+//A Modbus TCP request or response is an MBAP header followed by the PDU:
+//
+// TRANSACTION(2) PROTOCOL(2)=0 LENGTH(2) UNIT(1) FUNCTION(1) DATA...
+//
+//where LENGTH counts the bytes after it. Everything is big endian.
+const mbapLength = 7
+
+const (
+	FuncReadHoldingRegisters = 0x03
+	FuncReadInputRegisters   = 0x04
+)
+
+//The most registers a single read may ask for
+const MaxReadRegisters = 125
+
+//A PDU is at most 253 bytes
+const maxPDULength = 253
+
+//ExceptionError is returned when the device answers with an exception
+//rather than the registers, e.g. because the address is not mapped
+type ExceptionError struct {
+	Function byte
+	Code     byte
+}
+
+func (e *ExceptionError) Error() string {
+	var msg string
+	switch e.Code {
+	case 0x01:
+		msg = "illegal function"
+	case 0x02:
+		msg = "illegal data address"
+	case 0x03:
+		msg = "illegal data value"
+	case 0x04:
+		msg = "server device failure"
+	case 0x06:
+		msg = "server device busy"
+	case 0x0A:
+		msg = "gateway path unavailable"
+	case 0x0B:
+		msg = "gateway target device failed to respond"
+	default:
+		msg = "unknown exception"
+	}
+	return fmt.Sprintf("modbus exception 0x%02x (%s) for function 0x%02x", e.Code, msg, e.Function)
+}
+
+//Client performs one transaction at a time over a connection. If a
+//transaction fails with anything other than an ExceptionError the
+//connection should be abandoned.
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	unit    uint8
+	timeout time.Duration
+	tid     uint16
+}
+
+func NewClient(conn net.Conn, r *bufio.Reader, unit uint8, timeout time.Duration) *Client {
+	return &Client{conn: conn, r: r, unit: unit, timeout: timeout}
+}
+
+//ReadRegisters reads count consecutive 16 bit registers starting at the
+//zero based address, using FuncReadHoldingRegisters or
+//FuncReadInputRegisters
+func (c *Client) ReadRegisters(function byte, address uint16, count uint16) ([]uint16, error) {
+	if count == 0 || count > MaxReadRegisters {
+		return nil, fmt.Errorf("cannot read %d registers at once", count)
+	}
+	pdu := make([]byte, 5)
+	pdu[0] = function
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], count)
+	resp, err := c.transact(pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != len(resp)-2 || int(resp[1]) != int(count)*2 {
+		return nil, fmt.Errorf("expected %d registers in response, got %d bytes", count, len(resp)-1)
+	}
+	rv := make([]uint16, count)
+	for i := range rv {
+		rv[i] = binary.BigEndian.Uint16(resp[2+2*i:])
+	}
+	return rv, nil
+}
+
+//transact sends the PDU and returns the PDU of the response
+func (c *Client) transact(pdu []byte) ([]byte, error) {
+	c.tid++
+	req := make([]byte, mbapLength+len(pdu))
+	binary.BigEndian.PutUint16(req[0:], c.tid)
+	binary.BigEndian.PutUint16(req[2:], 0)
+	binary.BigEndian.PutUint16(req[4:], uint16(len(pdu)+1))
+	req[6] = c.unit
+	copy(req[mbapLength:], pdu)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tid, resp, err := readADU(c.r)
+		if err != nil {
+			return nil, err
+		}
+		//A late answer to an earlier request that we gave up on
+		if tid != c.tid {
+			continue
+		}
+		if resp[0] == pdu[0]|0x80 {
+			if len(resp) < 2 {
+				return nil, fmt.Errorf("truncated exception response")
+			}
+			return nil, &ExceptionError{Function: pdu[0], Code: resp[1]}
+		}
+		if resp[0] != pdu[0] {
+			return nil, fmt.Errorf("expected function 0x%02x in response, got 0x%02x", pdu[0], resp[0])
+		}
+		return resp, nil
+	}
+}
+
+//readADU reads a request or response and returns its transaction id and
+//PDU. The unit id is not checked because gateways do not always echo it.
+func readADU(r *bufio.Reader) (uint16, []byte, error) {
+	hdr := make([]byte, mbapLength)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint16(hdr[2:]) != 0 {
+		return 0, nil, fmt.Errorf("unexpected protocol id %d", binary.BigEndian.Uint16(hdr[2:]))
+	}
+	length := int(binary.BigEndian.Uint16(hdr[4:])) - 1
+	if length < 1 || length > maxPDULength {
+		return 0, nil, fmt.Errorf("bad length %d in header", length+1)
+	}
+	pdu := make([]byte, length)
+	_, err = io.ReadFull(r, pdu)
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint16(hdr[0:]), pdu, nil
+}
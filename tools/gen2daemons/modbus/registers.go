@@ -0,0 +1,291 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+)
+
+const DefaultPeriod = time.Second
+const DefaultTimeout = 5 * time.Second
+const DefaultUnitID = 1
+
+//RegisterType is how the value of a register is encoded
+type RegisterType struct {
+	Name string
+	//How many 16 bit registers the value spans
+	Words  int
+	decode func(bits uint64) float64
+}
+
+var registerTypes = []*RegisterType{
+	{"int16", 1, func(b uint64) float64 { return float64(int16(b)) }},
+	{"uint16", 1, func(b uint64) float64 { return float64(uint16(b)) }},
+	{"int32", 2, func(b uint64) float64 { return float64(int32(b)) }},
+	{"uint32", 2, func(b uint64) float64 { return float64(uint32(b)) }},
+	{"int64", 4, func(b uint64) float64 { return float64(int64(b)) }},
+	{"uint64", 4, func(b uint64) float64 { return float64(b) }},
+	{"float32", 2, func(b uint64) float64 { return float64(math.Float32frombits(uint32(b))) }},
+	{"float64", 4, func(b uint64) float64 { return math.Float64frombits(b) }},
+}
+
+func lookupRegisterType(name string) *RegisterType {
+	for _, rt := range registerTypes {
+		if rt.Name == name {
+			return rt
+		}
+	}
+	return nil
+}
+
+//Register is one value on the device, which becomes one stream
+type Register struct {
+	Name string
+	//FuncReadHoldingRegisters or FuncReadInputRegisters
+	Function byte
+	//Zero based, i.e. holding register 40001 is address 0
+	Address uint16
+	Type    *RegisterType
+	//The first register holds the least significant word. The bytes within
+	//a register are always big endian.
+	LittleEndianWords bool
+	//The stored value is raw*Scale + Offset
+	Scale  float64
+	Offset float64
+	Unit   string
+	Period time.Duration
+}
+
+//Decode turns the registers of the value into the value to store
+func (r *Register) Decode(words []uint16) float64 {
+	var bits uint64
+	for i := 0; i < r.Type.Words; i++ {
+		w := words[i]
+		if r.LittleEndianWords {
+			w = words[r.Type.Words-1-i]
+		}
+		bits = bits<<16 | uint64(w)
+	}
+	return r.Type.decode(bits)*r.Scale + r.Offset
+}
+
+//DeviceConfig is everything needed to poll a device
+type DeviceConfig struct {
+	Target     string
+	UnitID     uint8
+	Collection string
+	Timeout    time.Duration
+	Registers  []*Register
+}
+
+//ParseDeviceConfig reads the descriptor and the register map of a device.
+//The descriptor is modbus.tcp.<host:port>[?unit=N] and the device metadata
+//holds the collection and the defaults for its streams:
+//
+// collection=meters/feeder1 (required)
+// period=1s, timeout=5s, wordorder=big|little
+//
+//Every stream of the device is a register, with the metadata
+//
+// address=N (required, zero based, 0x prefix for hex)
+// table=holding|input (default holding)
+// type=int16|uint16|int32|uint32|int64|uint64|float32|float64 (default uint16)
+// scale=1, offset=0, unit=, and period and wordorder to override the device
+func ParseDeviceConfig(prefix string, md *manifest.ManifestDevice) (*DeviceConfig, error) {
+	rv := &DeviceConfig{
+		UnitID:  DefaultUnitID,
+		Timeout: DefaultTimeout,
+	}
+	suffix := strings.TrimPrefix(md.Descriptor, prefix)
+	parts := strings.SplitN(suffix, "?", 2)
+	rv.Target = parts[0]
+	_, _, err := net.SplitHostPort(rv.Target)
+	if err != nil {
+		return nil, fmt.Errorf("host:port is malformed")
+	}
+	if len(parts) == 2 {
+		params, err := url.ParseQuery(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("descriptor parameters are malformed")
+		}
+		if u := params.Get("unit"); u != "" {
+			unit, err := strconv.ParseUint(u, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unit must be between 0 and 255")
+			}
+			rv.UnitID = uint8(unit)
+		}
+	}
+
+	rv.Collection = strings.Trim(md.Metadata["collection"], "/")
+	if rv.Collection == "" {
+		return nil, fmt.Errorf("device is missing the collection metadata")
+	}
+	if t, ok := md.Metadata["timeout"]; ok {
+		rv.Timeout, err = time.ParseDuration(t)
+		if err != nil || rv.Timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be a positive duration e.g. 5s")
+		}
+	}
+	defaults := &Register{Period: DefaultPeriod}
+	err = parseCommon(defaults, md.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(md.Streams))
+	for name := range md.Streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		reg, err := parseRegister(name, md.Streams[name].Metadata, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("stream %s: %v", name, err)
+		}
+		rv.Registers = append(rv.Registers, reg)
+	}
+	if len(rv.Registers) == 0 {
+		return nil, fmt.Errorf("device has no registers, add them with setmeta %s/<stream> address=N", md.Descriptor)
+	}
+	return rv, nil
+}
+
+//parseCommon parses the settings that the device provides defaults for
+func parseCommon(reg *Register, metadata map[string]string) error {
+	if p, ok := metadata["period"]; ok {
+		period, err := time.ParseDuration(p)
+		if err != nil || period <= 0 {
+			return fmt.Errorf("period must be a positive duration e.g. 500ms")
+		}
+		reg.Period = period
+	}
+	switch strings.ToLower(metadata["wordorder"]) {
+	case "":
+	case "big":
+		reg.LittleEndianWords = false
+	case "little":
+		reg.LittleEndianWords = true
+	default:
+		return fmt.Errorf("invalid wordorder %q, must be big or little", metadata["wordorder"])
+	}
+	return nil
+}
+
+func parseRegister(name string, metadata map[string]string, defaults *Register) (*Register, error) {
+	reg := &Register{
+		Name:              name,
+		Function:          FuncReadHoldingRegisters,
+		Type:              lookupRegisterType("uint16"),
+		LittleEndianWords: defaults.LittleEndianWords,
+		Scale:             1,
+		Period:            defaults.Period,
+		Unit:              metadata["unit"],
+	}
+	err := parseCommon(reg, metadata)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := metadata["address"]
+	if !ok {
+		return nil, fmt.Errorf("missing address")
+	}
+	addr, err := strconv.ParseUint(a, 0, 16)
+	if err != nil {
+		return nil, fmt.Errorf("address must be between 0 and 65535")
+	}
+	reg.Address = uint16(addr)
+	switch strings.ToLower(metadata["table"]) {
+	case "", "holding":
+	case "input":
+		reg.Function = FuncReadInputRegisters
+	default:
+		return nil, fmt.Errorf("invalid table %q, must be holding or input", metadata["table"])
+	}
+	if t, ok := metadata["type"]; ok {
+		reg.Type = lookupRegisterType(strings.ToLower(t))
+		if reg.Type == nil {
+			return nil, fmt.Errorf("unknown type %q", t)
+		}
+	}
+	if int(reg.Address)+reg.Type.Words > 65536 {
+		return nil, fmt.Errorf("%s at address %d runs past the last register", reg.Type.Name, reg.Address)
+	}
+	if s, ok := metadata["scale"]; ok {
+		reg.Scale, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("scale is malformed")
+		}
+	}
+	if o, ok := metadata["offset"]; ok {
+		reg.Offset, err = strconv.ParseFloat(o, 64)
+		if err != nil {
+			return nil, fmt.Errorf("offset is malformed")
+		}
+	}
+	return reg, nil
+}
+
+//Read is one request, covering one or more registers that are polled
+//together
+type Read struct {
+	Function  byte
+	Address   uint16
+	Count     uint16
+	Period    time.Duration
+	Registers []*Register
+}
+
+//PlanReads groups registers with the same period that are next to each
+//other in the same table, so that they are read in one request. Registers
+//are never read across gaps because devices often reject unmapped
+//addresses.
+func PlanReads(regs []*Register) []*Read {
+	sorted := append([]*Register{}, regs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if a.Function != b.Function {
+			return a.Function < b.Function
+		}
+		return a.Address < b.Address
+	})
+	var rv []*Read
+	var cur *Read
+	for _, reg := range sorted {
+		end := int(reg.Address) + reg.Type.Words
+		if cur != nil && cur.Period == reg.Period && cur.Function == reg.Function &&
+			int(reg.Address) <= int(cur.Address)+int(cur.Count) &&
+			end-int(cur.Address) <= MaxReadRegisters {
+			if end > int(cur.Address)+int(cur.Count) {
+				cur.Count = uint16(end - int(cur.Address))
+			}
+			cur.Registers = append(cur.Registers, reg)
+			continue
+		}
+		cur = &Read{
+			Function:  reg.Function,
+			Address:   reg.Address,
+			Count:     uint16(reg.Type.Words),
+			Period:    reg.Period,
+			Registers: []*Register{reg},
+		}
+		rv = append(rv, cur)
+	}
+	return rv
+}
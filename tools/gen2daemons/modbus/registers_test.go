@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+)
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		typ    string
+		little bool
+		scale  float64
+		offset float64
+		words  []uint16
+		value  float64
+	}{
+		{"int16", false, 1, 0, []uint16{0xFFFF}, -1},
+		{"uint16", false, 0.1, 0, []uint16{2305}, 230.5},
+		{"int32", false, 1, 0, []uint16{0xFFFF, 0xFFFE}, -2},
+		{"uint32", false, 1, 0, []uint16{0x0001, 0x0002}, 65538},
+		{"uint32", true, 1, 0, []uint16{0x0002, 0x0001}, 65538},
+		{"float32", false, 1, 0, []uint16{0x4248, 0x0000}, 50},
+		{"float32", true, 1, -40, []uint16{0x0000, 0x4248}, 10},
+		{"float64", false, 1, 0, []uint16{0x400E, 0x0000, 0x0000, 0x0000}, 3.75},
+		{"int64", true, 1, 0, []uint16{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}, -1},
+	}
+	for _, c := range cases {
+		reg := &Register{Type: lookupRegisterType(c.typ), LittleEndianWords: c.little, Scale: c.scale, Offset: c.offset}
+		v := reg.Decode(c.words)
+		if v != c.value {
+			t.Errorf("%s little=%v %x: expected %v got %v", c.typ, c.little, c.words, c.value, v)
+		}
+	}
+}
+
+func TestParseDeviceConfig(t *testing.T) {
+	md := &manifest.ManifestDevice{
+		Descriptor: "modbus.tcp.10.0.0.5:502?unit=3",
+		Metadata:   map[string]string{"collection": "/meters/feeder1/", "period": "2s", "wordorder": "little"},
+		Streams: map[string]*manifest.ManifestDeviceStream{
+			"Voltage": {Metadata: map[string]string{"address": "0x10", "type": "float32", "unit": "V"}},
+			"Energy":  {Metadata: map[string]string{"address": "100", "table": "input", "type": "uint32", "scale": "0.001", "wordorder": "big", "period": "1m"}},
+		},
+	}
+	cfg, err := ParseDeviceConfig("modbus.tcp.", md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Target != "10.0.0.5:502" || cfg.UnitID != 3 || cfg.Collection != "meters/feeder1" || cfg.Timeout != DefaultTimeout {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Registers) != 2 {
+		t.Fatalf("expected 2 registers, got %d", len(cfg.Registers))
+	}
+	e, v := cfg.Registers[0], cfg.Registers[1]
+	if e.Name != "Energy" || e.Function != FuncReadInputRegisters || e.Address != 100 || e.Type.Name != "uint32" ||
+		e.Scale != 0.001 || e.LittleEndianWords || e.Period != time.Minute {
+		t.Fatalf("unexpected register %+v", e)
+	}
+	if v.Name != "Voltage" || v.Function != FuncReadHoldingRegisters || v.Address != 16 || v.Unit != "V" ||
+		v.Scale != 1 || !v.LittleEndianWords || v.Period != 2*time.Second {
+		t.Fatalf("unexpected register %+v", v)
+	}
+
+	bad := []*manifest.ManifestDevice{
+		{Descriptor: "modbus.tcp.10.0.0.5", Metadata: md.Metadata, Streams: md.Streams},
+		{Descriptor: "modbus.tcp.10.0.0.5:502?unit=300", Metadata: md.Metadata, Streams: md.Streams},
+		{Descriptor: "modbus.tcp.10.0.0.5:502", Metadata: map[string]string{}, Streams: md.Streams},
+		{Descriptor: "modbus.tcp.10.0.0.5:502", Metadata: md.Metadata, Streams: map[string]*manifest.ManifestDeviceStream{}},
+		{Descriptor: "modbus.tcp.10.0.0.5:502", Metadata: md.Metadata, Streams: map[string]*manifest.ManifestDeviceStream{
+			"x": {Metadata: map[string]string{"type": "float32"}},
+		}},
+		{Descriptor: "modbus.tcp.10.0.0.5:502", Metadata: md.Metadata, Streams: map[string]*manifest.ManifestDeviceStream{
+			"x": {Metadata: map[string]string{"address": "1", "type": "float16"}},
+		}},
+		{Descriptor: "modbus.tcp.10.0.0.5:502", Metadata: md.Metadata, Streams: map[string]*manifest.ManifestDeviceStream{
+			"x": {Metadata: map[string]string{"address": "65535", "type": "uint32"}},
+		}},
+	}
+	for _, b := range bad {
+		_, err := ParseDeviceConfig("modbus.tcp.", b)
+		if err == nil {
+			t.Errorf("expected %s %v %v to be rejected", b.Descriptor, b.Metadata, b.Streams["x"])
+		}
+	}
+}
+
+func TestPlanReads(t *testing.T) {
+	u16 := lookupRegisterType("uint16")
+	f32 := lookupRegisterType("float32")
+	regs := []*Register{
+		{Name: "a", Function: FuncReadHoldingRegisters, Address: 0, Type: f32, Period: time.Second},
+		{Name: "b", Function: FuncReadHoldingRegisters, Address: 2, Type: u16, Period: time.Second},
+		//A gap, so a new read
+		{Name: "c", Function: FuncReadHoldingRegisters, Address: 4, Type: u16, Period: time.Second},
+		//Same address in the other table
+		{Name: "d", Function: FuncReadInputRegisters, Address: 0, Type: u16, Period: time.Second},
+		//Adjacent but polled at a different rate
+		{Name: "e", Function: FuncReadHoldingRegisters, Address: 3, Type: u16, Period: time.Minute},
+		//The same registers read as another type
+		{Name: "f", Function: FuncReadHoldingRegisters, Address: 1, Type: u16, Period: time.Second},
+	}
+	reads := PlanReads(regs)
+	expected := []struct {
+		function byte
+		address  uint16
+		count    uint16
+		names    string
+	}{
+		{FuncReadHoldingRegisters, 0, 3, "afb"},
+		{FuncReadHoldingRegisters, 4, 1, "c"},
+		{FuncReadInputRegisters, 0, 1, "d"},
+		{FuncReadHoldingRegisters, 3, 1, "e"},
+	}
+	if len(reads) != len(expected) {
+		t.Fatalf("expected %d reads got %d", len(expected), len(reads))
+	}
+	for i, e := range expected {
+		rd := reads[i]
+		names := ""
+		for _, r := range rd.Registers {
+			names += r.Name
+		}
+		if rd.Function != e.function || rd.Address != e.address || rd.Count != e.count || names != e.names {
+			t.Errorf("read %d: expected %+v got %+v (%s)", i, e, rd, names)
+		}
+	}
+
+	//Long runs are split at the request limit
+	var long []*Register
+	for i := 0; i < 100; i++ {
+		long = append(long, &Register{Function: FuncReadHoldingRegisters, Address: uint16(2 * i), Type: f32, Period: time.Second})
+	}
+	reads = PlanReads(long)
+	if len(reads) != 2 || reads[0].Count != 124 || reads[1].Address != 124 || reads[1].Count != 76 {
+		t.Fatalf("long run was not split correctly")
+	}
+}
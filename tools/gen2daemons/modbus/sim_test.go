@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+)
+
+//SimServer is a simulated Modbus TCP device. It serves the holding and
+//input registers that have been set and answers anything else with an
+//illegal data address exception.
+type SimServer struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	tables  map[byte]map[uint16]uint16
+	stalled bool
+	conns   int
+}
+
+func NewSimServer() (*SimServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &SimServer{
+		ln: ln,
+		tables: map[byte]map[uint16]uint16{
+			FuncReadHoldingRegisters: make(map[uint16]uint16),
+			FuncReadInputRegisters:   make(map[uint16]uint16),
+		},
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *SimServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *SimServer) Close() {
+	s.ln.Close()
+}
+
+//Set stores consecutive registers starting at address
+func (s *SimServer) Set(function byte, address uint16, words ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range words {
+		s.tables[function][address+uint16(i)] = w
+	}
+}
+
+//SetFloat32 stores a float32 with the most significant word first
+func (s *SimServer) SetFloat32(function byte, address uint16, v float32) {
+	bits := math.Float32bits(v)
+	s.Set(function, address, uint16(bits>>16), uint16(bits))
+}
+
+//SetStalled makes the server read requests without answering them, like a
+//device that has hung
+func (s *SimServer) SetStalled(stalled bool) {
+	s.mu.Lock()
+	s.stalled = stalled
+	s.mu.Unlock()
+}
+
+//Connections is how many connections have been accepted
+func (s *SimServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *SimServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *SimServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		tid, pdu, err := readADU(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		stalled := s.stalled
+		resp := s.respond(pdu)
+		s.mu.Unlock()
+		if stalled {
+			continue
+		}
+		adu := make([]byte, mbapLength+len(resp))
+		binary.BigEndian.PutUint16(adu[0:], tid)
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(resp)+1))
+		adu[6] = 1
+		copy(adu[mbapLength:], resp)
+		_, err = c.Write(adu)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *SimServer) respond(pdu []byte) []byte {
+	table, ok := s.tables[pdu[0]]
+	if !ok {
+		return []byte{pdu[0] | 0x80, 0x01}
+	}
+	if len(pdu) != 5 {
+		return []byte{pdu[0] | 0x80, 0x03}
+	}
+	address := binary.BigEndian.Uint16(pdu[1:])
+	count := binary.BigEndian.Uint16(pdu[3:])
+	if count == 0 || count > MaxReadRegisters {
+		return []byte{pdu[0] | 0x80, 0x03}
+	}
+	resp := make([]byte, 2+2*count)
+	resp[0] = pdu[0]
+	resp[1] = byte(2 * count)
+	for i := uint16(0); i < count; i++ {
+		w, ok := table[address+i]
+		if !ok {
+			return []byte{pdu[0] | 0x80, 0x02}
+		}
+		binary.BigEndian.PutUint16(resp[2+2*i:], w)
+	}
+	return resp
+}
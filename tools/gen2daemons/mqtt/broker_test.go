@@ -0,0 +1,294 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//TestBroker is an MQTT 3.1.1 broker with just enough of the protocol for
+//the driver: CONNECT with optional credentials, SUBSCRIBE, UNSUBSCRIBE,
+//PINGREQ and DISCONNECT. Messages are published with Publish and delivered
+//at QoS 0.
+type TestBroker struct {
+	ln       net.Listener
+	username string
+	password string
+
+	mu      sync.Mutex
+	clients map[*brokerClient]bool
+}
+
+type brokerClient struct {
+	conn    net.Conn
+	wmu     sync.Mutex
+	filters []string
+}
+
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+//NewTestBroker starts a broker. If username is set, clients must present
+//it and the password.
+func NewTestBroker(username string, password string) (*TestBroker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &TestBroker{
+		ln:       ln,
+		username: username,
+		password: password,
+		clients:  make(map[*brokerClient]bool),
+	}
+	go b.serve()
+	return b, nil
+}
+
+func (b *TestBroker) URL() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *TestBroker) Close() {
+	b.ln.Close()
+	b.Kick()
+}
+
+//Kick drops every client, as if the broker restarted
+func (b *TestBroker) Kick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+//WaitSubscribed waits until a client has subscribed with the filter
+func (b *TestBroker) WaitSubscribed(filter string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		for c := range b.clients {
+			for _, f := range c.filters {
+				if f == filter {
+					b.mu.Unlock()
+					return nil
+				}
+			}
+		}
+		b.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("nobody subscribed to %s", filter)
+}
+
+//Publish delivers the message to every matching subscription
+func (b *TestBroker) Publish(topic string, payload []byte) {
+	body := make([]byte, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	copy(body[2:], topic)
+	copy(body[2+len(topic):], payload)
+	b.mu.Lock()
+	var targets []*brokerClient
+	for c := range b.clients {
+		for _, f := range c.filters {
+			if topicMatches(f, topic) {
+				targets = append(targets, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range targets {
+		c.write(pktPublish<<4, body)
+	}
+}
+
+func (b *TestBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &brokerClient{conn: conn}
+		go b.handle(c)
+	}
+}
+
+func (b *TestBroker) handle(c *brokerClient) {
+	defer func() {
+		c.conn.Close()
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+	}()
+	r := bufio.NewReader(c.conn)
+	hdr, body, err := readPacket(r)
+	if err != nil || hdr>>4 != pktConnect {
+		return
+	}
+	if !b.authorized(body) {
+		//Not authorized
+		c.write(pktConnack<<4, []byte{0, 5})
+		return
+	}
+	b.mu.Lock()
+	b.clients[c] = true
+	b.mu.Unlock()
+	c.write(pktConnack<<4, []byte{0, 0})
+	for {
+		hdr, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch hdr >> 4 {
+		case pktSubscribe:
+			var filters []string
+			var granted []byte
+			rest := body[2:]
+			for len(rest) > 0 {
+				f, n := readString(rest)
+				if n < 0 || len(rest) < n+1 {
+					return
+				}
+				filters = append(filters, f)
+				granted = append(granted, 0)
+				rest = rest[n+1:]
+			}
+			b.mu.Lock()
+			c.filters = append(c.filters, filters...)
+			b.mu.Unlock()
+			c.write(pktSuback<<4, append(body[:2:2], granted...))
+		case pktUnsubscribe:
+			c.write(pktUnsuback<<4, body[:2])
+		case pktPingreq:
+			c.write(pktPingresp<<4, nil)
+		case pktDisconnect:
+			return
+		}
+	}
+}
+
+//authorized checks the credentials in a CONNECT packet
+func (b *TestBroker) authorized(body []byte) bool {
+	if b.username == "" {
+		return true
+	}
+	//Protocol name, level, flags, keep alive
+	_, n := readString(body)
+	if n < 0 || len(body) < n+4 {
+		return false
+	}
+	flags := body[n+1]
+	rest := body[n+4:]
+	_, n = readString(rest)
+	if n < 0 || flags&0x80 == 0 || flags&0x40 == 0 {
+		return false
+	}
+	rest = rest[n:]
+	if flags&0x04 != 0 {
+		//Will topic and message
+		for i := 0; i < 2; i++ {
+			_, n = readString(rest)
+			if n < 0 {
+				return false
+			}
+			rest = rest[n:]
+		}
+	}
+	user, n := readString(rest)
+	if n < 0 {
+		return false
+	}
+	pass, n := readString(rest[n:])
+	return n >= 0 && user == b.username && pass == b.password
+}
+
+func (c *brokerClient) write(hdr byte, body []byte) {
+	pkt := []byte{hdr}
+	l := len(body)
+	for {
+		d := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			d |= 0x80
+		}
+		pkt = append(pkt, d)
+		if l == 0 {
+			break
+		}
+	}
+	pkt = append(pkt, body...)
+	c.wmu.Lock()
+	c.conn.Write(pkt)
+	c.wmu.Unlock()
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	hdr, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l := 0
+	for mult := 1; ; mult *= 128 {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		l += int(d&0x7F) * mult
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, l)
+	_, err = io.ReadFull(r, body)
+	return hdr, body, err
+}
+
+//readString reads a length prefixed string and returns how many bytes it
+//took, or -1 if it is truncated
+func readString(b []byte) (string, int) {
+	if len(b) < 2 {
+		return "", -1
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", -1
+	}
+	return string(b[2 : 2+l]), 2 + l
+}
+
+func topicMatches(filter string, topic string) bool {
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) || (f != "+" && f != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
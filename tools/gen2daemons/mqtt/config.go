@@ -0,0 +1,259 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+)
+
+const DefaultTimeout = 10 * time.Second
+
+const (
+	FormatJSON  = "json"
+	FormatSenML = "senml"
+	FormatRaw   = "raw"
+)
+
+//DeviceConfig is everything needed to subscribe to a device
+type DeviceConfig struct {
+	//tcp://host:port or ssl://host:port
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	//Set for ssl:// brokers
+	TLS     *tls.Config
+	Timeout time.Duration
+	Topics  []string
+	QoS     byte
+	Format  string
+	//Templates for the collection and name of each value, see expand
+	Collection string
+	Name       string
+	//The unit of values whose payload does not say
+	Unit string
+	//The units of individual streams, by name
+	Units map[string]string
+	//JSON only: the field holding the time of the values, and what a
+	//numeric time counts
+	TimeField string
+	TimeUnit  time.Duration
+	//JSON only: if set, only these fields are stored
+	Fields map[string]bool
+}
+
+//ParseDeviceConfig reads the subscription of a device from its metadata in
+//the manifest. The descriptor only identifies the device, so that moving to
+//another broker does not change the streams:
+//
+// broker=tcp://host:1883 or ssl://host:8883 (required)
+// topic=a/+/b[,c/#] (required)
+// collection=gateways/{1} (required)
+// format=json|senml|raw (default json), qos=0|1 (default 0)
+// name={field}, unit=, timefield=, timeunit=s|ms|us|ns (default ms), fields=a,b.c
+// username=, password= or password_env=, ca=, cert=, key=, insecure=true
+// clientid=, timeout=10s
+//
+//The units of individual streams can be set in the stream metadata.
+func ParseDeviceConfig(md *manifest.ManifestDevice) (*DeviceConfig, error) {
+	meta := md.Metadata
+	rv := &DeviceConfig{
+		ClientID:   "smartgridstore-" + manifest.GetDescriptorShortForm(md.Descriptor),
+		Timeout:    DefaultTimeout,
+		Format:     FormatJSON,
+		Collection: strings.Trim(meta["collection"], "/"),
+		Name:       "{field}",
+		Unit:       meta["unit"],
+		Units:      make(map[string]string),
+		TimeField:  meta["timefield"],
+		TimeUnit:   time.Millisecond,
+	}
+	u, err := url.Parse(meta["broker"])
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("broker must be of the form tcp://host:port or ssl://host:port")
+	}
+	switch u.Scheme {
+	case "tcp":
+	case "ssl":
+		rv.TLS = &tls.Config{}
+	default:
+		return nil, fmt.Errorf("broker must be of the form tcp://host:port or ssl://host:port")
+	}
+	rv.Broker = u.Scheme + "://" + u.Host
+	if c, ok := meta["clientid"]; ok {
+		rv.ClientID = c
+	}
+	if t, ok := meta["timeout"]; ok {
+		rv.Timeout, err = time.ParseDuration(t)
+		if err != nil || rv.Timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be a positive duration e.g. 10s")
+		}
+	}
+
+	for _, t := range strings.Split(meta["topic"], ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			rv.Topics = append(rv.Topics, t)
+		}
+	}
+	if len(rv.Topics) == 0 {
+		return nil, fmt.Errorf("device is missing the topic metadata")
+	}
+	switch meta["qos"] {
+	case "", "0":
+	case "1":
+		rv.QoS = 1
+	default:
+		return nil, fmt.Errorf("qos must be 0 or 1")
+	}
+	if f, ok := meta["format"]; ok {
+		rv.Format = strings.ToLower(f)
+	}
+	switch rv.Format {
+	case FormatJSON, FormatSenML:
+	case FormatRaw:
+		//There is no field, so name the stream after the end of the topic
+		rv.Name = "{-1}"
+	default:
+		return nil, fmt.Errorf("invalid format %q, must be json, senml or raw", rv.Format)
+	}
+
+	if rv.Collection == "" {
+		return nil, fmt.Errorf("device is missing the collection metadata")
+	}
+	if n, ok := meta["name"]; ok {
+		rv.Name = n
+	}
+	for _, tmpl := range []string{rv.Collection, rv.Name} {
+		_, err := expand(tmpl, []string{}, "", true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, s := range md.Streams {
+		if unit, ok := s.Metadata["unit"]; ok {
+			rv.Units[name] = unit
+		}
+	}
+	switch strings.ToLower(meta["timeunit"]) {
+	case "s":
+		rv.TimeUnit = time.Second
+	case "", "ms":
+	case "us":
+		rv.TimeUnit = time.Microsecond
+	case "ns":
+		rv.TimeUnit = time.Nanosecond
+	default:
+		return nil, fmt.Errorf("invalid timeunit %q, must be s, ms, us or ns", meta["timeunit"])
+	}
+	if f, ok := meta["fields"]; ok {
+		rv.Fields = make(map[string]bool)
+		for _, field := range strings.Split(f, ",") {
+			rv.Fields[strings.TrimSpace(field)] = true
+		}
+	}
+
+	rv.Username = meta["username"]
+	rv.Password = meta["password"]
+	if env, ok := meta["password_env"]; ok {
+		rv.Password = os.Getenv(env)
+		if rv.Password == "" {
+			return nil, fmt.Errorf("password_env is set but %s is empty", env)
+		}
+	}
+	if rv.TLS == nil {
+		for _, k := range []string{"ca", "cert", "key", "insecure"} {
+			if _, ok := meta[k]; ok {
+				return nil, fmt.Errorf("%s is only valid for ssl:// brokers", k)
+			}
+		}
+		return rv, nil
+	}
+	if ca, ok := meta["ca"]; ok {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca: %v", err)
+		}
+		rv.TLS.RootCAs = x509.NewCertPool()
+		if !rv.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	_, hascert := meta["cert"]
+	_, haskey := meta["key"]
+	if hascert != haskey {
+		return nil, fmt.Errorf("cert and key must be given together")
+	}
+	if hascert {
+		cert, err := tls.LoadX509KeyPair(meta["cert"], meta["key"])
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %v", err)
+		}
+		rv.TLS.Certificates = []tls.Certificate{cert}
+	}
+	if ins, ok := meta["insecure"]; ok {
+		rv.TLS.InsecureSkipVerify, err = strconv.ParseBool(ins)
+		if err != nil {
+			return nil, fmt.Errorf("insecure must be true or false")
+		}
+	}
+	return rv, nil
+}
+
+//expand fills in a collection or name template. {field} is the field of
+//the value in the payload, {topic} is the whole topic and {N} is the Nth
+//level of the topic, counting from 1, or from the end if negative. If
+//check is set it only validates the template.
+func expand(tmpl string, levels []string, field string, check bool) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			out.WriteString(tmpl)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated { in %q", tmpl)
+		}
+		out.WriteString(tmpl[:start])
+		key := tmpl[start+1 : start+end]
+		tmpl = tmpl[start+end+1:]
+		switch key {
+		case "field":
+			out.WriteString(field)
+			continue
+		case "topic":
+			out.WriteString(strings.Join(levels, "/"))
+			continue
+		}
+		n, err := strconv.Atoi(key)
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("unknown placeholder {%s}", key)
+		}
+		if check {
+			continue
+		}
+		if n < 0 {
+			n += len(levels) + 1
+		}
+		if n < 1 || n > len(levels) {
+			return "", fmt.Errorf("topic %q has no level {%s}", strings.Join(levels, "/"), key)
+		}
+		out.WriteString(levels[n-1])
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//Driver definition
+type MQTTSubscriber struct {
+	inserter *gen2ingress.Inserter
+}
+
+func (ms *MQTTSubscriber) DIDPrefix() string {
+	return "mqtt."
+}
+func (ms *MQTTSubscriber) InitiatesConnections() bool {
+	return true
+}
+func (ms *MQTTSubscriber) SetConn(in *gen2ingress.Inserter) {
+	ms.inserter = in
+}
+
+func (ms *MQTTSubscriber) HandleDevice(ctx context.Context, descriptor string) error {
+	return fmt.Errorf("the subscription is in the manifest, use HandleManifestDevice")
+}
+
+func (ms *MQTTSubscriber) HandleManifestDevice(ctx context.Context, md *manifest.ManifestDevice) error {
+	//Format: mqtt.<name>, the rest is in the metadata, see ParseDeviceConfig
+	cfg, err := ParseDeviceConfig(md)
+	if err != nil {
+		return err
+	}
+	device := &MQTTDevice{
+		descriptor: md.Descriptor,
+		inserter:   ms.inserter,
+		cfg:        cfg,
+		annotated:  make(map[string]bool),
+	}
+	gen2ingress.Loop(ctx, md.Descriptor, device.process)
+	return nil
+}
+
+type MQTTDevice struct {
+	descriptor string
+	inserter   *gen2ingress.Inserter
+	cfg        *DeviceConfig
+
+	//handle holds mu, the client of a lost connection may still be
+	//delivering a message when the next one connects
+	mu                         sync.Mutex
+	annotated                  map[string]bool
+	lastBadMessageNotification time.Time
+	accumulatedBadMessages     int
+}
+
+//process subscribes and inserts messages until ctx is cancelled or the
+//connection to the broker is lost, in which case Loop reconnects
+func (d *MQTTDevice) process(ctx context.Context) error {
+	shortform := manifest.GetDescriptorShortForm(d.descriptor)
+	hb := gen2ingress.Status(d.descriptor)
+	lost := make(chan error, 1)
+	opts := mqtt.NewClientOptions().
+		AddBroker(d.cfg.Broker).
+		SetClientID(d.cfg.ClientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetOrderMatters(true).
+		SetConnectTimeout(d.cfg.Timeout).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		})
+	if d.cfg.Username != "" {
+		opts.SetUsername(d.cfg.Username)
+		opts.SetPassword(d.cfg.Password)
+	}
+	if d.cfg.TLS != nil {
+		opts.SetTLSConfig(d.cfg.TLS)
+	}
+	client := mqtt.NewClient(opts)
+	tok := client.Connect()
+	tok.Wait()
+	if tok.Error() != nil {
+		return tok.Error()
+	}
+	defer func() {
+		client.Disconnect(250)
+		//Wait for a message that was being handled, nothing is inserted
+		//for the device once we return
+		d.mu.Lock()
+		d.mu.Unlock()
+	}()
+
+	filters := make(map[string]byte)
+	for _, t := range d.cfg.Topics {
+		filters[t] = d.cfg.QoS
+	}
+	stok := client.SubscribeMultiple(filters, func(c mqtt.Client, msg mqtt.Message) {
+		d.handle(msg.Topic(), msg.Payload(), hb)
+	})
+	if !stok.WaitTimeout(d.cfg.Timeout) {
+		return fmt.Errorf("timed out subscribing")
+	}
+	if stok.Error() != nil {
+		return stok.Error()
+	}
+	for t, code := range stok.(*mqtt.SubscribeToken).Result() {
+		//0x80 is a failure, anything else is the granted QoS
+		if code == 0x80 {
+			return fmt.Errorf("broker refused the subscription to %s", t)
+		}
+	}
+	fmt.Printf("[%s] subscribed to %s on %s\n", shortform, strings.Join(d.cfg.Topics, ","), d.cfg.Broker)
+	hb.Connected()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-lost:
+		return err
+	}
+}
+
+func (d *MQTTDevice) handle(topic string, payload []byte, hb *manifest.DeviceHeartbeat) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	records, err := d.records(topic, payload, time.Now())
+	if err != nil {
+		d.accumulatedBadMessages++
+		if time.Since(d.lastBadMessageNotification) > 30*time.Second {
+			fmt.Printf("[%s] skipping bad message on %s: %v (repeated %d times)\n", manifest.GetDescriptorShortForm(d.descriptor), topic, err, d.accumulatedBadMessages)
+			hb.Error(err)
+			d.lastBadMessageNotification = time.Now()
+			d.accumulatedBadMessages = 0
+		}
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+	d.inserter.ProcessBatch(records)
+	points := 0
+	for _, ir := range records {
+		points += len(ir.Data)
+		if ir.AnnotationChanges != nil {
+			d.annotated[ir.Signal] = true
+		}
+	}
+	hb.Data(points)
+}
+
+//records turns a message into one record per stream
+func (d *MQTTDevice) records(topic string, payload []byte, now time.Time) ([]gen2ingress.InsertRecord, error) {
+	samples, err := ParsePayload(d.cfg, payload, now)
+	if err != nil {
+		return nil, err
+	}
+	levels := strings.Split(topic, "/")
+	var rv []gen2ingress.InsertRecord
+	bystream := make(map[string]int)
+	for _, s := range samples {
+		collection, err := expand(d.cfg.Collection, levels, s.Field, false)
+		if err != nil {
+			return nil, err
+		}
+		name, err := expand(d.cfg.Name, levels, s.Field, false)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("value has an empty name")
+		}
+		//The collection comes from the topic, so it is part of the identity
+		//of the stream
+		signal := collection + "/" + name
+		idx, ok := bystream[signal]
+		if !ok {
+			unit, ok := d.cfg.Units[name]
+			if !ok {
+				unit = s.Unit
+			}
+			if unit == "" {
+				unit = d.cfg.Unit
+			}
+			ir := gen2ingress.InsertRecord{
+				Name:       name,
+				Collection: collection,
+				Unit:       unit,
+				Descriptor: d.descriptor,
+				Signal:     signal,
+			}
+			if !d.annotated[signal] {
+				ir.AnnotationChanges = map[string]string{"topic": topic, "format": d.cfg.Format}
+			}
+			idx = len(rv)
+			bystream[signal] = idx
+			rv = append(rv, ir)
+		}
+		rv[idx].Data = append(rv[idx].Data, btrdb.RawPoint{Time: s.Time, Value: s.Value})
+	}
+	return rv, nil
+}
+
+func main() {
+	gen2ingress.Gen2Ingress(&MQTTSubscriber{})
+	fmt.Printf("this should not have happened :/\n")
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+)
+
+//TestEndToEnd subscribes to the test broker and checks what lands in the
+//sink, then drops the connection and checks that process returns so that
+//Loop can reconnect
+func TestEndToEnd(t *testing.T) {
+	broker, err := NewTestBroker("ingress", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	md := &manifest.ManifestDevice{
+		Descriptor: "mqtt.test",
+		Metadata: map[string]string{
+			"broker":     broker.URL(),
+			"topic":      "site/+/telemetry",
+			"collection": "test/{2}",
+			"timefield":  "ts",
+			"timeunit":   "s",
+			"unit":       "unknown",
+			"username":   "ingress",
+			"password":   "secret",
+			"timeout":    "2s",
+		},
+		Streams: map[string]*manifest.ManifestDeviceStream{
+			"temp": {Metadata: map[string]string{"unit": "C"}},
+		},
+	}
+	cfg, err := ParseDeviceConfig(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := gen2ingress.NewMemorySink()
+	ins, err := gen2ingress.NewInserter(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &MQTTDevice{
+		descriptor: md.Descriptor,
+		inserter:   ins,
+		cfg:        cfg,
+		annotated:  make(map[string]bool),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.process(ctx)
+	}()
+	err = broker.WaitSubscribed("site/+/telemetry", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("site/gw1/telemetry", []byte(`{"ts": 1600000000, "temp": 21.5, "rh": 40}`))
+	broker.Publish("site/gw2/telemetry", []byte(`{"ts": 1600000001, "temp": 19}`))
+	//Bad messages and other topics are skipped
+	broker.Publish("site/gw1/telemetry", []byte(`not json`))
+	broker.Publish("site/gw1/status", []byte(`{"ts": 1600000000, "up": 1}`))
+	broker.Publish("site/gw1/telemetry", []byte(`{"ts": 1600000002, "temp": 22}`))
+
+	waitFor(t, sink, "test/gw1", "temp", 2)
+	waitFor(t, sink, "test/gw1", "rh", 1)
+	waitFor(t, sink, "test/gw2", "temp", 1)
+	temp := sink.Stream("test/gw1", "temp")
+	if temp.Unit != "C" || sink.Stream("test/gw1", "rh").Unit != "unknown" {
+		t.Fatalf("unexpected units %s %s", temp.Unit, sink.Stream("test/gw1", "rh").Unit)
+	}
+	if ann := temp.Annotations(); ann["topic"] != "site/gw1/telemetry" || ann["format"] != "json" {
+		t.Fatalf("unexpected annotations %v", ann)
+	}
+	if sink.Stream("test/gw1", "up") != nil {
+		t.Fatalf("message on another topic was stored")
+	}
+	if sink.Stream("test/gw1", "temp").UUID.String() == sink.Stream("test/gw2", "temp").UUID.String() {
+		t.Fatalf("streams in different collections have the same UUID")
+	}
+
+	broker.Kick()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("expected an error after the connection was lost")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("lost connection was not detected")
+	}
+
+	//What Loop would do after the backoff
+	go func() {
+		done <- dev.process(ctx)
+	}()
+	err = broker.WaitSubscribed("site/+/telemetry", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("site/gw1/telemetry", []byte(`{"ts": 1600000003, "temp": 23}`))
+	waitFor(t, sink, "test/gw1", "temp", 3)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	broker, err := NewTestBroker("ingress", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	cfg, err := ParseDeviceConfig(&manifest.ManifestDevice{
+		Descriptor: "mqtt.test",
+		Metadata:   map[string]string{"broker": broker.URL(), "topic": "#", "collection": "test", "username": "ingress", "password": "wrong"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &MQTTDevice{descriptor: "mqtt.test", cfg: cfg, annotated: make(map[string]bool)}
+	err = dev.process(context.Background())
+	if err == nil {
+		t.Fatalf("connected with the wrong password")
+	}
+}
+
+//waitFor waits until the stream has at least n points
+func waitFor(t *testing.T, sink *gen2ingress.MemorySink, collection string, name string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := sink.Stream(collection, name)
+		if s != nil && len(s.Points()) >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, s := range sink.Streams() {
+				t.Logf("%s/%s: %v", s.Collection, s.Name, s.Points())
+			}
+			t.Fatalf("timed out waiting for %s/%s", collection, name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Sample is one value found in a payload
+type Sample struct {
+	//The path of the value in a JSON payload, the name of a SenML record or
+	//empty for raw payloads
+	Field string
+	Time  int64
+	Value float64
+	//Empty unless the payload says
+	Unit string
+}
+
+//ParsePayload extracts the values of a message. Values without a time in
+//the payload are given the time the message arrived.
+func ParsePayload(cfg *DeviceConfig, payload []byte, now time.Time) ([]Sample, error) {
+	switch cfg.Format {
+	case FormatJSON:
+		return parseJSON(cfg, payload, now)
+	case FormatSenML:
+		return parseSenML(payload, now)
+	case FormatRaw:
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("payload is not a number")
+		}
+		return []Sample{{Time: now.UnixNano(), Value: v}}, nil
+	}
+	panic("unknown format")
+}
+
+//parseJSON accepts an object, or an array of objects, whose numeric and
+//boolean fields are values. Nested objects are flattened with a "." so
+//{"a": {"b": 1}} has the field a.b
+func parseJSON(cfg *DeviceConfig, payload []byte, now time.Time) ([]Sample, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	//Timestamps in ns do not fit in a float64
+	dec.UseNumber()
+	var doc interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("payload is not JSON: %v", err)
+	}
+	var objs []map[string]interface{}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		objs = append(objs, d)
+	case []interface{}:
+		for _, e := range d {
+			obj, ok := e.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("payload array must hold objects")
+			}
+			objs = append(objs, obj)
+		}
+	default:
+		return nil, fmt.Errorf("payload must be an object or an array of objects")
+	}
+	var rv []Sample
+	for _, obj := range objs {
+		t := now.UnixNano()
+		if cfg.TimeField != "" {
+			tv, ok := obj[cfg.TimeField]
+			if !ok {
+				return nil, fmt.Errorf("payload has no %q field", cfg.TimeField)
+			}
+			t, err = parseJSONTime(tv, cfg.TimeUnit)
+			if err != nil {
+				return nil, err
+			}
+			delete(obj, cfg.TimeField)
+		}
+		rv = flatten(cfg, "", obj, t, rv)
+	}
+	return rv, nil
+}
+
+func flatten(cfg *DeviceConfig, prefix string, obj map[string]interface{}, t int64, rv []Sample) []Sample {
+	for k, v := range obj {
+		field := prefix + k
+		var val float64
+		switch tv := v.(type) {
+		case map[string]interface{}:
+			rv = flatten(cfg, field+".", tv, t, rv)
+			continue
+		case json.Number:
+			f, err := tv.Float64()
+			if err != nil {
+				continue
+			}
+			val = f
+		case bool:
+			if tv {
+				val = 1
+			}
+		default:
+			//Strings, arrays and nulls are not values
+			continue
+		}
+		if cfg.Fields != nil && !cfg.Fields[field] {
+			continue
+		}
+		rv = append(rv, Sample{Field: field, Time: t, Value: val})
+	}
+	return rv
+}
+
+//parseJSONTime accepts a number of the given unit since the epoch or an
+//RFC 3339 string
+func parseJSONTime(v interface{}, unit time.Duration) (int64, error) {
+	switch tv := v.(type) {
+	case json.Number:
+		if i, err := tv.Int64(); err == nil {
+			return i * int64(unit), nil
+		}
+		f, err := tv.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("time %q is malformed", tv)
+		}
+		return int64(f * float64(unit)), nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, tv)
+		if err != nil {
+			return 0, fmt.Errorf("time %q is malformed", tv)
+		}
+		return t.UnixNano(), nil
+	}
+	return 0, fmt.Errorf("time must be a number or a string")
+}
+
+//senmlRecord is a record of a SenML pack (RFC 8428) in JSON. The base
+//fields carry over to the records that follow.
+type senmlRecord struct {
+	BaseName  *string  `json:"bn"`
+	BaseTime  *float64 `json:"bt"`
+	BaseUnit  *string  `json:"bu"`
+	BaseValue *float64 `json:"bv"`
+	Name      string   `json:"n"`
+	Unit      string   `json:"u"`
+	Value     *float64 `json:"v"`
+	BoolValue *bool    `json:"vb"`
+	Time      float64  `json:"t"`
+}
+
+//Times below this are relative to now, see RFC 8428 section 4.5.3
+const senmlRelativeTime = 1 << 28
+
+func parseSenML(payload []byte, now time.Time) ([]Sample, error) {
+	var pack []senmlRecord
+	err := json.Unmarshal(payload, &pack)
+	if err != nil {
+		return nil, fmt.Errorf("payload is not a SenML pack: %v", err)
+	}
+	var bn, bu string
+	var bt, bv float64
+	var rv []Sample
+	for _, r := range pack {
+		if r.BaseName != nil {
+			bn = *r.BaseName
+		}
+		if r.BaseTime != nil {
+			bt = *r.BaseTime
+		}
+		if r.BaseUnit != nil {
+			bu = *r.BaseUnit
+		}
+		if r.BaseValue != nil {
+			bv = *r.BaseValue
+		}
+		var val float64
+		switch {
+		case r.Value != nil:
+			val = bv + *r.Value
+		case r.BoolValue != nil:
+			if *r.BoolValue {
+				val = 1
+			}
+		default:
+			//String and data values are not stored
+			continue
+		}
+		name := bn + r.Name
+		if name == "" {
+			return nil, fmt.Errorf("SenML record has no name")
+		}
+		unit := r.Unit
+		if unit == "" {
+			unit = bu
+		}
+		rv = append(rv, Sample{Field: name, Time: senmlTime(bt+r.Time, now), Value: val, Unit: unit})
+	}
+	return rv, nil
+}
+
+//senmlTime converts seconds since the epoch, or relative to now if small,
+//to nanoseconds
+func senmlTime(t float64, now time.Time) int64 {
+	if t < senmlRelativeTime {
+		return now.UnixNano() + int64(t*1e9)
+	}
+	sec := math.Floor(t)
+	return int64(sec)*1e9 + int64(math.Round((t-sec)*1e9))
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+)
+
+func sorted(s []Sample) []Sample {
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Field != s[j].Field {
+			return s[i].Field < s[j].Field
+		}
+		return s[i].Time < s[j].Time
+	})
+	return s
+}
+
+func checkSamples(t *testing.T, name string, got []Sample, expected []Sample) {
+	got = sorted(got)
+	if len(got) != len(expected) {
+		t.Fatalf("%s: expected %v got %v", name, expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("%s: expected %v got %v", name, expected, got)
+		}
+	}
+}
+
+func TestParsePayload(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cfg := &DeviceConfig{Format: FormatJSON, TimeUnit: time.Millisecond}
+
+	s, err := ParsePayload(cfg, []byte(`{"temp": 21.5, "on": true, "label": "x", "power": {"p": 3, "q": -1}}`), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := now.UnixNano()
+	checkSamples(t, "json", s, []Sample{{"on", n, 1, ""}, {"power.p", n, 3, ""}, {"power.q", n, -1, ""}, {"temp", n, 21.5, ""}})
+
+	cfg.TimeField = "ts"
+	cfg.Fields = map[string]bool{"temp": true}
+	s, err = ParsePayload(cfg, []byte(`[{"ts": 1600000000123, "temp": 1, "rh": 40}, {"ts": "2020-09-13T12:26:40.5Z", "temp": 2}]`), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, "json with time", s, []Sample{{"temp", 1600000000123000000, 1, ""}, {"temp", 1600000000500000000, 2, ""}})
+	_, err = ParsePayload(cfg, []byte(`{"temp": 1}`), now)
+	if err == nil {
+		t.Fatalf("missing time was accepted")
+	}
+	cfg.TimeUnit = time.Nanosecond
+	s, err = ParsePayload(cfg, []byte(`{"ts": 1600000000123456789, "temp": 1}`), now)
+	if err != nil || s[0].Time != 1600000000123456789 {
+		t.Fatalf("ns time lost precision: %v %v", s, err)
+	}
+
+	s, err = ParsePayload(&DeviceConfig{Format: FormatSenML}, []byte(`[
+		{"bn": "urn:dev:1:", "bt": 1600000000, "bu": "V", "n": "voltage", "v": 120.1},
+		{"n": "voltage", "t": 1, "v": 120.2},
+		{"n": "current", "u": "A", "t": 1, "v": 5},
+		{"n": "label", "vs": "hello"},
+		{"bn": "", "bt": -2, "n": "relative", "vb": true}
+	]`), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, "senml", s, []Sample{
+		{"relative", n - 2000000000, 1, "V"},
+		{"urn:dev:1:current", 1600000001000000000, 5, "A"},
+		{"urn:dev:1:voltage", 1600000000000000000, 120.1, "V"},
+		{"urn:dev:1:voltage", 1600000001000000000, 120.2, "V"},
+	})
+
+	s, err = ParsePayload(&DeviceConfig{Format: FormatRaw}, []byte(" 59.98\n"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, "raw", s, []Sample{{"", n, 59.98, ""}})
+	_, err = ParsePayload(&DeviceConfig{Format: FormatRaw}, []byte("on"), now)
+	if err == nil {
+		t.Fatalf("bad raw payload was accepted")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	levels := []string{"site", "gw7", "telemetry"}
+	cases := map[string]string{
+		"sensors/{2}":       "sensors/gw7",
+		"{field}":           "temp",
+		"{-1}_{field}":      "telemetry_temp",
+		"{topic}":           "site/gw7/telemetry",
+		"{1}/{2}/{3}/fixed": "site/gw7/telemetry/fixed",
+	}
+	for tmpl, expected := range cases {
+		got, err := expand(tmpl, levels, "temp", false)
+		if err != nil || got != expected {
+			t.Errorf("%s: expected %s got %s (%v)", tmpl, expected, got, err)
+		}
+	}
+	for _, bad := range []string{"{4}", "{-4}", "{0}", "{bogus}", "{1"} {
+		_, err := expand(bad, levels, "temp", false)
+		if err == nil {
+			t.Errorf("%s was accepted", bad)
+		}
+	}
+}
+
+func TestParseDeviceConfig(t *testing.T) {
+	md := &manifest.ManifestDevice{
+		Descriptor: "mqtt.gateway7",
+		Metadata: map[string]string{
+			"broker":     "tcp://broker.local:1883",
+			"topic":      "site/+/telemetry, site/+/status",
+			"collection": "sites/{2}/",
+			"format":     "senml",
+			"qos":        "1",
+			"username":   "ingress",
+			"password":   "secret",
+		},
+		Streams: map[string]*manifest.ManifestDeviceStream{
+			"temp": {Metadata: map[string]string{"unit": "C"}},
+		},
+	}
+	cfg, err := ParseDeviceConfig(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Broker != "tcp://broker.local:1883" || len(cfg.Topics) != 2 || cfg.Topics[1] != "site/+/status" ||
+		cfg.Collection != "sites/{2}" || cfg.Name != "{field}" || cfg.QoS != 1 || cfg.Format != FormatSenML ||
+		cfg.Units["temp"] != "C" || cfg.Username != "ingress" || cfg.Password != "secret" || cfg.TLS != nil {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	for _, bad := range []map[string]string{
+		{"topic": "a", "collection": "c"},
+		{"broker": "http://x:1", "topic": "a", "collection": "c"},
+		{"broker": "tcp://x:1", "collection": "c"},
+		{"broker": "tcp://x:1", "topic": "a"},
+		{"broker": "tcp://x:1", "topic": "a", "collection": "{bogus}"},
+		{"broker": "tcp://x:1", "topic": "a", "collection": "c", "format": "xml"},
+		{"broker": "tcp://x:1", "topic": "a", "collection": "c", "qos": "2"},
+		{"broker": "tcp://x:1", "topic": "a", "collection": "c", "ca": "/ca.pem"},
+		{"broker": "ssl://x:1", "topic": "a", "collection": "c", "cert": "/cert.pem"},
+		{"broker": "tcp://x:1", "topic": "a", "collection": "c", "password_env": "MQTT_TEST_UNSET_PASSWORD"},
+	} {
+		_, err := ParseDeviceConfig(&manifest.ManifestDevice{Descriptor: "mqtt.x", Metadata: bad})
+		if err == nil {
+			t.Errorf("%v was accepted", bad)
+		}
+	}
+}
@@ -15,84 +15,247 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
-	"github.com/pborman/uuid"
-
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 	btrdb "gopkg.in/BTrDB/btrdb.v4"
 )
 
 type Inserter struct {
 	cachemu          sync.Mutex
-	streamcache      map[streamkey]*btrdb.Stream
-	db               *btrdb.BTrDB
+	streamcache      map[streamkey]SinkStream
+	sink             Sink
 	workq            chan InsertRecord
 	coalesceInterval time.Duration
+	flagPolicy       FlagPolicy
 	maxSize          int64
 	curSize          int64
 	dropped          int64
+	//The spool is nil unless SPOOL_DIRECTORY is set
+	spool   *Spool
+	spooled int64
+	//Closing replayStop stops the replayer, which then closes replayDone
+	replayStop chan struct{}
+	replayDone chan struct{}
+	//Device metrics, keyed by collection
+	metricsmu sync.Mutex
+	metrics   map[string]*metrics.Device
+
+	//Inserts are made with ctx, which is cancelled when Close gives up on
+	//flushing
+	ctx    context.Context
+	cancel func()
+	//closemu is held for reading while a batch is queued, so that workq is
+	//not closed under it
+	closemu sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+	//Readings appended to a worker buffer that have not been flushed yet
+	buffered int64
+	//Readings that could not be inserted or spooled
+	lost int64
+	//Readings that arrived after Close was called
+	late int64
+	//Streams with annotation changes that were not written by a worker that
+	//has exited
+	pendingAnnotations int64
+}
+
+//ShutdownReport summarizes what Close could not write
+type ShutdownReport struct {
+	//Readings still queued or buffered when the flush deadline passed
+	Unflushed int64
+	//Readings whose final insert failed and that could not be spooled
+	Failed int64
+	//Readings received after shutdown began
+	Late int64
+	//Streams whose annotation changes were not written
+	Annotations int64
+	//Bytes left in the spool, these are replayed on the next start
+	Spooled int64
+}
+
+//Clean is true if nothing was lost, spooled data is not lost
+func (r *ShutdownReport) Clean() bool {
+	return r.Unflushed == 0 && r.Failed == 0 && r.Late == 0 && r.Annotations == 0
+}
+
+func (r *ShutdownReport) String() string {
+	if r.Clean() && r.Spooled == 0 {
+		return "all data was written"
+	}
+	return fmt.Sprintf("%d readings unflushed, %d failed, %d received during shutdown, %d streams with unwritten annotations, %d bytes left in the spool",
+		r.Unflushed, r.Failed, r.Late, r.Annotations, r.Spooled)
 }
 type streamkey struct {
 	Collection string
 	Name       string
 	Unit       string
+	Descriptor string
+	Signal     string
+}
+
+func (ir *InsertRecord) streamkey() streamkey {
+	return streamkey{
+		Collection: ir.Collection,
+		Name:       ir.Name,
+		Unit:       ir.Unit,
+		Descriptor: ir.Descriptor,
+		Signal:     ir.Signal,
+	}
 }
 
 //Default queue size is 1GB
 const DefaultWorkQueueLength = 1000 * 1000 * 1000
 
-func NewInserter(db *btrdb.BTrDB) *Inserter {
+func NewInserter(sink Sink) (*Inserter, error) {
 	wql := DefaultWorkQueueLength
 	paramQueueLength := os.Getenv("WORK_QUEUE_LENGTH")
 	if paramQueueLength != "" {
 		parsed, err := strconv.ParseInt(paramQueueLength, 10, 64)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("WORK_QUEUE_LENGTH is malformed: %v", err)
 		}
 		wql = int(parsed)
 	}
+	fp, err := FlagPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
 	rv := Inserter{
-		streamcache: make(map[streamkey]*btrdb.Stream),
-		db:          db,
+		streamcache: make(map[streamkey]SinkStream),
+		sink:        sink,
 		//We assume a worst case where every record is just one raw point
 		//which makes Size() return 116
 		workq:            make(chan InsertRecord, wql/116),
 		coalesceInterval: 2 * time.Second,
+		flagPolicy:       *fp,
 		maxSize:          int64(wql),
+		metrics:          make(map[string]*metrics.Device),
+	}
+	rv.ctx, rv.cancel = context.WithCancel(context.Background())
+	metrics.QueueDepth("work", func() float64 {
+		return float64(len(rv.workq))
+	})
+	if spcfg := SpoolConfigFromEnv(); spcfg != nil {
+		sp, err := OpenSpool(*spcfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not open spool: %v", err)
+		}
+		rv.spool = sp
+		rv.replayStop = make(chan struct{})
+		rv.replayDone = make(chan struct{})
+		fmt.Printf("Spooling to %q (max %d bytes, replay %d records/s), %d bytes pending replay\n",
+			spcfg.Directory, spcfg.MaxSize, spcfg.ReplayRate, sp.Size())
+		go rv.replayer()
 	}
 	for i := 0; i < 4; i++ {
+		rv.workers.Add(1)
 		go rv.worker()
 	}
 	go func() {
 		var lastDropped int64
+		var lastSpooled int64
 		for {
 			deltaDropped := atomic.LoadInt64(&rv.dropped) - lastDropped
 			if deltaDropped > 0 {
 				fmt.Printf("CRITICAL: IN THE PAST 5 SECONDS, %d BATCHES HAVE BEEN DROPPED\n", deltaDropped)
 			}
+			lastDropped += deltaDropped
 			curSize := atomic.LoadInt64(&rv.curSize)
 			fullPercentage := float64(curSize) / float64(rv.maxSize) * 100
 			if fullPercentage > 5 {
 				fmt.Printf("WARNING: QUEUE IS %.2f%% FULL.\n", fullPercentage)
 			}
+			if rv.spool != nil {
+				deltaSpooled := atomic.LoadInt64(&rv.spooled) - lastSpooled
+				lastSpooled += deltaSpooled
+				if deltaSpooled > 0 || !rv.spool.Empty() {
+					fmt.Printf("WARNING: %d RECORDS SPOOLED IN THE PAST 5 SECONDS, SPOOL IS %d BYTES\n", deltaSpooled, rv.spool.Size())
+				}
+			}
 			time.Sleep(5 * time.Second)
 		}
 	}()
-	return &rv
+	return &rv, nil
 }
 
 func (ins *Inserter) SetCoalesceInterval(d time.Duration) {
 	ins.coalesceInterval = d
 }
+
+//SetFlagPolicy replaces the policy read from the environment. Like
+//SetCoalesceInterval it must be called before any batches are processed,
+//i.e. from Driver.SetConn.
+func (ins *Inserter) SetFlagPolicy(p FlagPolicy) {
+	ins.flagPolicy = p
+}
+
+//metricsKey is the key of a device in the metrics cache. Drivers that do
+//not use the manifest leave the descriptor empty, the collection stands in
+//for the device for them
+func metricsKey(descriptor string, collection string) string {
+	if descriptor == "" {
+		return "collection:" + collection
+	}
+	return descriptor
+}
+
+//metricsFor returns the metrics of the device that records came from. They
+//are labelled with the short form of the descriptor, like the rest of the
+//device metrics in engine.go, so that a device has one set of series.
+func (ins *Inserter) metricsFor(descriptor string, collection string) *metrics.Device {
+	key := metricsKey(descriptor, collection)
+	ins.metricsmu.Lock()
+	defer ins.metricsmu.Unlock()
+	m, ok := ins.metrics[key]
+	if !ok {
+		if descriptor == "" {
+			m = metrics.ForDevice(collection)
+		} else {
+			m = metrics.ForDevice(manifest.GetDescriptorShortForm(descriptor))
+		}
+		ins.metrics[key] = m
+	}
+	return m
+}
+
+//ForgetDevice removes the metrics of a device that is no longer handled by
+//this node
+func (ins *Inserter) ForgetDevice(descriptor string) {
+	ins.metricsmu.Lock()
+	delete(ins.metrics, metricsKey(descriptor, ""))
+	ins.metricsmu.Unlock()
+	metrics.ForDevice(manifest.GetDescriptorShortForm(descriptor)).Forget()
+}
+
 func (ins *Inserter) ProcessBatch(ir []InsertRecord) {
+	ins.closemu.RLock()
+	defer ins.closemu.RUnlock()
 	irSize := 0
 	for _, r := range ir {
 		irSize += r.Size()
+		ins.metricsFor(r.Descriptor, r.Collection).Received(len(r.Data))
+	}
+	if ins.closed {
+		//Shutting down, the driver has not noticed yet
+		for _, r := range ir {
+			atomic.AddInt64(&ins.late, int64(len(r.Data)))
+		}
+		ins.recordsDropped(ir)
+		return
 	}
 	cursize := atomic.LoadInt64(&ins.curSize)
 	ok := cursize+int64(irSize) < ins.maxSize
 
+	//Once anything is in the spool, new batches must also go to the spool
+	//so that they are inserted in order
+	if ins.spool != nil && (!ok || !ins.spool.Empty()) {
+		ins.spoolRecords(ir)
+		return
+	}
 	if !ok {
 		atomic.AddInt64(&ins.dropped, int64(len(ir)))
+		ins.recordsDropped(ir)
 		return
 	}
 	atomic.AddInt64(&ins.curSize, int64(irSize))
@@ -101,7 +264,236 @@ func (ins *Inserter) ProcessBatch(ir []InsertRecord) {
 	}
 }
 
+//Close stops accepting batches and flushes everything that is queued. If
+//that takes longer than ctx allows, the inserts in flight are abandoned.
+//Records that fail to insert are spooled if there is a spool.
+func (ins *Inserter) Close(ctx context.Context) *ShutdownReport {
+	//Only failures from here on are reported, earlier ones were logged
+	failedBefore := atomic.LoadInt64(&ins.lost)
+	ins.closemu.Lock()
+	ins.closed = true
+	close(ins.workq)
+	ins.closemu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ins.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Printf("Flush deadline exceeded, abandoning inserts\n")
+		ins.cancel()
+		//Give the workers a moment to notice
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}
+	rv := &ShutdownReport{
+		Failed:      atomic.LoadInt64(&ins.lost) - failedBefore,
+		Late:        atomic.LoadInt64(&ins.late),
+		Annotations: atomic.LoadInt64(&ins.pendingAnnotations),
+	}
+	//Anything the workers did not get to
+	var leftover []InsertRecord
+	for ir := range ins.workq {
+		leftover = append(leftover, ir)
+	}
+	if ins.spool != nil && len(leftover) > 0 {
+		ins.spoolRecords(leftover)
+	} else {
+		for _, ir := range leftover {
+			rv.Unflushed += int64(len(ir.Data))
+		}
+	}
+	rv.Unflushed += atomic.LoadInt64(&ins.buffered)
+	if ins.spool != nil {
+		//Records the replayer has not acknowledged are replayed again on the
+		//next start
+		close(ins.replayStop)
+		select {
+		case <-ins.replayDone:
+		case <-ctx.Done():
+			//Abandon the insert the replayer is blocked in, it must have
+			//stopped before the spool is closed
+			ins.cancel()
+			<-ins.replayDone
+		}
+		rv.Spooled = ins.spool.Size()
+		err := ins.spool.Close()
+		if err != nil {
+			fmt.Printf("Could not close spool: %v\n", err)
+		}
+	}
+	return rv
+}
+
+func (ins *Inserter) recordsDropped(irz []InsertRecord) {
+	for _, r := range irz {
+		ins.metricsFor(r.Descriptor, r.Collection).Dropped(len(r.Data))
+	}
+}
+
+func (sk streamkey) record(dat []btrdb.RawPoint, ann map[string]string) InsertRecord {
+	return InsertRecord{
+		Data:              dat,
+		Name:              sk.Name,
+		Collection:        sk.Collection,
+		Unit:              sk.Unit,
+		Descriptor:        sk.Descriptor,
+		Signal:            sk.Signal,
+		AnnotationChanges: ann,
+	}
+}
+
+func (ins *Inserter) getStream(sk streamkey) (SinkStream, error) {
+	ins.cachemu.Lock()
+	defer ins.cachemu.Unlock()
+	stream, ok := ins.streamcache[sk]
+	if ok {
+		return stream, nil
+	}
+	stream, err := ins.sink.OpenStream(ins.ctx, specFor(sk))
+	if err != nil {
+		return nil, err
+	}
+	ins.streamcache[sk] = stream
+	return stream, nil
+}
+
+//spoolRecords appends records to the spool, counting them as dropped if the
+//spool is full or cannot be written
+func (ins *Inserter) spoolRecords(irz []InsertRecord) {
+	ok, err := ins.spool.Append(irz)
+	if err != nil {
+		fmt.Printf("CRITICAL: could not write to spool: %v\n", err)
+	}
+	if !ok {
+		atomic.AddInt64(&ins.dropped, int64(len(irz)))
+		ins.recordsDropped(irz)
+		return
+	}
+	atomic.AddInt64(&ins.spooled, int64(len(irz)))
+}
+
+//replayer inserts spooled records in order, at no more than the configured
+//replay rate. Records are only acknowledged (and eventually deleted from
+//disk) once they have been inserted successfully
+func (ins *Inserter) replayer() {
+	defer close(ins.replayDone)
+	//sleep returns false if the replayer has been stopped
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-ins.replayStop:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+	pos := ins.spool.Cursor()
+	for {
+		then := time.Now()
+		ents, end, err := ins.spool.Read(pos, ins.spool.cfg.ReplayRate)
+		if err != nil {
+			fmt.Printf("CRITICAL: could not read from spool: %v\n", err)
+			if !sleep(10 * time.Second) {
+				return
+			}
+			continue
+		}
+		if len(ents) == 0 {
+			//Skip past the end of finished segments so that the spool is
+			//seen to be empty
+			if end != pos {
+				err = ins.spool.Ack(end)
+				if err != nil {
+					fmt.Printf("CRITICAL: could not acknowledge spool records: %v\n", err)
+				}
+				pos = ins.spool.Cursor()
+			}
+			if !sleep(1 * time.Second) {
+				return
+			}
+			continue
+		}
+		total := 0
+		for _, e := range ents {
+			for {
+				err := ins.replayRecord(&e.Record)
+				if err == nil {
+					break
+				}
+				fmt.Printf("Spool replay error (will retry): %v\n", err)
+				if !sleep(10 * time.Second) {
+					return
+				}
+			}
+			total += len(e.Record.Data)
+			pos = e.End
+		}
+		err = ins.spool.Ack(pos)
+		if err != nil {
+			fmt.Printf("CRITICAL: could not acknowledge spool records: %v\n", err)
+		}
+		pos = ins.spool.Cursor()
+		fmt.Printf("Replayed %d spooled readings in %.2f ms\n", total, float64(time.Since(then)/time.Microsecond)/1000.0)
+		if elapsed := time.Since(then); elapsed < time.Second {
+			if !sleep(time.Second - elapsed) {
+				return
+			}
+		}
+	}
+}
+
+func (ins *Inserter) replayRecord(ir *InsertRecord) error {
+	if len(ir.Data) == 0 {
+		return nil
+	}
+	keep, flags := ins.flagPolicy.split(ir)
+	if flags != nil {
+		fstream, err := ins.getStream(ins.flagPolicy.flagsKey(ir.streamkey()))
+		if err != nil {
+			return err
+		}
+		err = fstream.Insert(ins.ctx, flags)
+		if err != nil {
+			return err
+		}
+	}
+	if len(keep) != len(ir.Data) {
+		ins.metricsFor(ir.Descriptor, ir.Collection).Rejected(len(ir.Data) - len(keep))
+	}
+	//So that a retry does not write the flags again
+	ir.Data = keep
+	ir.Flags = nil
+	if len(ir.Data) == 0 {
+		return nil
+	}
+	stream, err := ins.getStream(ir.streamkey())
+	if err != nil {
+		return err
+	}
+	if ir.AnnotationChanges != nil {
+		err := stream.SetAnnotations(ins.ctx, ir.AnnotationChanges)
+		if err != nil {
+			return err
+		}
+		ir.AnnotationChanges = nil
+	}
+	then := time.Now()
+	err = stream.Insert(ins.ctx, ir.Data)
+	if err != nil {
+		return err
+	}
+	metrics.ObserveLatency("replay", time.Since(then))
+	ins.metricsFor(ir.Descriptor, ir.Collection).Inserted(len(ir.Data))
+	return nil
+}
+
 func (ins *Inserter) worker() {
+	defer ins.workers.Done()
 	debugDelay := os.Getenv("DEBUG_DELAY_INSERTS") == "YES"
 	buf := make(map[streamkey][]btrdb.RawPoint)
 	anns := make(map[streamkey]map[string]string)
@@ -113,84 +505,102 @@ func (ins *Inserter) worker() {
 			time.Sleep(10 * time.Second)
 		}
 		for sk, dat := range buf {
-			ins.cachemu.Lock()
-			stream, ok := ins.streamcache[sk]
-			if !ok {
-				sz, err := ins.db.LookupStreams(context.Background(), sk.Collection,
-					false, btrdb.OptKV("name", sk.Name), nil)
-				if err != nil {
-					panic(err)
-				}
-				if len(sz) == 0 {
-					//create stream and assign to stream
-					uu := uuid.NewRandom()
-					st, err := ins.db.Create(context.Background(),
-						uu, sk.Collection, btrdb.M{"name": sk.Name, "unit": sk.Unit}, nil)
-					if err != nil {
-						panic(err)
-					}
-					stream = st
-					ins.streamcache[sk] = stream
-				} else {
-					stream = sz[0]
-					ins.streamcache[sk] = stream
+			stream, err := ins.getStream(sk)
+			if err != nil {
+				if ins.spool == nil {
+					//The stream will be looked up again on the next batch
+					fmt.Printf("Got stream lookup error for %s/%s (dropping %d readings): %v\n", sk.Collection, sk.Name, len(dat), err)
+					atomic.AddInt64(&ins.dropped, 1)
+					atomic.AddInt64(&ins.lost, int64(len(dat)))
+					atomic.AddInt64(&ins.buffered, -int64(len(dat)))
+					ins.metricsFor(sk.Descriptor, sk.Collection).Dropped(len(dat))
+					continue
 				}
+				fmt.Printf("Got stream lookup error (spooling): %v\n", err)
+				ins.spoolRecords([]InsertRecord{sk.record(dat, anns[sk])})
+				atomic.AddInt64(&ins.buffered, -int64(len(dat)))
+				delete(anns, sk)
+				continue
 			}
-			ins.cachemu.Unlock()
 
 			ann, ok := anns[sk]
 			if ok {
-				_, aver, err := stream.Annotations(context.Background())
-				if err != nil {
-					panic(err)
-				}
-				changes := make(map[string]*string)
-				for k, v := range ann {
-					vc := v
-					changes[k] = &vc
-				}
-				err = stream.CompareAndSetAnnotation(context.Background(), aver, changes)
+				err := stream.SetAnnotations(ins.ctx, ann)
 				if err != nil {
-					fmt.Printf("failed to set annotations: %v (%d)\n", err, aver)
+					fmt.Printf("failed to set annotations: %v\n", err)
 				} else {
 					delete(anns, sk)
 				}
 			}
 
 			total += len(dat)
-			err := stream.Insert(context.Background(), dat)
+			insertStart := time.Now()
+			err = stream.Insert(ins.ctx, dat)
+			metrics.ObserveLatency("insert", time.Since(insertStart))
 			if err != nil {
-				fmt.Printf("Got insert error (ignoring): %v\n", err)
+				if ins.spool != nil {
+					fmt.Printf("Got insert error (spooling): %v\n", err)
+					ins.spoolRecords([]InsertRecord{sk.record(dat, nil)})
+				} else {
+					fmt.Printf("Got insert error (ignoring): %v\n", err)
+					atomic.AddInt64(&ins.lost, int64(len(dat)))
+					ins.metricsFor(sk.Descriptor, sk.Collection).Dropped(len(dat))
+				}
+			} else {
+				ins.metricsFor(sk.Descriptor, sk.Collection).Inserted(len(dat))
 			}
+			atomic.AddInt64(&ins.buffered, -int64(len(dat)))
 		}
 		buf = make(map[streamkey][]btrdb.RawPoint)
 		coalesceTime = time.Now()
+		if total > 0 {
+			metrics.ObserveLatency("batch", coalesceTime.Sub(then))
+		}
 		fmt.Printf("Batch of %d readings processed in %.2f ms\n", total, float64(coalesceTime.Sub(then)/time.Microsecond)/1000.0)
 	}
 	for {
 		var ir InsertRecord
+		var ok bool
 		//Opportunistically flush the buffer if there is no work to be done
 		select {
-		case ir = <-ins.workq:
+		case ir, ok = <-ins.workq:
 		default:
 			flushBuf()
-			ir = <-ins.workq
+			ir, ok = <-ins.workq
+		}
+		if !ok {
+			//Close was called
+			flushBuf()
+			atomic.AddInt64(&ins.pendingAnnotations, int64(len(anns)))
+			return
 		}
 		atomic.AddInt64(&ins.curSize, -int64(ir.Size()))
 		if len(ir.Data) == 0 {
 			continue
 		}
 		if ir.Name == "" || ir.Collection == "" {
-			spew.Dump(ir)
-			panic("missing name or collection")
+			fmt.Printf("Dropping record with missing name or collection (collection=%q name=%q unit=%q)\n", ir.Collection, ir.Name, ir.Unit)
+			atomic.AddInt64(&ins.dropped, 1)
+			ins.metricsFor(ir.Descriptor, ir.Collection).Rejected(len(ir.Data))
+			continue
 		}
-		sk := streamkey{Name: ir.Name,
-			Collection: ir.Collection,
-			Unit:       ir.Unit}
+		sk := ir.streamkey()
 		if ir.AnnotationChanges != nil {
 			anns[sk] = ir.AnnotationChanges
 		}
-		buf[sk] = append(buf[sk], ir.Data...)
+		keep, flags := ins.flagPolicy.split(&ir)
+		if flags != nil {
+			fsk := ins.flagPolicy.flagsKey(sk)
+			buf[fsk] = append(buf[fsk], flags...)
+			atomic.AddInt64(&ins.buffered, int64(len(flags)))
+		}
+		if len(keep) != len(ir.Data) {
+			ins.metricsFor(ir.Descriptor, ir.Collection).Rejected(len(ir.Data) - len(keep))
+		}
+		if len(keep) > 0 {
+			buf[sk] = append(buf[sk], keep...)
+			atomic.AddInt64(&ins.buffered, int64(len(keep)))
+		}
 		if time.Since(coalesceTime) > ins.coalesceInterval || len(buf) > 4000 {
 			flushBuf()
 		}
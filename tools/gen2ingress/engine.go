@@ -13,15 +13,46 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/BTrDB/smartgridstore/tools"
 	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 	etcd "github.com/coreos/etcd/clientv3"
-	"github.com/pborman/uuid"
-	btrdb "gopkg.in/BTrDB/btrdb.v4"
 )
 
+var status *manifest.StatusReporter
+
+//FlushTimeout is how long buffered data is given to be written on shutdown.
+//Kubernetes kills a pod 30 seconds after SIGTERM by default.
+const FlushTimeout = 20 * time.Second
+
+//shutdownContext is cancelled on SIGTERM or SIGINT
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigc
+		fmt.Printf("Received %s, shutting down\n", sig)
+		cancel()
+		//A second signal means the operator does not want to wait
+		sig = <-sigc
+		fmt.Printf("Received %s again, exiting without flushing\n", sig)
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+//Status returns the heartbeat that is written to the manifest for the given
+//device. Drivers should report data on it, DialLoop and Loop keep the
+//connection state up to date. It is a no-op outside of Gen2Ingress.
+func Status(descriptor string) *manifest.DeviceHeartbeat {
+	return status.Device(descriptor)
+}
+
 //This is called by the main method of the driver-specific executable
 func Gen2Ingress(driver Driver) {
 	if len(os.Args) == 2 && os.Args[1] == "-version" {
@@ -29,6 +60,8 @@ func Gen2Ingress(driver Driver) {
 		os.Exit(0)
 	}
 	fmt.Printf("Booting gen2 ingress version %d.%d.%d\n", tools.VersionMajor, tools.VersionMinor, tools.VersionPatch)
+	metrics.Serve()
+	ctx := shutdownContext()
 
 	manifest.SetEtcdKeyPrefix("")
 
@@ -46,154 +79,144 @@ func Gen2Ingress(driver Driver) {
 		log.Fatalf("Error: %v", err)
 	}
 	defer etcdConn.Close()
-	log.Println("Connecting to BTrDB...")
-	btrdbconn, err := btrdb.Connect(context.Background(), btrdb.EndpointsFromEnv()...)
+	status = manifest.NewStatusReporter(etcdConn, manifest.NodeName())
+	status.Start(ctx)
+	sinkcfg, err := SinkConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Error in INGRESS_SINK: %v\n", err)
+		return
+	}
+	sink, err := OpenSink(context.Background(), sinkcfg)
 	if err != nil {
-		fmt.Printf("Error connecting to the BTrDB: %v\n", err)
+		fmt.Printf("Error opening the %s sink: %v\n", sinkcfg.Kind, err)
 		return
 	}
 
 	defer func() {
-		err := btrdbconn.Disconnect()
+		err := sink.Close()
 		if err == nil {
 			fmt.Println("Finished closing connection")
 		} else {
 			fmt.Printf("Could not close connection: %v\n", err)
 		}
 	}()
-	log.Println("Connected")
-
-	ourid := uuid.NewRandom().String()
 
-	insert := NewInserter(btrdbconn)
+	insert, err := NewInserter(sink)
+	if err != nil {
+		fmt.Printf("Error creating inserter: %v\n", err)
+		return
+	}
 	driver.SetConn(insert)
 
 	//Do we even need to lock anything in the manifest table
 	if !driver.InitiatesConnections() {
-		for {
-			time.Sleep(5 * time.Second)
-		}
+		<-ctx.Done()
+		flush(insert)
+		return
 	}
 
-	ourActiveDevices := make(map[string]context.CancelFunc)
-
-	//Get the lock table
-devloop:
-	for {
-		time.Sleep(3 * time.Second)
-		devs, err := manifest.RetrieveMultipleManifestDevices(context.Background(), etcdConn, driver.DIDPrefix())
-		if err != nil {
-			panic(err)
-		}
-		copyActiveDevices := make(map[string]context.CancelFunc)
-		for k, v := range ourActiveDevices {
-			copyActiveDevices[k] = v
-		}
-		for _, d := range devs {
-			delete(copyActiveDevices, d.Descriptor)
-		}
-
-		//Any entries left in the copy are devices that have been removed from the
-		//descriptor table
-		for id, cancel := range copyActiveDevices {
-			shortform := manifest.GetDescriptorShortForm(id)
-			fmt.Printf("[%s] Device was removed from manifest. Stopping processing\n", shortform)
-			cancel()
-			delete(ourActiveDevices, id)
-		}
+	lm := manifest.NewLockManager(etcdConn, driver.DIDPrefix(), manifest.NewNodeID(), deviceHandler(driver, insert))
+	lm.Run(ctx)
+	//Run only returns once the device handlers have (or DrainTimeout has
+	//passed), and they only return once the drivers have stopped
+	//inserting. We keep the locks until the data is written, so that the
+	//node taking over does not race with us.
+	flush(insert)
+	lm.Release()
+}
 
-		//Check which of the devices are locked
-		ltable, err := manifest.GetLockTable(context.Background(), etcdConn, driver.DIDPrefix())
-		us, min2, locked := parseLTable(ltable, ourid)
-		//If we already have more than the two minimum nodes, then don't
-		//take on any new nodes
-		if us > min2 && min2 != -1 {
-			//Do not start doing a new device if we are not doing a small number
-			//of devices
-			continue
+//deviceHandler runs a device with the driver while this node holds its
+//lock. It returns once the driver has stopped, so that the lock manager only
+//releases the lock and the status is only removed when no more data for the
+//device is coming.
+func deviceHandler(driver Driver, insert *Inserter) manifest.DeviceHandler {
+	return func(ctx context.Context, md *manifest.ManifestDevice) {
+		shortform := manifest.GetDescriptorShortForm(md.Descriptor)
+		fmt.Printf("[%s] We locked device and are started processing\n", shortform)
+		var err error
+		if mdriver, ok := driver.(ManifestDriver); ok {
+			err = mdriver.HandleManifestDevice(ctx, md)
+		} else {
+			err = driver.HandleDevice(ctx, md.Descriptor)
 		}
-		fmt.Printf("We have a total of %d devices locked\n", us)
-		// We need to start a device
-		for _, d := range devs {
-			if locked[d.Descriptor] {
-				continue
-			}
-			identifier := d.Descriptor
-			ctx, cancel := context.WithCancel(context.Background())
-			gotlock, err := manifest.ObtainDeviceLock(ctx, etcdConn, d, ourid, driver.DIDPrefix())
-			if err != nil {
-				panic(err)
-			}
-			if gotlock {
-				shortform := manifest.GetDescriptorShortForm(identifier)
-				fmt.Printf("[%s] We locked device and are started processing\n", shortform)
-				ourActiveDevices[identifier] = cancel
-				err := driver.HandleDevice(ctx, identifier)
-				if err != nil {
-					fmt.Printf("[%s] device configuration error: %v\n", shortform, err)
-				}
-				continue devloop
-			} else {
-				cancel()
-			}
+		if err != nil {
+			fmt.Printf("[%s] device configuration error: %v\n", shortform, err)
 		}
+		//Keep the lock of a device that could not be started, so that it
+		//is not picked up by another node
+		<-ctx.Done()
+		fmt.Printf("[%s] Stopped processing device\n", shortform)
+		insert.ForgetDevice(md.Descriptor)
+		Status(md.Descriptor).Remove()
 	}
 }
 
-func parseLTable(t map[string][]string, ourid string) (int, int, map[string]bool) {
-	min := -1
-	min2 := -1
-	us := 0
-	locked := make(map[string]bool)
-	for k, v := range t {
-		//k is a node, v is a list of dids
-		if len(v) <= min || min == -1 {
-			min2 = min
-			min = len(v)
-		}
-		if k == ourid {
-			us = len(v)
-		}
-		for _, vi := range v {
-			locked[vi] = true
-		}
+func flush(insert *Inserter) {
+	fmt.Printf("Flushing buffered data (up to %s)\n", FlushTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+	defer cancel()
+	report := insert.Close(ctx)
+	if report.Clean() {
+		fmt.Printf("Shutdown complete: %s\n", report)
+	} else {
+		fmt.Printf("CRITICAL: shutdown lost data: %s\n", report)
 	}
-	return us, min2, locked
 }
 
+//DialLoop connects to the target and runs f on the connection, reconnecting
+//after a backoff when it fails. It returns once ctx is cancelled and f has
+//returned, so drivers should call it from HandleDevice rather than in a
+//goroutine.
 func DialLoop(ctx context.Context, target string, descriptor string, f DialProcessFunction) {
 	shortform := manifest.GetDescriptorShortForm(descriptor)
+	hb := Status(descriptor)
 	for {
 		if ctx.Err() != nil {
 			fmt.Printf("[%s] context cancelled\n", shortform)
 			return
 		}
 		fmt.Printf("[%s] beginning dial of %s\n", shortform, target)
+		hb.Connecting()
 		sctx, cancel := context.WithCancel(ctx)
 		err := dial(sctx, descriptor, target, f)
 		cancel()
 		fmt.Printf("[%s] fatal error: %v\n", shortform, err)
-		if ctx.Err() != nil {
+		hb.Disconnected(err)
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(10 * time.Second):
 		}
-		time.Sleep(10 * time.Second)
 		fmt.Printf("[%s] backoff over, reconnecting\n", shortform)
+		metrics.ForDevice(shortform).Reconnected()
 	}
 }
+
+//Loop is like DialLoop for drivers that make their own connection, f should
+//call Status(descriptor).Connected() once it is connected and return when
+//ctx is cancelled
 func Loop(ctx context.Context, descriptor string, f CustomProcessFunction) {
 	shortform := manifest.GetDescriptorShortForm(descriptor)
+	hb := Status(descriptor)
 	for {
 		if ctx.Err() != nil {
 			fmt.Printf("[%s] context cancelled\n", shortform)
 			return
 		}
 		fmt.Printf("[%s] beginning connect\n", shortform)
+		hb.Connecting()
 		sctx, cancel := context.WithCancel(ctx)
 		err := custom(sctx, descriptor, f)
 		cancel()
 		fmt.Printf("[%s] fatal error: %v\n", shortform, err)
-		time.Sleep(10 * time.Second)
+		hb.Disconnected(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
 		fmt.Printf("[%s] backoff over, reconnecting\n", shortform)
+		metrics.ForDevice(shortform).Reconnected()
 	}
 }
 func custom(ctx context.Context, descriptor string, f CustomProcessFunction) (err error) {
@@ -227,6 +250,7 @@ func dial(ctx context.Context, descriptor string, target string, f DialProcessFu
 		return err
 	}
 	fmt.Printf("[%s] dial succeeded\n", shortform)
+	Status(descriptor).Connected()
 	br := bufio.NewReader(conn)
 	return f(ctx, conn, br)
 }
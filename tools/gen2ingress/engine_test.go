@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//busyDriver inserts a point at a time until its device is stopped
+type busyDriver struct {
+	inserter *Inserter
+	produced int64
+}
+
+func (d *busyDriver) DIDPrefix() string          { return "test.busy" }
+func (d *busyDriver) InitiatesConnections() bool { return true }
+func (d *busyDriver) SetConn(in *Inserter)       { d.inserter = in }
+func (d *busyDriver) HandleDevice(ctx context.Context, descriptor string) error {
+	Loop(ctx, descriptor, func(ctx context.Context) error {
+		for i := int64(0); ctx.Err() == nil; i++ {
+			d.inserter.ProcessBatch([]InsertRecord{{
+				Data:       []btrdb.RawPoint{{Time: i, Value: 1}},
+				Collection: "test/busy",
+				Name:       "x",
+				Descriptor: descriptor,
+			}})
+			atomic.AddInt64(&d.produced, 1)
+		}
+		return ctx.Err()
+	})
+	return nil
+}
+
+func TestShutdownWhileProducing(t *testing.T) {
+	ms := NewMemorySink()
+	ins, err := NewInserter(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := &busyDriver{}
+	driver.SetConn(ins)
+	handler := deviceHandler(driver, ins)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		handler(ctx, &manifest.ManifestDevice{Descriptor: "test.busy.1"})
+		close(done)
+	}()
+	for atomic.LoadInt64(&driver.produced) < 100 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	//This is what Gen2Ingress does once the handlers have returned
+	cctx, ccancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccancel()
+	report := ins.Close(cctx)
+	if !report.Clean() {
+		t.Fatalf("unexpected loss: %s", report)
+	}
+	produced := atomic.LoadInt64(&driver.produced)
+	s := ms.Stream("test/busy", "x")
+	if s == nil || int64(len(s.Points())) != produced {
+		t.Fatalf("expected all %d points to be flushed", produced)
+	}
+}
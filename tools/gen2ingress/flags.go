@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//FlagsNamePlaceholder is replaced with the name of the signal in
+//FlagPolicy.StreamName
+const FlagsNamePlaceholder = "{name}"
+
+//FlagsUnit is the unit of the companion flags streams
+const FlagsUnit = "flags"
+
+//FlagPolicy controls what the Inserter does with InsertRecord.Flags
+type FlagPolicy struct {
+	//StreamName is the name of the stream the flags of a signal are written
+	//to, in the same collection, e.g. "{name}_FLAGS". If it is empty the
+	//flags are not stored.
+	StreamName string
+	//Samples with any of these bits set are not written to the signal
+	//stream. Their flags are still written to the flags stream.
+	DropMask uint64
+}
+
+//FlagPolicyFromEnv reads FLAGS_STREAM_NAME and FLAGS_DROP_MASK. The mask
+//may be given in hex with a 0x prefix.
+func FlagPolicyFromEnv() (*FlagPolicy, error) {
+	rv := &FlagPolicy{
+		StreamName: os.Getenv("FLAGS_STREAM_NAME"),
+	}
+	if rv.StreamName != "" && !strings.Contains(rv.StreamName, FlagsNamePlaceholder) {
+		return nil, fmt.Errorf("FLAGS_STREAM_NAME must contain %s", FlagsNamePlaceholder)
+	}
+	if m := os.Getenv("FLAGS_DROP_MASK"); m != "" {
+		mask, err := strconv.ParseUint(m, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("FLAGS_DROP_MASK is malformed: %v", err)
+		}
+		rv.DropMask = mask
+	}
+	return rv, nil
+}
+
+//flagsKey returns the key of the flags stream of the given signal
+func (p *FlagPolicy) flagsKey(sk streamkey) streamkey {
+	signal := sk.Signal
+	if signal == "" {
+		signal = sk.Name
+	}
+	return streamkey{
+		Collection: sk.Collection,
+		Name:       strings.Replace(p.StreamName, FlagsNamePlaceholder, sk.Name, -1),
+		Unit:       FlagsUnit,
+		Descriptor: sk.Descriptor,
+		Signal:     signal + "#flags",
+	}
+}
+
+//split returns the points of the record that should be written and the
+//points of its flags stream, which is nil if there is none. Records whose
+//flags do not line up with their data are written as is.
+func (p *FlagPolicy) split(ir *InsertRecord) (keep []btrdb.RawPoint, flags []btrdb.RawPoint) {
+	if len(ir.Flags) != len(ir.Data) {
+		return ir.Data, nil
+	}
+	if p.StreamName != "" {
+		flags = make([]btrdb.RawPoint, len(ir.Data))
+		for i, d := range ir.Data {
+			flags[i] = btrdb.RawPoint{Time: d.Time, Value: float64(ir.Flags[i])}
+		}
+	}
+	if p.DropMask == 0 {
+		return ir.Data, flags
+	}
+	keep = make([]btrdb.RawPoint, 0, len(ir.Data))
+	for i, d := range ir.Data {
+		if ir.Flags[i]&p.DropMask == 0 {
+			keep = append(keep, d)
+		}
+	}
+	return keep, flags
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"context"
+	"testing"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+func TestFlagPolicy(t *testing.T) {
+	ms := NewMemorySink()
+	ins, err := NewInserter(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins.SetFlagPolicy(FlagPolicy{StreamName: "{name}_FLAGS", DropMask: 0x4})
+	ins.ProcessBatch([]InsertRecord{
+		{
+			Data:       []btrdb.RawPoint{{Time: 1, Value: 10}, {Time: 2, Value: 20}, {Time: 3, Value: 30}},
+			Flags:      []uint64{0, 0x4, 0x1},
+			Collection: "test/flags",
+			Name:       "x",
+		},
+		//Without flags nothing is dropped or written to a flags stream
+		{
+			Data:       []btrdb.RawPoint{{Time: 1, Value: 1}},
+			Collection: "test/flags",
+			Name:       "y",
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ins.Close(ctx)
+
+	x := ms.Stream("test/flags", "x")
+	if x == nil || len(x.Points()) != 2 || x.Points()[0].Time != 1 || x.Points()[1].Time != 3 {
+		t.Fatalf("the flagged sample was not dropped")
+	}
+	xf := ms.Stream("test/flags", "x_FLAGS")
+	if xf == nil || xf.Unit != FlagsUnit {
+		t.Fatalf("flags stream was not created")
+	}
+	expected := []btrdb.RawPoint{{Time: 1, Value: 0}, {Time: 2, Value: 4}, {Time: 3, Value: 1}}
+	pts := xf.Points()
+	if len(pts) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, pts)
+	}
+	for i := range pts {
+		if pts[i] != expected[i] {
+			t.Fatalf("expected %v got %v", expected, pts)
+		}
+	}
+	if ms.Stream("test/flags", "y") == nil || ms.Stream("test/flags", "y_FLAGS") != nil {
+		t.Fatalf("record without flags was handled wrong")
+	}
+}
@@ -11,21 +11,29 @@ import (
 	"context"
 	"net"
 
+	"github.com/BTrDB/smartgridstore/tools/manifest"
 	"gopkg.in/BTrDB/btrdb.v4"
 )
 
 type InsertRecord struct {
 	Data []btrdb.RawPoint
-	//TODO this is not used
+	//Flags is either empty or holds the quality flags of each point in
+	//Data, see FlagPolicy
 	Flags             []uint64
 	Name              string
 	Collection        string
 	Unit              string
 	AnnotationChanges map[string]string
+	//The manifest descriptor of the device the data came from and the
+	//identity of the signal within it (Name if empty). Together they
+	//determine the UUID of the stream, see StreamUUID. Drivers that do not
+	//use the manifest can leave Descriptor empty.
+	Descriptor string
+	Signal     string
 }
 
 func (ir *InsertRecord) Size() int {
-	return len(ir.Data)*16 + 100
+	return len(ir.Data)*16 + len(ir.Flags)*8 + 100
 }
 
 type DialProcessFunction func(ctx context.Context, conn *net.TCPConn, r *bufio.Reader) error
@@ -42,6 +50,18 @@ type Driver interface {
 	//This is called early on
 	SetConn(in *Inserter)
 	//For devices that are connected TO, descriptors will be handed to the driver
-	//from the manifest table
+	//from the manifest table. It runs the device until ctx is cancelled and
+	//must only return once the device has stopped inserting, e.g. by calling
+	//DialLoop or Loop directly. An error means the device could not be
+	//started.
 	HandleDevice(ctx context.Context, descriptor string) error
 }
+
+//ManifestDriver is implemented by drivers that are configured by the
+//metadata of the device and its streams in the manifest. If a driver
+//implements it, HandleManifestDevice is called instead of HandleDevice, and
+//must block in the same way.
+type ManifestDriver interface {
+	Driver
+	HandleManifestDevice(ctx context.Context, md *manifest.ManifestDevice) error
+}
@@ -0,0 +1,444 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/pborman/uuid"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//A Sink is where the Inserter puts data. Normally this is BTrDB, but
+//drivers can be tested against the in-memory sink, and the file sink
+//allows a dry run ingest without a database.
+type Sink interface {
+	//OpenStream returns the stream described by spec, creating it if it
+	//does not exist. Several nodes may open the same stream at once, they
+	//must all end up with the same stream.
+	OpenStream(ctx context.Context, spec *StreamSpec) (SinkStream, error)
+	Close() error
+}
+
+type SinkStream interface {
+	Insert(ctx context.Context, dat []btrdb.RawPoint) error
+	//SetAnnotations adds or replaces the given annotations, leaving any
+	//others untouched
+	SetAnnotations(ctx context.Context, ann map[string]string) error
+}
+
+const (
+	SinkBTrDB = "btrdb"
+	SinkCSV   = "csv"
+	SinkLine  = "line"
+)
+
+type SinkConfig struct {
+	//One of SinkBTrDB, SinkCSV or SinkLine
+	Kind string
+	//For the file sinks, the file to write to, or "-" for stdout
+	Path string
+}
+
+//SinkConfigFromEnv parses INGRESS_SINK, which is one of
+// btrdb (the default)
+// csv:/path/to/file
+// line:/path/to/file
+//where the csv sink writes collection,name,unit,time,value rows and the
+//line sink writes influx line protocol. A path of - means stdout.
+func SinkConfigFromEnv() (*SinkConfig, error) {
+	return ParseSinkConfig(os.Getenv("INGRESS_SINK"))
+}
+
+func ParseSinkConfig(s string) (*SinkConfig, error) {
+	if s == "" || s == SinkBTrDB {
+		return &SinkConfig{Kind: SinkBTrDB}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("sink %q is malformed, expected btrdb, csv:<path> or line:<path>", s)
+	}
+	switch parts[0] {
+	case SinkCSV, SinkLine:
+		return &SinkConfig{Kind: parts[0], Path: parts[1]}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", parts[0])
+}
+
+//OpenSink connects to BTrDB or opens the output file, depending on the
+//configuration
+func OpenSink(ctx context.Context, cfg *SinkConfig) (Sink, error) {
+	switch cfg.Kind {
+	case SinkBTrDB:
+		log.Println("Connecting to BTrDB...")
+		db, err := btrdb.Connect(ctx, btrdb.EndpointsFromEnv()...)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Connected")
+		return NewBTrDBSink(db), nil
+	case SinkCSV, SinkLine:
+		log.Printf("Writing %s output to %s (dry run)", cfg.Kind, cfg.Path)
+		return OpenFileSink(cfg.Kind, cfg.Path)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Kind)
+}
+
+//BTrDBSink stores data in BTrDB
+type BTrDBSink struct {
+	db *btrdb.BTrDB
+}
+
+type btrdbSinkStream struct {
+	s *btrdb.Stream
+}
+
+func NewBTrDBSink(db *btrdb.BTrDB) *BTrDBSink {
+	return &BTrDBSink{db: db}
+}
+
+func (bs *BTrDBSink) OpenStream(ctx context.Context, spec *StreamSpec) (SinkStream, error) {
+	//If we lose a race with another node the second lookup finds its stream
+	for attempt := 0; attempt < 2; attempt++ {
+		st, err := bs.lookup(ctx, spec)
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			return &btrdbSinkStream{s: st}, nil
+		}
+		st, err = bs.db.Create(ctx, spec.UUID, spec.Collection, spec.Tags(), spec.Annotations())
+		if err == nil {
+			return &btrdbSinkStream{s: st}, nil
+		}
+		if btrdb.ToCodedError(err).Code != bte.StreamExists {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("stream %s/%s (%s) exists but could not be found", spec.Collection, spec.Name, spec.UUID)
+}
+
+//lookup returns nil if the stream does not exist
+func (bs *BTrDBSink) lookup(ctx context.Context, spec *StreamSpec) (*btrdb.Stream, error) {
+	st := bs.db.StreamFromUUID(spec.UUID)
+	ex, err := st.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ex {
+		col, err := st.Collection(ctx)
+		if err == nil && col != spec.Collection {
+			fmt.Printf("stream %s is in collection %q, not %q, it was probably renamed\n", spec.UUID, col, spec.Collection)
+		}
+		return st, nil
+	}
+	//Streams created before the UUIDs were deterministic. Those with a
+	//signal annotation belong to another device that uses the same name.
+	sz, err := bs.db.LookupStreams(ctx, spec.Collection, false, btrdb.OptKV("name", spec.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+	legacy := []*btrdb.Stream{}
+	for _, st := range sz {
+		anns, _, err := st.Annotations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := anns["signal"]; !ok {
+			legacy = append(legacy, st)
+		}
+	}
+	if len(legacy) == 0 {
+		return nil, nil
+	}
+	if len(legacy) > 1 {
+		fmt.Printf("WARNING: %d streams named %q in %q, use streamdedup to merge them\n", len(legacy), spec.Name, spec.Collection)
+	}
+	return legacy[0], nil
+}
+
+func (bs *BTrDBSink) Close() error {
+	return bs.db.Disconnect()
+}
+
+func (s *btrdbSinkStream) Insert(ctx context.Context, dat []btrdb.RawPoint) error {
+	err := s.s.Insert(ctx, dat)
+	if err != nil {
+		return fmt.Errorf("stream %s: %v", s.s.UUID().String(), err)
+	}
+	return nil
+}
+
+func (s *btrdbSinkStream) SetAnnotations(ctx context.Context, ann map[string]string) error {
+	_, aver, err := s.s.Annotations(ctx)
+	if err != nil {
+		return err
+	}
+	changes := make(map[string]*string)
+	for k, v := range ann {
+		vc := v
+		changes[k] = &vc
+	}
+	err = s.s.CompareAndSetAnnotation(ctx, aver, changes)
+	if err != nil {
+		return fmt.Errorf("stream %s: %v (%d)", s.s.UUID().String(), err, aver)
+	}
+	return nil
+}
+
+//MemorySink keeps everything in memory, it is intended for tests
+type MemorySink struct {
+	mu      sync.Mutex
+	streams map[[2]string]*MemoryStream
+}
+
+type MemoryStream struct {
+	mu          sync.Mutex
+	UUID        uuid.UUID
+	Collection  string
+	Name        string
+	Unit        string
+	points      []btrdb.RawPoint
+	annotations map[string]string
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{streams: make(map[[2]string]*MemoryStream)}
+}
+
+func (ms *MemorySink) OpenStream(ctx context.Context, spec *StreamSpec) (SinkStream, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	key := [2]string{spec.Collection, spec.Name}
+	if s, ok := ms.streams[key]; ok {
+		return s, nil
+	}
+	s := &MemoryStream{
+		UUID:        spec.UUID,
+		Collection:  spec.Collection,
+		Name:        spec.Name,
+		Unit:        spec.Unit,
+		annotations: spec.Annotations(),
+	}
+	ms.streams[key] = s
+	return s, nil
+}
+
+func (ms *MemorySink) Close() error {
+	return nil
+}
+
+//Stream returns the given stream, or nil if it has not been created
+func (ms *MemorySink) Stream(collection string, name string) *MemoryStream {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.streams[[2]string{collection, name}]
+}
+
+//Streams returns all the streams sorted by collection and name
+func (ms *MemorySink) Streams() []*MemoryStream {
+	ms.mu.Lock()
+	rv := make([]*MemoryStream, 0, len(ms.streams))
+	for _, s := range ms.streams {
+		rv = append(rv, s)
+	}
+	ms.mu.Unlock()
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Collection != rv[j].Collection {
+			return rv[i].Collection < rv[j].Collection
+		}
+		return rv[i].Name < rv[j].Name
+	})
+	return rv
+}
+
+func (s *MemoryStream) Insert(ctx context.Context, dat []btrdb.RawPoint) error {
+	s.mu.Lock()
+	s.points = append(s.points, dat...)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStream) SetAnnotations(ctx context.Context, ann map[string]string) error {
+	s.mu.Lock()
+	for k, v := range ann {
+		s.annotations[k] = v
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+//Points returns a copy of the points in insertion order
+func (s *MemoryStream) Points() []btrdb.RawPoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]btrdb.RawPoint{}, s.points...)
+}
+
+//Annotations returns a copy of the annotations
+func (s *MemoryStream) Annotations() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rv := make(map[string]string, len(s.annotations))
+	for k, v := range s.annotations {
+		rv[k] = v
+	}
+	return rv
+}
+
+//FileSink writes every insert to a file, either as CSV or as influx line
+//protocol. Annotations are written as comment lines. Streams are never
+//looked up from the file, so every stream is created on first use.
+type FileSink struct {
+	mu     sync.Mutex
+	kind   string
+	f      io.WriteCloser
+	w      *bufio.Writer
+	csv    *csv.Writer
+	closed bool
+}
+
+type fileSinkStream struct {
+	fs         *FileSink
+	collection string
+	name       string
+	unit       string
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func OpenFileSink(kind string, path string) (*FileSink, error) {
+	var f io.WriteCloser
+	if path == "-" {
+		f = nopCloser{os.Stdout}
+	} else {
+		of, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		f = of
+	}
+	return NewFileSink(kind, f)
+}
+
+//NewFileSink writes to w, which is closed when the sink is closed
+func NewFileSink(kind string, w io.WriteCloser) (*FileSink, error) {
+	fs := &FileSink{
+		kind: kind,
+		f:    w,
+		w:    bufio.NewWriter(w),
+	}
+	switch kind {
+	case SinkCSV:
+		fs.csv = csv.NewWriter(fs.w)
+		fs.csv.Write([]string{"collection", "name", "unit", "time", "value"})
+		fs.csv.Flush()
+	case SinkLine:
+	default:
+		return nil, fmt.Errorf("unknown file sink type %q", kind)
+	}
+	return fs, fs.w.Flush()
+}
+
+func (fs *FileSink) OpenStream(ctx context.Context, spec *StreamSpec) (SinkStream, error) {
+	return &fileSinkStream{fs: fs, collection: spec.Collection, name: spec.Name, unit: spec.Unit}, nil
+}
+
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	err := fs.w.Flush()
+	cerr := fs.f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+//Line protocol measurements escape commas and spaces, tag values also
+//escape equals signs
+var lineMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+var lineTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`, "\n", `\n`)
+
+func (s *fileSinkStream) Insert(ctx context.Context, dat []btrdb.RawPoint) error {
+	fs := s.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return fmt.Errorf("sink is closed")
+	}
+	switch fs.kind {
+	case SinkCSV:
+		row := []string{s.collection, s.name, s.unit, "", ""}
+		for _, p := range dat {
+			row[3] = strconv.FormatInt(p.Time, 10)
+			row[4] = strconv.FormatFloat(p.Value, 'g', -1, 64)
+			fs.csv.Write(row)
+		}
+		fs.csv.Flush()
+		if err := fs.csv.Error(); err != nil {
+			return err
+		}
+	case SinkLine:
+		prefix := fmt.Sprintf("%s,name=%s,unit=%s value=",
+			lineMeasurementEscaper.Replace(s.collection),
+			lineTagEscaper.Replace(s.name),
+			lineTagEscaper.Replace(s.unit))
+		if s.unit == "" {
+			prefix = fmt.Sprintf("%s,name=%s value=",
+				lineMeasurementEscaper.Replace(s.collection),
+				lineTagEscaper.Replace(s.name))
+		}
+		for _, p := range dat {
+			fs.w.WriteString(prefix)
+			fs.w.WriteString(strconv.FormatFloat(p.Value, 'g', -1, 64))
+			fs.w.WriteByte(' ')
+			fs.w.WriteString(strconv.FormatInt(p.Time, 10))
+			fs.w.WriteByte('\n')
+		}
+	}
+	return fs.w.Flush()
+}
+
+func (s *fileSinkStream) SetAnnotations(ctx context.Context, ann map[string]string) error {
+	fs := s.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return fmt.Errorf("sink is closed")
+	}
+	keys := make([]string, 0, len(ann))
+	for k := range ann {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(fs.w, "# annotation %s %s %s=%q\n", s.collection, s.name, k, ann[k])
+	}
+	return fs.w.Flush()
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+func waitForPoints(t *testing.T, ms *MemorySink, collection string, name string, n int) *MemoryStream {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s := ms.Stream(collection, name)
+		if s != nil && len(s.Points()) >= n {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d points in %s/%s", n, collection, name)
+	return nil
+}
+
+func TestInserterMemorySink(t *testing.T) {
+	ms := NewMemorySink()
+	ins, err := NewInserter(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins.ProcessBatch([]InsertRecord{
+		{
+			Data:              []btrdb.RawPoint{{Time: 1, Value: 1}, {Time: 2, Value: 2}},
+			Collection:        "test/a",
+			Name:              "x",
+			Unit:              "V",
+			AnnotationChanges: map[string]string{"k": "v"},
+		},
+		//This used to panic the whole daemon
+		{
+			Data: []btrdb.RawPoint{{Time: 1, Value: 1}},
+			Name: "nocollection",
+		},
+		{
+			Data:       []btrdb.RawPoint{{Time: 3, Value: 3}},
+			Collection: "test/a",
+			Name:       "x",
+			Unit:       "V",
+		},
+	})
+	s := waitForPoints(t, ms, "test/a", "x", 3)
+	if s.Unit != "V" {
+		t.Fatalf("expected unit V got %q", s.Unit)
+	}
+	if s.Annotations()["k"] != "v" {
+		t.Fatalf("annotation was not set: %v", s.Annotations())
+	}
+	total := 0.0
+	for _, p := range s.Points() {
+		total += p.Value
+	}
+	if total != 6 {
+		t.Fatalf("unexpected points %v", s.Points())
+	}
+	if len(ms.Streams()) != 1 {
+		t.Fatalf("expected one stream, got %d", len(ms.Streams()))
+	}
+}
+
+func TestInserterClose(t *testing.T) {
+	ms := NewMemorySink()
+	ins, err := NewInserter(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Nothing is flushed on the interval, only on Close
+	ins.SetCoalesceInterval(time.Hour)
+	for i := 0; i < 100; i++ {
+		ins.ProcessBatch([]InsertRecord{{
+			Data:              []btrdb.RawPoint{{Time: int64(i), Value: 1}},
+			Collection:        "test/close",
+			Name:              "x",
+			AnnotationChanges: map[string]string{"k": "v"},
+		}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report := ins.Close(ctx)
+	if !report.Clean() {
+		t.Fatalf("unexpected loss: %s", report)
+	}
+	s := ms.Stream("test/close", "x")
+	if s == nil || len(s.Points()) != 100 {
+		t.Fatalf("expected 100 points to be flushed")
+	}
+	ins.ProcessBatch([]InsertRecord{{
+		Data:       []btrdb.RawPoint{{Time: 200, Value: 1}},
+		Collection: "test/close",
+		Name:       "x",
+	}})
+	if ins.late != 1 {
+		t.Fatalf("expected a late reading, got %d", ins.late)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	cases := []struct {
+		kind     string
+		expected string
+	}{
+		{SinkCSV, "collection,name,unit,time,value\n" +
+			"# annotation test/a my name k=\"v\"\n" +
+			"test/a,my name,V,1000,1.5\n" +
+			"test/a,my name,V,2000,-2\n"},
+		{SinkLine, "# annotation test/a my name k=\"v\"\n" +
+			"test/a,name=my\\ name,unit=V value=1.5 1000\n" +
+			"test/a,name=my\\ name,unit=V value=-2 2000\n"},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		fs, err := NewFileSink(c.kind, nopCloser{buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := fs.OpenStream(context.Background(), &StreamSpec{Collection: "test/a", Name: "my name", Unit: "V"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.SetAnnotations(context.Background(), map[string]string{"k": "v"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.Insert(context.Background(), []btrdb.RawPoint{{Time: 1000, Value: 1.5}, {Time: 2000, Value: -2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.expected {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", c.kind, c.expected, buf.String())
+		}
+		if st.Insert(context.Background(), nil) == nil {
+			t.Fatalf("%s: insert after close should fail", c.kind)
+		}
+	}
+}
+
+func TestParseSinkConfig(t *testing.T) {
+	for in, exp := range map[string]SinkConfig{
+		"":                   {Kind: SinkBTrDB},
+		"btrdb":              {Kind: SinkBTrDB},
+		"csv:-":              {Kind: SinkCSV, Path: "-"},
+		"line:/tmp/out.line": {Kind: SinkLine, Path: "/tmp/out.line"},
+	} {
+		cfg, err := ParseSinkConfig(in)
+		if err != nil || *cfg != exp {
+			t.Fatalf("%q: expected %+v got %+v (%v)", in, exp, cfg, err)
+		}
+	}
+	for _, in := range []string{"csv", "csv:", "parquet:/tmp/x", "memory"} {
+		_, err := ParseSinkConfig(in)
+		if err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
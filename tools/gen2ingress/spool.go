@@ -0,0 +1,575 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//The spool is an on-disk write ahead queue of InsertRecords. Records are
+//appended to numbered segment files and a cursor file records how far
+//replay has progressed. Segments are only deleted once every record in
+//them has been acknowledged after a successful insert.
+
+//Default spool size limit is 10GB
+const DefaultSpoolMaxSize = 10 * 1000 * 1000 * 1000
+
+//Default replay rate is 1000 records per second
+const DefaultSpoolReplayRate = 1000
+
+//Segments are rotated once they exceed this size
+const spoolSegmentSize = 64 * 1024 * 1024
+
+const spoolCursorFile = "cursor"
+const spoolSegmentPrefix = "segment-"
+const spoolSegmentSuffix = ".dat"
+
+//Each entry is prefixed with its length and a CRC of the payload
+const spoolEntryHeader = 8
+
+type SpoolConfig struct {
+	Directory string
+	//Maximum total size of the segment files in bytes
+	MaxSize int64
+	//Maximum number of records per second replayed into BTrDB
+	ReplayRate int
+}
+
+//SpoolConfigFromEnv returns the spool configuration in the environment, or
+//nil if SPOOL_DIRECTORY is not set (which disables the spool)
+func SpoolConfigFromEnv() *SpoolConfig {
+	dir := os.Getenv("SPOOL_DIRECTORY")
+	if dir == "" {
+		return nil
+	}
+	rv := &SpoolConfig{
+		Directory:  dir,
+		MaxSize:    DefaultSpoolMaxSize,
+		ReplayRate: DefaultSpoolReplayRate,
+	}
+	if p := os.Getenv("SPOOL_MAX_SIZE"); p != "" {
+		parsed, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		rv.MaxSize = parsed
+	}
+	if p := os.Getenv("SPOOL_REPLAY_RATE"); p != "" {
+		parsed, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		rv.ReplayRate = int(parsed)
+	}
+	return rv
+}
+
+type spoolPosition struct {
+	Segment int64
+	Offset  int64
+}
+
+type spoolEntry struct {
+	Record InsertRecord
+	//The position immediately after this entry
+	End spoolPosition
+}
+
+//errSpoolClosed is returned by operations on a spool after Close
+var errSpoolClosed = fmt.Errorf("spool is closed")
+
+type Spool struct {
+	mu     sync.Mutex
+	cfg    SpoolConfig
+	closed bool
+	//Segments are rotated once they exceed this size
+	segmentSize int64
+	wseg        int64
+	wfile       *os.File
+	woff        int64
+	size        int64
+	cursor      spoolPosition
+	rfile       *os.File
+	rseg        int64
+	rbuf        *bufio.Reader
+	roff        int64
+}
+
+//OpenSpool opens (or creates) the spool in the configured directory. Any
+//records left over from a previous run will be replayed
+func OpenSpool(cfg SpoolConfig) (*Spool, error) {
+	if cfg.ReplayRate <= 0 {
+		cfg.ReplayRate = DefaultSpoolReplayRate
+	}
+	err := os.MkdirAll(cfg.Directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	sp := &Spool{cfg: cfg, rseg: -1, segmentSize: spoolSegmentSize}
+	segs, err := sp.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range segs {
+		fi, err := os.Stat(sp.segmentPath(s))
+		if err != nil {
+			return nil, err
+		}
+		sp.size += fi.Size()
+	}
+	cdata, err := ioutil.ReadFile(filepath.Join(cfg.Directory, spoolCursorFile))
+	if err == nil {
+		_, err = fmt.Sscanf(string(cdata), "%d %d", &sp.cursor.Segment, &sp.cursor.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt spool cursor: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(segs) > 0 && sp.cursor.Segment < segs[0] {
+		sp.cursor = spoolPosition{Segment: segs[0]}
+	}
+	//Begin writing into a fresh segment so that a record torn by a crash can
+	//only ever be at the end of a segment we no longer append to. An empty
+	//last segment cannot hold a torn record, so it is reused, which is
+	//always the case after a clean shutdown with everything replayed.
+	sp.wseg = sp.cursor.Segment
+	if len(segs) > 0 {
+		last := segs[len(segs)-1]
+		sp.wseg = last + 1
+		fi, err := os.Stat(sp.segmentPath(last))
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() == 0 && sp.cursor.Segment <= last {
+			sp.wseg = last
+		}
+	}
+	if sp.cursor.Segment > sp.wseg {
+		//Everything on disk has been acknowledged
+		sp.wseg = sp.cursor.Segment
+	}
+	if err := sp.openWriteSegment(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func (sp *Spool) segmentPath(seg int64) string {
+	return filepath.Join(sp.cfg.Directory, fmt.Sprintf("%s%016d%s", spoolSegmentPrefix, seg, spoolSegmentSuffix))
+}
+
+//segments returns the numbers of the segment files in ascending order
+func (sp *Spool) segments() ([]int64, error) {
+	ents, err := ioutil.ReadDir(sp.cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+	rv := []int64{}
+	for _, e := range ents {
+		n := e.Name()
+		if !strings.HasPrefix(n, spoolSegmentPrefix) || !strings.HasSuffix(n, spoolSegmentSuffix) {
+			continue
+		}
+		seg, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(n, spoolSegmentPrefix), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		rv = append(rv, seg)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i] < rv[j] })
+	return rv, nil
+}
+
+func (sp *Spool) openWriteSegment() error {
+	f, err := os.OpenFile(sp.segmentPath(sp.wseg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	sp.wfile = f
+	sp.woff = fi.Size()
+	return nil
+}
+
+//Size returns the total number of bytes in the spool
+func (sp *Spool) Size() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.size
+}
+
+//Empty returns true if every record in the spool has been acknowledged
+func (sp *Spool) Empty() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.cursor.Segment == sp.wseg && sp.cursor.Offset >= sp.woff
+}
+
+//Append durably writes the records to the spool. If the spool would exceed
+//its size limit, nothing is written and false is returned
+func (sp *Spool) Append(irz []InsertRecord) (bool, error) {
+	buf := bytes.Buffer{}
+	for idx := range irz {
+		payload := encodeSpoolRecord(&irz[idx])
+		hdr := make([]byte, spoolEntryHeader)
+		binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(payload))
+		buf.Write(hdr)
+		buf.Write(payload)
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.size+int64(buf.Len()) > sp.cfg.MaxSize {
+		return false, nil
+	}
+	if sp.closed {
+		return false, errSpoolClosed
+	}
+	if sp.woff > sp.segmentSize {
+		if err := sp.wfile.Close(); err != nil {
+			return false, err
+		}
+		sp.wseg++
+		if err := sp.openWriteSegment(); err != nil {
+			return false, err
+		}
+	}
+	n, err := sp.wfile.Write(buf.Bytes())
+	sp.woff += int64(n)
+	sp.size += int64(n)
+	if err != nil {
+		return false, err
+	}
+	return true, sp.wfile.Sync()
+}
+
+//Read returns up to max unacknowledged records following the given
+//position, and the position it read up to. That is past the end of the
+//records if it skipped the end of a finished segment, so it should be
+//acknowledged even if there are no records. Read does not advance the
+//cursor, call Ack once the records have been inserted
+func (sp *Spool) Read(from spoolPosition, max int) ([]spoolEntry, spoolPosition, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	rv := []spoolEntry{}
+	pos := from
+	if sp.closed {
+		return rv, pos, errSpoolClosed
+	}
+	for len(rv) < max {
+		if pos.Segment == sp.wseg && pos.Offset >= sp.woff {
+			return rv, pos, nil
+		}
+		if err := sp.seekRead(pos); err != nil {
+			return rv, pos, err
+		}
+		ir, n, err := sp.readEntry()
+		if err != nil {
+			if pos.Segment == sp.wseg {
+				//The writer has not finished this entry
+				return rv, pos, nil
+			}
+			//We have reached the end of a segment that will never be written
+			//again (possibly with a torn record from a crash) so move on
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				fmt.Printf("WARNING: discarding the remainder of spool segment %d: %v\n", pos.Segment, err)
+			}
+			pos = spoolPosition{Segment: pos.Segment + 1}
+			continue
+		}
+		pos.Offset += n
+		sp.roff = pos.Offset
+		rv = append(rv, spoolEntry{Record: ir, End: pos})
+	}
+	return rv, pos, nil
+}
+
+func (sp *Spool) seekRead(pos spoolPosition) error {
+	if sp.rfile != nil && sp.rseg == pos.Segment && sp.roff == pos.Offset {
+		return nil
+	}
+	if sp.rfile != nil {
+		sp.rfile.Close()
+		sp.rfile = nil
+	}
+	f, err := os.Open(sp.segmentPath(pos.Segment))
+	if err != nil {
+		if os.IsNotExist(err) && pos.Segment < sp.wseg {
+			//Treat a missing segment as an empty one
+			sp.rfile = nil
+			return nil
+		}
+		return err
+	}
+	_, err = f.Seek(pos.Offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	sp.rfile = f
+	sp.rseg = pos.Segment
+	sp.roff = pos.Offset
+	sp.rbuf = bufio.NewReader(f)
+	return nil
+}
+
+func (sp *Spool) readEntry() (InsertRecord, int64, error) {
+	if sp.rfile == nil {
+		return InsertRecord{}, 0, io.EOF
+	}
+	hdr := make([]byte, spoolEntryHeader)
+	_, err := io.ReadFull(sp.rbuf, hdr)
+	if err != nil {
+		sp.invalidateRead()
+		return InsertRecord{}, 0, err
+	}
+	ln := binary.LittleEndian.Uint32(hdr[0:4])
+	payload := make([]byte, ln)
+	_, err = io.ReadFull(sp.rbuf, payload)
+	if err != nil {
+		sp.invalidateRead()
+		return InsertRecord{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		sp.invalidateRead()
+		return InsertRecord{}, 0, fmt.Errorf("checksum mismatch")
+	}
+	ir, err := decodeSpoolRecord(payload)
+	if err != nil {
+		sp.invalidateRead()
+		return InsertRecord{}, 0, err
+	}
+	return ir, int64(spoolEntryHeader) + int64(ln), nil
+}
+
+func (sp *Spool) invalidateRead() {
+	if sp.rfile != nil {
+		sp.rfile.Close()
+	}
+	sp.rfile = nil
+	sp.rseg = -1
+}
+
+//Cursor returns the position of the first unacknowledged record
+func (sp *Spool) Cursor() spoolPosition {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.cursor
+}
+
+//Ack marks every record before pos as inserted, and deletes any segments
+//that are now fully acknowledged
+func (sp *Spool) Ack(pos spoolPosition) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.closed {
+		return errSpoolClosed
+	}
+	if err := sp.ackLocked(pos); err != nil {
+		return err
+	}
+	segs, err := sp.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s >= pos.Segment || s == sp.wseg {
+			break
+		}
+		p := sp.segmentPath(s)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		sp.size -= fi.Size()
+	}
+	//If the reader has caught up with the writer, start a new write segment
+	//and delete the old one rather than letting it grow
+	if pos.Segment == sp.wseg && pos.Offset == sp.woff && sp.woff > 0 {
+		sp.invalidateRead()
+		if err := sp.wfile.Close(); err != nil {
+			return err
+		}
+		old := sp.segmentPath(sp.wseg)
+		sp.size -= sp.woff
+		sp.wseg++
+		if err := sp.openWriteSegment(); err != nil {
+			return err
+		}
+		if err := sp.ackLocked(spoolPosition{Segment: sp.wseg}); err != nil {
+			return err
+		}
+		return os.Remove(old)
+	}
+	return nil
+}
+
+func (sp *Spool) ackLocked(pos spoolPosition) error {
+	tmp := filepath.Join(sp.cfg.Directory, spoolCursorFile+".tmp")
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", pos.Segment, pos.Offset)), 0644)
+	if err != nil {
+		return err
+	}
+	sp.cursor = pos
+	return os.Rename(tmp, filepath.Join(sp.cfg.Directory, spoolCursorFile))
+}
+
+//Close closes the spool files. Unacknowledged records remain on disk and
+//will be replayed when the spool is next opened
+func (sp *Spool) Close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.closed {
+		return nil
+	}
+	sp.closed = true
+	sp.invalidateRead()
+	return sp.wfile.Close()
+}
+
+func encodeSpoolRecord(ir *InsertRecord) []byte {
+	buf := bytes.Buffer{}
+	putString := func(s string) {
+		var l [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(l[:], uint64(len(s)))
+		buf.Write(l[:n])
+		buf.WriteString(s)
+	}
+	putUvarint := func(v uint64) {
+		var l [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(l[:], v)
+		buf.Write(l[:n])
+	}
+	putString(ir.Collection)
+	putString(ir.Name)
+	putString(ir.Unit)
+	putString(ir.Descriptor)
+	putString(ir.Signal)
+	putUvarint(uint64(len(ir.AnnotationChanges)))
+	for k, v := range ir.AnnotationChanges {
+		putString(k)
+		putString(v)
+	}
+	putUvarint(uint64(len(ir.Data)))
+	var pt [16]byte
+	for _, d := range ir.Data {
+		binary.LittleEndian.PutUint64(pt[0:8], uint64(d.Time))
+		binary.LittleEndian.PutUint64(pt[8:16], math.Float64bits(d.Value))
+		buf.Write(pt[:])
+	}
+	putUvarint(uint64(len(ir.Flags)))
+	for _, f := range ir.Flags {
+		putUvarint(f)
+	}
+	return buf.Bytes()
+}
+
+func decodeSpoolRecord(b []byte) (InsertRecord, error) {
+	r := bytes.NewReader(b)
+	rv := InsertRecord{}
+	getString := func() (string, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if l > uint64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := make([]byte, l)
+		_, err = io.ReadFull(r, s)
+		return string(s), err
+	}
+	var err error
+	if rv.Collection, err = getString(); err != nil {
+		return rv, err
+	}
+	if rv.Name, err = getString(); err != nil {
+		return rv, err
+	}
+	if rv.Unit, err = getString(); err != nil {
+		return rv, err
+	}
+	if rv.Descriptor, err = getString(); err != nil {
+		return rv, err
+	}
+	if rv.Signal, err = getString(); err != nil {
+		return rv, err
+	}
+	nanns, err := binary.ReadUvarint(r)
+	if err != nil {
+		return rv, err
+	}
+	if nanns > 0 {
+		rv.AnnotationChanges = make(map[string]string)
+	}
+	for i := uint64(0); i < nanns; i++ {
+		k, err := getString()
+		if err != nil {
+			return rv, err
+		}
+		v, err := getString()
+		if err != nil {
+			return rv, err
+		}
+		rv.AnnotationChanges[k] = v
+	}
+	npts, err := binary.ReadUvarint(r)
+	if err != nil {
+		return rv, err
+	}
+	if npts*16 > uint64(r.Len()) {
+		return rv, io.ErrUnexpectedEOF
+	}
+	rv.Data = make([]btrdb.RawPoint, npts)
+	var pt [16]byte
+	for i := range rv.Data {
+		if _, err := io.ReadFull(r, pt[:]); err != nil {
+			return rv, err
+		}
+		rv.Data[i].Time = int64(binary.LittleEndian.Uint64(pt[0:8]))
+		rv.Data[i].Value = math.Float64frombits(binary.LittleEndian.Uint64(pt[8:16]))
+	}
+	nflags, err := binary.ReadUvarint(r)
+	if err != nil {
+		return rv, err
+	}
+	if nflags > 0 {
+		rv.Flags = make([]uint64, nflags)
+	}
+	for i := range rv.Flags {
+		if rv.Flags[i], err = binary.ReadUvarint(r); err != nil {
+			return rv, err
+		}
+	}
+	if r.Len() != 0 {
+		return rv, fmt.Errorf("%d bytes after the end of the record", r.Len())
+	}
+	return rv, nil
+}
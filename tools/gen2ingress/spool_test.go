@@ -0,0 +1,260 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+func spoolRecord(name string, t int64) InsertRecord {
+	return InsertRecord{
+		Data:       []btrdb.RawPoint{{Time: t, Value: float64(t)}},
+		Collection: "test/spool",
+		Name:       name,
+		Descriptor: "dev",
+		Signal:     name,
+	}
+}
+
+func openTestSpool(t *testing.T, dir string) *Spool {
+	sp, err := OpenSpool(SpoolConfig{Directory: dir, MaxSize: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func appendRecords(t *testing.T, sp *Spool, from int64, to int64) {
+	for i := from; i < to; i++ {
+		ok, err := sp.Append([]InsertRecord{spoolRecord("x", i)})
+		if err != nil || !ok {
+			t.Fatalf("append failed: %v %v", ok, err)
+		}
+	}
+}
+
+//readAll reads every record in the spool from the cursor, and returns their
+//times and the position reached
+func readAll(t *testing.T, sp *Spool) ([]int64, spoolPosition) {
+	rv := []int64{}
+	pos := sp.Cursor()
+	for {
+		ents, end, err := sp.Read(pos, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range ents {
+			rv = append(rv, e.Record.Data[0].Time)
+		}
+		if end == pos {
+			return rv, pos
+		}
+		pos = end
+	}
+}
+
+func expectTimes(t *testing.T, got []int64, from int64, to int64) {
+	if int64(len(got)) != to-from {
+		t.Fatalf("expected %d records got %v", to-from, got)
+	}
+	for i, v := range got {
+		if v != from+int64(i) {
+			t.Fatalf("expected record %d to be %d got %v", i, from+int64(i), got)
+		}
+	}
+}
+
+func TestSpoolRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp := openTestSpool(t, dir)
+	sp.segmentSize = 100
+	appendRecords(t, sp, 0, 20)
+	segs, err := sp.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 3 {
+		t.Fatalf("expected the segments to rotate, got %v", segs)
+	}
+	if sp.Empty() {
+		t.Fatalf("spool with records should not be empty")
+	}
+	times, end := readAll(t, sp)
+	expectTimes(t, times, 0, 20)
+	if err := sp.Ack(end); err != nil {
+		t.Fatal(err)
+	}
+	if !sp.Empty() {
+		t.Fatalf("spool should be empty once everything is acknowledged")
+	}
+	segs, err = sp.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 1 || sp.Size() != 0 {
+		t.Fatalf("expected only an empty write segment to be left, got %v and %d bytes", segs, sp.Size())
+	}
+	sp.Close()
+	if _, err := sp.Append([]InsertRecord{spoolRecord("x", 1)}); err != errSpoolClosed {
+		t.Fatalf("expected append to a closed spool to fail, got %v", err)
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp := openTestSpool(t, dir)
+	appendRecords(t, sp, 0, 10)
+	ents, _, err := sp.Read(sp.Cursor(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Ack(ents[3].End); err != nil {
+		t.Fatal(err)
+	}
+	sp.Close()
+
+	//The cursor survives a restart, and new records follow the old ones
+	sp = openTestSpool(t, dir)
+	appendRecords(t, sp, 10, 12)
+	times, end := readAll(t, sp)
+	expectTimes(t, times, 4, 12)
+	if err := sp.Ack(end); err != nil {
+		t.Fatal(err)
+	}
+	if !sp.Empty() {
+		t.Fatalf("spool should be empty once everything is acknowledged")
+	}
+	sp.Close()
+
+	//After a clean shutdown the spool is empty as soon as it is opened, so
+	//batches are not sent through it
+	sp = openTestSpool(t, dir)
+	defer sp.Close()
+	if !sp.Empty() {
+		t.Fatalf("expected an empty spool after reopening, cursor %v", sp.Cursor())
+	}
+}
+
+func TestSpoolTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp := openTestSpool(t, dir)
+	appendRecords(t, sp, 0, 5)
+	seg := sp.wseg
+	sp.Close()
+	//A crash part way through writing a record
+	f, err := os.OpenFile(sp.segmentPath(seg), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{200, 0, 0, 0, 1, 2, 3, 4, 5})
+	f.Close()
+
+	sp = openTestSpool(t, dir)
+	defer sp.Close()
+	if sp.wseg == seg {
+		t.Fatalf("expected a new write segment after the torn record")
+	}
+	appendRecords(t, sp, 5, 8)
+	times, end := readAll(t, sp)
+	expectTimes(t, times, 0, 8)
+	if err := sp.Ack(end); err != nil {
+		t.Fatal(err)
+	}
+	if !sp.Empty() {
+		t.Fatalf("spool should be empty once everything is acknowledged")
+	}
+	if _, err := os.Stat(sp.segmentPath(seg)); !os.IsNotExist(err) {
+		t.Fatalf("expected the segment with the torn record to be deleted: %v", err)
+	}
+}
+
+//blockingSink has streams whose inserts block until they are cancelled
+type blockingSink struct {
+	inserting chan struct{}
+}
+
+func (bs *blockingSink) OpenStream(ctx context.Context, spec *StreamSpec) (SinkStream, error) {
+	return bs, nil
+}
+
+func (bs *blockingSink) Close() error {
+	return nil
+}
+
+func (bs *blockingSink) Insert(ctx context.Context, dat []btrdb.RawPoint) error {
+	select {
+	case bs.inserting <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (bs *blockingSink) SetAnnotations(ctx context.Context, ann map[string]string) error {
+	return nil
+}
+
+func TestSpoolReplayClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp := openTestSpool(t, dir)
+	appendRecords(t, sp, 0, 5)
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SPOOL_DIRECTORY", dir)
+	defer os.Unsetenv("SPOOL_DIRECTORY")
+	bs := &blockingSink{inserting: make(chan struct{}, 1)}
+	ins, err := NewInserter(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bs.inserting:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the spool was not replayed")
+	}
+	//The deadline passes while the replayer is blocked in an insert
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report := ins.Close(ctx)
+	select {
+	case <-ins.replayDone:
+	default:
+		t.Fatalf("the spool was closed before the replayer stopped")
+	}
+	if report.Spooled == 0 {
+		t.Fatalf("expected the records to remain spooled: %s", report)
+	}
+	//Nothing was acknowledged, so all the records are replayed next time
+	sp = openTestSpool(t, dir)
+	defer sp.Close()
+	got, _ := readAll(t, sp)
+	expectTimes(t, got, 0, 5)
+}
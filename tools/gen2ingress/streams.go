@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"fmt"
+
+	"github.com/pborman/uuid"
+)
+
+//GEN2INGRESS_SPACE is the namespace of the stream UUIDs, like the
+//INGESTER_SPACE of the uPMU ingester
+const GEN2INGRESS_SPACE_STRING = "af908949-04ea-4548-a7ef-07c7473f4715"
+
+var GEN2INGRESS_SPACE = uuid.Parse(GEN2INGRESS_SPACE_STRING)
+
+//StreamUUID returns the UUID of a signal of a device. Descriptors start
+//with the driver prefix, so the same signal on a different driver or
+//device is a different stream. The collection is not part of the UUID so
+//that renaming it does not orphan the existing stream.
+func StreamUUID(descriptor string, signal string) uuid.UUID {
+	return uuid.NewSHA1(GEN2INGRESS_SPACE, []byte(fmt.Sprintf("%s.%s", descriptor, signal)))
+}
+
+//StreamSpec is everything a stream is created with
+type StreamSpec struct {
+	UUID       uuid.UUID
+	Collection string
+	Name       string
+	Unit       string
+	//The manifest descriptor of the device, empty for drivers that do not
+	//use the manifest
+	Descriptor string
+	//The identity of the signal within the device
+	Signal string
+}
+
+//specFor works out the stream for records with the given key. Without a
+//descriptor the collection has to stand in for the device.
+func specFor(sk streamkey) *StreamSpec {
+	signal := sk.Signal
+	if signal == "" {
+		signal = sk.Name
+	}
+	var uu uuid.UUID
+	if sk.Descriptor != "" {
+		uu = StreamUUID(sk.Descriptor, signal)
+	} else {
+		uu = StreamUUID("collection:"+sk.Collection, signal)
+	}
+	return &StreamSpec{
+		UUID:       uu,
+		Collection: sk.Collection,
+		Name:       sk.Name,
+		Unit:       sk.Unit,
+		Descriptor: sk.Descriptor,
+		Signal:     signal,
+	}
+}
+
+func (s *StreamSpec) Tags() map[string]string {
+	return map[string]string{"name": s.Name, "unit": s.Unit}
+}
+
+//Annotations record where the stream came from, so that tools can find
+//the streams of a device and recompute their UUIDs
+func (s *StreamSpec) Annotations() map[string]string {
+	rv := map[string]string{"signal": s.Signal}
+	if s.Descriptor != "" {
+		rv["descriptor"] = s.Descriptor
+	}
+	return rv
+}
+
+//Deterministic is true if the UUID of a stream with the given annotations
+//was derived from them, i.e. it was not created by the old random scheme
+func Deterministic(uu uuid.UUID, collection string, annotations map[string]string) bool {
+	signal, ok := annotations["signal"]
+	if !ok {
+		return false
+	}
+	desc, ok := annotations["descriptor"]
+	if !ok {
+		desc = "collection:" + collection
+	}
+	return uuid.Equal(uu, StreamUUID(desc, signal))
+}
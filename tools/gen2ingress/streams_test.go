@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package gen2ingress
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pborman/uuid"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+func TestStreamUUID(t *testing.T) {
+	a := specFor(streamkey{Collection: "gep/a", Name: "FREQ", Descriptor: "gep.pdc.a", Signal: "1234"})
+	renamed := specFor(streamkey{Collection: "gep/renamed", Name: "FREQ2", Descriptor: "gep.pdc.a", Signal: "1234"})
+	if !uuid.Equal(a.UUID, renamed.UUID) {
+		t.Fatalf("renaming the collection or signal must not change the stream")
+	}
+	other := specFor(streamkey{Collection: "gep/a", Name: "FREQ", Descriptor: "gep.pdc.b", Signal: "1234"})
+	if uuid.Equal(a.UUID, other.UUID) {
+		t.Fatalf("different devices must have different streams")
+	}
+	nodesc := specFor(streamkey{Collection: "fnet/a", Name: "Voltage"})
+	if nodesc.Signal != "Voltage" || uuid.Equal(nodesc.UUID, specFor(streamkey{Collection: "fnet/b", Name: "Voltage"}).UUID) {
+		t.Fatalf("without a descriptor the collection and name identify the stream")
+	}
+	for _, spec := range []*StreamSpec{a, nodesc} {
+		if !Deterministic(spec.UUID, spec.Collection, spec.Annotations()) {
+			t.Fatalf("%s/%s is not recognized as deterministic", spec.Collection, spec.Name)
+		}
+	}
+	if Deterministic(uuid.NewRandom(), a.Collection, a.Annotations()) {
+		t.Fatalf("a random UUID was recognized as deterministic")
+	}
+}
+
+func TestInserterStreamIdentity(t *testing.T) {
+	ms := NewMemorySink()
+	ins, err := NewInserter(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins.ProcessBatch([]InsertRecord{{
+		Data:       []btrdb.RawPoint{{Time: 1, Value: 1}},
+		Collection: "test/id",
+		Name:       "x",
+		Descriptor: "test.device",
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ins.Close(ctx)
+	s := ms.Stream("test/id", "x")
+	if s == nil {
+		t.Fatalf("stream was not created")
+	}
+	if !uuid.Equal(s.UUID, StreamUUID("test.device", "x")) {
+		t.Fatalf("stream has UUID %s", s.UUID)
+	}
+	if s.Annotations()["descriptor"] != "test.device" {
+		t.Fatalf("descriptor annotation missing: %v", s.Annotations())
+	}
+}
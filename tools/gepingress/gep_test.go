@@ -0,0 +1,299 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGUIDRoundTrip(t *testing.T) {
+	id := "7c0e2a64-1d5b-4f3e-9a2b-0123456789ab"
+	raw, err := encodeGUID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[0] != 0x64 || raw[3] != 0x7c || raw[4] != 0x5b || raw[8] != 0x9a {
+		t.Fatalf("guid not in .NET byte order: %x", raw)
+	}
+	if got := parseGUID(raw); got != id {
+		t.Fatalf("expected %s got %s", id, got)
+	}
+}
+
+func Test7BitRoundTrip(t *testing.T) {
+	buf := make([]byte, 16)
+	for _, v := range []uint64{0, 1, 127, 128, 300, 1 << 35, 1<<56 - 1, 1 << 56, math.MaxUint64} {
+		pos := 0
+		write7BitUint64(buf, &pos, v)
+		end := pos
+		pos = 0
+		got, err := read7BitUint64(buf[:end], &pos)
+		if err != nil || got != v || pos != end {
+			t.Fatalf("uint64 %d: got %d (%v) after %d/%d bytes", v, got, err, pos, end)
+		}
+	}
+	for _, v := range []uint32{0, 127, 128, 1 << 21, math.MaxUint32} {
+		pos := 0
+		write7BitUint32(buf, &pos, v)
+		end := pos
+		pos = 0
+		got, err := read7BitUint32(buf[:end], &pos)
+		if err != nil || got != v || pos != end {
+			t.Fatalf("uint32 %d: got %d (%v) after %d/%d bytes", v, got, err, pos, end)
+		}
+	}
+}
+
+type tsscSample struct {
+	id    uint16
+	ts    int64
+	flags uint32
+	value float32
+}
+
+//Frames of several signals, with repeated values, zeros, jitter, gaps
+//and flag changes to exercise every code
+func tsscSamples(n int) []tsscSample {
+	r := rand.New(rand.NewSource(42))
+	rv := []tsscSample{}
+	ts := UnixNanosToTicks(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	ids := []uint16{0, 1, 2, 3, 17, 300, 4095, 65000}
+	for i := 0; i < n; i++ {
+		ts += 333333
+		if i%97 == 0 {
+			ts += int64(r.Intn(1000000))
+		}
+		for j, id := range ids {
+			var v float32
+			switch {
+			case j == 0:
+				v = 60 + float32(r.NormFloat64()*0.01)
+			case j == 1 && i%5 != 0:
+				v = 0
+			case j == 2:
+				v = float32(i % 3)
+			default:
+				v = float32(r.NormFloat64() * math.Pow(10, float64(j)))
+			}
+			var flags uint32
+			if i%50 == j {
+				flags = StateDataQualityMask
+			}
+			mts := ts
+			if j == 7 && i%11 == 0 {
+				mts -= 333333
+			}
+			rv = append(rv, tsscSample{id, mts, flags, v})
+		}
+	}
+	return rv
+}
+
+func TestTSSCRoundTrip(t *testing.T) {
+	samples := tsscSamples(2000)
+	enc := NewTSSCEncoder()
+	dec := NewTSSCDecoder()
+	idx := 0
+	blocks := 0
+	for idx < len(samples) {
+		buf := make([]byte, 4096)
+		enc.SetBuffer(buf)
+		start := idx
+		for idx < len(samples) {
+			s := samples[idx]
+			if !enc.TryAddMeasurement(s.id, s.ts, s.flags, s.value) {
+				break
+			}
+			idx++
+		}
+		n := enc.FinishBlock()
+		blocks++
+		dec.SetBuffer(buf[:n])
+		for i := start; i < idx; i++ {
+			ok, id, ts, flags, value, err := dec.TryGetMeasurement()
+			if err != nil {
+				t.Fatalf("sample %d: %v", i, err)
+			}
+			if !ok {
+				t.Fatalf("block ended early at sample %d", i)
+			}
+			s := samples[i]
+			if id != s.id || ts != s.ts || flags != s.flags || math.Float32bits(value) != math.Float32bits(s.value) {
+				t.Fatalf("sample %d: expected %+v got id=%d ts=%d flags=%x value=%v", i, s, id, ts, flags, value)
+			}
+		}
+		ok, _, _, _, _, err := dec.TryGetMeasurement()
+		if ok || err != nil {
+			t.Fatalf("expected end of block, got ok=%v err=%v", ok, err)
+		}
+	}
+	if blocks < 2 {
+		t.Fatalf("expected the samples to span several blocks")
+	}
+	bytesPerSample := float64(blocks*4096) / float64(len(samples))
+	t.Logf("%d samples in %d blocks, at most %.2f bytes per sample", len(samples), blocks, bytesPerSample)
+}
+
+func subscribeToFake(t *testing.T, modes uint32) (*FakePublisher, *Subscriber, chan Measurement, chan []byte, func()) {
+	fp, err := NewFakePublisher("127.0.0.1:0", FakeDevice("PMU1", "TEST", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chm := make(chan Measurement, 10000)
+	chmd := make(chan []byte, 10)
+	sub := &Subscriber{
+		Address:          fp.Addr(),
+		FilterExpression: "FILTER ActiveMeasurements WHERE SignalID LIKE '%'",
+		OperationalModes: modes,
+		OnMeasurements: func(ms []Measurement) {
+			for _, m := range ms {
+				chm <- m
+			}
+		},
+		OnMetadata: func(dat []byte) { chmd <- dat },
+		OnMessage: func(isError bool, message string) {
+			if isError {
+				t.Errorf("subscriber error: %s", message)
+			}
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = sub.Connect(ctx)
+	if err != nil {
+		fp.Close()
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Run()
+	}()
+	err = fp.WaitSubscribed(1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fp, sub, chm, chmd, func() {
+		sub.Close()
+		<-done
+		fp.Close()
+	}
+}
+
+func testSubscriber(t *testing.T, modes uint32) {
+	fp, _, chm, chmd, closefn := subscribeToFake(t, modes)
+	defer closefn()
+
+	cs := fp.ConnectionStrings()
+	if len(cs) != 1 || !strings.Contains(cs[0], "inputMeasurementKeys={FILTER ActiveMeasurements WHERE SignalID LIKE '%'};") {
+		t.Fatalf("unexpected connection strings %v", cs)
+	}
+
+	select {
+	case md := <-chmd:
+		_, metamap, err := ParseXMLMetadata(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metamap) != 3 {
+			t.Fatalf("expected 3 measurements in metadata, got %d", len(metamap))
+		}
+		for _, s := range fp.Signals {
+			m := metamap[s.SignalID]
+			if m == nil {
+				t.Fatalf("signal %s missing from metadata", s.SignalID)
+			}
+			if m.CPhasorSourceIndex != 0 && m.PhasorDetail == nil {
+				t.Fatalf("signal %s was not linked to its phasor", s.SignalID)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for metadata")
+	}
+
+	expected := []Measurement{}
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+	for frame := 0; frame < 300; frame++ {
+		ts := start + int64(frame)*int64(time.Second)/30/100*100
+		batch := []Measurement{}
+		for i, s := range fp.Signals {
+			m := Measurement{
+				SignalID:  s.SignalID,
+				Timestamp: ts,
+				Value:     float64(float32(60 + float64(i)*100 + math.Sin(float64(frame)/10))),
+			}
+			if frame%40 == i {
+				m.Flags = StateTimeQualityMask
+			}
+			batch = append(batch, m)
+		}
+		err := fp.Publish(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, batch...)
+	}
+
+	for i, exp := range expected {
+		select {
+		case m := <-chm:
+			if m.SignalID != exp.SignalID || m.Timestamp != exp.Timestamp || m.Value != exp.Value || m.Flags != exp.Flags {
+				t.Fatalf("measurement %d: expected %+v got %+v", i, exp, m)
+			}
+			sig := fp.Signals[i%len(fp.Signals)]
+			if m.Source != sig.Source || m.ID != sig.ID {
+				t.Fatalf("measurement %d: expected key %s:%d got %s:%d", i, sig.Source, sig.ID, m.Source, m.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for measurement %d", i)
+		}
+	}
+}
+
+func TestSubscriberCompact(t *testing.T) {
+	testSubscriber(t, DefaultOperationalModes)
+}
+
+func TestSubscriberTSSC(t *testing.T) {
+	testSubscriber(t, DefaultOperationalModesWithTSSC)
+}
+
+func TestSubscriberMetadataRefresh(t *testing.T) {
+	fp, sub, _, chmd, closefn := subscribeToFake(t, DefaultOperationalModesWithTSSC)
+	defer closefn()
+	<-chmd
+	err := sub.RequestMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case md := <-chmd:
+		if !strings.Contains(string(md), fp.Signals[0].SignalID) {
+			t.Fatalf("refreshed metadata is missing signals")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for metadata refresh")
+	}
+	//Notifications must be confirmed without breaking the connection
+	err = fp.Notify("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sub.RequestMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-chmd:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection broken after notification")
+	}
+}
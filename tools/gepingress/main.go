@@ -10,9 +10,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
@@ -20,18 +20,9 @@ import (
 	btrdb "gopkg.in/BTrDB/btrdb.v4"
 )
 
-var globalmu sync.RWMutex
-var globalmap map[uint64]*GEPDevice
-
-func init() {
-	globalmap = make(map[uint64]*GEPDevice)
-}
-
 //Driver definition
 type GEPIngress struct {
-	inserter   *gen2ingress.Inserter
-	identifier uint64
-	mu         sync.Mutex
+	inserter *gen2ingress.Inserter
 }
 
 func (gep *GEPIngress) DIDPrefix() string {
@@ -64,7 +55,7 @@ func (gep *GEPIngress) HandleDevice(ctx context.Context, descriptor string) erro
 	if err != nil {
 		return fmt.Errorf("host:ip is malformed")
 	}
-	porti, err := strconv.ParseInt(port, 10, 16)
+	porti, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
 		return fmt.Errorf("host:ip is malformed")
 	}
@@ -84,7 +75,7 @@ func (gep *GEPIngress) HandleDevice(ctx context.Context, descriptor string) erro
 		expression:       expression,
 	}
 
-	go gen2ingress.Loop(ctx, device.descriptor, device.begin)
+	gen2ingress.Loop(ctx, device.descriptor, device.begin)
 	return nil
 }
 
@@ -97,12 +88,13 @@ type GEPDevice struct {
 	host             string
 	port             uint16
 	expression       string
-	identifier       uint64
+	sub              *Subscriber
+	status           *manifest.DeviceHeartbeat
 
 	chMeasurement chan *Measurement
 	chMetadata    chan []byte
 	chMessage     chan msg
-	chFailed      chan bool
+	chFailed      chan error
 
 	metamap     map[string]*CMeasurementDetail
 	metaraw     *CNewDataSet
@@ -124,44 +116,41 @@ type Measurement struct {
 }
 
 func (d *GEPDevice) begin(ctx context.Context) error {
-	//Obtain a new device ID
-	d.driver.mu.Lock()
-	d.driver.identifier++
-	did := d.driver.identifier
-	d.identifier = did
-	d.driver.mu.Unlock()
-	globalmu.Lock()
-	globalmap[did] = d
-	globalmu.Unlock()
-	defer func() {
-		globalmu.Lock()
-		delete(globalmap, did)
-		globalmu.Unlock()
-	}()
-
 	d.chMeasurement = make(chan *Measurement, 1000)
 	d.chMetadata = make(chan []byte, 10)
 	d.chMessage = make(chan msg, 100)
-	d.chFailed = make(chan bool, 10)
+	d.chFailed = make(chan error, 1)
 	d.metachanged = make(map[string]time.Time)
 
+	shortform := manifest.GetDescriptorShortForm(d.descriptor)
+	d.status = gen2ingress.Status(d.descriptor)
+	d.sub = &Subscriber{
+		Address:          net.JoinHostPort(d.host, strconv.Itoa(int(d.port))),
+		FilterExpression: d.expression,
+		OperationalModes: DefaultOperationalModesWithTSSC,
+		OnMeasurements:   func(ms []Measurement) { d.Measurements(ctx, ms) },
+		OnMetadata:       func(dat []byte) { d.Metadata(ctx, dat) },
+		OnMessage:        func(isError bool, message string) { d.Message(ctx, isError, message) },
+	}
+	err := d.sub.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("failed first connection: %v", err)
+	}
+	defer d.sub.Close()
+	d.status.Connected()
+	go func() {
+		d.chFailed <- d.sub.Run()
+	}()
+
 	//Refresh the device metadata periodically
 	go d.periodicallAskForMetadata(ctx)
 
-	shortform := manifest.GetDescriptorShortForm(d.descriptor)
-	okay := NewDriver(d.identifier, d.host, d.port, d.expression)
-	if !okay {
-		return fmt.Errorf("failed first connection")
-	}
 	//This function is supposed to synchronously handle the device
 	lastMeasurementFailNotification := time.Time{}
 	accumulatedMFail := 0
 	for {
 		select {
 		case <-ctx.Done():
-			//There is a race in the GEP driver. Delaying sidesteps that
-			time.Sleep(1 * time.Second)
-			Abort(d.identifier)
 			return ctx.Err()
 		case m := <-d.chMessage:
 			t := "INFO"
@@ -169,6 +158,9 @@ func (d *GEPDevice) begin(ctx context.Context) error {
 				t = "ERROR"
 			}
 			fmt.Printf("[%s] GEP %s: %s\n", shortform, t, m.Msg)
+			if m.IsError {
+				d.status.Error(fmt.Errorf("GEP error: %s", m.Msg))
+			}
 		case md := <-d.chMetadata:
 			err := d.processMetadata(md)
 			if err != nil {
@@ -184,13 +176,11 @@ func (d *GEPDevice) begin(ctx context.Context) error {
 					accumulatedMFail = 0
 					//This could potentially happen because a new device came online
 					//and we don't have it's metadata
-					RequestMetadata(d.identifier)
+					d.sub.RequestMetadata()
 				}
 			}
-		case <-d.chFailed:
-			time.Sleep(1 * time.Second)
-			Abort(d.identifier)
-			return fmt.Errorf("connection failed")
+		case err := <-d.chFailed:
+			return fmt.Errorf("connection failed: %v", err)
 		}
 	}
 }
@@ -216,7 +206,7 @@ func (d *GEPDevice) periodicallAskForMetadata(ctx context.Context) {
 				return
 			}
 		}
-		RequestMetadata(d.identifier)
+		d.sub.RequestMetadata()
 	}
 }
 
@@ -291,39 +281,47 @@ func (d *GEPDevice) processMeasurement(m *Measurement) error {
 		Collection:        d.collectionPrefix + "/" + dacro,
 		Unit:              md.CSignalAcronym, //TODO fix this
 		AnnotationChanges: attributes,
+		Descriptor:        d.descriptor,
+		//The signal reference can be edited in the historian, the ID cannot
+		Signal: m.SignalID,
 	}
 	d.inserter.ProcessBatch([]gen2ingress.InsertRecord{ir})
 	return nil
 }
 
-//For all of these functions: be quick with the data, we are in the C
-//context
-func (d *GEPDevice) Measurement(m *Measurement) {
-	d.chMeasurement <- m
-}
-
-func (d *GEPDevice) Metadata(dat []byte) {
-	//We need to copy the byte array. It's backed by C
-	clone := make([]byte, len(dat))
-	copy(clone[:], dat)
-	d.chMetadata <- clone
+//These are called by the subscriber. They must not block once the
+//context is done, as nothing is reading the channels anymore
+func (d *GEPDevice) Measurements(ctx context.Context, ms []Measurement) {
+	d.status.Data(len(ms))
+	for i := range ms {
+		select {
+		case d.chMeasurement <- &ms[i]:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (d *GEPDevice) Message(isError bool, message string) {
-	d.chMessage <- msg{isError, message}
+func (d *GEPDevice) Metadata(ctx context.Context, dat []byte) {
+	select {
+	case d.chMetadata <- dat:
+	case <-ctx.Done():
+	}
 }
 
-func (d *GEPDevice) Failed() {
-	d.chFailed <- true
+func (d *GEPDevice) Message(ctx context.Context, isError bool, message string) {
+	select {
+	case d.chMessage <- msg{isError, message}:
+	case <-ctx.Done():
+	}
 }
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == "-fakepublisher" {
+		err := RunFakePublisher(os.Args[2])
+		fmt.Printf("fake publisher failed: %v\n", err)
+		os.Exit(1)
+	}
 	gen2ingress.Gen2Ingress(&GEPIngress{})
 	fmt.Printf("this should not have happened :/\n")
 }
-
-// func (d *GEPDevice) abortOnCtxDone() {
-// 	<-d.ctx.Done()
-// 	time.Sleep(1 * time.Second)
-// 	Abort(d.identifier)
-// }
@@ -0,0 +1,314 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+//The constants in this file follow the Gateway Exchange Protocol as
+//implemented by the GSF DataSubscriber / DataPublisher, see
+// https://github.com/GridProtectionAlliance/gsf/blob/master/Source/Libraries/TimeSeriesPlatformLibrary/Transport/Constants.h
+
+//Commands sent from the subscriber to the publisher
+const (
+	CmdConnect                    byte = 0x00
+	CmdMetadataRefresh            byte = 0x01
+	CmdSubscribe                  byte = 0x02
+	CmdUnsubscribe                byte = 0x03
+	CmdRotateCipherKeys           byte = 0x04
+	CmdUpdateProcessingInterval   byte = 0x05
+	CmdDefineOperationalModes     byte = 0x06
+	CmdConfirmNotification        byte = 0x07
+	CmdConfirmBufferBlock         byte = 0x08
+	CmdPublishCommandMeasurements byte = 0x09
+)
+
+//Responses sent from the publisher to the subscriber
+const (
+	RespSucceeded              byte = 0x80
+	RespFailed                 byte = 0x81
+	RespDataPacket             byte = 0x82
+	RespUpdateSignalIndexCache byte = 0x83
+	RespUpdateBaseTimes        byte = 0x84
+	RespUpdateCipherKeys       byte = 0x85
+	RespDataStartTime          byte = 0x86
+	RespProcessingComplete     byte = 0x87
+	RespBufferBlock            byte = 0x88
+	RespNotification           byte = 0x89
+	RespConfigurationChanged   byte = 0x8A
+	RespNoOP                   byte = 0xFF
+)
+
+//Operational modes are negotiated with CmdDefineOperationalModes
+const (
+	OpModeVersionMask               uint32 = 0x0000001F
+	OpModeCompressionMask           uint32 = 0x000000E0
+	OpModeEncodingMask              uint32 = 0x00000300
+	OpModeReceiveExternalMetadata   uint32 = 0x02000000
+	OpModeReceiveInternalMetadata   uint32 = 0x04000000
+	OpModeCompressPayloadData       uint32 = 0x20000000
+	OpModeCompressSignalIndexCache  uint32 = 0x40000000
+	OpModeCompressMetadata          uint32 = 0x80000000
+	OpModeCompressionGZip           uint32 = 0x00000020
+	OpModeCompressionTSSC           uint32 = 0x00000040
+	OpModeEncodingUTF8              uint32 = 0x00000200
+	DefaultOperationalModes         uint32 = OpModeCompressionGZip | OpModeEncodingUTF8 | OpModeReceiveInternalMetadata | OpModeCompressSignalIndexCache | OpModeCompressMetadata
+	DefaultOperationalModesWithTSSC uint32 = DefaultOperationalModes | OpModeCompressPayloadData | OpModeCompressionTSSC
+)
+
+//Flags at the start of every data packet
+const (
+	DataPacketSynchronized byte = 0x01
+	DataPacketCompact      byte = 0x02
+	DataPacketCipherIndex  byte = 0x04
+	DataPacketCompressed   byte = 0x08
+)
+
+//Flags at the start of every compact measurement, each of which stands
+//in for a group of full state flags
+const (
+	CompactDataRange       byte = 0x01
+	CompactDataQuality     byte = 0x02
+	CompactTimeQuality     byte = 0x04
+	CompactSystemIssue     byte = 0x08
+	CompactCalculatedValue byte = 0x10
+	CompactDiscardedValue  byte = 0x20
+	CompactBaseTimeOffset  byte = 0x40
+	CompactTimeIndex       byte = 0x80
+)
+
+const (
+	StateDataRangeMask       uint32 = 0x000000FC
+	StateDataQualityMask     uint32 = 0x0000EF03
+	StateTimeQualityMask     uint32 = 0x00BF0000
+	StateSystemIssueMask     uint32 = 0xE0000000
+	StateCalculatedValueMask uint32 = 0x00001000
+	StateDiscardedValueMask  uint32 = 0x00400000
+)
+
+//The payload header is a four byte marker and a little endian length.
+//Nobody checks the marker, but we send the one the GSF uses
+var payloadMarker = []byte{0xAA, 0xBB, 0xCC, 0xDD}
+
+const payloadHeaderSize = 8
+const responseHeaderSize = 6
+
+//Packets larger than this are treated as a corrupt stream
+const maxPacketSize = 32 * 1024 * 1024
+
+//Ticks are 100ns intervals since 0001-01-01, the top two bits are used to
+//indicate leap seconds
+const ticksUnixEpoch = 621355968000000000
+const ticksValueMask = 0x3FFFFFFFFFFFFFFF
+
+func TicksToUnixNanos(ticks int64) int64 {
+	return ((ticks & ticksValueMask) - ticksUnixEpoch) * 100
+}
+
+func UnixNanosToTicks(ns int64) int64 {
+	return ns/100 + ticksUnixEpoch
+}
+
+func mapCompactFlags(c byte) uint32 {
+	var f uint32
+	if c&CompactDataRange != 0 {
+		f |= StateDataRangeMask
+	}
+	if c&CompactDataQuality != 0 {
+		f |= StateDataQualityMask
+	}
+	if c&CompactTimeQuality != 0 {
+		f |= StateTimeQualityMask
+	}
+	if c&CompactSystemIssue != 0 {
+		f |= StateSystemIssueMask
+	}
+	if c&CompactCalculatedValue != 0 {
+		f |= StateCalculatedValueMask
+	}
+	if c&CompactDiscardedValue != 0 {
+		f |= StateDiscardedValueMask
+	}
+	return f
+}
+
+func mapFullFlags(f uint32) byte {
+	var c byte
+	if f&StateDataRangeMask != 0 {
+		c |= CompactDataRange
+	}
+	if f&StateDataQualityMask != 0 {
+		c |= CompactDataQuality
+	}
+	if f&StateTimeQualityMask != 0 {
+		c |= CompactTimeQuality
+	}
+	if f&StateSystemIssueMask != 0 {
+		c |= CompactSystemIssue
+	}
+	if f&StateCalculatedValueMask != 0 {
+		c |= CompactCalculatedValue
+	}
+	if f&StateDiscardedValueMask != 0 {
+		c |= CompactDiscardedValue
+	}
+	return c
+}
+
+//GUIDs are sent in the .NET byte order, where the first three fields are
+//little endian
+func parseGUID(b []byte) string {
+	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6],
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15])
+}
+
+func encodeGUID(s string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(raw) != 16 {
+		return nil, fmt.Errorf("invalid guid %q", s)
+	}
+	return []byte{raw[3], raw[2], raw[1], raw[0], raw[5], raw[4], raw[7], raw[6],
+		raw[8], raw[9], raw[10], raw[11], raw[12], raw[13], raw[14], raw[15]}, nil
+}
+
+//writePacket frames a command or response with the payload header
+func writePacket(w io.Writer, body []byte) error {
+	buf := make([]byte, payloadHeaderSize+len(body))
+	copy(buf, payloadMarker)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(body)))
+	copy(buf[payloadHeaderSize:], body)
+	_, err := w.Write(buf)
+	return err
+}
+
+//readPacket reads a single framed packet
+func readPacket(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, payloadHeaderSize)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	ln := binary.LittleEndian.Uint32(hdr[4:])
+	if ln > maxPacketSize {
+		return nil, fmt.Errorf("packet size %d is too large", ln)
+	}
+	body := make([]byte, ln)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeCommand(w io.Writer, cmd byte, data []byte) error {
+	body := make([]byte, 1+len(data))
+	body[0] = cmd
+	copy(body[1:], data)
+	return writePacket(w, body)
+}
+
+func writeResponse(w io.Writer, resp byte, cmd byte, data []byte) error {
+	body := make([]byte, responseHeaderSize+len(data))
+	body[0] = resp
+	body[1] = cmd
+	binary.BigEndian.PutUint32(body[2:], uint32(len(data)))
+	copy(body[responseHeaderSize:], data)
+	return writePacket(w, body)
+}
+
+//decompressIfGzip returns the contents of the gzip stream, or the original
+//data if it is not compressed
+func decompressIfGzip(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	rdr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+func compressGzip(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+//The GSF 7 bit encoding is little endian base 128, except that the ninth
+//byte of a 64 bit value holds eight bits
+func read7BitUint64(data []byte, pos *int) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if *pos >= len(data) {
+			return 0, fmt.Errorf("truncated 7 bit value")
+		}
+		b := data[*pos]
+		*pos++
+		if i == 8 {
+			return v | uint64(b)<<56, nil
+		}
+		v |= uint64(b&0x7F) << uint(7*i)
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return v, nil
+}
+
+func read7BitUint32(data []byte, pos *int) (uint32, error) {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		if *pos >= len(data) {
+			return 0, fmt.Errorf("truncated 7 bit value")
+		}
+		b := data[*pos]
+		*pos++
+		v |= uint32(b&0x7F) << uint(7*i)
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return v, nil
+}
+
+func write7BitUint64(data []byte, pos *int, v uint64) {
+	for i := 0; i < 8; i++ {
+		if v < 0x80 {
+			data[*pos] = byte(v)
+			*pos++
+			return
+		}
+		data[*pos] = byte(v) | 0x80
+		*pos++
+		v >>= 7
+	}
+	data[*pos] = byte(v)
+	*pos++
+}
+
+func write7BitUint32(data []byte, pos *int, v uint32) {
+	for v >= 0x80 {
+		data[*pos] = byte(v) | 0x80
+		*pos++
+		v >>= 7
+	}
+	data[*pos] = byte(v)
+	*pos++
+}
@@ -0,0 +1,452 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FakePublisher is a minimal GEP publisher used to test the subscriber
+//without an openPDC or openHistorian. It serves the measurements in a
+//fixed metadata set, and publishes whatever measurements it is given to
+//every subscribed client, using TSSC if the client asked for it.
+type FakePublisher struct {
+	Signals  []FakeSignal
+	Metadata []byte
+
+	ln      net.Listener
+	mu      sync.Mutex
+	clients map[*fakeClient]bool
+}
+
+type FakeSignal struct {
+	SignalID string
+	Source   string
+	ID       uint32
+}
+
+type fakeClient struct {
+	conn       net.Conn
+	wmu        sync.Mutex
+	modes      uint32
+	subscribed bool
+	connstring string
+	tssc       *TSSCEncoder
+	tsscSeq    uint16
+}
+
+//The size of the TSSC blocks, a block that fills up is split across data
+//packets
+const fakeTSSCBlockSize = 16 * 1024
+
+//NewFakePublisher listens on addr. The runtime index of each measurement
+//is its position in md.CMeasurementDetail, and its measurement key is
+//taken from the ID, which has the form SOURCE:ID
+func NewFakePublisher(addr string, md *CNewDataSet) (*FakePublisher, error) {
+	metadata, err := xml.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	signals := []FakeSignal{}
+	for _, m := range md.CMeasurementDetail {
+		parts := strings.SplitN(m.CID, ":", 2)
+		sig := FakeSignal{SignalID: m.CSignalID, Source: parts[0]}
+		if len(parts) == 2 {
+			id, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("measurement key %q is malformed", m.CID)
+			}
+			sig.ID = uint32(id)
+		}
+		signals = append(signals, sig)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	fp := &FakePublisher{
+		Signals:  signals,
+		Metadata: metadata,
+		ln:       ln,
+		clients:  make(map[*fakeClient]bool),
+	}
+	go fp.accept()
+	return fp, nil
+}
+
+func (fp *FakePublisher) Addr() string {
+	return fp.ln.Addr().String()
+}
+
+func (fp *FakePublisher) Close() {
+	fp.ln.Close()
+	fp.mu.Lock()
+	for c := range fp.clients {
+		c.conn.Close()
+	}
+	fp.mu.Unlock()
+}
+
+//Subscribed returns the number of clients that have subscribed
+func (fp *FakePublisher) Subscribed() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	n := 0
+	for c := range fp.clients {
+		if c.subscribed {
+			n++
+		}
+	}
+	return n
+}
+
+//ConnectionStrings returns the connection strings of the subscribed clients
+func (fp *FakePublisher) ConnectionStrings() []string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	rv := []string{}
+	for c := range fp.clients {
+		if c.subscribed {
+			rv = append(rv, c.connstring)
+		}
+	}
+	return rv
+}
+
+//WaitSubscribed waits until n clients have subscribed
+func (fp *FakePublisher) WaitSubscribed(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for fp.Subscribed() < n {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %d subscribers", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+//Publish sends the measurements to every subscribed client. The ID and
+//Source of the measurements are ignored, the SignalID must be one of
+//the publisher's signals.
+func (fp *FakePublisher) Publish(ms []Measurement) error {
+	fp.mu.Lock()
+	clients := make(map[*fakeClient]uint32)
+	for c := range fp.clients {
+		if c.subscribed {
+			clients[c] = c.modes
+		}
+	}
+	fp.mu.Unlock()
+	for c, modes := range clients {
+		var err error
+		if modes&OpModeCompressPayloadData != 0 && modes&OpModeCompressionTSSC != 0 {
+			err = fp.publishTSSC(c, ms)
+		} else {
+			err = fp.publishCompact(c, ms)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Notify sends a notification to every client
+func (fp *FakePublisher) Notify(message string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	for c := range fp.clients {
+		data := make([]byte, 4+len(message))
+		binary.BigEndian.PutUint32(data, uint32(len(message)))
+		copy(data[4:], message)
+		err := c.respond(RespNotification, CmdConfirmNotification, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fp *FakePublisher) signalIndex(signalID string) (uint16, error) {
+	for idx, s := range fp.Signals {
+		if strings.EqualFold(s.SignalID, signalID) {
+			return uint16(idx), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown signal %s", signalID)
+}
+
+func (fp *FakePublisher) publishCompact(c *fakeClient, ms []Measurement) error {
+	data := make([]byte, 5, 5+len(ms)*15)
+	data[0] = DataPacketCompact
+	binary.BigEndian.PutUint32(data[1:], uint32(len(ms)))
+	for _, m := range ms {
+		idx, err := fp.signalIndex(m.SignalID)
+		if err != nil {
+			return err
+		}
+		var rec [15]byte
+		rec[0] = mapFullFlags(m.Flags)
+		binary.BigEndian.PutUint16(rec[1:], idx)
+		binary.BigEndian.PutUint32(rec[3:], math.Float32bits(float32(m.Value)))
+		binary.BigEndian.PutUint64(rec[7:], uint64(UnixNanosToTicks(m.Timestamp)))
+		data = append(data, rec[:]...)
+	}
+	return c.respond(RespDataPacket, 0, data)
+}
+
+func (fp *FakePublisher) publishTSSC(c *fakeClient, ms []Measurement) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	block := make([]byte, fakeTSSCBlockSize)
+	c.tssc.SetBuffer(block)
+	count := 0
+	flush := func() error {
+		n := c.tssc.FinishBlock()
+		data := make([]byte, 8+n)
+		data[0] = DataPacketCompact | DataPacketCompressed
+		binary.BigEndian.PutUint32(data[1:], uint32(count))
+		data[5] = tsscVersion
+		binary.BigEndian.PutUint16(data[6:], c.tsscSeq)
+		copy(data[8:], block[:n])
+		c.tsscSeq++
+		if c.tsscSeq == 0 {
+			c.tsscSeq = 1
+		}
+		count = 0
+		block = make([]byte, fakeTSSCBlockSize)
+		c.tssc.SetBuffer(block)
+		return c.respondLocked(RespDataPacket, 0, data)
+	}
+	for _, m := range ms {
+		idx, err := fp.signalIndex(m.SignalID)
+		if err != nil {
+			return err
+		}
+		ticks := UnixNanosToTicks(m.Timestamp)
+		if !c.tssc.TryAddMeasurement(idx, ticks, m.Flags, float32(m.Value)) {
+			if err := flush(); err != nil {
+				return err
+			}
+			c.tssc.TryAddMeasurement(idx, ticks, m.Flags, float32(m.Value))
+		}
+		count++
+	}
+	if count > 0 {
+		return flush()
+	}
+	return nil
+}
+
+func (fp *FakePublisher) accept() {
+	for {
+		conn, err := fp.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeClient{conn: conn, tssc: NewTSSCEncoder()}
+		fp.mu.Lock()
+		fp.clients[c] = true
+		fp.mu.Unlock()
+		go func() {
+			fp.serve(c)
+			conn.Close()
+			fp.mu.Lock()
+			delete(fp.clients, c)
+			fp.mu.Unlock()
+		}()
+	}
+}
+
+func (fp *FakePublisher) serve(c *fakeClient) {
+	for {
+		body, err := readPacket(c.conn)
+		if err != nil || len(body) < 1 {
+			return
+		}
+		cmd, data := body[0], body[1:]
+		switch cmd {
+		case CmdDefineOperationalModes:
+			if len(data) < 4 {
+				return
+			}
+			fp.mu.Lock()
+			c.modes = binary.BigEndian.Uint32(data)
+			fp.mu.Unlock()
+		case CmdMetadataRefresh:
+			md := fp.Metadata
+			fp.mu.Lock()
+			modes := c.modes
+			fp.mu.Unlock()
+			if modes&OpModeCompressMetadata != 0 {
+				md = compressGzip(md)
+			}
+			err = c.respond(RespSucceeded, cmd, md)
+		case CmdSubscribe:
+			if len(data) < 5 || int(binary.BigEndian.Uint32(data[1:])) != len(data)-5 {
+				err = c.respond(RespFailed, cmd, []byte("malformed subscribe command"))
+				break
+			}
+			if data[0]&DataPacketCompact == 0 {
+				err = c.respond(RespFailed, cmd, []byte("only the compact format is supported"))
+				break
+			}
+			fp.mu.Lock()
+			modes := c.modes
+			fp.mu.Unlock()
+			err = c.respond(RespUpdateSignalIndexCache, 0, fp.signalIndexCache(modes))
+			if err != nil {
+				break
+			}
+			c.wmu.Lock()
+			c.tssc.Reset()
+			c.tsscSeq = 0
+			c.wmu.Unlock()
+			fp.mu.Lock()
+			c.connstring = string(data[5:])
+			c.subscribed = true
+			fp.mu.Unlock()
+			err = c.respond(RespSucceeded, cmd, []byte("client subscribed"))
+		case CmdUnsubscribe:
+			fp.mu.Lock()
+			c.subscribed = false
+			fp.mu.Unlock()
+			err = c.respond(RespSucceeded, cmd, []byte("client unsubscribed"))
+		case CmdConfirmNotification, CmdConfirmBufferBlock:
+		default:
+			err = c.respond(RespFailed, cmd, []byte("command not supported"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (fp *FakePublisher) signalIndexCache(modes uint32) []byte {
+	body := make([]byte, 24)
+	binary.BigEndian.PutUint32(body[20:], uint32(len(fp.Signals)))
+	for idx, s := range fp.Signals {
+		guid, err := encodeGUID(s.SignalID)
+		if err != nil {
+			panic(err)
+		}
+		rec := make([]byte, 22+len(s.Source)+4)
+		binary.BigEndian.PutUint16(rec, uint16(idx))
+		copy(rec[2:], guid)
+		binary.BigEndian.PutUint32(rec[18:], uint32(len(s.Source)))
+		copy(rec[22:], s.Source)
+		binary.BigEndian.PutUint32(rec[22+len(s.Source):], s.ID)
+		body = append(body, rec...)
+	}
+	binary.BigEndian.PutUint32(body, uint32(len(body)))
+	if modes&OpModeCompressSignalIndexCache != 0 {
+		return compressGzip(body)
+	}
+	return body
+}
+
+func (c *fakeClient) respond(resp byte, cmd byte, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.respondLocked(resp, cmd, data)
+}
+
+func (c *fakeClient) respondLocked(resp byte, cmd byte, data []byte) error {
+	return writeResponse(c.conn, resp, cmd, data)
+}
+
+//FakeDevice returns the metadata for a PMU with a frequency and a voltage
+//phasor, which is enough to exercise the metadata handling in the driver
+func FakeDevice(acronym string, source string, firstID int) *CNewDataSet {
+	now := time.Now().UTC().Format(time.RFC3339)
+	md := &CNewDataSet{
+		CDeviceDetail: []*CDeviceDetail{{
+			CAcronym:         acronym,
+			CName:            acronym,
+			CEnabled:         true,
+			CFramesPerSecond: 30,
+			CProtocolName:    "IEEE C37.118.2-2011",
+			CUpdatedOn:       now,
+		}},
+		CPhasorDetail: []*CPhasorDetail{{
+			CDeviceAcronym: acronym,
+			CID:            "1",
+			CLabel:         "BUS1",
+			CPhase:         "+",
+			CSourceIndex:   1,
+			CType:          "V",
+			CUpdatedOn:     now,
+		}},
+	}
+	signals := []struct {
+		suffix  string
+		acronym string
+		phasor  int
+	}{
+		{"FQ", "FREQ", 0},
+		{"PM1", "VPHM", 1},
+		{"PA1", "VPHA", 1},
+	}
+	for i, sig := range signals {
+		md.CMeasurementDetail = append(md.CMeasurementDetail, &CMeasurementDetail{
+			CDescription:       acronym + " " + sig.acronym,
+			CDeviceAcronym:     acronym,
+			CEnabled:           true,
+			CID:                fmt.Sprintf("%s:%d", source, firstID+i),
+			CPhasorSourceIndex: sig.phasor,
+			CPointTag:          fmt.Sprintf("%s_%s:%s", source, acronym, sig.suffix),
+			CSignalAcronym:     sig.acronym,
+			CSignalID:          fakeGUID(acronym, i),
+			CSignalReference:   acronym + "-" + sig.suffix,
+			CUpdatedOn:         now,
+		})
+	}
+	return md
+}
+
+func fakeGUID(acronym string, i int) string {
+	h := fnv.New64a()
+	h.Write([]byte(acronym))
+	v := h.Sum64()
+	return fmt.Sprintf("%08x-%04x-4%03x-8%03x-%012x", uint32(v>>32), uint16(v>>16), uint16(v)&0xFFF, i&0xFFF, v&0xFFFFFFFFFFFF)
+}
+
+//RunFakePublisher serves a single fake PMU publishing at 30Hz, which is
+//useful for testing a deployment end to end
+func RunFakePublisher(addr string) error {
+	md := FakeDevice("FAKEPMU", "FAKE", 1)
+	fp, err := NewFakePublisher(addr, md)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("fake publisher listening on %s\n", fp.Addr())
+	ticker := time.NewTicker(time.Second / 30)
+	defer ticker.Stop()
+	for t := range ticker.C {
+		//Align to the frame like a PMU would
+		ns := t.UnixNano() / int64(time.Second/30) * int64(time.Second/30)
+		sec := float64(ns) / 1e9
+		err := fp.Publish([]Measurement{
+			{SignalID: fp.Signals[0].SignalID, Timestamp: ns, Value: 60 + 0.01*math.Sin(sec/10)},
+			{SignalID: fp.Signals[1].SignalID, Timestamp: ns, Value: 7200 + 10*math.Sin(sec)},
+			{SignalID: fp.Signals[2].SignalID, Timestamp: ns, Value: math.Mod(sec*36, 360) - 180},
+		})
+		if err != nil {
+			fmt.Printf("publish failed: %v\n", err)
+		}
+	}
+	return nil
+}
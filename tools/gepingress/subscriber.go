@@ -0,0 +1,374 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools"
+)
+
+const subscriberDialTimeout = 30 * time.Second
+const subscriberWriteTimeout = 30 * time.Second
+
+//Subscriber is a GEP client. All data is received over the TCP command
+//channel, we do not support UDP data channels or encryption.
+type Subscriber struct {
+	Address          string
+	FilterExpression string
+	OperationalModes uint32
+
+	//These are called from the goroutine calling Run
+	OnMeasurements func(ms []Measurement)
+	OnMetadata     func(data []byte)
+	OnMessage      func(isError bool, message string)
+
+	conn net.Conn
+	wmu  sync.Mutex
+
+	signals   map[uint16]signalIndexEntry
+	baseTimes [2]int64
+
+	tssc         *TSSCDecoder
+	tsscSequence uint16
+}
+
+type signalIndexEntry struct {
+	SignalID string
+	Source   string
+	ID       uint32
+}
+
+//Connect dials the publisher, negotiates the operational modes, and
+//requests the subscription and the metadata
+func (s *Subscriber) Connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: subscriberDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.signals = make(map[uint16]signalIndexEntry)
+	s.tssc = NewTSSCDecoder()
+	s.tsscSequence = 0
+
+	modes := make([]byte, 4)
+	binary.BigEndian.PutUint32(modes, s.OperationalModes)
+	err = s.sendCommand(CmdDefineOperationalModes, modes)
+	if err == nil {
+		err = s.subscribe()
+	}
+	if err == nil {
+		err = s.RequestMetadata()
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+//Close closes the connection, causing Run to return
+func (s *Subscriber) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Subscriber) RequestMetadata() error {
+	return s.sendCommand(CmdMetadataRefresh, nil)
+}
+
+func (s *Subscriber) sendCommand(cmd byte, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(subscriberWriteTimeout))
+	return writeCommand(s.conn, cmd, data)
+}
+
+func (s *Subscriber) subscribe() error {
+	cs := fmt.Sprintf("trackLatestMeasurements=false;includeTime=true;"+
+		"lagTime=10;leadTime=5;useLocalClockAsRealTime=false;processingInterval=-1;"+
+		"useMillisecondResolution=false;requestNaNValueFilter=false;"+
+		"assemblyInfo={source=gepingress; version=%d.%d.%d};",
+		tools.VersionMajor, tools.VersionMinor, tools.VersionPatch)
+	if s.FilterExpression != "" {
+		cs += "inputMeasurementKeys={" + s.FilterExpression + "};"
+	}
+	buf := make([]byte, 5+len(cs))
+	buf[0] = DataPacketCompact
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(cs)))
+	copy(buf[5:], cs)
+	return s.sendCommand(CmdSubscribe, buf)
+}
+
+//Run processes responses from the publisher until the connection fails
+func (s *Subscriber) Run() error {
+	for {
+		body, err := readPacket(s.conn)
+		if err != nil {
+			return err
+		}
+		err = s.handleResponse(body)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Subscriber) message(isError bool, format string, args ...interface{}) {
+	if s.OnMessage != nil {
+		s.OnMessage(isError, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *Subscriber) handleResponse(body []byte) error {
+	if len(body) < responseHeaderSize {
+		return fmt.Errorf("response is too short")
+	}
+	code, cmd := body[0], body[1]
+	ln := binary.BigEndian.Uint32(body[2:])
+	data := body[responseHeaderSize:]
+	if int(ln) > len(data) {
+		return fmt.Errorf("response length %d exceeds packet length %d", ln, len(data))
+	}
+	data = data[:ln]
+
+	switch code {
+	case RespSucceeded:
+		if cmd == CmdMetadataRefresh {
+			md, err := decompressIfGzip(data)
+			if err != nil {
+				return fmt.Errorf("could not decompress metadata: %v", err)
+			}
+			if s.OnMetadata != nil {
+				s.OnMetadata(md)
+			}
+			return nil
+		}
+		s.message(false, "command 0x%02x succeeded: %s", cmd, data)
+	case RespFailed:
+		s.message(true, "command 0x%02x failed: %s", cmd, data)
+	case RespDataPacket:
+		return s.handleDataPacket(data)
+	case RespUpdateSignalIndexCache:
+		return s.handleSignalIndexCache(data)
+	case RespUpdateBaseTimes:
+		if len(data) < 20 {
+			return fmt.Errorf("base times response is too short")
+		}
+		s.baseTimes[0] = int64(binary.BigEndian.Uint64(data[4:]))
+		s.baseTimes[1] = int64(binary.BigEndian.Uint64(data[12:]))
+	case RespUpdateCipherKeys:
+		return fmt.Errorf("publisher requires encryption, which is not supported")
+	case RespDataStartTime:
+		if len(data) >= 8 {
+			t := TicksToUnixNanos(int64(binary.BigEndian.Uint64(data)))
+			s.message(false, "data start time %s", time.Unix(0, t).UTC().Format(time.RFC3339Nano))
+		}
+	case RespProcessingComplete:
+		s.message(false, "processing complete: %s", data)
+	case RespBufferBlock:
+		//We don't ask for buffer blocks, but the publisher waits for the
+		//confirmation before sending the next one
+		if len(data) >= 4 {
+			return s.sendCommand(CmdConfirmBufferBlock, data[:4])
+		}
+	case RespNotification:
+		if len(data) >= 4 {
+			s.message(false, "notification: %s", data[4:])
+			return s.sendCommand(CmdConfirmNotification, data[:4])
+		}
+	case RespConfigurationChanged:
+		s.message(false, "publisher configuration changed, refreshing metadata")
+		return s.RequestMetadata()
+	case RespNoOP:
+	default:
+		s.message(true, "unknown response code 0x%02x", code)
+	}
+	return nil
+}
+
+func (s *Subscriber) handleSignalIndexCache(data []byte) error {
+	data, err := decompressIfGzip(data)
+	if err != nil {
+		return fmt.Errorf("could not decompress signal index cache: %v", err)
+	}
+	//Skip the binary length and the subscriber ID
+	if len(data) < 24 {
+		return fmt.Errorf("signal index cache is too short")
+	}
+	count := int(binary.BigEndian.Uint32(data[20:]))
+	pos := 24
+	signals := make(map[uint16]signalIndexEntry)
+	for i := 0; i < count; i++ {
+		if len(data) < pos+22 {
+			return fmt.Errorf("signal index cache is truncated")
+		}
+		idx := binary.BigEndian.Uint16(data[pos:])
+		signalID := parseGUID(data[pos+2:])
+		srclen := int(binary.BigEndian.Uint32(data[pos+18:]))
+		pos += 22
+		if srclen < 0 || len(data) < pos+srclen+4 {
+			return fmt.Errorf("signal index cache is truncated")
+		}
+		source := string(data[pos : pos+srclen])
+		id := binary.BigEndian.Uint32(data[pos+srclen:])
+		pos += srclen + 4
+		signals[idx] = signalIndexEntry{SignalID: signalID, Source: source, ID: id}
+	}
+	s.signals = signals
+	s.message(false, "received signal index cache with %d signals", len(signals))
+	return nil
+}
+
+func (s *Subscriber) handleDataPacket(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("data packet is too short")
+	}
+	flags := data[0]
+	pos := 1
+	includeTime := true
+	var frameTime int64
+	if flags&DataPacketSynchronized != 0 {
+		if len(data) < pos+8 {
+			return fmt.Errorf("data packet is too short")
+		}
+		frameTime = int64(binary.BigEndian.Uint64(data[pos:]))
+		pos += 8
+		includeTime = false
+	}
+	if flags&DataPacketCipherIndex != 0 {
+		pos++
+	}
+	if len(data) < pos+4 {
+		return fmt.Errorf("data packet is too short")
+	}
+	count := int(binary.BigEndian.Uint32(data[pos:]))
+	pos += 4
+
+	var ms []Measurement
+	var err error
+	if flags&DataPacketCompressed != 0 {
+		ms, err = s.parseTSSC(data[pos:], count)
+	} else if flags&DataPacketCompact != 0 {
+		ms, err = s.parseCompact(data[pos:], count, includeTime, frameTime)
+	} else {
+		err = fmt.Errorf("the full measurement format is not supported")
+	}
+	if err != nil {
+		return err
+	}
+	if len(ms) > 0 && s.OnMeasurements != nil {
+		s.OnMeasurements(ms)
+	}
+	return nil
+}
+
+//measurement resolves the runtime ID. Measurements that are not in the
+//signal index cache are dropped, which is what the GSF subscriber does
+func (s *Subscriber) measurement(idx uint16, ticks int64, flags uint32, value float32) (Measurement, bool) {
+	sig, ok := s.signals[idx]
+	if !ok {
+		return Measurement{}, false
+	}
+	return Measurement{
+		ID:        sig.ID,
+		Source:    sig.Source,
+		SignalID:  sig.SignalID,
+		Value:     float64(value),
+		Timestamp: TicksToUnixNanos(ticks),
+		Flags:     flags,
+	}, true
+}
+
+func (s *Subscriber) parseCompact(data []byte, count int, includeTime bool, frameTime int64) ([]Measurement, error) {
+	rv := make([]Measurement, 0, count)
+	pos := 0
+	for i := 0; i < count; i++ {
+		if len(data) < pos+7 {
+			return nil, fmt.Errorf("compact measurement is truncated")
+		}
+		cflags := data[pos]
+		idx := binary.BigEndian.Uint16(data[pos+1:])
+		value := math.Float32frombits(binary.BigEndian.Uint32(data[pos+3:]))
+		pos += 7
+		ts := frameTime
+		if includeTime {
+			if cflags&CompactBaseTimeOffset != 0 {
+				if len(data) < pos+4 {
+					return nil, fmt.Errorf("compact measurement is truncated")
+				}
+				tidx := 0
+				if cflags&CompactTimeIndex != 0 {
+					tidx = 1
+				}
+				ts = s.baseTimes[tidx] + int64(binary.BigEndian.Uint32(data[pos:]))
+				pos += 4
+			} else {
+				if len(data) < pos+8 {
+					return nil, fmt.Errorf("compact measurement is truncated")
+				}
+				ts = int64(binary.BigEndian.Uint64(data[pos:]))
+				pos += 8
+			}
+		}
+		m, ok := s.measurement(idx, ts, mapCompactFlags(cflags), value)
+		if ok {
+			rv = append(rv, m)
+		}
+	}
+	return rv, nil
+}
+
+func (s *Subscriber) parseTSSC(data []byte, count int) ([]Measurement, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("tssc packet is too short")
+	}
+	if data[0] != tsscVersion {
+		return nil, fmt.Errorf("tssc version %d is not supported", data[0])
+	}
+	seq := binary.BigEndian.Uint16(data[1:])
+	if seq == 0 && s.tsscSequence > 0 {
+		s.message(false, "tssc algorithm reset by publisher")
+		s.tssc.Reset()
+		s.tsscSequence = 0
+	}
+	if seq != s.tsscSequence {
+		//The decoder state depends on every previous packet, so there is no
+		//way to recover without reconnecting
+		return nil, fmt.Errorf("tssc is out of sequence, expected %d got %d", s.tsscSequence, seq)
+	}
+	s.tssc.SetBuffer(data[3:])
+	rv := make([]Measurement, 0, count)
+	for {
+		ok, idx, ts, flags, value, err := s.tssc.TryGetMeasurement()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		m, ok := s.measurement(idx, ts, flags, value)
+		if ok {
+			rv = append(rv, m)
+		}
+	}
+	s.tsscSequence++
+	//Zero is reserved for a reset
+	if s.tsscSequence == 0 {
+		s.tsscSequence = 1
+	}
+	return rv, nil
+}
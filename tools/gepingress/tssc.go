@@ -0,0 +1,748 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+//This is a port of the Time-Series Special Compression (TSSC) algorithm
+//from the GSF. Each measurement is encoded as a sequence of adaptive
+//prefix codes, one for each field that changed since the previous
+//measurement, followed by the changed bits. The bit stream holding the
+//codes is interleaved with the byte stream holding the values. See
+// https://github.com/GridProtectionAlliance/gsf/tree/master/Source/Libraries/TimeSeriesPlatformLibrary/Transport/TSSCDecoder.cpp
+
+//The version byte at the start of every TSSC data packet
+const tsscVersion = 85
+
+const (
+	tsscEndOfStream = iota
+	tsscPointIDXOR4
+	tsscPointIDXOR8
+	tsscPointIDXOR12
+	tsscPointIDXOR16
+	tsscTimeDelta1Forward
+	tsscTimeDelta2Forward
+	tsscTimeDelta3Forward
+	tsscTimeDelta4Forward
+	tsscTimeDelta1Reverse
+	tsscTimeDelta2Reverse
+	tsscTimeDelta3Reverse
+	tsscTimeDelta4Reverse
+	tsscTimestamp2
+	tsscTimeXOR7Bit
+	tsscStateFlags2
+	tsscStateFlags7Bit32
+	tsscValue1
+	tsscValue2
+	tsscValue3
+	tsscValueZero
+	tsscValueXOR4
+	tsscValueXOR8
+	tsscValueXOR12
+	tsscValueXOR16
+	tsscValueXOR20
+	tsscValueXOR24
+	tsscValueXOR28
+	tsscValueXOR32
+)
+
+//tsscPoint is the per point state shared by the encoder and decoder. The
+//code words are adapted to the statistics of the codes written while this
+//point was the previous point.
+type tsscPoint struct {
+	PrevNextPointID1 uint16
+	PrevStateFlags1  uint32
+	PrevStateFlags2  uint32
+	PrevValue1       uint32
+	PrevValue2       uint32
+	PrevValue3       uint32
+
+	commandStats                [32]int
+	commandsSentSinceLastChange int
+	startupMode                 int
+	mode                        int
+	mode21                      int
+	mode31                      int
+	mode301                     int
+	mode41                      int
+	mode401                     int
+	mode4001                    int
+}
+
+func newTSSCPoint() *tsscPoint {
+	return &tsscPoint{mode: 4, mode41: tsscValue1, mode401: tsscTimeDelta1Forward, mode4001: tsscValue2}
+}
+
+func (p *tsscPoint) updateCodeStatistics(code int) {
+	p.commandsSentSinceLastChange++
+	p.commandStats[code]++
+	if p.startupMode == 0 && p.commandsSentSinceLastChange > 5 {
+		p.startupMode++
+		p.adaptCommands()
+	} else if p.startupMode == 1 && p.commandsSentSinceLastChange > 20 {
+		p.startupMode++
+		p.adaptCommands()
+	} else if p.startupMode == 2 && p.commandsSentSinceLastChange > 100 {
+		p.adaptCommands()
+	}
+}
+
+//adaptCommands picks the mode that would have used the fewest bits for
+//the codes seen since the last change
+func (p *tsscPoint) adaptCommands() {
+	code1, count1 := 0, 0
+	code2, count2 := 1, 0
+	code3, count3 := 2, 0
+	total := 0
+	for i := range p.commandStats {
+		count := p.commandStats[i]
+		p.commandStats[i] = 0
+		total += count
+		if count > count3 {
+			if count > count1 {
+				code3, count3 = code2, count2
+				code2, count2 = code1, count1
+				code1, count1 = i, count
+			} else if count > count2 {
+				code3, count3 = code2, count2
+				code2, count2 = i, count
+			} else {
+				code3, count3 = i, count
+			}
+		}
+	}
+	mode1Size := total * 5
+	mode2Size := count1 + (total-count1)*6
+	mode3Size := count1 + count2*2 + (total-count1-count2)*7
+	mode4Size := count1 + count2*2 + count3*3 + (total-count1-count2-count3)*8
+	minSize := mode1Size
+	if mode2Size < minSize {
+		minSize = mode2Size
+	}
+	if mode3Size < minSize {
+		minSize = mode3Size
+	}
+	if mode4Size < minSize {
+		minSize = mode4Size
+	}
+	switch minSize {
+	case mode1Size:
+		p.mode = 1
+	case mode2Size:
+		p.mode = 2
+		p.mode21 = code1
+	case mode3Size:
+		p.mode = 3
+		p.mode31 = code1
+		p.mode301 = code2
+	default:
+		p.mode = 4
+		p.mode41 = code1
+		p.mode401 = code2
+		p.mode4001 = code3
+	}
+	p.commandsSentSinceLastChange = 0
+}
+
+//TSSCDecoder holds the state of a TSSC stream. The state carries over
+//from one data packet to the next, so a single decoder must see every
+//packet in sequence.
+type TSSCDecoder struct {
+	data     []byte
+	position int
+
+	bitStreamCache int
+	bitStreamCount int
+
+	prevTimestamp1 int64
+	prevTimestamp2 int64
+	prevTimeDelta1 int64
+	prevTimeDelta2 int64
+	prevTimeDelta3 int64
+	prevTimeDelta4 int64
+
+	lastPoint *tsscPoint
+	points    []*tsscPoint
+}
+
+func NewTSSCDecoder() *TSSCDecoder {
+	d := &TSSCDecoder{}
+	d.Reset()
+	return d
+}
+
+func (d *TSSCDecoder) Reset() {
+	d.data = nil
+	d.position = 0
+	d.points = nil
+	d.lastPoint = newTSSCPoint()
+	d.clearBitStream()
+	d.prevTimestamp1 = 0
+	d.prevTimestamp2 = 0
+	d.prevTimeDelta1 = math.MaxInt64
+	d.prevTimeDelta2 = math.MaxInt64
+	d.prevTimeDelta3 = math.MaxInt64
+	d.prevTimeDelta4 = math.MaxInt64
+}
+
+//SetBuffer sets the block of data to decode
+func (d *TSSCDecoder) SetBuffer(data []byte) {
+	d.clearBitStream()
+	d.data = data
+	d.position = 0
+}
+
+func (d *TSSCDecoder) clearBitStream() {
+	d.bitStreamCache = 0
+	d.bitStreamCount = 0
+}
+
+func (d *TSSCDecoder) readByte() (uint32, error) {
+	if d.position >= len(d.data) {
+		return 0, fmt.Errorf("tssc block is truncated")
+	}
+	b := d.data[d.position]
+	d.position++
+	return uint32(b), nil
+}
+
+func (d *TSSCDecoder) readBit() (int, error) {
+	if d.bitStreamCount == 0 {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		d.bitStreamCount = 8
+		d.bitStreamCache = int(b)
+	}
+	d.bitStreamCount--
+	return (d.bitStreamCache >> uint(d.bitStreamCount)) & 1, nil
+}
+
+func (d *TSSCDecoder) readBits4() (uint32, error) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		b, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | uint32(b)
+	}
+	return v, nil
+}
+
+func (d *TSSCDecoder) readBits5() (int, error) {
+	if d.bitStreamCount < 5 {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		d.bitStreamCount += 8
+		d.bitStreamCache = (d.bitStreamCache << 8) | int(b)
+	}
+	d.bitStreamCount -= 5
+	return (d.bitStreamCache >> uint(d.bitStreamCount)) & 31, nil
+}
+
+//prefixCodes returns the codes that have a short prefix in the current
+//mode, in the order of their prefixes 1, 01 and 001
+func (p *tsscPoint) prefixCodes() []int {
+	switch p.mode {
+	case 2:
+		return []int{p.mode21}
+	case 3:
+		return []int{p.mode31, p.mode301}
+	case 4:
+		return []int{p.mode41, p.mode401, p.mode4001}
+	}
+	return nil
+}
+
+func (d *TSSCDecoder) readCode() (int, error) {
+	p := d.lastPoint
+	code := -1
+	for _, c := range p.prefixCodes() {
+		bit, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			code = c
+			break
+		}
+	}
+	if code < 0 {
+		var err error
+		code, err = d.readBits5()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if code > tsscValueXOR32 {
+		return 0, fmt.Errorf("invalid tssc code %d", code)
+	}
+	p.updateCodeStatistics(code)
+	return code, nil
+}
+
+//TryGetMeasurement decodes the next measurement in the block. It returns
+//false once the block is exhausted.
+func (d *TSSCDecoder) TryGetMeasurement() (ok bool, id uint16, timestamp int64, stateFlags uint32, value float32, err error) {
+	if d.position == len(d.data) && d.bitStreamCount == 0 {
+		d.clearBitStream()
+		return false, 0, 0, 0, 0, nil
+	}
+	code, err := d.readCode()
+	if err != nil {
+		return false, 0, 0, 0, 0, err
+	}
+	if code == tsscEndOfStream {
+		d.clearBitStream()
+		return false, 0, 0, 0, 0, nil
+	}
+
+	if code <= tsscPointIDXOR16 {
+		err = d.decodePointID(code)
+		if err == nil {
+			code, err = d.readCode()
+		}
+		if err != nil {
+			return false, 0, 0, 0, 0, err
+		}
+		if code < tsscTimeDelta1Forward {
+			return false, 0, 0, 0, 0, fmt.Errorf("tssc expecting code >= %d, got %d", tsscTimeDelta1Forward, code)
+		}
+	}
+
+	id = d.lastPoint.PrevNextPointID1
+	for int(id) >= len(d.points) {
+		d.points = append(d.points, nil)
+	}
+	nextPoint := d.points[id]
+	if nextPoint == nil {
+		nextPoint = newTSSCPoint()
+		nextPoint.PrevNextPointID1 = id + 1
+		d.points[id] = nextPoint
+	}
+
+	if code <= tsscTimeXOR7Bit {
+		timestamp, err = d.decodeTimestamp(code)
+		if err == nil {
+			code, err = d.readCode()
+		}
+		if err != nil {
+			return false, 0, 0, 0, 0, err
+		}
+		if code < tsscStateFlags2 {
+			return false, 0, 0, 0, 0, fmt.Errorf("tssc expecting code >= %d, got %d", tsscStateFlags2, code)
+		}
+	} else {
+		timestamp = d.prevTimestamp1
+	}
+
+	if code <= tsscStateFlags7Bit32 {
+		stateFlags, err = d.decodeStateFlags(code, nextPoint)
+		if err == nil {
+			code, err = d.readCode()
+		}
+		if err != nil {
+			return false, 0, 0, 0, 0, err
+		}
+		if code < tsscValue1 {
+			return false, 0, 0, 0, 0, fmt.Errorf("tssc expecting code >= %d, got %d", tsscValue1, code)
+		}
+	} else {
+		stateFlags = nextPoint.PrevStateFlags1
+	}
+
+	raw, err := d.decodeValue(code, nextPoint)
+	if err != nil {
+		return false, 0, 0, 0, 0, err
+	}
+	d.lastPoint = nextPoint
+	return true, id, timestamp, stateFlags, math.Float32frombits(raw), nil
+}
+
+func (d *TSSCDecoder) decodePointID(code int) error {
+	var changed uint32
+	var a, b uint32
+	var err error
+	switch code {
+	case tsscPointIDXOR4:
+		changed, err = d.readBits4()
+	case tsscPointIDXOR8:
+		changed, err = d.readByte()
+	case tsscPointIDXOR12:
+		if a, err = d.readBits4(); err == nil {
+			b, err = d.readByte()
+			changed = a ^ b<<4
+		}
+	case tsscPointIDXOR16:
+		if a, err = d.readByte(); err == nil {
+			b, err = d.readByte()
+			changed = a ^ b<<8
+		}
+	}
+	if err != nil {
+		return err
+	}
+	d.lastPoint.PrevNextPointID1 ^= uint16(changed)
+	return nil
+}
+
+func (d *TSSCDecoder) decodeTimestamp(code int) (int64, error) {
+	var ts int64
+	switch code {
+	case tsscTimeDelta1Forward:
+		ts = d.prevTimestamp1 + d.prevTimeDelta1
+	case tsscTimeDelta2Forward:
+		ts = d.prevTimestamp1 + d.prevTimeDelta2
+	case tsscTimeDelta3Forward:
+		ts = d.prevTimestamp1 + d.prevTimeDelta3
+	case tsscTimeDelta4Forward:
+		ts = d.prevTimestamp1 + d.prevTimeDelta4
+	case tsscTimeDelta1Reverse:
+		ts = d.prevTimestamp1 - d.prevTimeDelta1
+	case tsscTimeDelta2Reverse:
+		ts = d.prevTimestamp1 - d.prevTimeDelta2
+	case tsscTimeDelta3Reverse:
+		ts = d.prevTimestamp1 - d.prevTimeDelta3
+	case tsscTimeDelta4Reverse:
+		ts = d.prevTimestamp1 - d.prevTimeDelta4
+	case tsscTimestamp2:
+		ts = d.prevTimestamp2
+	case tsscTimeXOR7Bit:
+		v, err := read7BitUint64(d.data, &d.position)
+		if err != nil {
+			return 0, err
+		}
+		ts = d.prevTimestamp1 ^ int64(v)
+	}
+	updateTimeDeltas(&d.prevTimestamp1, &d.prevTimestamp2,
+		[]*int64{&d.prevTimeDelta1, &d.prevTimeDelta2, &d.prevTimeDelta3, &d.prevTimeDelta4}, ts)
+	return ts, nil
+}
+
+//updateTimeDeltas keeps the four smallest distinct deltas between
+//consecutive timestamps, and is shared with the encoder
+func updateTimeDeltas(prev1, prev2 *int64, deltas []*int64, ts int64) {
+	minDelta := *prev1 - ts
+	if minDelta < 0 {
+		minDelta = -minDelta
+	}
+	if minDelta < *deltas[3] && minDelta != *deltas[0] && minDelta != *deltas[1] && minDelta != *deltas[2] {
+		if minDelta < *deltas[0] {
+			*deltas[3], *deltas[2], *deltas[1], *deltas[0] = *deltas[2], *deltas[1], *deltas[0], minDelta
+		} else if minDelta < *deltas[1] {
+			*deltas[3], *deltas[2], *deltas[1] = *deltas[2], *deltas[1], minDelta
+		} else if minDelta < *deltas[2] {
+			*deltas[3], *deltas[2] = *deltas[2], minDelta
+		} else {
+			*deltas[3] = minDelta
+		}
+	}
+	*prev2 = *prev1
+	*prev1 = ts
+}
+
+func (d *TSSCDecoder) decodeStateFlags(code int, p *tsscPoint) (uint32, error) {
+	var flags uint32
+	if code == tsscStateFlags2 {
+		flags = p.PrevStateFlags2
+	} else {
+		var err error
+		flags, err = read7BitUint32(d.data, &d.position)
+		if err != nil {
+			return 0, err
+		}
+	}
+	p.PrevStateFlags2 = p.PrevStateFlags1
+	p.PrevStateFlags1 = flags
+	return flags, nil
+}
+
+func (d *TSSCDecoder) decodeValue(code int, p *tsscPoint) (uint32, error) {
+	var value uint32
+	switch code {
+	case tsscValue1:
+		return p.PrevValue1, nil
+	case tsscValue2:
+		value = p.PrevValue2
+		p.PrevValue2 = p.PrevValue1
+		p.PrevValue1 = value
+		return value, nil
+	case tsscValue3:
+		value = p.PrevValue3
+		p.PrevValue3 = p.PrevValue2
+		p.PrevValue2 = p.PrevValue1
+		p.PrevValue1 = value
+		return value, nil
+	case tsscValueZero:
+		value = 0
+	default:
+		//The XOR codes are a nibble from the bit stream for the odd sizes,
+		//followed by the remaining bytes, least significant first
+		nbits := uint(4 * (code - tsscValueXOR4 + 1))
+		var changed uint32
+		var shift uint
+		if nbits%8 != 0 {
+			n, err := d.readBits4()
+			if err != nil {
+				return 0, err
+			}
+			changed = n
+			shift = 4
+		}
+		for ; shift < nbits; shift += 8 {
+			b, err := d.readByte()
+			if err != nil {
+				return 0, err
+			}
+			changed |= b << shift
+		}
+		value = changed ^ p.PrevValue1
+	}
+	p.PrevValue3 = p.PrevValue2
+	p.PrevValue2 = p.PrevValue1
+	p.PrevValue1 = value
+	return value, nil
+}
+
+//TSSCEncoder is the inverse of TSSCDecoder. We only use it in the fake
+//publisher.
+type TSSCEncoder struct {
+	data         []byte
+	position     int
+	lastPosition int
+
+	bitStreamBufferIndex int
+	bitStreamCache       int
+	bitStreamCount       int
+
+	prevTimestamp1 int64
+	prevTimestamp2 int64
+	prevTimeDelta1 int64
+	prevTimeDelta2 int64
+	prevTimeDelta3 int64
+	prevTimeDelta4 int64
+
+	lastPoint *tsscPoint
+	points    []*tsscPoint
+}
+
+func NewTSSCEncoder() *TSSCEncoder {
+	e := &TSSCEncoder{}
+	e.Reset()
+	return e
+}
+
+func (e *TSSCEncoder) Reset() {
+	e.points = nil
+	e.lastPoint = newTSSCPoint()
+	e.data = nil
+	e.position = 0
+	e.lastPosition = 0
+	e.clearBitStream()
+	e.prevTimestamp1 = 0
+	e.prevTimestamp2 = 0
+	e.prevTimeDelta1 = math.MaxInt64
+	e.prevTimeDelta2 = math.MaxInt64
+	e.prevTimeDelta3 = math.MaxInt64
+	e.prevTimeDelta4 = math.MaxInt64
+}
+
+func (e *TSSCEncoder) clearBitStream() {
+	e.bitStreamBufferIndex = -1
+	e.bitStreamCache = 0
+	e.bitStreamCount = 0
+}
+
+//SetBuffer starts a new block that will be written into buf
+func (e *TSSCEncoder) SetBuffer(buf []byte) {
+	e.clearBitStream()
+	e.data = buf
+	e.position = 0
+	e.lastPosition = len(buf)
+}
+
+//FinishBlock terminates the block and returns the number of bytes used
+func (e *TSSCEncoder) FinishBlock() int {
+	e.bitStreamFlush()
+	return e.position
+}
+
+func (e *TSSCEncoder) writeByte(b byte) {
+	e.data[e.position] = b
+	e.position++
+}
+
+func (e *TSSCEncoder) writeBits(code int, length uint) {
+	if e.bitStreamBufferIndex < 0 {
+		e.bitStreamBufferIndex = e.position
+		e.position++
+	}
+	e.bitStreamCache = (e.bitStreamCache << length) | code
+	e.bitStreamCount += int(length)
+	for e.bitStreamCount > 7 {
+		e.data[e.bitStreamBufferIndex] = byte(e.bitStreamCache >> uint(e.bitStreamCount-8))
+		e.bitStreamCount -= 8
+		if e.bitStreamCount > 0 {
+			e.bitStreamBufferIndex = e.position
+			e.position++
+		} else {
+			e.bitStreamBufferIndex = -1
+		}
+	}
+	e.bitStreamCache &= (1 << uint(e.bitStreamCount)) - 1
+}
+
+//bitStreamFlush pads out the final bit stream byte. If there are bits
+//pending, the decoder could mistake the padding for a code, so an end of
+//stream code is written first.
+func (e *TSSCEncoder) bitStreamFlush() {
+	if e.bitStreamCount == 0 {
+		return
+	}
+	e.writeCode(tsscEndOfStream)
+	if e.bitStreamCount > 0 {
+		e.data[e.bitStreamBufferIndex] = byte(e.bitStreamCache << uint(8-e.bitStreamCount))
+	}
+	e.clearBitStream()
+}
+
+func (e *TSSCEncoder) writeCode(code int) {
+	p := e.lastPoint
+	prefixes := p.prefixCodes()
+	written := false
+	for i, c := range prefixes {
+		if code == c {
+			e.writeBits(1, uint(i+1))
+			written = true
+			break
+		}
+	}
+	if !written {
+		e.writeBits(code, uint(5+len(prefixes)))
+	}
+	p.updateCodeStatistics(code)
+}
+
+//writeXOR writes the changed bits using the smallest of the XOR codes
+//starting at baseCode
+func (e *TSSCEncoder) writeXOR(baseCode int, changed uint32) {
+	nibbles := 1
+	for nibbles < 8 && changed>>uint(4*nibbles) != 0 {
+		nibbles++
+	}
+	e.writeCode(baseCode + nibbles - 1)
+	shift := uint(0)
+	if nibbles%2 == 1 {
+		e.writeBits(int(changed&15), 4)
+		shift = 4
+	}
+	for ; shift < uint(4*nibbles); shift += 8 {
+		e.writeByte(byte(changed >> shift))
+	}
+}
+
+//TryAddMeasurement returns false if the block is full, in which case the
+//block should be finished and the measurement added to a new one
+func (e *TSSCEncoder) TryAddMeasurement(id uint16, timestamp int64, stateFlags uint32, value float32) bool {
+	//The worst case is a little under 40 bytes
+	if e.lastPosition-e.position < 100 {
+		return false
+	}
+	for int(id) >= len(e.points) {
+		e.points = append(e.points, nil)
+	}
+	point := e.points[id]
+	if point == nil {
+		point = newTSSCPoint()
+		point.PrevNextPointID1 = id + 1
+		e.points[id] = point
+	}
+
+	if e.lastPoint.PrevNextPointID1 != id {
+		e.writeXOR(tsscPointIDXOR4, uint32(id^e.lastPoint.PrevNextPointID1))
+		e.lastPoint.PrevNextPointID1 = id
+	}
+
+	if e.prevTimestamp1 != timestamp {
+		e.writeTimestamp(timestamp)
+	}
+
+	if point.PrevStateFlags1 != stateFlags {
+		if point.PrevStateFlags2 == stateFlags {
+			e.writeCode(tsscStateFlags2)
+		} else {
+			e.writeCode(tsscStateFlags7Bit32)
+			write7BitUint32(e.data, &e.position, stateFlags)
+		}
+		point.PrevStateFlags2 = point.PrevStateFlags1
+		point.PrevStateFlags1 = stateFlags
+	}
+
+	raw := math.Float32bits(value)
+	switch {
+	case raw == point.PrevValue1:
+		e.writeCode(tsscValue1)
+	case raw == point.PrevValue2:
+		e.writeCode(tsscValue2)
+		point.PrevValue2 = point.PrevValue1
+		point.PrevValue1 = raw
+	case raw == point.PrevValue3:
+		e.writeCode(tsscValue3)
+		point.PrevValue3 = point.PrevValue2
+		point.PrevValue2 = point.PrevValue1
+		point.PrevValue1 = raw
+	default:
+		if raw == 0 {
+			e.writeCode(tsscValueZero)
+		} else {
+			e.writeXOR(tsscValueXOR4, raw^point.PrevValue1)
+		}
+		point.PrevValue3 = point.PrevValue2
+		point.PrevValue2 = point.PrevValue1
+		point.PrevValue1 = raw
+	}
+	e.lastPoint = point
+	return true
+}
+
+func (e *TSSCEncoder) writeTimestamp(ts int64) {
+	deltas := []int64{e.prevTimeDelta1, e.prevTimeDelta2, e.prevTimeDelta3, e.prevTimeDelta4}
+	written := false
+	for i, delta := range deltas {
+		if delta != math.MaxInt64 && ts == e.prevTimestamp1+delta {
+			e.writeCode(tsscTimeDelta1Forward + i)
+			written = true
+			break
+		}
+	}
+	if !written {
+		for i, delta := range deltas {
+			if delta != math.MaxInt64 && ts == e.prevTimestamp1-delta {
+				e.writeCode(tsscTimeDelta1Reverse + i)
+				written = true
+				break
+			}
+		}
+	}
+	if !written {
+		if ts == e.prevTimestamp2 {
+			e.writeCode(tsscTimestamp2)
+		} else {
+			e.writeCode(tsscTimeXOR7Bit)
+			write7BitUint64(e.data, &e.position, uint64(ts^e.prevTimestamp1))
+		}
+	}
+	updateTimeDeltas(&e.prevTimestamp1, &e.prevTimestamp2,
+		[]*int64{&e.prevTimeDelta1, &e.prevTimeDelta2, &e.prevTimeDelta3, &e.prevTimeDelta4}, ts)
+}
@@ -0,0 +1,423 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package importman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+//ImportState is the progress of an import, saved so that an interrupted
+//import can be resumed
+type ImportState struct {
+	Collection string         `json:"collection"`
+	Started    time.Time      `json:"started"`
+	Updated    time.Time      `json:"updated"`
+	Sources    []*SourceState `json:"sources"`
+}
+
+//SourceState is the progress of one source, usually a file
+type SourceState struct {
+	Name string `json:"name"`
+	//Read is set once all the streams of the source have been read, after
+	//which Total is final
+	Read bool `json:"read"`
+	//Done is set once all the points of the source have been inserted
+	Done     bool  `json:"done"`
+	Inserted int64 `json:"inserted"`
+	Total    int64 `json:"total"`
+	//Streams holds the checkpoints of the streams read from the source. It
+	//is dropped once the source is done.
+	Streams map[string]*StreamCheckpoint `json:"streams,omitempty"`
+
+	pending int
+}
+
+//StreamCheckpoint is how much of the data of a stream read from a source
+//has been inserted
+type StreamCheckpoint struct {
+	Collection string `json:"collection"`
+	Name       string `json:"name"`
+	//Offset is the number of points of the stream that have been inserted
+	Offset int64 `json:"offset"`
+	Total  int64 `json:"total"`
+	//LastTime is the time of the last point inserted
+	LastTime int64 `json:"last_time"`
+	Done     bool  `json:"done"`
+}
+
+//CheckpointStore persists the state of an import
+type CheckpointStore interface {
+	//Load returns nil if there is no saved state
+	Load() (*ImportState, error)
+	Save(st *ImportState) error
+}
+
+type fileStore struct {
+	filename string
+}
+
+//NewFileStore keeps the state of an import in a local file
+func NewFileStore(filename string) CheckpointStore {
+	return &fileStore{filename: filename}
+}
+
+func (fs *fileStore) Load() (*ImportState, error) {
+	data, err := ioutil.ReadFile(fs.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &ImportState{}
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fs.filename, err)
+	}
+	return st, nil
+}
+
+//Save replaces the file atomically, so a crash leaves either the old or
+//the new state
+func (fs *fileStore) Save(st *ImportState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.filename), filepath.Base(fs.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.filename)
+}
+
+//The etcd key prefix under which import states are kept
+const etcdCheckpointPrefix = "importman/checkpoint/"
+
+type etcdStore struct {
+	client *etcd.Client
+	key    string
+}
+
+//NewEtcdStore keeps the state of an import in etcd, under the given name
+func NewEtcdStore(client *etcd.Client, name string) CheckpointStore {
+	return &etcdStore{client: client, key: etcdCheckpointPrefix + name}
+}
+
+func (es *etcdStore) Load() (*ImportState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := es.client.Get(ctx, es.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	st := &ImportState{}
+	err = json.Unmarshal(resp.Kvs[0].Value, st)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", es.key, err)
+	}
+	return st, nil
+}
+
+func (es *etcdStore) Save(st *ImportState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = es.client.Put(ctx, es.key, string(data))
+	return err
+}
+
+//The progress of an import is saved after this many inserts, or once this
+//much time has passed since it was last saved, whichever comes first
+const (
+	CheckpointInserts  = 100
+	CheckpointInterval = 10 * time.Second
+)
+
+//Checkpoint tracks the progress of an import and saves it every
+//CheckpointInserts inserts or CheckpointInterval, and when the import
+//finishes. The inserts since the last save are not recorded if the import is
+//interrupted, so a resumed import inserts them again: points are delivered at
+//least once. The streams of a source are told apart by their collection,
+//tags and the order in which the data source returned them, so a resumed
+//import must read the same files with the same options.
+type Checkpoint struct {
+	mu      sync.Mutex
+	store   CheckpointStore
+	state   *ImportState
+	resumed bool
+	sources map[string]*SourceState
+	//The source of the last stream that was enqueued
+	current *SourceState
+	//How many times each stream has been seen in each source
+	seen map[string]int
+	//The points of the sources that were skipped entirely
+	skipped int64
+
+	//The number of inserts since the state was last saved, and when it was
+	unsaved    int
+	saved      time.Time
+	maxInserts int
+	interval   time.Duration
+}
+
+//streamProgress is the checkpoint of one stream being inserted
+type streamProgress struct {
+	src *SourceState
+	ck  *StreamCheckpoint
+}
+
+//OpenCheckpoint loads the saved state of an import into the given
+//collection, or starts a new one if there is none
+func OpenCheckpoint(store CheckpointStore, collection string) (*Checkpoint, error) {
+	st, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load checkpoint: %v", err)
+	}
+	cp := &Checkpoint{
+		store:      store,
+		state:      st,
+		resumed:    st != nil,
+		saved:      time.Now(),
+		maxInserts: CheckpointInserts,
+		interval:   CheckpointInterval,
+		sources:    make(map[string]*SourceState),
+		seen:       make(map[string]int),
+	}
+	if st == nil {
+		cp.state = &ImportState{Collection: collection, Started: time.Now()}
+	} else if st.Collection != collection {
+		return nil, fmt.Errorf("the checkpoint is of an import into %q, not %q", st.Collection, collection)
+	}
+	for _, src := range cp.state.Sources {
+		cp.sources[src.Name] = src
+	}
+	return cp, nil
+}
+
+//Resumed returns true if the checkpoint was of an earlier run
+func (cp *Checkpoint) Resumed() bool {
+	return cp.resumed
+}
+
+//State returns a copy of the state of the import
+func (cp *Checkpoint) State() *ImportState {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	data, err := json.Marshal(cp.state)
+	if err != nil {
+		panic(err)
+	}
+	rv := &ImportState{}
+	json.Unmarshal(data, rv)
+	return rv
+}
+
+//Begin lists the sources of the data source and tells it to skip the ones
+//that are done, if it can
+func (cp *Checkpoint) Begin(ds plugins.DataSource) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	rs, ok := ds.(plugins.ResumableSource)
+	if !ok {
+		return nil
+	}
+	for _, name := range rs.Sources() {
+		src := cp.source(name)
+		if src.Done {
+			rs.SkipSource(name)
+			cp.skipped += src.Inserted
+		}
+	}
+	return cp.save()
+}
+
+//Skipped returns the number of points in the sources that the data source
+//will skip
+func (cp *Checkpoint) Skipped() int64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.skipped
+}
+
+//source returns the state of a source, adding it if it is new
+func (cp *Checkpoint) source(name string) *SourceState {
+	src, ok := cp.sources[name]
+	if !ok {
+		src = &SourceState{Name: name}
+		cp.sources[name] = src
+		cp.state.Sources = append(cp.state.Sources, src)
+	}
+	return src
+}
+
+//Enqueued records that a stream is about to be inserted and returns its
+//checkpoint. The points before the checkpoint's offset must not be inserted
+//again.
+func (cp *Checkpoint) Enqueued(s plugins.Stream) *streamProgress {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	name := ""
+	if ss, ok := s.(plugins.SourcedStream); ok {
+		name = ss.Source()
+	}
+	src := cp.source(name)
+	//Data sources read their sources one at a time, so the previous source
+	//has been read completely
+	if cp.current != nil && cp.current != src {
+		cp.read(cp.current)
+	}
+	cp.current = src
+
+	tags := make([]string, 0, len(s.Tags()))
+	for k, v := range s.Tags() {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	key := s.CollectionSuffix() + ";" + strings.Join(tags, ";")
+	seenkey := name + "\x00" + key
+	cp.seen[seenkey]++
+	key = fmt.Sprintf("%s#%d", key, cp.seen[seenkey])
+
+	if src.Done {
+		//The data source could not skip it
+		return &streamProgress{src: src, ck: &StreamCheckpoint{Done: true}}
+	}
+	if src.Streams == nil {
+		src.Streams = make(map[string]*StreamCheckpoint)
+	}
+	ck, ok := src.Streams[key]
+	if !ok {
+		total, _ := s.Total()
+		ck = &StreamCheckpoint{
+			Collection: s.CollectionSuffix(),
+			Name:       s.Tags()["name"],
+			Total:      total,
+		}
+		src.Streams[key] = ck
+		src.Total += total
+	}
+	if !ck.Done {
+		src.pending++
+	}
+	return &streamProgress{src: src, ck: ck}
+}
+
+//Inserted records that the points following the checkpoint's offset have
+//been inserted
+func (cp *Checkpoint) Inserted(sp *streamProgress, pts []plugins.Point) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	sp.ck.Offset += int64(len(pts))
+	sp.ck.LastTime = pts[len(pts)-1].Time
+	sp.src.Inserted += int64(len(pts))
+	return cp.batch()
+}
+
+//Finished records that all the points of a stream have been inserted
+func (cp *Checkpoint) Finished(sp *streamProgress) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if sp.ck.Done {
+		return nil
+	}
+	sp.ck.Done = true
+	//The total is only an estimate for some data sources
+	sp.ck.Total = sp.ck.Offset
+	sp.src.pending--
+	cp.done(sp.src)
+	return cp.batch()
+}
+
+//NoMoreStreams records that all the sources have been read
+func (cp *Checkpoint) NoMoreStreams() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, src := range cp.state.Sources {
+		cp.read(src)
+	}
+	return cp.save()
+}
+
+func (cp *Checkpoint) read(src *SourceState) {
+	src.Read = true
+	cp.done(src)
+}
+
+//done checks if the source is done
+func (cp *Checkpoint) done(src *SourceState) {
+	if src.Done || !src.Read || src.pending > 0 {
+		return
+	}
+	for _, ck := range src.Streams {
+		if !ck.Done {
+			return
+		}
+	}
+	src.Done = true
+	src.Total = src.Inserted
+	src.Streams = nil
+}
+
+//Flush saves the progress recorded since the last save
+func (cp *Checkpoint) Flush() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.unsaved == 0 {
+		return nil
+	}
+	return cp.save()
+}
+
+//batch saves the state if enough has changed since it was last saved
+func (cp *Checkpoint) batch() error {
+	cp.unsaved++
+	if cp.unsaved < cp.maxInserts && time.Since(cp.saved) < cp.interval {
+		return nil
+	}
+	return cp.save()
+}
+
+func (cp *Checkpoint) save() error {
+	cp.state.Updated = time.Now()
+	err := cp.store.Save(cp.state)
+	if err != nil {
+		return fmt.Errorf("could not save checkpoint: %v", err)
+	}
+	cp.unsaved = 0
+	cp.saved = cp.state.Updated
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package importman
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+)
+
+type testStream struct {
+	source string
+	name   string
+	points []plugins.Point
+}
+
+func newStream(source string, name string) *testStream {
+	return &testStream{source: source, name: name, points: make([]plugins.Point, 3)}
+}
+
+func (s *testStream) CollectionSuffix() string {
+	return "/test"
+}
+
+func (s *testStream) Tags() map[string]string {
+	return map[string]string{"name": s.name}
+}
+
+func (s *testStream) Annotations() map[string]string {
+	return nil
+}
+
+func (s *testStream) Next() []plugins.Point {
+	rv := s.points
+	s.points = nil
+	return rv
+}
+
+func (s *testStream) Total() (int64, bool) {
+	return int64(len(s.points)), true
+}
+
+func (s *testStream) Source() string {
+	return s.source
+}
+
+type testSource struct {
+	sources []string
+	skipped []string
+}
+
+func (s *testSource) Next() []plugins.Stream {
+	return nil
+}
+
+func (s *testSource) Total() (int64, bool) {
+	return 0, false
+}
+
+func (s *testSource) Sources() []string {
+	return s.sources
+}
+
+func (s *testSource) SkipSource(source string) {
+	s.skipped = append(s.skipped, source)
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(filepath.Join(dir, "state.json"))
+
+	//The first run finishes a.d and is interrupted half way through b.d
+	cp, err := OpenCheckpoint(store, "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Resumed() {
+		t.Fatalf("new checkpoint claims to be resumed")
+	}
+	//Save after every insert, so the interrupted run leaves all its progress
+	cp.maxInserts = 1
+	ds := &testSource{sources: []string{"a.d", "b.d", "c.d"}}
+	err = cp.Begin(ds)
+	if err != nil || len(ds.skipped) != 0 {
+		t.Fatalf("unexpected skip %v %v", ds.skipped, err)
+	}
+	a1 := cp.Enqueued(newStream("a.d", "x"))
+	a2 := cp.Enqueued(newStream("a.d", "y"))
+	b1 := cp.Enqueued(newStream("b.d", "x"))
+	//The same stream twice in a source is told apart by its order
+	b2 := cp.Enqueued(newStream("b.d", "x"))
+	for _, sp := range []*streamProgress{a1, a2} {
+		if sp.ck.Offset != 0 || sp.ck.Done {
+			t.Fatalf("unexpected checkpoint %+v", sp.ck)
+		}
+		cp.Inserted(sp, []plugins.Point{{Time: 1}, {Time: 2}, {Time: 3}})
+		cp.Finished(sp)
+	}
+	cp.Inserted(b1, []plugins.Point{{Time: 1}, {Time: 2}})
+	cp.Inserted(b2, []plugins.Point{{Time: 1}})
+	st := cp.State()
+	if !st.Sources[0].Done || st.Sources[0].Inserted != 6 || st.Sources[0].Streams != nil {
+		t.Fatalf("a.d should be done: %+v", st.Sources[0])
+	}
+	if st.Sources[1].Done || st.Sources[1].Inserted != 3 || st.Sources[1].Read {
+		t.Fatalf("b.d should be in progress: %+v", st.Sources[1])
+	}
+
+	//Another collection is refused
+	_, err = OpenCheckpoint(store, "other")
+	if err == nil {
+		t.Fatalf("checkpoint of another collection was accepted")
+	}
+
+	//The second run skips a.d and the points of b.d that were inserted
+	cp, err = OpenCheckpoint(store, "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Resumed() {
+		t.Fatalf("checkpoint was not resumed")
+	}
+	cp.maxInserts = 1
+	ds = &testSource{sources: []string{"a.d", "b.d", "c.d"}}
+	err = cp.Begin(ds)
+	if err != nil || len(ds.skipped) != 1 || ds.skipped[0] != "a.d" || cp.Skipped() != 6 {
+		t.Fatalf("unexpected skip %v %d %v", ds.skipped, cp.Skipped(), err)
+	}
+	b1 = cp.Enqueued(newStream("b.d", "x"))
+	b2 = cp.Enqueued(newStream("b.d", "x"))
+	if b1.ck.Offset != 2 || b1.ck.LastTime != 2 || b2.ck.Offset != 1 {
+		t.Fatalf("unexpected offsets %+v %+v", b1.ck, b2.ck)
+	}
+	c1 := cp.Enqueued(newStream("c.d", "x"))
+	cp.Inserted(b1, []plugins.Point{{Time: 3}})
+	cp.Finished(b1)
+	if cp.State().Sources[1].Done {
+		t.Fatalf("b.d is done before all its streams are")
+	}
+	cp.Inserted(b2, []plugins.Point{{Time: 2}, {Time: 3}})
+	cp.Finished(b2)
+	if !cp.State().Sources[1].Done {
+		t.Fatalf("b.d should be done")
+	}
+	cp.NoMoreStreams()
+	if cp.State().Sources[2].Done {
+		t.Fatalf("c.d is done before its streams are")
+	}
+	cp.Inserted(c1, []plugins.Point{{Time: 1}, {Time: 2}, {Time: 3}})
+	cp.Finished(c1)
+
+	st, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range st.Sources {
+		if !src.Done || src.Total != src.Inserted || (src.Name != "c.d" && src.Inserted != 6) {
+			t.Fatalf("unexpected final state %+v", src)
+		}
+	}
+}
+
+//countingStore keeps the state in memory and counts the saves
+type countingStore struct {
+	saved *ImportState
+	saves int
+}
+
+func (cs *countingStore) Load() (*ImportState, error) {
+	return cs.saved, nil
+}
+
+func (cs *countingStore) Save(st *ImportState) error {
+	cs.saves++
+	//Copy it, like a real store would
+	cs.saved = (&Checkpoint{state: st}).State()
+	return nil
+}
+
+func TestCheckpointBatching(t *testing.T) {
+	store := &countingStore{}
+	cp, err := OpenCheckpoint(store, "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.maxInserts = 3
+	cp.interval = time.Hour
+	if err := cp.Begin(&testSource{sources: []string{"a.d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 1 {
+		t.Fatalf("expected a save on begin, got %d", store.saves)
+	}
+	sp := cp.Enqueued(newStream("a.d", "x"))
+	for i := int64(1); i <= 5; i++ {
+		if err := cp.Inserted(sp, []plugins.Point{{Time: i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.saves != 2 {
+		t.Fatalf("expected one batched save, got %d", store.saves-1)
+	}
+	//A run interrupted now resumes from the third point, so the fourth and
+	//fifth are inserted again
+	resumed, err := OpenCheckpoint(store, "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp := resumed.Enqueued(newStream("a.d", "x"))
+	if rsp.ck.Offset != 3 || rsp.ck.LastTime != 3 {
+		t.Fatalf("unexpected resumed checkpoint %+v", rsp.ck)
+	}
+
+	if err := cp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 3 || store.saved.Sources[0].Inserted != 5 {
+		t.Fatalf("flush did not save: %d saves, %+v", store.saves, store.saved.Sources[0])
+	}
+	//There is nothing left to flush
+	cp.Flush()
+	if store.saves != 3 {
+		t.Fatalf("empty flush saved")
+	}
+
+	//The interval saves even if there have been few inserts
+	cp.interval = 0
+	if err := cp.Inserted(sp, []plugins.Point{{Time: 6}}); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 4 {
+		t.Fatalf("expected a save once the interval has passed, got %d", store.saves)
+	}
+	cp.interval = time.Hour
+	cp.Finished(sp)
+	if err := cp.NoMoreStreams(); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 5 || !store.saved.Sources[0].Done {
+		t.Fatalf("the end of the import was not saved: %d saves, %+v", store.saves, store.saved.Sources[0])
+	}
+}
@@ -32,10 +32,16 @@ type streamVal struct {
 	stream *btrdb.Stream
 }
 
+//queuedStream is a stream waiting to be inserted
+type queuedStream struct {
+	stream   plugins.Stream
+	progress *streamProgress
+}
+
 type dataWriter struct {
 	collectionPrefix   string
 	gdb                *btrdb.BTrDB
-	input              chan plugins.Stream
+	input              chan queuedStream
 	done               chan struct{}
 	bardone            chan struct{}
 	streams            map[streamKey]*streamVal
@@ -47,12 +53,16 @@ type dataWriter struct {
 	bar                *pb.ProgressBar
 	checkExisting      bool
 	obliterateExisting bool
+	checkpoint         *Checkpoint
 	mu                 sync.Mutex
 	barmu              sync.Mutex
 	wg                 sync.WaitGroup
 }
 
-func NewDataWriter(collectionPrefix string, checkExisting bool, total int64, obliterate bool) *dataWriter {
+//NewDataWriter starts inserting streams. If checkpoint is not nil, the
+//progress is recorded in it and the points it has already recorded are not
+//inserted again.
+func NewDataWriter(collectionPrefix string, checkExisting bool, total int64, obliterate bool, checkpoint *Checkpoint) *dataWriter {
 	if collectionPrefix == "" {
 		fmt.Printf("no collection specified\n")
 		os.Exit(1)
@@ -67,13 +77,20 @@ func NewDataWriter(collectionPrefix string, checkExisting bool, total int64, obl
 	rv := &dataWriter{
 		gdb:                db,
 		collectionPrefix:   collectionPrefix,
-		input:              make(chan plugins.Stream, 300),
+		input:              make(chan queuedStream, 300),
 		done:               make(chan struct{}),
 		bardone:            make(chan struct{}),
 		checkExisting:      checkExisting,
 		obliterateExisting: obliterate,
 		bar:                pb.Full.Start(int(total)),
 		streams:            make(map[streamKey]*streamVal),
+		checkpoint:         checkpoint,
+	}
+	if checkpoint != nil {
+		//The sources that are done are skipped by the data source
+		rv.totalQueued = checkpoint.Skipped()
+		rv.totalWritten = rv.totalQueued
+		rv.bar.SetCurrent(rv.totalWritten)
 	}
 	go rv.startWorkers()
 	return rv
@@ -106,13 +123,32 @@ func (dw *dataWriter) Enqueue(sz []plugins.Stream) {
 		} else {
 			dw.unknown = true
 		}
-		dw.input <- s
+		qs := queuedStream{stream: s}
+		if dw.checkpoint != nil {
+			qs.progress = dw.checkpoint.Enqueued(s)
+		}
+		dw.input <- qs
 	}
 }
 func (dw *dataWriter) NoMoreStreams() {
 	//fmt.Printf("total queued points is %d\n", dw.totalQueued)
 	dw.bar.SetTotal(dw.totalQueued)
 	close(dw.input)
+	if dw.checkpoint != nil {
+		dw.mustCheckpoint(dw.checkpoint.NoMoreStreams())
+	}
+}
+func (dw *dataWriter) mustCheckpoint(err error) {
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+func (dw *dataWriter) written(n int) {
+	dw.barmu.Lock()
+	dw.totalWritten += int64(n)
+	dw.bar.SetCurrent(dw.totalWritten)
+	dw.barmu.Unlock()
 }
 func (dw *dataWriter) getHandleFor(db *btrdb.BTrDB, s plugins.Stream) *btrdb.Stream {
 	if s == nil {
@@ -195,29 +231,61 @@ func (dw *dataWriter) startSingleWorkerLoop() {
 	// }
 	additionalConnection := dw.gdb
 	for {
-		stream, ok := <-dw.input
+		qs, ok := <-dw.input
 		if !ok {
 			dw.wg.Done()
 			return
 		}
+		stream := qs.stream
+		//Points that were inserted before the import was interrupted
+		var skip int64
+		if qs.progress != nil {
+			if qs.progress.ck.Done {
+				for pts := stream.Next(); len(pts) > 0; pts = stream.Next() {
+					dw.written(len(pts))
+				}
+				continue
+			}
+			skip = qs.progress.ck.Offset
+		}
 		dbstream := dw.getHandleFor(additionalConnection, stream)
 		pts := stream.Next()
 		for len(pts) > 0 {
+			if skip > 0 {
+				n := int64(len(pts))
+				if n > skip {
+					n = skip
+				}
+				skip -= n
+				dw.written(int(n))
+				pts = pts[n:]
+				if len(pts) == 0 {
+					pts = stream.Next()
+					continue
+				}
+			}
 			err := dbstream.InsertF(context.Background(), len(pts), func(i int) int64 {
 				return pts[i].Time
 			}, func(i int) float64 {
 				return pts[i].Value
 			})
 
-			dw.barmu.Lock()
-			dw.totalWritten += int64(len(pts))
-			dw.bar.SetCurrent(dw.totalWritten)
-			dw.barmu.Unlock()
+			dw.written(len(pts))
 			if err != nil {
 				fmt.Printf("error writing to BTrDB: %v\n", err)
+				//Keep the progress of the other streams for the next run
+				if dw.checkpoint != nil {
+					dw.checkpoint.Flush()
+				}
 				os.Exit(1)
 			}
+			if qs.progress != nil {
+				dw.mustCheckpoint(dw.checkpoint.Inserted(qs.progress, pts))
+			}
 			pts = stream.Next()
 		}
+		if qs.progress != nil {
+			dw.mustCheckpoint(dw.checkpoint.Finished(qs.progress))
+		}
 	}
 }
@@ -11,6 +11,9 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
+	"text/tabwriter"
 	"time"
 
 	"net/http"
@@ -18,7 +21,11 @@ import (
 
 	"github.com/BTrDB/smartgridstore/tools"
 	"github.com/BTrDB/smartgridstore/tools/importman"
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins/comtrade"
 	"github.com/BTrDB/smartgridstore/tools/importman/plugins/openhistorian"
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins/tabular"
+	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/urfave/cli"
 )
 
@@ -47,6 +54,14 @@ func main() {
 			Name:  "erase",
 			Usage: "if a stream already exists, erase it. Implies --continue",
 		},
+		cli.StringFlag{
+			Name:  "checkpoint",
+			Usage: "record progress in this file, and resume from it if it exists",
+		},
+		cli.StringFlag{
+			Name:  "checkpoint_etcd",
+			Usage: "record progress in etcd under this name, and resume from it if it exists",
+		},
 	}
 	app.Version = fmt.Sprintf("%d.%d.%d", tools.VersionMajor, tools.VersionMinor, tools.VersionPatch)
 	app.Commands = []cli.Command{
@@ -64,6 +79,37 @@ func main() {
 					Name:  "metadata",
 					Usage: "specify stream metadata as CSV",
 				},
+				cli.BoolFlag{
+					Name:  "comtrade",
+					Usage: "treat files as COMTRADE (IEEE C37.111) .cfg/.dat pairs",
+				},
+				cli.StringFlag{
+					Name:  "comtrade_side",
+					Usage: "store COMTRADE channels with a transformer ratio as primary or secondary values, rather than as recorded",
+				},
+				cli.BoolFlag{
+					Name:  "csv",
+					Usage: "treat files as CSV tables, imported according to --mapping",
+				},
+				cli.BoolFlag{
+					Name:  "parquet",
+					Usage: "treat files as Parquet tables, imported according to --mapping",
+				},
+				cli.StringFlag{
+					Name:  "mapping",
+					Usage: "a YAML file describing the time column and the stream of each column of CSV or Parquet tables",
+				},
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "show the progress of a checkpointed import",
+			Action: importStatus,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "streams",
+					Usage: "also show the streams of sources that are in progress",
+				},
 			},
 		},
 	}
@@ -75,12 +121,30 @@ func main() {
 }
 
 func importFiles(c *cli.Context) error {
-	if !c.Bool("openhist_v1") {
-		fmt.Printf("please specify the format of the input files (e.g --openhist_v1)\n")
+	var driver plugins.DataSource
+	var err error
+	formats := 0
+	for _, f := range []string{"openhist_v1", "comtrade", "csv", "parquet"} {
+		if c.Bool(f) {
+			formats++
+		}
+	}
+	switch {
+	case formats > 1:
+		fmt.Printf("please specify only one format\n")
+		os.Exit(1)
+	case c.Bool("openhist_v1"):
+		driver, err = openhist.NewOpenHistorian(c.String("metadata"), c.Args())
+	case c.Bool("comtrade"):
+		driver, err = comtrade.NewComtrade(c.Args(), c.String("comtrade_side"))
+	case c.Bool("csv"):
+		driver, err = tabular.NewCSV(c.String("mapping"), c.Args())
+	case c.Bool("parquet"):
+		driver, err = tabular.NewParquet(c.String("mapping"), c.Args())
+	default:
+		fmt.Printf("please specify the format of the input files (e.g --openhist_v1, --comtrade, --csv or --parquet)\n")
 		os.Exit(1)
 	}
-	//We only support openhistorian files for now, so this is not hard
-	driver, err := openhist.NewOpenHistorian(c.String("metadata"), c.Args())
 	if err != nil {
 		fmt.Printf("failed to load files: %v\n", err)
 		os.Exit(1)
@@ -91,7 +155,29 @@ func importFiles(c *cli.Context) error {
 	if erase {
 		cont = true
 	}
-	dw := importman.NewDataWriter(c.GlobalString("collection"), cont, ttl, erase)
+	var checkpoint *importman.Checkpoint
+	if store := checkpointStore(c); store != nil {
+		checkpoint, err = importman.OpenCheckpoint(store, c.GlobalString("collection"))
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if checkpoint.Resumed() {
+			if erase {
+				fmt.Printf("refusing to erase streams while resuming an import\n")
+				os.Exit(1)
+			}
+			//The streams were created by the interrupted import
+			cont = true
+			fmt.Printf("resuming import started %s\n", checkpoint.State().Started.Format(time.RFC3339))
+		}
+		err = checkpoint.Begin(driver)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	dw := importman.NewDataWriter(c.GlobalString("collection"), cont, ttl, erase, checkpoint)
 
 	then := time.Now()
 
@@ -106,3 +192,98 @@ func importFiles(c *cli.Context) error {
 	fmt.Printf("import complete: %s\n", time.Now().Sub(then))
 	return nil
 }
+
+//checkpointStore returns where the progress of the import is recorded, or
+//nil if it is not
+func checkpointStore(c *cli.Context) importman.CheckpointStore {
+	file := c.GlobalString("checkpoint")
+	name := c.GlobalString("checkpoint_etcd")
+	switch {
+	case file != "" && name != "":
+		fmt.Printf("please specify only one of --checkpoint and --checkpoint_etcd\n")
+		os.Exit(1)
+	case file != "":
+		return importman.NewFileStore(file)
+	case name != "":
+		etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+		if len(etcdEndpoint) == 0 {
+			etcdEndpoint = "localhost:2379"
+		}
+		etcdClient, err := etcd.New(etcd.Config{
+			Endpoints:   []string{etcdEndpoint},
+			DialTimeout: 5 * time.Second})
+		if err != nil {
+			fmt.Printf("could not connect to etcd: %v\n", err)
+			os.Exit(1)
+		}
+		return importman.NewEtcdStore(etcdClient, name)
+	}
+	return nil
+}
+
+func importStatus(c *cli.Context) error {
+	store := checkpointStore(c)
+	if store == nil {
+		fmt.Printf("please specify --checkpoint or --checkpoint_etcd\n")
+		os.Exit(1)
+	}
+	st, err := store.Load()
+	if err != nil {
+		fmt.Printf("could not load checkpoint: %v\n", err)
+		os.Exit(1)
+	}
+	if st == nil {
+		fmt.Printf("no import has been checkpointed there\n")
+		os.Exit(1)
+	}
+	fmt.Printf("import into %s, started %s, last progress %s\n", st.Collection,
+		st.Started.Format(time.RFC3339), st.Updated.Format(time.RFC3339))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tSTATE\tINSERTED\tTOTAL\tPROGRESS")
+	var inserted, done int64
+	for _, src := range st.Sources {
+		state := "pending"
+		switch {
+		case src.Done:
+			state = "done"
+			done++
+		case src.Inserted > 0 || len(src.Streams) > 0:
+			state = "in progress"
+		}
+		inserted += src.Inserted
+		total, progress := "-", "-"
+		if src.Read {
+			total = strconv.FormatInt(src.Total, 10)
+			progress = "100.0%"
+			if src.Total > 0 {
+				progress = fmt.Sprintf("%.1f%%", 100*float64(src.Inserted)/float64(src.Total))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", src.Name, state, src.Inserted, total, progress)
+		if !c.Bool("streams") || src.Done {
+			continue
+		}
+		keys := make([]string, 0, len(src.Streams))
+		for k := range src.Streams {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ck := src.Streams[k]
+			last := "pending"
+			if ck.Done {
+				last = "done"
+			} else if ck.Offset > 0 {
+				last = "at " + time.Unix(0, ck.LastTime).UTC().Format(time.RFC3339Nano)
+			}
+			progress := "-"
+			if ck.Total > 0 {
+				progress = fmt.Sprintf("%.1f%%", 100*float64(ck.Offset)/float64(ck.Total))
+			}
+			fmt.Fprintf(tw, "  %s/%s\t%s\t%d\t%d\t%s\n", ck.Collection, ck.Name, last, ck.Offset, ck.Total, progress)
+		}
+	}
+	tw.Flush()
+	fmt.Printf("%d of %d sources done, %d points inserted\n", done, len(st.Sources), inserted)
+	return nil
+}
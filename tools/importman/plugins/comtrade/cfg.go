@@ -0,0 +1,392 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package comtrade
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatASCII    = "ASCII"
+	FormatBinary   = "BINARY"
+	FormatBinary32 = "BINARY32"
+	FormatFloat32  = "FLOAT32"
+)
+
+//Config is the contents of a .cfg file. The 1991, 1999 and 2013 revisions
+//are supported.
+type Config struct {
+	Station  string
+	Device   string
+	RevYear  int
+	Analog   []*AnalogChannel
+	Digital  []*DigitalChannel
+	LineFreq float64
+	//If there are no rates, or the only rate is 0, the timestamps in the
+	//data file are used instead
+	Rates []Rate
+	//The time of the first sample and of the trigger, in the time zone
+	//given by TimeCode
+	Start   time.Time
+	Trigger time.Time
+	Format  string
+	//The timestamps in the data file are multiples of TimeMult*TimeUnit.
+	//The unit is a microsecond unless the start time has nanoseconds.
+	TimeMult float64
+	TimeUnit time.Duration
+	//The offset of the times in the files from UTC
+	TimeCode time.Duration
+}
+
+//Rate is a section of the record with a fixed sample rate
+type Rate struct {
+	//Samples per second
+	Samp float64
+	//The number of the last sample at this rate, counting from 1
+	EndSamp int64
+}
+
+type AnalogChannel struct {
+	Index   int
+	ID      string
+	Phase   string
+	Circuit string
+	Unit    string
+	//The value is A*x + B for the recorded x
+	A    float64
+	B    float64
+	Skew float64
+	Min  float64
+	Max  float64
+	//The ratio of the transformer, and whether the values are on its
+	//primary (P) or secondary (S) side. Zero if not given.
+	Primary   float64
+	Secondary float64
+	PS        string
+}
+
+type DigitalChannel struct {
+	Index   int
+	ID      string
+	Phase   string
+	Circuit string
+	//The state of the channel when nothing is happening
+	Normal int
+}
+
+//Samples is the number of samples in the data file, or 0 if unknown
+func (c *Config) Samples() int64 {
+	if len(c.Rates) == 0 {
+		return 0
+	}
+	return c.Rates[len(c.Rates)-1].EndSamp
+}
+
+//FixedRate is true if sample times come from the rates rather than the
+//timestamps in the data file
+func (c *Config) FixedRate() bool {
+	return len(c.Rates) > 0 && c.Rates[0].Samp > 0
+}
+
+//SampleTime returns the time of the kth sample (counting from 1) with the
+//given timestamp from the data file, in nanoseconds since the epoch
+func (c *Config) SampleTime(k int64, timestamp int64) (int64, error) {
+	start := c.Start.UnixNano() - int64(c.TimeCode)
+	if !c.FixedRate() {
+		return start + int64(float64(timestamp)*c.TimeMult*float64(c.TimeUnit)), nil
+	}
+	var offset float64
+	var prevEnd int64
+	for i, r := range c.Rates {
+		//Only the first rate is checked when the file is parsed
+		if r.Samp <= 0 {
+			return 0, fmt.Errorf("sample rate %d is not positive", i+1)
+		}
+		if k <= r.EndSamp || i == len(c.Rates)-1 {
+			return start + int64(offset+float64(k-prevEnd-1)*1e9/r.Samp), nil
+		}
+		offset += float64(r.EndSamp-prevEnd) * 1e9 / r.Samp
+		prevEnd = r.EndSamp
+	}
+	return 0, fmt.Errorf("no sample rate for sample %d", k)
+}
+
+type cfgReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+//next returns the fields of the next line, or nil at the end of the file
+func (r *cfgReader) next() []string {
+	for r.s.Scan() {
+		r.line++
+		ln := strings.TrimSpace(r.s.Text())
+		if ln == "" {
+			continue
+		}
+		fields := strings.Split(ln, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		return fields
+	}
+	return nil
+}
+
+func (r *cfgReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", r.line, fmt.Sprintf(format, args...))
+}
+
+func ParseConfig(in io.Reader) (*Config, error) {
+	r := &cfgReader{s: bufio.NewScanner(in)}
+	rv := &Config{RevYear: 1991, TimeMult: 1, TimeUnit: time.Microsecond}
+
+	f := r.next()
+	if len(f) < 2 {
+		return nil, r.errorf("expected station name and recording device id")
+	}
+	rv.Station = f[0]
+	rv.Device = f[1]
+	if len(f) > 2 && f[2] != "" {
+		year, err := strconv.Atoi(f[2])
+		if err != nil {
+			return nil, r.errorf("bad revision year %q", f[2])
+		}
+		rv.RevYear = year
+	}
+
+	f = r.next()
+	if len(f) != 3 {
+		return nil, r.errorf("expected channel counts")
+	}
+	total, err1 := strconv.Atoi(f[0])
+	nanalog, err2 := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(f[1]), "A"))
+	ndigital, err3 := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(f[2]), "D"))
+	if err1 != nil || err2 != nil || err3 != nil || nanalog < 0 || ndigital < 0 || total != nanalog+ndigital {
+		return nil, r.errorf("bad channel counts %v", f)
+	}
+
+	for i := 0; i < nanalog; i++ {
+		f = r.next()
+		if len(f) != 10 && len(f) != 13 {
+			return nil, r.errorf("expected an analog channel")
+		}
+		ch := &AnalogChannel{ID: f[1], Phase: f[2], Circuit: f[3], Unit: f[4]}
+		ch.Index, err1 = strconv.Atoi(f[0])
+		vals := []*float64{&ch.A, &ch.B, &ch.Skew, &ch.Min, &ch.Max}
+		for j, v := range vals {
+			*v, err2 = parseFloat(f[5+j])
+			if err2 != nil {
+				break
+			}
+		}
+		if len(f) == 13 {
+			ch.Primary, err3 = parseFloat(f[10])
+			if err3 == nil {
+				ch.Secondary, err3 = parseFloat(f[11])
+			}
+			ch.PS = strings.ToUpper(f[12])
+		}
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, r.errorf("bad analog channel %v", f)
+		}
+		rv.Analog = append(rv.Analog, ch)
+	}
+	for i := 0; i < ndigital; i++ {
+		f = r.next()
+		ch := &DigitalChannel{}
+		var normal string
+		switch len(f) {
+		case 3:
+			ch.ID, normal = f[1], f[2]
+		case 5:
+			ch.ID, ch.Phase, ch.Circuit, normal = f[1], f[2], f[3], f[4]
+		default:
+			return nil, r.errorf("expected a digital channel")
+		}
+		ch.Index, err1 = strconv.Atoi(f[0])
+		ch.Normal, err2 = strconv.Atoi(normal)
+		if err1 != nil || err2 != nil {
+			return nil, r.errorf("bad digital channel %v", f)
+		}
+		rv.Digital = append(rv.Digital, ch)
+	}
+
+	f = r.next()
+	if len(f) != 1 {
+		return nil, r.errorf("expected the line frequency")
+	}
+	rv.LineFreq, err1 = parseFloat(f[0])
+	if err1 != nil {
+		return nil, r.errorf("bad line frequency %q", f[0])
+	}
+
+	f = r.next()
+	if len(f) != 1 {
+		return nil, r.errorf("expected the number of sample rates")
+	}
+	nrates, err := strconv.Atoi(f[0])
+	if err != nil || nrates < 0 {
+		return nil, r.errorf("bad number of sample rates %q", f[0])
+	}
+	//With no rates there is still a line giving the number of samples
+	lines := nrates
+	if lines == 0 {
+		lines = 1
+	}
+	for i := 0; i < lines; i++ {
+		f = r.next()
+		if len(f) != 2 {
+			return nil, r.errorf("expected a sample rate")
+		}
+		var rate Rate
+		rate.Samp, err1 = parseFloat(f[0])
+		rate.EndSamp, err2 = strconv.ParseInt(f[1], 10, 64)
+		if err1 != nil || err2 != nil || rate.Samp < 0 || (i > 0 && rate.EndSamp < rv.Rates[i-1].EndSamp) {
+			return nil, r.errorf("bad sample rate %v", f)
+		}
+		if nrates == 0 {
+			rate.Samp = 0
+		}
+		rv.Rates = append(rv.Rates, rate)
+	}
+
+	for _, t := range []*time.Time{&rv.Start, &rv.Trigger} {
+		f = r.next()
+		if len(f) != 2 {
+			return nil, r.errorf("expected a date and time")
+		}
+		var nanos bool
+		*t, nanos, err = parseTime(f[0], f[1], rv.RevYear)
+		if err != nil {
+			return nil, r.errorf("%v", err)
+		}
+		if nanos && t == &rv.Start {
+			rv.TimeUnit = time.Nanosecond
+		}
+	}
+
+	f = r.next()
+	if len(f) != 1 {
+		return nil, r.errorf("expected the file type")
+	}
+	rv.Format = strings.ToUpper(f[0])
+	switch rv.Format {
+	case FormatASCII, FormatBinary, FormatBinary32, FormatFloat32:
+	default:
+		return nil, r.errorf("unknown file type %q", f[0])
+	}
+	if rv.RevYear < 1999 {
+		return rv, nil
+	}
+
+	f = r.next()
+	if f == nil {
+		return rv, nil
+	}
+	rv.TimeMult, err = parseFloat(f[0])
+	if err != nil || rv.TimeMult <= 0 {
+		return nil, r.errorf("bad time multiplier %q", f[0])
+	}
+
+	f = r.next()
+	if f == nil {
+		return rv, nil
+	}
+	rv.TimeCode, err = parseTimeCode(f[0])
+	if err != nil {
+		return nil, r.errorf("%v", err)
+	}
+	return rv, nil
+}
+
+//parseFloat also accepts the empty string, which the standard allows for
+//some fields
+func parseFloat(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+//parseTime parses dd/mm/yyyy,hh:mm:ss.ssssss, or mm/dd/yy for the 1991
+//revision, and says whether the fraction has nanoseconds
+func parseTime(date string, clock string, revYear int) (time.Time, bool, error) {
+	d := strings.Split(date, "/")
+	c := strings.Split(clock, ":")
+	if len(d) != 3 || len(c) != 3 {
+		return time.Time{}, false, fmt.Errorf("bad date and time %s,%s", date, clock)
+	}
+	day, err1 := strconv.Atoi(d[0])
+	month, err2 := strconv.Atoi(d[1])
+	year, err3 := strconv.Atoi(d[2])
+	if revYear < 1999 {
+		day, month = month, day
+		if year < 100 {
+			year += 1900
+			if year < 1970 {
+				year += 100
+			}
+		}
+	}
+	hour, err4 := strconv.Atoi(c[0])
+	minute, err5 := strconv.Atoi(c[1])
+	secparts := strings.SplitN(c[2], ".", 2)
+	sec, err6 := strconv.Atoi(secparts[0])
+	var nsec int
+	var nanos bool
+	var err7 error
+	if len(secparts) == 2 {
+		frac := secparts[1]
+		nanos = len(frac) > 6
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsec, err7 = strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+	}
+	for _, err := range []error{err1, err2, err3, err4, err5, err6, err7} {
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("bad date and time %s,%s", date, clock)
+		}
+	}
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, false, fmt.Errorf("bad date %s", date)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, sec, nsec, time.UTC), nanos, nil
+}
+
+//parseTimeCode parses an offset from UTC such as -5, +5h30 or 0. An x or
+//an empty code means the offset is unknown and is taken to be 0.
+func parseTimeCode(code string) (time.Duration, error) {
+	if code == "" || strings.ToLower(code) == "x" {
+		return 0, nil
+	}
+	neg := strings.HasPrefix(code, "-")
+	s := strings.TrimLeft(code, "+-")
+	parts := strings.SplitN(s, "h", 2)
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("bad time code %q", code)
+	}
+	d := time.Duration(h) * time.Hour
+	if len(parts) == 2 && parts[1] != "" {
+		m, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, fmt.Errorf("bad time code %q", code)
+		}
+		d += time.Duration(m) * time.Minute
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
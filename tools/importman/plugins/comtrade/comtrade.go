@@ -0,0 +1,333 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package comtrade imports IEEE C37.111 (COMTRADE) records, given as
+//.cfg/.dat pairs. Each channel becomes a stream in a collection named after
+//the station and recording device, so records from the same device are
+//merged into the same streams.
+package comtrade
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+)
+
+//What values to store for channels with a transformer ratio
+const (
+	SideAsRecorded = ""
+	SidePrimary    = "primary"
+	SideSecondary  = "secondary"
+)
+
+//The unit of digital channels
+const DigitalUnit = "status"
+
+//How many points a stream returns from each call to Next
+const chunkSize = 50000
+
+type record struct {
+	base    string
+	cfgfile string
+	datfile string
+	cfg     *Config
+}
+
+type comtrade struct {
+	records []*record
+	cursor  int
+	total   int64
+	side    string
+	skipped map[string]bool
+	sources []string
+}
+
+//NewComtrade opens the records with the given files. Either or both of
+//the .cfg and .dat file of a record can be given. side is one of the
+//Side constants.
+func NewComtrade(filenames []string, side string) (plugins.DataSource, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no files specified")
+	}
+	switch side {
+	case SideAsRecorded, SidePrimary, SideSecondary:
+	default:
+		return nil, fmt.Errorf("invalid side %q, must be primary or secondary", side)
+	}
+	rv := &comtrade{side: side, skipped: make(map[string]bool)}
+	seen := make(map[string]bool)
+	for _, f := range filenames {
+		ext := filepath.Ext(f)
+		switch strings.ToLower(ext) {
+		case ".cfg", ".dat":
+		case ".cff":
+			return nil, fmt.Errorf("%s: single file (.cff) records are not supported, convert them to .cfg and .dat", f)
+		default:
+			return nil, fmt.Errorf("%s: expected a .cfg or .dat file", f)
+		}
+		base := strings.TrimSuffix(f, ext)
+		if seen[base] {
+			continue
+		}
+		seen[base] = true
+		rec, err := openRecord(base)
+		if err != nil {
+			return nil, fmt.Errorf("error processing record %s: %v", base, err)
+		}
+		rv.records = append(rv.records, rec)
+		rv.sources = append(rv.sources, rec.datfile)
+		rv.total += rec.cfg.Samples() * int64(len(rec.cfg.Analog)+len(rec.cfg.Digital))
+	}
+	return rv, nil
+}
+
+//findFile returns base.ext or base.EXT, whichever exists
+func findFile(base string, ext string) (string, error) {
+	for _, e := range []string{ext, strings.ToUpper(ext)} {
+		if _, err := os.Stat(base + e); err == nil {
+			return base + e, nil
+		}
+	}
+	return "", fmt.Errorf("could not find %s%s", base, ext)
+}
+
+func openRecord(base string) (*record, error) {
+	rv := &record{base: filepath.Base(base)}
+	var err error
+	rv.cfgfile, err = findFile(base, ".cfg")
+	if err != nil {
+		return nil, err
+	}
+	rv.datfile, err = findFile(base, ".dat")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(rv.cfgfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rv.cfg, err = ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rv.cfgfile, err)
+	}
+	return rv, nil
+}
+
+func (ct *comtrade) Next() []plugins.Stream {
+	for ct.cursor < len(ct.records) && ct.skipped[ct.records[ct.cursor].datfile] {
+		ct.records[ct.cursor] = nil
+		ct.cursor++
+	}
+	if ct.cursor == len(ct.records) {
+		return nil
+	}
+	rec := ct.records[ct.cursor]
+	ct.records[ct.cursor] = nil
+	ct.cursor++
+	f, err := os.Open(rec.datfile)
+	if err != nil {
+		fmt.Printf("could not open data file: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	data, err := ReadData(rec.cfg, f)
+	if err != nil {
+		fmt.Printf("critical error in %s: %v\n", rec.datfile, err)
+		os.Exit(1)
+	}
+	return rec.streams(data, ct.side)
+}
+
+func (ct *comtrade) Total() (int64, bool) {
+	return ct.total, true
+}
+
+//Sources returns the .dat file of each record
+func (ct *comtrade) Sources() []string {
+	return ct.sources
+}
+
+func (ct *comtrade) SkipSource(source string) {
+	ct.skipped[source] = true
+}
+
+//clean makes a station or device name usable as a collection element
+func clean(s string) string {
+	s = strings.TrimSpace(strings.Replace(s, "/", "_", -1))
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+//streams turns the channels of the record into streams
+func (rec *record) streams(data *Data, side string) []plugins.Stream {
+	cfg := rec.cfg
+	suffix := "/" + clean(cfg.Station) + "/" + clean(cfg.Device)
+	common := map[string]string{
+		"station":  cfg.Station,
+		"device":   cfg.Device,
+		"rev_year": strconv.Itoa(cfg.RevYear),
+		"record":   rec.base,
+		"trigger":  cfg.Trigger.Add(-cfg.TimeCode).Format(time.RFC3339Nano),
+		"linefreq": strconv.FormatFloat(cfg.LineFreq, 'g', -1, 64),
+	}
+	//Channels often share an id, e.g. the currents of several feeders
+	names := make(map[string]int)
+	for _, ch := range cfg.Analog {
+		names[ch.ID]++
+	}
+	for _, ch := range cfg.Digital {
+		names[ch.ID]++
+	}
+	name := func(id string, kind string, index int) string {
+		if id == "" {
+			return fmt.Sprintf("%s%d", kind, index)
+		}
+		if names[id] > 1 {
+			return fmt.Sprintf("%s_%s%d", id, kind, index)
+		}
+		return id
+	}
+
+	rv := make([]plugins.Stream, 0, len(cfg.Analog)+len(cfg.Digital))
+	for i, ch := range cfg.Analog {
+		factor, values := scaling(ch, side)
+		s := &ctstream{
+			source: rec.datfile,
+			suffix: suffix,
+			tags:   map[string]string{"name": name(ch.ID, "A", ch.Index), "unit": ch.Unit},
+			anns:   annotations(common, ch.Index, ch.ID, "analog", ch.Phase, ch.Circuit, ch.Unit),
+			points: make([]plugins.Point, 0, len(data.Times)),
+		}
+		s.anns["a"] = strconv.FormatFloat(ch.A, 'g', -1, 64)
+		s.anns["b"] = strconv.FormatFloat(ch.B, 'g', -1, 64)
+		s.anns["skew"] = strconv.FormatFloat(ch.Skew, 'g', -1, 64)
+		if ch.Primary > 0 && ch.Secondary > 0 {
+			s.anns["primary"] = strconv.FormatFloat(ch.Primary, 'g', -1, 64)
+			s.anns["secondary"] = strconv.FormatFloat(ch.Secondary, 'g', -1, 64)
+		}
+		s.anns["values"] = values
+		for k, x := range data.Analog[i] {
+			if math.IsNaN(x) {
+				continue
+			}
+			s.points = append(s.points, plugins.Point{Time: data.Times[k], Value: (ch.A*x + ch.B) * factor})
+		}
+		rv = append(rv, s)
+	}
+	for i, ch := range cfg.Digital {
+		s := &ctstream{
+			source: rec.datfile,
+			suffix: suffix,
+			tags:   map[string]string{"name": name(ch.ID, "D", ch.Index), "unit": DigitalUnit},
+			anns:   annotations(common, ch.Index, ch.ID, "digital", ch.Phase, ch.Circuit, DigitalUnit),
+			points: make([]plugins.Point, len(data.Times)),
+		}
+		s.anns["normal"] = strconv.Itoa(ch.Normal)
+		for k, v := range data.Digital[i] {
+			s.points[k] = plugins.Point{Time: data.Times[k]}
+			if v {
+				s.points[k].Value = 1
+			}
+		}
+		rv = append(rv, s)
+	}
+	return rv
+}
+
+//scaling returns what the scaled values of the channel must be multiplied
+//by to be on the requested side of the transformer, and which side they
+//are then on
+func scaling(ch *AnalogChannel, side string) (float64, string) {
+	recorded := SideAsRecorded
+	switch ch.PS {
+	case "P":
+		recorded = SidePrimary
+	case "S":
+		recorded = SideSecondary
+	}
+	if side == SideAsRecorded || recorded == SideAsRecorded || side == recorded || ch.Primary <= 0 || ch.Secondary <= 0 {
+		return 1, recorded
+	}
+	if side == SidePrimary {
+		return ch.Primary / ch.Secondary, SidePrimary
+	}
+	return ch.Secondary / ch.Primary, SideSecondary
+}
+
+func annotations(common map[string]string, index int, id string, kind string, phase string, circuit string, unit string) map[string]string {
+	rv := make(map[string]string, len(common)+12)
+	for k, v := range common {
+		rv[k] = v
+	}
+	rv["channel"] = strconv.Itoa(index)
+	rv["channel_id"] = id
+	rv["type"] = kind
+	rv["phase"] = phase
+	rv["circuit"] = circuit
+	rv["unit"] = unit
+	return rv
+}
+
+type ctstream struct {
+	source string
+	suffix string
+	tags   map[string]string
+	anns   map[string]string
+	points []plugins.Point
+}
+
+//The CollectionSuffix is what will be appended onto the user specified
+//destination collection. It can be an empty string as long as the Tags
+//are unique for all streams, otherwise the combination of CollectionSuffix
+//and Tags must be unique
+func (s *ctstream) CollectionSuffix() string {
+	return s.suffix
+}
+
+//The Tags form part of the identity of the stream. Specifically if there
+//is a `name` tag, it is used in the plotter as the final element of the
+//tree.
+func (s *ctstream) Tags() map[string]string {
+	return s.tags
+}
+
+//Annotations contain additional metadata that is associated with the stream
+//but is changeable or otherwise not suitable for identifying the stream
+func (s *ctstream) Annotations() map[string]string {
+	return s.anns
+}
+
+//Next returns a chunk of data for insertion. If the data is empty it is
+//assumed that there is no more data to insert
+func (s *ctstream) Next() (data []plugins.Point) {
+	n := len(s.points)
+	if n > chunkSize {
+		n = chunkSize
+	}
+	rv := s.points[:n]
+	s.points = s.points[n:]
+	return rv
+}
+
+//Source is the .dat file of the record
+func (s *ctstream) Source() string {
+	return s.source
+}
+
+//Total returns the total number of datapoints, used for progress estimation.
+//If no total is available, return 0, false
+func (s *ctstream) Total() (total int64, totalKnown bool) {
+	return int64(len(s.points)), true
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package comtrade
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+)
+
+func writeRecord(t *testing.T, dir string, name string, cfg string, dat []byte) string {
+	base := filepath.Join(dir, name)
+	err := ioutil.WriteFile(base+".cfg", []byte(cfg), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(base+".dat", dat, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+//readAll returns the streams of the next record by name
+func readAll(ds plugins.DataSource) map[string]plugins.Stream {
+	rv := make(map[string]plugins.Stream)
+	for _, s := range ds.Next() {
+		rv[s.CollectionSuffix()+"/"+s.Tags()["name"]] = s
+	}
+	return rv
+}
+
+func points(s plugins.Stream) []plugins.Point {
+	var rv []plugins.Point
+	for pts := s.Next(); len(pts) > 0; pts = s.Next() {
+		rv = append(rv, pts...)
+	}
+	return rv
+}
+
+func pt(t int64, v float64) plugins.Point {
+	return plugins.Point{Time: t, Value: v}
+}
+
+func checkPoints(t *testing.T, name string, got []plugins.Point, expected []plugins.Point) {
+	if len(got) != len(expected) {
+		t.Fatalf("%s: expected %v got %v", name, expected, got)
+	}
+	for i := range got {
+		if got[i].Time != expected[i].Time || math.Abs(got[i].Value-expected[i].Value) > 1e-9 {
+			t.Fatalf("%s: expected %v got %v", name, expected, got)
+		}
+	}
+}
+
+func TestASCII(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comtrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//Two rate sections, a CT with a 600:5 ratio recorded on the secondary
+	//side, two channels with the same id and a digital channel
+	base := writeRecord(t, dir, "fault1", `Sub 7,Relay/A,1999
+4,3A,1D
+1,IA,A,Feeder 1,A,0.5,1,0,-32767,32767,600,5,S
+2,VA,A,Bus,kV,0.01,0,0,-32767,32767,1,1,P
+3,VA,A,Line,kV,0.01,0,0,-32767,32767,1,1,P
+1,Trip,,,0
+60
+2
+1000,2
+500,4
+13/05/2021,14:30:00.000000
+13/05/2021,14:30:00.001000
+ASCII
+1
+`, []byte("1,0,10,100,200,0\r\n2,,20,,210,1\r\n3,,30,300,220,1\r\n4,,40,400,230,0\r\n"))
+
+	ds, err := NewComtrade([]string{base + ".cfg", base + ".dat"}, SidePrimary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := ds.Total(); total != 16 {
+		t.Fatalf("expected 16 points got %d", total)
+	}
+	streams := readAll(ds)
+	if len(streams) != 4 {
+		t.Fatalf("expected 4 streams got %v", streams)
+	}
+	t0 := time.Date(2021, 5, 13, 14, 30, 0, 0, time.UTC).UnixNano()
+	ms := int64(time.Millisecond)
+	times := []int64{t0, t0 + ms, t0 + 2*ms, t0 + 4*ms}
+
+	ia := streams["/Sub 7/Relay_A/IA"]
+	if ia == nil || ia.Tags()["unit"] != "A" {
+		t.Fatalf("missing IA stream")
+	}
+	ann := ia.Annotations()
+	if ann["station"] != "Sub 7" || ann["phase"] != "A" || ann["circuit"] != "Feeder 1" || ann["values"] != SidePrimary ||
+		ann["primary"] != "600" || ann["trigger"] != "2021-05-13T14:30:00.001Z" {
+		t.Fatalf("unexpected annotations %v", ann)
+	}
+	//(0.5x + 1) * 600/5
+	checkPoints(t, "IA", points(ia), []plugins.Point{pt(times[0], 720), pt(times[1], 1320), pt(times[2], 1920), pt(times[3], 2520)})
+	//The missing sample is skipped
+	checkPoints(t, "VA_A2", points(streams["/Sub 7/Relay_A/VA_A2"]), []plugins.Point{pt(times[0], 1), pt(times[2], 3), pt(times[3], 4)})
+	checkPoints(t, "VA_A3", points(streams["/Sub 7/Relay_A/VA_A3"]), []plugins.Point{pt(times[0], 2), pt(times[1], 2.1), pt(times[2], 2.2), pt(times[3], 2.3)})
+	trip := streams["/Sub 7/Relay_A/Trip"]
+	if trip.Tags()["unit"] != DigitalUnit || trip.Annotations()["normal"] != "0" {
+		t.Fatalf("unexpected digital stream %v %v", trip.Tags(), trip.Annotations())
+	}
+	checkPoints(t, "Trip", points(trip), []plugins.Point{pt(times[0], 0), pt(times[1], 1), pt(times[2], 1), pt(times[3], 0)})
+	if len(ds.Next()) != 0 {
+		t.Fatalf("expected only one record")
+	}
+}
+
+func TestBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comtrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := func(format string) string {
+		//No fixed rate, so the timestamps count multiples of 2us, in a
+		//time zone 5 hours behind UTC
+		return `Station,DFR,2013
+18,1A,17D
+1,V,,,V,2,0,0,-32767,32767,1,1,S
+` + digitalLines(17) + `60
+0
+0,3
+01/02/2020,10:00:00.000000
+01/02/2020,10:00:00.000000
+` + format + `
+2
+-5h00,-5h00
+`
+	}
+	var dat16, dat32, datf bytes.Buffer
+	values := []float32{1, -2, 3}
+	for k, v := range values {
+		var ts uint32 = uint32(k * 100)
+		binary.Write(&dat16, binary.LittleEndian, []uint32{uint32(k + 1), ts})
+		binary.Write(&dat32, binary.LittleEndian, []uint32{uint32(k + 1), ts})
+		binary.Write(&datf, binary.LittleEndian, []uint32{uint32(k + 1), ts})
+		a16 := int16(v)
+		a32 := int32(v)
+		if k == 1 {
+			a16 = missingBinary
+			a32 = missingBinary32
+		}
+		binary.Write(&dat16, binary.LittleEndian, a16)
+		binary.Write(&dat32, binary.LittleEndian, a32)
+		binary.Write(&datf, binary.LittleEndian, v)
+		//Channel 1 is set on the first sample and channel 17 on the last
+		digital := []uint16{0, 0}
+		if k == 0 {
+			digital[0] = 1
+		}
+		if k == 2 {
+			digital[1] = 1
+		}
+		for _, b := range []*bytes.Buffer{&dat16, &dat32, &datf} {
+			binary.Write(b, binary.LittleEndian, digital)
+		}
+	}
+	t0 := time.Date(2020, 2, 1, 15, 0, 0, 0, time.UTC).UnixNano()
+	us := int64(time.Microsecond)
+	times := []int64{t0, t0 + 200*us, t0 + 400*us}
+	for _, c := range []struct {
+		format string
+		dat    []byte
+		v      []plugins.Point
+	}{
+		{FormatBinary, dat16.Bytes(), []plugins.Point{pt(times[0], 2), pt(times[2], 6)}},
+		{FormatBinary32, dat32.Bytes(), []plugins.Point{pt(times[0], 2), pt(times[2], 6)}},
+		{FormatFloat32, datf.Bytes(), []plugins.Point{pt(times[0], 2), pt(times[1], -4), pt(times[2], 6)}},
+	} {
+		base := writeRecord(t, dir, c.format, cfg(c.format), c.dat)
+		ds, err := NewComtrade([]string{base + ".dat"}, SideAsRecorded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams := readAll(ds)
+		if len(streams) != 18 {
+			t.Fatalf("%s: expected 18 streams got %d", c.format, len(streams))
+		}
+		v := streams["/Station/DFR/V"]
+		if v.Annotations()["values"] != SideSecondary {
+			t.Fatalf("%s: unexpected annotations %v", c.format, v.Annotations())
+		}
+		checkPoints(t, c.format+" V", points(v), c.v)
+		checkPoints(t, c.format+" D1", points(streams["/Station/DFR/D1"]), []plugins.Point{pt(times[0], 1), pt(times[1], 0), pt(times[2], 0)})
+		checkPoints(t, c.format+" D17", points(streams["/Station/DFR/D17"]), []plugins.Point{pt(times[0], 0), pt(times[1], 0), pt(times[2], 1)})
+	}
+
+	base := writeRecord(t, dir, "truncated", cfg(FormatBinary), dat16.Bytes()[:dat16.Len()-1])
+	rec, err := openRecord(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(rec.datfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = ReadData(rec.cfg, f)
+	if err == nil {
+		t.Fatalf("truncated file was accepted")
+	}
+}
+
+func digitalLines(n int) string {
+	rv := ""
+	for i := 1; i <= n; i++ {
+		rv += fmt.Sprintf("%d,D%d,,,0\n", i+1, i)
+	}
+	return rv
+}
+
+func TestParseConfig1991(t *testing.T) {
+	cfg, err := ParseConfig(bytes.NewBufferString(`OLD STATION,1
+2,1A,1D
+1,IA,A,,A,0.1,0,0,-2048,2047
+2,BRK,1
+50
+1
+4800,100
+12/31/99,23:59:59.500000
+12/31/99,23:59:59.600000
+ASCII
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RevYear != 1991 || cfg.Start != time.Date(1999, 12, 31, 23, 59, 59, 500000000, time.UTC) || cfg.Rates[0].Samp != 4800 ||
+		cfg.Digital[0].ID != "BRK" || cfg.Digital[0].Normal != 1 || cfg.TimeMult != 1 {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	for _, bad := range []string{
+		"S,D,1999\n2,2A,1D\n",
+		"S,D,1999\n1,1A,0D\n1,IA,A,,A,x,0,0,0,0,1,1,P\n",
+		"S,D,1999\n0,0A,0D\n60\n1\n100,10\n32/01/2020,00:00:00\n01/01/2020,00:00:00\nASCII\n",
+		"S,D,1999\n0,0A,0D\n60\n1\n100,10\n01/01/2020,00:00:00\n01/01/2020,00:00:00\nCSV\n",
+	} {
+		_, err := ParseConfig(bytes.NewBufferString(bad))
+		if err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestCorruptData(t *testing.T) {
+	//A sample count that would take all the memory to preallocate, and a
+	//second rate of zero, which the first sample past the first rate
+	//divides by
+	cfg, err := ParseConfig(bytes.NewBufferString(`S,D,1999
+1,1A,0D
+1,IA,A,,A,1,0,0,-32767,32767,1,1,P
+60
+2
+1000,2
+0,9000000000000000000
+01/01/2020,00:00:00.000000
+01/01/2020,00:00:00.000000
+ASCII
+1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadData(cfg, bytes.NewBufferString("1,,10\n2,,20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Times) != 2 || cap(data.Times) > maxPrealloc {
+		t.Fatalf("unexpected times %v with capacity %d", data.Times, cap(data.Times))
+	}
+	_, err = ReadData(cfg, bytes.NewBufferString("1,,10\n2,,20\n3,,30\n"))
+	if err == nil {
+		t.Fatalf("expected an error for a sample with a zero rate")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package comtrade
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//Data is the contents of a .dat file
+type Data struct {
+	//The time of each sample in nanoseconds since the epoch
+	Times []int64
+	//The recorded values of each analog channel, before scaling. Missing
+	//values are NaN.
+	Analog [][]float64
+	//The state of each digital channel
+	Digital [][]bool
+}
+
+//The values the binary formats use for a missing analog sample
+const missingBinary = -0x8000
+const missingBinary32 = -0x80000000
+
+//The 1991 revision used this for missing ASCII values
+const missingASCII1991 = "99999"
+
+//The number of samples in the configuration is only used as a hint, a
+//corrupt file could otherwise make us allocate any amount of memory
+const maxPrealloc = 1 << 16
+
+//ReadData reads the samples described by the configuration
+func ReadData(cfg *Config, in io.Reader) (*Data, error) {
+	rv := &Data{
+		Analog:  make([][]float64, len(cfg.Analog)),
+		Digital: make([][]bool, len(cfg.Digital)),
+	}
+	if n := cfg.Samples(); n > 0 {
+		if n > maxPrealloc {
+			n = maxPrealloc
+		}
+		rv.Times = make([]int64, 0, n)
+		for i := range rv.Analog {
+			rv.Analog[i] = make([]float64, 0, n)
+		}
+	}
+	var err error
+	if cfg.Format == FormatASCII {
+		err = rv.readASCII(cfg, in)
+	} else {
+		err = rv.readBinary(cfg, in)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (d *Data) readASCII(cfg *Config, in io.Reader) error {
+	s := bufio.NewScanner(in)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	nfields := 2 + len(cfg.Analog) + len(cfg.Digital)
+	var k int64
+	for line := 1; s.Scan(); line++ {
+		ln := strings.TrimSpace(s.Text())
+		//Old files end with a ^Z
+		if ln == "" || ln == "\x1a" {
+			continue
+		}
+		f := strings.Split(ln, ",")
+		if len(f) != nfields {
+			return fmt.Errorf("line %d: expected %d fields, got %d", line, nfields, len(f))
+		}
+		k++
+		var ts int64
+		var err error
+		if tf := strings.TrimSpace(f[1]); tf != "" {
+			ts, err = strconv.ParseInt(tf, 10, 64)
+			if err != nil {
+				return fmt.Errorf("line %d: bad timestamp %q", line, tf)
+			}
+		} else if !cfg.FixedRate() {
+			return fmt.Errorf("line %d: missing timestamp", line)
+		}
+		t, err := cfg.SampleTime(k, ts)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		d.Times = append(d.Times, t)
+		for i := range cfg.Analog {
+			v := strings.TrimSpace(f[2+i])
+			if v == "" || (cfg.RevYear < 1999 && v == missingASCII1991) {
+				d.Analog[i] = append(d.Analog[i], math.NaN())
+				continue
+			}
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("line %d: bad value %q for %s", line, v, cfg.Analog[i].ID)
+			}
+			d.Analog[i] = append(d.Analog[i], x)
+		}
+		for i := range cfg.Digital {
+			v := strings.TrimSpace(f[2+len(cfg.Analog)+i])
+			if v != "0" && v != "1" {
+				return fmt.Errorf("line %d: bad state %q for %s", line, v, cfg.Digital[i].ID)
+			}
+			d.Digital[i] = append(d.Digital[i], v == "1")
+		}
+	}
+	return s.Err()
+}
+
+//readBinary reads records of
+//
+// SAMPLE(4) TIMESTAMP(4) ANALOG(2 or 4 each) DIGITAL(2 per 16 channels)
+//
+//all little endian
+func (d *Data) readBinary(cfg *Config, in io.Reader) error {
+	awidth := 2
+	if cfg.Format != FormatBinary {
+		awidth = 4
+	}
+	dwords := (len(cfg.Digital) + 15) / 16
+	rec := make([]byte, 8+awidth*len(cfg.Analog)+2*dwords)
+	r := bufio.NewReader(in)
+	for k := int64(1); ; k++ {
+		_, err := io.ReadFull(r, rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("sample %d is truncated", k)
+		}
+		if err != nil {
+			return err
+		}
+		ts := binary.LittleEndian.Uint32(rec[4:])
+		if ts == 0xFFFFFFFF && !cfg.FixedRate() {
+			return fmt.Errorf("sample %d is missing its timestamp", k)
+		}
+		t, err := cfg.SampleTime(k, int64(ts))
+		if err != nil {
+			return fmt.Errorf("sample %d: %v", k, err)
+		}
+		d.Times = append(d.Times, t)
+		for i := range cfg.Analog {
+			off := 8 + awidth*i
+			var x float64
+			switch cfg.Format {
+			case FormatBinary:
+				v := int16(binary.LittleEndian.Uint16(rec[off:]))
+				x = float64(v)
+				if v == missingBinary {
+					x = math.NaN()
+				}
+			case FormatBinary32:
+				v := int32(binary.LittleEndian.Uint32(rec[off:]))
+				x = float64(v)
+				if v == missingBinary32 {
+					x = math.NaN()
+				}
+			case FormatFloat32:
+				x = float64(math.Float32frombits(binary.LittleEndian.Uint32(rec[off:])))
+			}
+			d.Analog[i] = append(d.Analog[i], x)
+		}
+		doff := 8 + awidth*len(cfg.Analog)
+		for i := range cfg.Digital {
+			word := binary.LittleEndian.Uint16(rec[doff+2*(i/16):])
+			d.Digital[i] = append(d.Digital[i], word&(1<<uint(i%16)) != 0)
+		}
+	}
+}
@@ -47,3 +47,27 @@ type Point struct {
 	Time  int64
 	Value float64
 }
+
+//SourcedStream is implemented by streams that know which source (usually a
+//file) their data was read from. Checkpoints are kept per source, so an
+//interrupted import can report and resume its progress per file. For that
+//to be exact, a source must yield the same streams and points, in the same
+//order, every time it is read.
+type SourcedStream interface {
+	Stream
+
+	//Source identifies where the data of this stream was read from
+	Source() string
+}
+
+//ResumableSource is implemented by data sources that can skip sources that
+//an interrupted import has already finished
+type ResumableSource interface {
+	DataSource
+
+	//Sources returns the names of all the sources, in the order they are read
+	Sources() []string
+
+	//SkipSource excludes a source from what Next returns
+	SkipSource(source string)
+}
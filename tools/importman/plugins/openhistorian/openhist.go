@@ -10,6 +10,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -37,6 +38,8 @@ type openhist struct {
 	total    int64
 	metadata map[uint32]*metadatarec
 	skiplist map[uint32]bool
+	skipped  map[string]bool
+	sources  []string
 }
 type metadatarec struct {
 	collection  string
@@ -50,7 +53,7 @@ func NewOpenHistorian(metadata string, filenames []string) (plugins.DataSource,
 	if len(filenames) == 0 {
 		return nil, fmt.Errorf("no files specified")
 	}
-	rv := &openhist{}
+	rv := &openhist{skipped: make(map[string]bool)}
 	if metadata != "" {
 		err := rv.loadMetadata(metadata)
 		if err != nil {
@@ -64,6 +67,7 @@ func NewOpenHistorian(metadata string, filenames []string) (plugins.DataSource,
 		}
 		ohf.parent = rv
 		rv.files = append(rv.files, ohf)
+		rv.sources = append(rv.sources, f)
 		rv.total += int64(ohf.pointsArchived)
 	}
 	return rv, nil
@@ -168,6 +172,10 @@ func openFile(filename string) (*openhistfile, error) {
 }
 
 func (oh *openhist) Next() []plugins.Stream {
+	for oh.cursor < len(oh.files) && oh.skipped[oh.files[oh.cursor].filename] {
+		oh.files[oh.cursor] = nil
+		oh.cursor++
+	}
 	if oh.cursor == len(oh.files) {
 		return nil
 	}
@@ -177,6 +185,14 @@ func (oh *openhist) Next() []plugins.Stream {
 	return rv
 }
 
+func (oh *openhist) Sources() []string {
+	return oh.sources
+}
+
+func (oh *openhist) SkipSource(source string) {
+	oh.skipped[source] = true
+}
+
 func (oh *openhist) Total() (int64, bool) {
 	return oh.total, true
 }
@@ -209,6 +225,7 @@ func (oh *openhistfile) Streams() []plugins.Stream {
 		if !ok {
 			stream = &ohstream{
 				typeID:   int(oh.blocks[datablock].typeID),
+				source:   oh.filename,
 				points:   make([]plugins.Point, 0, oh.datablockSize/10),
 				metadata: oh.parent.metadata[uint32(oh.blocks[datablock].typeID)],
 			}
@@ -236,15 +253,22 @@ func (oh *openhistfile) Streams() []plugins.Stream {
 		}
 	}
 
+	//In a stable order, so that checkpoints of resumed imports line up
+	ids := make([]int, 0, len(rvmap))
+	for id := range rvmap {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
 	rv := make([]plugins.Stream, 0, len(rvmap))
-	for _, s := range rvmap {
-		rv = append(rv, s)
+	for _, id := range ids {
+		rv = append(rv, rvmap[int32(id)])
 	}
 	return rv
 }
 
 type ohstream struct {
 	typeID       int
+	source       string
 	points       []plugins.Point
 	haveReturned bool
 	metadata     *metadatarec
@@ -292,6 +316,11 @@ func (s *ohstream) Next() (data []plugins.Point) {
 	return rv
 }
 
+//Source is the file the data was read from
+func (s *ohstream) Source() string {
+	return s.source
+}
+
 //Total returns the total number of datapoints, used for progress estimation.
 //If no total is available, return 0, false
 func (s *ohstream) Total() (total int64, totalKnown bool) {
@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package tabular
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type csvTable struct {
+	f       *os.File
+	r       *csv.Reader
+	columns []string
+}
+
+func openCSV(filename string, m *Mapping) (table, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(bufio.NewReaderSize(f, 1024*1024))
+	r.Comma = m.delimiter
+	r.Comment = m.comment
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		f.Close()
+		if err == io.EOF {
+			return nil, fmt.Errorf("the file is empty")
+		}
+		return nil, err
+	}
+	columns := make([]string, len(header))
+	for i, h := range header {
+		columns[i] = strings.TrimSpace(h)
+	}
+	//Excel writes a byte order mark
+	if len(columns) > 0 {
+		columns[0] = strings.TrimPrefix(columns[0], "\ufeff")
+	}
+	return &csvTable{f: f, r: r, columns: columns}, nil
+}
+
+func (t *csvTable) Columns() []string {
+	return t.columns
+}
+
+func (t *csvTable) Read(n int) ([][]string, error) {
+	rv := make([][]string, 0, n)
+	for len(rv) < n {
+		rec, err := t.r.Read()
+		if err == io.EOF {
+			return rv, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, rec)
+	}
+	return rv, nil
+}
+
+func (t *csvTable) Rows() (int64, bool) {
+	return 0, false
+}
+
+func (t *csvTable) Close() error {
+	return t.f.Close()
+}
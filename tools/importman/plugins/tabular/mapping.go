@@ -0,0 +1,314 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package tabular
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//The table layouts
+const (
+	//LayoutWide tables have a time column and one column per stream
+	LayoutWide = "wide"
+	//LayoutLong tables have a time column, a column naming the stream and
+	//a value column
+	LayoutLong = "long"
+)
+
+//The time formats that are not Go time layouts
+const (
+	TimeRFC3339 = "rfc3339"
+	TimeUnix    = "unix"
+	TimeUnixMs  = "unix_ms"
+	TimeUnixUs  = "unix_us"
+	TimeUnixNs  = "unix_ns"
+)
+
+//The unit of streams that are not given one
+const DefaultUnit = "unknown"
+
+//Mapping describes how the columns of a table become streams. It is read
+//from a YAML file.
+type Mapping struct {
+	//Layout is LayoutWide (the default) or LayoutLong
+	Layout string `yaml:"layout"`
+	//The field delimiter and comment character of CSV files. The
+	//delimiter defaults to a comma and there is no comment character by
+	//default.
+	Delimiter string     `yaml:"delimiter"`
+	Comment   string     `yaml:"comment"`
+	Time      TimeColumn `yaml:"time"`
+	//The columns holding the stream key and the value in the long layout
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+	//Defaults apply to every stream, and are overridden by Columns
+	Defaults Column `yaml:"defaults"`
+	//Columns is keyed by column name in the wide layout and by the value of
+	//the key column in the long layout
+	Columns map[string]*Column `yaml:"columns"`
+	//If Unmapped is set, columns (or keys) that are not in Columns are
+	//imported with the defaults, otherwise they are ignored
+	Unmapped bool `yaml:"unmapped"`
+
+	delimiter rune
+	comment   rune
+	loc       *time.Location
+	streams   map[string]*streamDesc
+}
+
+//TimeColumn describes the timestamps
+type TimeColumn struct {
+	Column string `yaml:"column"`
+	//Format is one of the Time constants or a Go time layout such as
+	//"2006-01-02 15:04:05.000". Defaults to rfc3339.
+	Format string `yaml:"format"`
+	//Timezone is the IANA time zone of timestamps that do not carry one,
+	//e.g. America/Los_Angeles. Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+}
+
+//Column describes the stream a column (or key) becomes. Any field that is
+//not set is taken from the defaults.
+type Column struct {
+	//Collection is appended to the collection given on the command line
+	Collection string `yaml:"collection"`
+	//Name defaults to the column name (or key)
+	Name        string            `yaml:"name"`
+	Unit        string            `yaml:"unit"`
+	Tags        map[string]string `yaml:"tags"`
+	Annotations map[string]string `yaml:"annotations"`
+	//Skip excludes the column from the import
+	Skip bool `yaml:"skip"`
+}
+
+type streamDesc struct {
+	suffix string
+	tags   map[string]string
+	anns   map[string]string
+}
+
+//LoadMapping reads a mapping file
+func LoadMapping(filename string) (*Mapping, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("no mapping file specified")
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseMapping(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return m, nil
+}
+
+//ParseMapping parses and checks a mapping
+func ParseMapping(data []byte) (*Mapping, error) {
+	m := &Mapping{}
+	err := yaml.UnmarshalStrict(data, m)
+	if err != nil {
+		return nil, err
+	}
+	switch m.Layout {
+	case "":
+		m.Layout = LayoutWide
+	case LayoutWide:
+	case LayoutLong:
+		if m.Key == "" || m.Value == "" {
+			return nil, fmt.Errorf("the long layout requires key and value columns")
+		}
+	default:
+		return nil, fmt.Errorf("unknown layout %q, must be wide or long", m.Layout)
+	}
+	if m.Time.Column == "" {
+		return nil, fmt.Errorf("no time column specified")
+	}
+	if m.Time.Format == "" {
+		m.Time.Format = TimeRFC3339
+	}
+	m.loc, err = time.LoadLocation(m.Time.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("bad timezone: %v", err)
+	}
+	m.delimiter = ','
+	if m.Delimiter != "" {
+		if m.Delimiter == `\t` {
+			m.Delimiter = "\t"
+		}
+		if utf8.RuneCountInString(m.Delimiter) != 1 {
+			return nil, fmt.Errorf("the delimiter must be a single character")
+		}
+		m.delimiter, _ = utf8.DecodeRuneInString(m.Delimiter)
+	}
+	if m.Comment != "" {
+		if utf8.RuneCountInString(m.Comment) != 1 {
+			return nil, fmt.Errorf("the comment must be a single character")
+		}
+		m.comment, _ = utf8.DecodeRuneInString(m.Comment)
+	}
+	for name, col := range m.Columns {
+		if col == nil {
+			m.Columns[name] = &Column{}
+		}
+	}
+	m.streams = make(map[string]*streamDesc)
+	return m, nil
+}
+
+//stream returns the stream that a column (or key) becomes, or nil if it is
+//not imported
+func (m *Mapping) stream(column string) *streamDesc {
+	if sd, ok := m.streams[column]; ok {
+		return sd
+	}
+	var sd *streamDesc
+	col, ok := m.Columns[column]
+	if (ok && !col.Skip) || (!ok && m.Unmapped) {
+		if col == nil {
+			col = &Column{}
+		}
+		sd = &streamDesc{
+			suffix: collection(first(col.Collection, m.Defaults.Collection)),
+			tags:   make(map[string]string),
+			anns:   make(map[string]string),
+		}
+		for _, src := range []map[string]string{m.Defaults.Tags, col.Tags} {
+			for k, v := range src {
+				sd.tags[k] = v
+			}
+		}
+		for _, src := range []map[string]string{m.Defaults.Annotations, col.Annotations} {
+			for k, v := range src {
+				sd.anns[k] = v
+			}
+		}
+		sd.tags["name"] = first(col.Name, column)
+		sd.tags["unit"] = first(col.Unit, m.Defaults.Unit, DefaultUnit)
+	}
+	m.streams[column] = sd
+	return sd
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+//collection makes sure a collection suffix starts with a slash
+func collection(s string) string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return ""
+	}
+	return "/" + s
+}
+
+//ParseTime converts a timestamp to nanoseconds since the epoch
+func (m *Mapping) ParseTime(v string) (int64, error) {
+	v = strings.TrimSpace(v)
+	switch m.Time.Format {
+	case TimeRFC3339:
+		t, err := time.ParseInLocation(time.RFC3339Nano, v, m.loc)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	case TimeUnix:
+		return parseScaled(v, 9)
+	case TimeUnixMs:
+		return parseScaled(v, 6)
+	case TimeUnixUs:
+		return parseScaled(v, 3)
+	case TimeUnixNs:
+		return parseScaled(v, 0)
+	default:
+		t, err := time.ParseInLocation(m.Time.Format, v, m.loc)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	}
+}
+
+//parseScaled parses a decimal number and multiplies it by 10^digits
+//without going through a float, so nanoseconds are not lost
+func parseScaled(v string, digits int) (int64, error) {
+	if v == "" {
+		return 0, fmt.Errorf("missing timestamp")
+	}
+	if strings.ContainsAny(v, "eE") {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(f * math.Pow10(digits)), nil
+	}
+	ipart, fpart := v, ""
+	if dot := strings.IndexByte(v, '.'); dot >= 0 {
+		ipart, fpart = v[:dot], v[dot+1:]
+	}
+	neg := strings.HasPrefix(ipart, "-")
+	if len(fpart) > digits {
+		fpart = fpart[:digits]
+	}
+	fpart += strings.Repeat("0", digits-len(fpart))
+	if ipart == "" || ipart == "-" || ipart == "+" {
+		ipart += "0"
+	}
+	i, err := strconv.ParseInt(ipart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad timestamp %q", v)
+	}
+	var f int64
+	if fpart != "" {
+		f, err = strconv.ParseInt(fpart, 10, 64)
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("bad timestamp %q", v)
+		}
+	}
+	if i > math.MaxInt64/int64(math.Pow10(digits)) || i < math.MinInt64/int64(math.Pow10(digits)) {
+		return 0, fmt.Errorf("timestamp %q is out of range", v)
+	}
+	rv := i * int64(math.Pow10(digits))
+	if neg {
+		return rv - f, nil
+	}
+	return rv + f, nil
+}
+
+//parseValue converts a cell to a value. Empty cells have no value.
+func parseValue(v string) (float64, bool, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil {
+		return f, true, nil
+	}
+	b, berr := strconv.ParseBool(v)
+	if berr == nil {
+		if b {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	}
+	return 0, false, fmt.Errorf("%q is not a number", v)
+}
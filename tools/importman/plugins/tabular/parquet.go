@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package tabular
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/types"
+)
+
+type parquetTable struct {
+	f       source.ParquetFile
+	pr      *reader.ParquetReader
+	columns []string
+	//The internal schema path of each column
+	paths []string
+	int96 []bool
+	rows  int64
+	read  int64
+}
+
+func openParquet(filename string, m *Mapping) (table, error) {
+	f, err := local.NewLocalFileReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rv := &parquetTable{f: f, pr: pr, rows: pr.GetNumRows()}
+	sh := pr.SchemaHandler
+	for _, path := range sh.ValueColumns {
+		//Repeated columns have a variable number of values per row, so they
+		//cannot be lined up with the time column
+		rl, err := sh.MaxRepetitionLevel(common.StrToPath(path))
+		if err != nil || rl > 0 {
+			continue
+		}
+		//The external path without the root, which is the column name for
+		//flat files
+		expath := common.StrToPath(sh.InPathToExPath[path])
+		rv.columns = append(rv.columns, strings.Join(expath[1:], "."))
+		rv.paths = append(rv.paths, path)
+		el := sh.SchemaElements[sh.MapIndex[path]]
+		rv.int96 = append(rv.int96, el.GetType() == parquet.Type_INT96)
+	}
+	return rv, nil
+}
+
+func (t *parquetTable) Columns() []string {
+	return t.columns
+}
+
+func (t *parquetTable) Read(n int) ([][]string, error) {
+	if t.read >= t.rows {
+		return nil, io.EOF
+	}
+	if left := t.rows - t.read; int64(n) > left {
+		n = int(left)
+	}
+	rv := make([][]string, n)
+	for i := range rv {
+		rv[i] = make([]string, len(t.columns))
+	}
+	for c, path := range t.paths {
+		values, _, _, err := t.pr.ReadColumnByPath(path, int64(n))
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %v", t.columns[c], err)
+		}
+		if len(values) != n {
+			return nil, fmt.Errorf("column %q: expected %d rows, got %d", t.columns[c], n, len(values))
+		}
+		for i, v := range values {
+			rv[i][c] = t.format(c, v)
+		}
+	}
+	t.read += int64(n)
+	if t.read >= t.rows {
+		return rv, io.EOF
+	}
+	return rv, nil
+}
+
+//format turns a value into the text that would have been in a CSV file, so
+//that both are parsed the same way. INT96 timestamps are written as RFC3339.
+func (t *parquetTable) format(c int, v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		if t.int96[c] {
+			return types.INT96ToTime(v).Format(time.RFC3339Nano)
+		}
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (t *parquetTable) Rows() (int64, bool) {
+	return t.rows, true
+}
+
+func (t *parquetTable) Close() error {
+	return t.f.Close()
+}
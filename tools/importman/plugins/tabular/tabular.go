@@ -0,0 +1,335 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package tabular imports CSV and Parquet tables, such as the exports of
+//other historians. A mapping file says which column holds the time, how
+//the timestamps are written and which stream each column becomes. Tables
+//are either wide (one column per stream) or long (a column naming the
+//stream and a value column).
+package tabular
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+)
+
+//How many points a stream returns from each call to Next
+const chunkSize = 50000
+
+//How many points are read from a table before its streams are returned.
+//Streams of later blocks are merged into the same BTrDB streams by the
+//data writer, so this bounds the memory used for large files.
+const blockPoints = 1000000
+
+//How many rows are read from a table at a time
+const readRows = 10000
+
+//table is a source of rows, i.e. a CSV or Parquet file
+type table interface {
+	//Columns returns the names of the columns
+	Columns() []string
+	//Read returns up to n rows. Once there are no rows left it returns
+	//io.EOF, possibly along with the last rows.
+	Read(n int) ([][]string, error)
+	//Rows returns the number of rows, if it is known
+	Rows() (int64, bool)
+	Close() error
+}
+
+type opener func(filename string, m *Mapping) (table, error)
+
+type tabular struct {
+	mapping    *Mapping
+	filenames  []string
+	open       opener
+	cursor     int
+	cur        *tableFile
+	total      int64
+	totalKnown bool
+	skipped    map[string]bool
+}
+
+//tableFile is the file being read
+type tableFile struct {
+	filename string
+	t        table
+	columns  []string
+	row      int64
+	timecol  int
+	//The wide layout: the stream of each column, nil if it is not imported
+	streams []*streamDesc
+	//The long layout
+	keycol   int
+	valuecol int
+}
+
+//NewCSV opens CSV files with a header row, to be imported according to the
+//given mapping file
+func NewCSV(mapping string, filenames []string) (plugins.DataSource, error) {
+	return newTabular(mapping, filenames, openCSV)
+}
+
+//NewParquet opens Parquet files, to be imported according to the given
+//mapping file. Nested columns are named by joining the path with dots and
+//repeated columns are not supported.
+func NewParquet(mapping string, filenames []string) (plugins.DataSource, error) {
+	return newTabular(mapping, filenames, openParquet)
+}
+
+func newTabular(mapping string, filenames []string, open opener) (*tabular, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no files specified")
+	}
+	m, err := LoadMapping(mapping)
+	if err != nil {
+		return nil, err
+	}
+	rv := &tabular{
+		mapping:    m,
+		filenames:  filenames,
+		open:       open,
+		totalKnown: true,
+		skipped:    make(map[string]bool),
+	}
+	//Check that all the files can be imported before starting
+	for _, f := range filenames {
+		tf, err := rv.openFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("error processing file %s: %v", f, err)
+		}
+		rows, known := tf.t.Rows()
+		rv.totalKnown = rv.totalKnown && known
+		if m.Layout == LayoutWide {
+			for _, sd := range tf.streams {
+				if sd != nil {
+					rv.total += rows
+				}
+			}
+		} else {
+			rv.total += rows
+		}
+		tf.t.Close()
+	}
+	return rv, nil
+}
+
+func (tb *tabular) openFile(filename string) (*tableFile, error) {
+	t, err := tb.open(filename, tb.mapping)
+	if err != nil {
+		return nil, err
+	}
+	columns := t.Columns()
+	tf := &tableFile{filename: filename, t: t, columns: columns, timecol: -1, keycol: -1, valuecol: -1}
+	m := tb.mapping
+	for i, c := range columns {
+		switch c {
+		case m.Time.Column:
+			tf.timecol = i
+		case m.Key:
+			tf.keycol = i
+		case m.Value:
+			tf.valuecol = i
+		}
+	}
+	err = nil
+	switch {
+	case tf.timecol < 0:
+		err = fmt.Errorf("there is no time column %q", m.Time.Column)
+	case m.Layout == LayoutLong && tf.keycol < 0:
+		err = fmt.Errorf("there is no key column %q", m.Key)
+	case m.Layout == LayoutLong && tf.valuecol < 0:
+		err = fmt.Errorf("there is no value column %q", m.Value)
+	case m.Layout == LayoutWide:
+		tf.streams = make([]*streamDesc, len(columns))
+		found := false
+		for i, c := range columns {
+			if i != tf.timecol {
+				tf.streams[i] = m.stream(c)
+				found = found || tf.streams[i] != nil
+			}
+		}
+		if !found {
+			err = fmt.Errorf("none of the columns are mapped to streams")
+		}
+	}
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return tf, nil
+}
+
+func (tb *tabular) Next() []plugins.Stream {
+	rv, err := tb.next()
+	if err != nil {
+		fmt.Printf("critical error: %v\n", err)
+		os.Exit(1)
+	}
+	return rv
+}
+
+func (tb *tabular) next() ([]plugins.Stream, error) {
+	for {
+		if tb.cur == nil {
+			if tb.cursor == len(tb.filenames) {
+				return nil, nil
+			}
+			if tb.skipped[tb.filenames[tb.cursor]] {
+				tb.cursor++
+				continue
+			}
+			tf, err := tb.openFile(tb.filenames[tb.cursor])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", tb.filenames[tb.cursor], err)
+			}
+			tb.cursor++
+			tb.cur = tf
+		}
+		streams, eof, err := tb.cur.block(tb.mapping)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tb.cur.filename, err)
+		}
+		if eof {
+			tb.cur.t.Close()
+			tb.cur = nil
+		}
+		if len(streams) > 0 {
+			return streams, nil
+		}
+	}
+}
+
+//block reads rows until it has blockPoints points or the file ends
+func (tf *tableFile) block(m *Mapping) ([]plugins.Stream, bool, error) {
+	streams := make(map[*streamDesc]*tstream)
+	var order []plugins.Stream
+	add := func(sd *streamDesc, t int64, v float64) {
+		s, ok := streams[sd]
+		if !ok {
+			s = &tstream{source: tf.filename, desc: sd}
+			streams[sd] = s
+			order = append(order, s)
+		}
+		s.points = append(s.points, plugins.Point{Time: t, Value: v})
+	}
+	npoints := 0
+	for npoints < blockPoints {
+		rows, err := tf.t.Read(readRows)
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		for _, row := range rows {
+			tf.row++
+			if len(row) <= tf.timecol {
+				return nil, false, fmt.Errorf("row %d: missing time", tf.row)
+			}
+			t, terr := m.ParseTime(row[tf.timecol])
+			if terr != nil {
+				return nil, false, fmt.Errorf("row %d: %v", tf.row, terr)
+			}
+			if m.Layout == LayoutLong {
+				sd := m.stream(row[tf.keycol])
+				if sd == nil {
+					continue
+				}
+				v, ok, verr := parseValue(row[tf.valuecol])
+				if verr != nil {
+					return nil, false, fmt.Errorf("row %d: %v", tf.row, verr)
+				}
+				if ok {
+					add(sd, t, v)
+					npoints++
+				}
+				continue
+			}
+			for i, sd := range tf.streams {
+				if sd == nil || i >= len(row) {
+					continue
+				}
+				v, ok, verr := parseValue(row[i])
+				if verr != nil {
+					return nil, false, fmt.Errorf("row %d: column %q: %v", tf.row, tf.columns[i], verr)
+				}
+				if ok {
+					add(sd, t, v)
+					npoints++
+				}
+			}
+		}
+		if err == io.EOF {
+			return order, true, nil
+		}
+	}
+	return order, false, nil
+}
+
+func (tb *tabular) Sources() []string {
+	return tb.filenames
+}
+
+func (tb *tabular) SkipSource(source string) {
+	tb.skipped[source] = true
+}
+
+func (tb *tabular) Total() (int64, bool) {
+	if !tb.totalKnown {
+		return 0, false
+	}
+	return tb.total, true
+}
+
+type tstream struct {
+	source string
+	desc   *streamDesc
+	points []plugins.Point
+}
+
+//The CollectionSuffix is what will be appended onto the user specified
+//destination collection. It can be an empty string as long as the Tags
+//are unique for all streams, otherwise the combination of CollectionSuffix
+//and Tags must be unique
+func (s *tstream) CollectionSuffix() string {
+	return s.desc.suffix
+}
+
+//The Tags form part of the identity of the stream. Specifically if there
+//is a `name` tag, it is used in the plotter as the final element of the
+//tree.
+func (s *tstream) Tags() map[string]string {
+	return s.desc.tags
+}
+
+//Annotations contain additional metadata that is associated with the stream
+//but is changeable or otherwise not suitable for identifying the stream
+func (s *tstream) Annotations() map[string]string {
+	return s.desc.anns
+}
+
+//Next returns a chunk of data for insertion. If the data is empty it is
+//assumed that there is no more data to insert
+func (s *tstream) Next() (data []plugins.Point) {
+	n := len(s.points)
+	if n > chunkSize {
+		n = chunkSize
+	}
+	rv := s.points[:n]
+	s.points = s.points[n:]
+	return rv
+}
+
+//Source is the file the data was read from
+func (s *tstream) Source() string {
+	return s.source
+}
+
+//Total returns the total number of datapoints, used for progress estimation.
+//If no total is available, return 0, false
+func (s *tstream) Total() (total int64, totalKnown bool) {
+	return int64(len(s.points)), true
+}
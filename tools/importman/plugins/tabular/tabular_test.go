@@ -0,0 +1,290 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package tabular
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/smartgridstore/tools/importman/plugins"
+)
+
+func writeFile(t *testing.T, dir string, name string, contents string) string {
+	fn := filepath.Join(dir, name)
+	err := ioutil.WriteFile(fn, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+//readAll drains the data source, returning the points of each stream by
+//collection suffix and name
+func readAll(t *testing.T, ds plugins.DataSource) (map[string][]plugins.Point, map[string]plugins.Stream) {
+	points := make(map[string][]plugins.Point)
+	streams := make(map[string]plugins.Stream)
+	tb := ds.(*tabular)
+	for {
+		sz, err := tb.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sz) == 0 {
+			return points, streams
+		}
+		for _, s := range sz {
+			key := s.CollectionSuffix() + "/" + s.Tags()["name"]
+			streams[key] = s
+			for pts := s.Next(); len(pts) > 0; pts = s.Next() {
+				points[key] = append(points[key], pts...)
+			}
+		}
+	}
+}
+
+func pt(t int64, v float64) plugins.Point {
+	return plugins.Point{Time: t, Value: v}
+}
+
+func checkPoints(t *testing.T, name string, got []plugins.Point, expected []plugins.Point) {
+	if len(got) != len(expected) {
+		t.Fatalf("%s: expected %v got %v", name, expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("%s: expected %v got %v", name, expected, got)
+		}
+	}
+}
+
+func TestWideCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tabular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := writeFile(t, dir, "mapping.yaml", `
+delimiter: ";"
+comment: "#"
+time:
+  column: Timestamp
+  format: "2006-01-02 15:04:05.000"
+  timezone: America/Los_Angeles
+defaults:
+  collection: plant
+  unit: MW
+  annotations:
+    source: historian
+columns:
+  "Unit 1 Output":
+    name: unit1
+    tags:
+      kind: gen
+  "Unit 2 Output":
+    collection: /plant/unit2/
+    name: output
+    annotations:
+      description: second unit
+  Breaker:
+    unit: status
+  Comments:
+    skip: true
+`)
+	//The second file has the columns in another order
+	f1 := writeFile(t, dir, "a.csv", "\ufeffTimestamp;Unit 1 Output;Unit 2 Output;Breaker;Comments;Other\n"+
+		"# exported by the historian\n"+
+		"2021-01-10 08:00:00.000;1.5;2.5;true;ok;9\n"+
+		"2021-01-10 08:00:00.500; 1.75;;false;;9\n")
+	f2 := writeFile(t, dir, "b.csv", "Unit 2 Output;Timestamp;Unit 1 Output\n"+
+		"3;2021-07-10 08:00:00.000;2\n")
+
+	ds, err := NewCSV(mapping, []string{f1, f2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, known := ds.Total(); known {
+		t.Fatalf("CSV files should not have a known total")
+	}
+	points, streams := readAll(t, ds)
+	if len(streams) != 3 {
+		t.Fatalf("expected 3 streams got %v", streams)
+	}
+	//PST in January, PDT in July
+	t0 := time.Date(2021, 1, 10, 16, 0, 0, 0, time.UTC).UnixNano()
+	t1 := time.Date(2021, 7, 10, 15, 0, 0, 0, time.UTC).UnixNano()
+	half := int64(500 * time.Millisecond)
+	checkPoints(t, "unit1", points["/plant/unit1"], []plugins.Point{pt(t0, 1.5), pt(t0+half, 1.75), pt(t1, 2)})
+	checkPoints(t, "unit2", points["/plant/unit2/output"], []plugins.Point{pt(t0, 2.5), pt(t1, 3)})
+	checkPoints(t, "breaker", points["/plant/Breaker"], []plugins.Point{pt(t0, 1), pt(t0+half, 0)})
+
+	u1 := streams["/plant/unit1"]
+	if u1.Tags()["unit"] != "MW" || u1.Tags()["kind"] != "gen" || u1.Annotations()["source"] != "historian" {
+		t.Fatalf("unexpected metadata %v %v", u1.Tags(), u1.Annotations())
+	}
+	u2 := streams["/plant/unit2/output"]
+	if u2.Annotations()["description"] != "second unit" || u2.Annotations()["source"] != "historian" {
+		t.Fatalf("unexpected annotations %v", u2.Annotations())
+	}
+	if streams["/plant/Breaker"].Tags()["unit"] != "status" {
+		t.Fatalf("unexpected tags %v", streams["/plant/Breaker"].Tags())
+	}
+}
+
+func TestLongCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tabular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := writeFile(t, dir, "mapping.yaml", `
+layout: long
+time:
+  column: time
+  format: unix_ms
+key: tag
+value: value
+unmapped: true
+columns:
+  PMU1.VA:
+    collection: pmu1
+    name: va
+    unit: V
+  PMU1.STAT:
+    skip: true
+`)
+	f := writeFile(t, dir, "long.csv", "tag,time,value,quality\n"+
+		"PMU1.VA,1600000000000.5,120.1,good\n"+
+		"PMU1.STAT,1600000000000,nonsense,good\n"+
+		"PMU1.FREQ,1600000000001,60.01,good\n"+
+		"PMU1.VA,1600000000001,,bad\n"+
+		"PMU1.VA,1600000000002,120.2,good\n")
+	ds, err := NewCSV(mapping, []string{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, streams := readAll(t, ds)
+	ms := int64(time.Millisecond)
+	t0 := 1600000000000 * ms
+	checkPoints(t, "va", points["/pmu1/va"], []plugins.Point{pt(t0+ms/2, 120.1), pt(t0+2*ms, 120.2)})
+	checkPoints(t, "freq", points["/PMU1.FREQ"], []plugins.Point{pt(t0+ms, 60.01)})
+	if streams["/PMU1.FREQ"].Tags()["unit"] != DefaultUnit || streams["/pmu1/va"].Tags()["unit"] != "V" {
+		t.Fatalf("unexpected units")
+	}
+	if len(streams) != 2 {
+		t.Fatalf("expected 2 streams got %v", streams)
+	}
+
+	//A value that is not a number is an error
+	bad := writeFile(t, dir, "bad.csv", "tag,time,value\nPMU1.VA,1600000000000,nonsense\n")
+	ds, err = NewCSV(mapping, []string{bad})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.(*tabular).next()
+	if err == nil {
+		t.Fatalf("bad value was accepted")
+	}
+}
+
+func TestChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tabular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := writeFile(t, dir, "mapping.yaml", "time: {column: t, format: unix_ns}\nunmapped: true\n")
+	f, err := os.Create(filepath.Join(dir, "big.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("t,a,b,c,d,e\n")
+	nrows := blockPoints/5 + 100
+	for i := 0; i < nrows; i++ {
+		f.WriteString("1000,1,2,3,4,5\n")
+	}
+	f.Close()
+	ds, err := NewCSV(mapping, []string{f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := ds.(*tabular)
+	//The file is returned in blocks, and the streams of each block in chunks
+	sz, err := tb.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sz) != 5 {
+		t.Fatalf("expected 5 streams got %d", len(sz))
+	}
+	if total, _ := sz[0].Total(); total >= int64(nrows) {
+		t.Fatalf("expected the first block to be smaller than the file, got %d points", total)
+	}
+	if len(sz[0].Next()) != chunkSize {
+		t.Fatalf("expected a chunk of %d points", chunkSize)
+	}
+	sz, err = tb.next()
+	if err != nil || len(sz) != 5 {
+		t.Fatalf("expected a second block: %v", err)
+	}
+	sz, err = tb.next()
+	if err != nil || len(sz) != 0 {
+		t.Fatalf("expected the end of the file: %v", err)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	for _, c := range []struct {
+		format string
+		in     string
+		out    int64
+	}{
+		{TimeUnix, "1600000000", 1600000000000000000},
+		{TimeUnix, "1600000000.123456789", 1600000000123456789},
+		{TimeUnix, "-1.5", -1500000000},
+		{TimeUnix, "1.6e9", 1600000000000000000},
+		{TimeUnixMs, "1600000000123", 1600000000123000000},
+		{TimeUnixUs, "1600000000123456", 1600000000123456000},
+		{TimeUnixNs, "1600000000123456789", 1600000000123456789},
+		{TimeRFC3339, "2020-09-13T12:26:40.5Z", 1600000000500000000},
+		{TimeRFC3339, "2020-09-13T14:26:40+02:00", 1600000000000000000},
+		{"01/02/2006 15:04:05", "09/13/2020 12:26:40", 1600000000000000000},
+	} {
+		m, err := ParseMapping([]byte("time: {column: t, format: \"" + c.format + "\"}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := m.ParseTime(c.in)
+		if err != nil || out != c.out {
+			t.Errorf("%s %q: expected %d got %d (%v)", c.format, c.in, c.out, out, err)
+		}
+	}
+	m, _ := ParseMapping([]byte("time: {column: t, format: unix}"))
+	for _, bad := range []string{"", "abc", "1.2.3", "1.-5", "99999999999999999999"} {
+		if _, err := m.ParseTime(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestParseMapping(t *testing.T) {
+	for _, bad := range []string{
+		"layout: wide\n",
+		"time: {column: t}\nlayout: tall\n",
+		"time: {column: t}\nlayout: long\nkey: k\n",
+		"time: {column: t, timezone: Mars/Olympus}\n",
+		"time: {column: t}\ndelimiter: ab\n",
+		"time: {column: t}\ncolumns: {a: {nmae: x}}\n",
+	} {
+		_, err := ParseMapping([]byte(bad))
+		if err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
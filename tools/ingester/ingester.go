@@ -23,6 +23,7 @@ import (
 	"github.com/BTrDB/btrdb-server/bte"
 	"github.com/BTrDB/smartgridstore/tools"
 	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 	"github.com/BTrDB/smartgridstore/tools/upmuparser"
 	"github.com/ceph/go-ceph/rados"
 	etcd "github.com/coreos/etcd/clientv3"
@@ -66,6 +67,7 @@ func main() {
 		os.Exit(0)
 	}
 	fmt.Printf("Booting ingester version %d.%d.%d\n", VersionMajor, VersionMinor, VersionPatch)
+	metrics.Serve()
 
 	var etcdPrefix string = os.Getenv("INGESTER_ETCD_CONFIG")
 	manifest.SetEtcdKeyPrefix(etcdPrefix)
@@ -284,6 +286,7 @@ func process(ctx context.Context, sernum string, alias string, streams []*btrdb.
 	}
 
 	documentsFound := (len(todo) != 0)
+	dm := metrics.ForDevice(alias)
 
 	var parsed []*upmuparser.Sync_Output
 	var synco *upmuparser.Sync_Output
@@ -334,6 +337,7 @@ func process(ctx context.Context, sernum string, alias string, streams []*btrdb.
 				fmt.Printf("Could not parse set at index %d in file %s from uPMU %s (serial=%s). Reason: %v\n", i, filename, alias, sernum, err)
 				if err == io.ErrUnexpectedEOF {
 					fmt.Println("Warning: skipping partially written/corrupt set...")
+					dm.Rejected(1)
 					continue
 				} else {
 					fmt.Println("Dumping bad file into error.dat...")
@@ -356,6 +360,7 @@ func process(ctx context.Context, sernum string, alias string, streams []*btrdb.
 			if timeArr[0] < 2010 || timeArr[0] > 2025 {
 				// if the year is outside of this range things must have gotten corrupted somehow
 				fmt.Printf("Rejecting bad date record for %v: year is %v\n", alias, timeArr[0])
+				dm.Rejected(1)
 				continue
 			}
 			timestamp = time.Date(int(timeArr[0]), time.Month(timeArr[1]), int(timeArr[2]), int(timeArr[3]), int(timeArr[4]), int(timeArr[5]), 0, time.UTC).UnixNano()
@@ -383,10 +388,14 @@ func process(ctx context.Context, sernum string, alias string, streams []*btrdb.
 		}
 
 		for idx, stream := range streams {
+			dm.Received(len(pts[idx]))
 		errloop:
 			for {
+				insertStart := time.Now()
 				err := stream.Insert(ctx, pts[idx])
+				metrics.ObserveLatency("insert", time.Since(insertStart))
 				if err == nil {
+					dm.Inserted(len(pts[idx]))
 					break errloop
 				} else {
 					fmt.Printf("Error inserting data: %v\n", err)
@@ -394,6 +403,7 @@ func process(ctx context.Context, sernum string, alias string, streams []*btrdb.
 					case bte.ResourceDepleted:
 						time.Sleep(30 * time.Second)
 					case bte.BadValue:
+						dm.Dropped(len(pts[idx]))
 						break errloop
 					default:
 						panic(err)
@@ -12,7 +12,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -95,6 +98,14 @@ func writeStringf(output io.Writer, format string, a ...interface{}) error {
 	return err
 }
 
+//ago formats a time in nanoseconds as the time since then
+func ago(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(time.Unix(0, t)).Round(time.Second))
+}
+
 func writeError(output io.Writer, err error) (bool, error) {
 	var err2 error
 	if err != nil {
@@ -344,6 +355,99 @@ func NewManifestCLIModule(etcdClient *etcd.Client) *admincli.GenericCLIModule {
 					return
 				},
 			},
+			&ManifestCommand{
+				name:      "status",
+				usageargs: "[prefix]",
+				hint:      "shows the liveness of all devices with a given prefix",
+				exec: func(ctx context.Context, output io.Writer, tokens ...string) (argsOK bool) {
+					if argsOK = len(tokens) == 0 || len(tokens) == 1; !argsOK {
+						return
+					}
+
+					prefix := ""
+					if len(tokens) == 1 {
+						prefix = tokens[0]
+					}
+
+					devs, err := manifest.RetrieveMultipleManifestDevices(ctx, etcdClient, prefix)
+					if waserr, _ := writeError(output, err); waserr {
+						return
+					}
+					statuses, err := manifest.RetrieveMultipleDeviceStatus(ctx, etcdClient, prefix)
+					if waserr, _ := writeError(output, err); waserr {
+						return
+					}
+					bydesc := make(map[string]*manifest.DeviceStatus)
+					for _, st := range statuses {
+						bydesc[st.Descriptor] = st
+					}
+
+					tw := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(tw, "DEVICE\tSTATE\tNODE\tLAST RECEIVED\tPOINTS/SEC\tLAST ERROR")
+					for _, dev := range devs {
+						st, ok := bydesc[dev.Descriptor]
+						if !ok {
+							//Either nothing holds the lock or the daemon that did has died
+							fmt.Fprintf(tw, "%s\toffline\t-\t-\t-\t-\n", dev.Descriptor)
+							continue
+						}
+						lasterr := "-"
+						if st.LastError != "" {
+							lasterr = fmt.Sprintf("%s (%s)", st.LastError, ago(st.LastErrorTime))
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f\t%s\n", dev.Descriptor, st.State, st.Node, ago(st.LastReceived), st.PointsPerSecond, lasterr)
+					}
+					tw.Flush()
+					return
+				},
+			},
+			&ManifestCommand{
+				name:      "locks",
+				usageargs: "prefix",
+				hint:      "shows which ingress node owns each device locked under the daemon prefix",
+				exec: func(ctx context.Context, output io.Writer, tokens ...string) (argsOK bool) {
+					if argsOK = len(tokens) == 1; !argsOK {
+						return
+					}
+					prefix := tokens[0]
+
+					ltable, err := manifest.GetLockTable(ctx, etcdClient, prefix)
+					if waserr, _ := writeError(output, err); waserr {
+						return
+					}
+					members, err := manifest.GetLockMembers(ctx, etcdClient, prefix)
+					if waserr, _ := writeError(output, err); waserr {
+						return
+					}
+					sort.Strings(members)
+					live := make(map[string]bool)
+					for _, m := range members {
+						live[m] = true
+						writeStringf(output, "node %s holds %d devices\n", m, len(ltable[m]))
+					}
+					owners := make(map[string]string)
+					descs := []string{}
+					for node, dz := range ltable {
+						if !live[node] {
+							//A node from before the lock manager, or one whose lease
+							//has not expired yet
+							writeStringf(output, "node %s holds %d devices but is not a member\n", node, len(dz))
+						}
+						for _, d := range dz {
+							owners[d] = node
+							descs = append(descs, d)
+						}
+					}
+					sort.Strings(descs)
+					tw := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(tw, "DEVICE\tOWNER")
+					for _, d := range descs {
+						fmt.Fprintf(tw, "%s\t%s\n", d, owners[d])
+					}
+					tw.Flush()
+					return
+				},
+			},
 		},
 	}
 }
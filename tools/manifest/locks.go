@@ -0,0 +1,436 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package manifest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+const manifestmemberpath = "manifestmembers/"
+
+//LockTTL is how many seconds the locks of a node survive after it stops
+//renewing its lease
+const LockTTL = 10
+
+//RebalanceInterval is how often the lock manager reconsiders which devices
+//it should hold. Membership changes trigger an earlier rebalance.
+const RebalanceInterval = 5 * time.Second
+
+//DrainTimeout is how long a device handler gets to finish after its
+//context is cancelled before the lock is released anyway
+const DrainTimeout = 30 * time.Second
+
+//A device that was handed off is not taken back by the same node for this
+//long, so that the node that needs it has a chance to take it
+const reacquireDelay = 3 * RebalanceInterval
+
+//DeviceHandler processes a device while this node holds its lock. It
+//should run until ctx is cancelled and only return once the device has
+//been drained, the lock is released after it returns. If it returns early
+//the lock is kept so that the device is not picked up by another node.
+type DeviceHandler func(ctx context.Context, md *ManifestDevice)
+
+//LockManager spreads the devices under a descriptor prefix evenly across
+//the nodes that run a LockManager for the same prefix. Each node keeps a
+//membership key and its device locks under a single lease, so if a node
+//dies its devices are picked up by the others after LockTTL.
+type LockManager struct {
+	ec      *etcd.Client
+	prefix  string
+	node    string
+	handler DeviceHandler
+
+	lease     etcd.LeaseID
+	kacancel  func()
+	leaseLost chan etcd.LeaseID
+
+	mu       sync.Mutex
+	owned    map[string]*ownedDevice
+	released map[string]time.Time
+	//Devices are released in the background, see stop
+	stopping sync.WaitGroup
+}
+
+type ownedDevice struct {
+	cancel    context.CancelFunc
+	done      chan struct{}
+	releasing bool
+}
+
+//NewNodeID returns a lock owner id that is recognizable in the lock table
+//but unique across restarts of the same node
+func NewNodeID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", NodeName(), hex.EncodeToString(b))
+}
+
+func getEtcdMemberKey(node string, prefix string) string {
+	return fmt.Sprintf("%s%s%s/%s", etcdprefix, manifestmemberpath, prefix, node)
+}
+
+//NewLockManager creates a lock manager for the devices whose descriptors
+//start with prefix. node is the id written into the lock table, see
+//NewNodeID.
+func NewLockManager(etcdClient *etcd.Client, prefix string, node string, handler DeviceHandler) *LockManager {
+	return &LockManager{
+		ec:        etcdClient,
+		prefix:    prefix,
+		node:      node,
+		handler:   handler,
+		leaseLost: make(chan etcd.LeaseID, 1),
+		owned:     make(map[string]*ownedDevice),
+		released:  make(map[string]time.Time),
+	}
+}
+
+//Owned returns the descriptors of the devices this node currently holds
+func (lm *LockManager) Owned() []string {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	rv := make([]string, 0, len(lm.owned))
+	for d := range lm.owned {
+		rv = append(rv, d)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+//GetLockMembers returns the ids of the nodes running a lock manager for
+//the prefix
+func GetLockMembers(ctx context.Context, etcdClient *etcd.Client, prefix string) ([]string, error) {
+	memberprefix := getEtcdMemberKey("", prefix)
+	resp, err := etcdClient.Get(ctx, memberprefix, etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		rv = append(rv, strings.TrimPrefix(string(kv.Key), memberprefix))
+	}
+	return rv, nil
+}
+
+//Run takes and hands off devices until ctx is cancelled. It then drains
+//every device it holds before returning, but keeps the locks so that the
+//caller can flush what the devices produced. Call Release afterwards.
+func (lm *LockManager) Run(ctx context.Context) {
+	memberprefix := getEtcdMemberKey("", lm.prefix)
+	wch := lm.ec.Watch(ctx, memberprefix, etcd.WithPrefix())
+	t := time.NewTicker(RebalanceInterval)
+	defer t.Stop()
+	for {
+		err := lm.rebalance(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("[locks] rebalance of %q failed: %v\n", lm.prefix, err)
+		}
+		select {
+		case <-ctx.Done():
+			lm.stopping.Wait()
+			lm.releaseAll(false)
+			return
+		case <-t.C:
+		case _, ok := <-wch:
+			if !ok {
+				wch = nil
+			}
+		case id := <-lm.leaseLost:
+			if id == lm.lease {
+				fmt.Printf("[locks] lease for %q was lost, stopping all devices\n", lm.prefix)
+				lm.kacancel()
+				lm.lease = 0
+				//The locks went with the lease, there is nothing to delete
+				lm.releaseAll(false)
+			}
+		}
+	}
+}
+
+func (lm *LockManager) ensureLease(ctx context.Context) error {
+	if lm.lease != 0 {
+		return nil
+	}
+	resp, err := lm.ec.Grant(ctx, LockTTL)
+	if err != nil {
+		return err
+	}
+	kactx, kacancel := context.WithCancel(context.Background())
+	ch, err := lm.ec.KeepAlive(kactx, resp.ID)
+	if err != nil {
+		kacancel()
+		return err
+	}
+	_, err = lm.ec.Put(ctx, getEtcdMemberKey(lm.node, lm.prefix), lm.node, etcd.WithLease(resp.ID))
+	if err != nil {
+		kacancel()
+		return err
+	}
+	lm.lease = resp.ID
+	lm.kacancel = kacancel
+	go func(id etcd.LeaseID) {
+		for range ch {
+		}
+		if kactx.Err() == nil {
+			select {
+			case lm.leaseLost <- id:
+			default:
+			}
+		}
+	}(resp.ID)
+	return nil
+}
+
+func (lm *LockManager) rebalance(ctx context.Context) error {
+	err := lm.ensureLease(ctx)
+	if err != nil {
+		return err
+	}
+	devs, err := RetrieveMultipleManifestDevices(ctx, lm.ec, lm.prefix)
+	if err != nil {
+		return err
+	}
+	ltable, err := GetLockTable(ctx, lm.ec, lm.prefix)
+	if err != nil {
+		return err
+	}
+	members, err := GetLockMembers(ctx, lm.ec, lm.prefix)
+	if err != nil {
+		return err
+	}
+	bydesc := make(map[string]*ManifestDevice)
+	descriptors := make([]string, 0, len(devs))
+	for _, d := range devs {
+		bydesc[d.Descriptor] = d
+		descriptors = append(descriptors, d.Descriptor)
+	}
+
+	//Devices we think we hold but whose lock is gone, e.g. deleted by hand
+	held := make(map[string]bool)
+	for _, d := range ltable[lm.node] {
+		held[d] = true
+	}
+	for _, d := range lm.Owned() {
+		if !held[d] {
+			fmt.Printf("[locks] lock for %s disappeared, stopping it\n", d)
+			lm.stop(d, false)
+		}
+	}
+
+	now := time.Now()
+	for d, t := range lm.released {
+		if now.Sub(t) > reacquireDelay {
+			delete(lm.released, d)
+		}
+	}
+	acquire, release := planRebalance(descriptors, ltable, len(members), lm.node, lm.released)
+	for _, d := range release {
+		if lm.stop(d, true) {
+			fmt.Printf("[locks] handing off %s\n", d)
+			lm.released[d] = now
+		}
+	}
+	for _, d := range acquire {
+		lockkey := getEtcdLockKey(d, lm.prefix)
+		txr, err := lm.ec.Txn(ctx).
+			If(etcd.Compare(etcd.CreateRevision(lockkey), "=", 0)).
+			Then(etcd.OpPut(lockkey, lm.node, etcd.WithLease(lm.lease))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txr.Succeeded {
+			//Another node got there first
+			continue
+		}
+		lm.start(bydesc[d])
+	}
+	return nil
+}
+
+//planRebalance works out which devices this node should take and which it
+//should hand off so that no node holds more than its fair share. Every
+//member gets at least devices/members devices, and devices%members of them
+//one more. Devices that are no longer in the manifest are always handed
+//off.
+func planRebalance(descriptors []string, ltable map[string][]string, members int, node string, cooldown map[string]time.Time) (acquire []string, release []string) {
+	if members < 1 {
+		members = 1
+	}
+	exists := make(map[string]bool)
+	for _, d := range descriptors {
+		exists[d] = true
+	}
+	locked := make(map[string]bool)
+	for _, dz := range ltable {
+		for _, d := range dz {
+			locked[d] = true
+		}
+	}
+	var ours []string
+	for _, d := range ltable[node] {
+		if !exists[d] {
+			release = append(release, d)
+			continue
+		}
+		ours = append(ours, d)
+	}
+	sort.Strings(ours)
+	base := len(descriptors) / members
+	extra := len(descriptors) % members
+	//The nodes that already hold more than base keep the extra devices, in
+	//order of node id so that they all agree on who has to give one up
+	var over []string
+	for n, dz := range ltable {
+		cnt := 0
+		for _, d := range dz {
+			if exists[d] {
+				cnt++
+			}
+		}
+		if cnt > base {
+			over = append(over, n)
+		}
+	}
+	sort.Strings(over)
+	fair := base
+	idx := sort.SearchStrings(over, node)
+	if idx < len(over) && over[idx] == node {
+		if idx < extra {
+			fair = base + 1
+		}
+	} else if len(over) < extra {
+		fair = base + 1
+	}
+	if len(ours) > fair {
+		release = append(release, ours[fair:]...)
+		//Give the other nodes a chance to pick them up first
+		return nil, release
+	}
+	sorted := append([]string{}, descriptors...)
+	sort.Strings(sorted)
+	for _, d := range sorted {
+		if len(ours)+len(acquire) >= fair {
+			break
+		}
+		if locked[d] {
+			continue
+		}
+		if _, ok := cooldown[d]; ok {
+			continue
+		}
+		acquire = append(acquire, d)
+	}
+	return acquire, release
+}
+
+func (lm *LockManager) start(md *ManifestDevice) {
+	ctx, cancel := context.WithCancel(context.Background())
+	od := &ownedDevice{cancel: cancel, done: make(chan struct{})}
+	lm.mu.Lock()
+	lm.owned[md.Descriptor] = od
+	lm.mu.Unlock()
+	go func() {
+		defer close(od.done)
+		lm.handler(ctx, md)
+	}()
+}
+
+//stop releases a device in the background so that a device that is slow
+//to drain does not hold up the rebalance. It returns false if the device
+//is already being released.
+func (lm *LockManager) stop(descriptor string, deleteLock bool) bool {
+	lm.mu.Lock()
+	od, ok := lm.owned[descriptor]
+	if ok {
+		if od.releasing {
+			lm.mu.Unlock()
+			return false
+		}
+		od.releasing = true
+	}
+	lm.mu.Unlock()
+	lm.stopping.Add(1)
+	go func() {
+		defer lm.stopping.Done()
+		lm.release(descriptor, deleteLock)
+	}()
+	return true
+}
+
+//release stops the handler, waits for it to drain and then, if deleteLock
+//is set, deletes the lock so another node can take the device
+func (lm *LockManager) release(descriptor string, deleteLock bool) {
+	lm.mu.Lock()
+	od, ok := lm.owned[descriptor]
+	lm.mu.Unlock()
+	if ok {
+		od.cancel()
+		select {
+		case <-od.done:
+		case <-time.After(DrainTimeout):
+			fmt.Printf("[locks] %s did not drain within %s, releasing it anyway\n", descriptor, DrainTimeout)
+		}
+		lm.mu.Lock()
+		delete(lm.owned, descriptor)
+		lm.mu.Unlock()
+	}
+	if !deleteLock {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lockkey := getEtcdLockKey(descriptor, lm.prefix)
+	_, err := lm.ec.Txn(ctx).
+		If(etcd.Compare(etcd.Value(lockkey), "=", lm.node)).
+		Then(etcd.OpDelete(lockkey)).
+		Commit()
+	if err != nil {
+		fmt.Printf("[locks] could not release %s: %v\n", descriptor, err)
+	}
+}
+
+//releaseAll drains the devices in parallel so that shutting down does not
+//take DrainTimeout per device
+func (lm *LockManager) releaseAll(deleteLocks bool) {
+	wg := sync.WaitGroup{}
+	for _, d := range lm.Owned() {
+		wg.Add(1)
+		go func(d string) {
+			defer wg.Done()
+			lm.release(d, deleteLocks)
+		}(d)
+	}
+	wg.Wait()
+}
+
+//Release gives up every lock held by this node at once by revoking the
+//lease, the other nodes pick the devices up on their next rebalance. It
+//must only be called once Run has returned.
+func (lm *LockManager) Release() {
+	if lm.lease == 0 {
+		return
+	}
+	lm.kacancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := lm.ec.Revoke(ctx, lm.lease)
+	if err != nil {
+		fmt.Printf("[locks] could not revoke lease, the locks expire in %ds: %v\n", LockTTL, err)
+	} else {
+		fmt.Printf("[locks] released all locks for %q\n", lm.prefix)
+	}
+	lm.lease = 0
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package manifest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	devs := []string{"d1", "d2", "d3", "d4", "d5"}
+	four := []string{"d1", "d2", "d3", "d4"}
+	cases := []struct {
+		name     string
+		devs     []string
+		ltable   map[string][]string
+		members  int
+		node     string
+		cooldown map[string]time.Time
+		acquire  []string
+		release  []string
+	}{
+		{
+			name:    "alone takes everything",
+			ltable:  map[string][]string{},
+			members: 1,
+			acquire: devs,
+		},
+		{
+			name:    "takes up to the fair share",
+			ltable:  map[string][]string{"b": {"d1"}},
+			members: 2,
+			acquire: []string{"d2", "d3", "d4"},
+		},
+		{
+			name:    "new member makes us hand off",
+			ltable:  map[string][]string{"a": devs},
+			members: 2,
+			release: []string{"d4", "d5"},
+		},
+		{
+			name:    "balanced does nothing",
+			ltable:  map[string][]string{"a": {"d1", "d2", "d3"}, "b": {"d4", "d5"}},
+			members: 2,
+		},
+		{
+			name:     "handed off devices are left for others",
+			ltable:   map[string][]string{"a": {"d1"}},
+			members:  2,
+			cooldown: map[string]time.Time{"d2": time.Now()},
+			acquire:  []string{"d3", "d4"},
+		},
+		{
+			name:    "removed devices are released",
+			ltable:  map[string][]string{"a": {"d1", "gone"}},
+			members: 3,
+			release: []string{"gone"},
+			acquire: []string{"d2"},
+		},
+		{
+			name:    "first node over the base share keeps the extra device",
+			devs:    four,
+			ltable:  map[string][]string{"a": {"d1", "d2"}, "b": {"d3", "d4"}},
+			members: 3,
+		},
+		{
+			name:    "other nodes over the base share hand off",
+			devs:    four,
+			ltable:  map[string][]string{"a": {"d1", "d2"}, "b": {"d3", "d4"}},
+			members: 3,
+			node:    "b",
+			release: []string{"d4"},
+		},
+		{
+			name:    "idle node waits for a hand off",
+			devs:    four,
+			ltable:  map[string][]string{"a": {"d1", "d2"}, "b": {"d3", "d4"}},
+			members: 3,
+			node:    "c",
+		},
+		{
+			name:    "idle node takes the handed off device",
+			devs:    four,
+			ltable:  map[string][]string{"a": {"d1", "d2"}, "b": {"d3"}},
+			members: 3,
+			node:    "c",
+			acquire: []string{"d4"},
+		},
+		{
+			name:    "joining node makes the largest hand off",
+			ltable:  map[string][]string{"a": {"d1", "d2", "d3"}, "b": {"d4", "d5"}},
+			members: 3,
+			release: []string{"d3"},
+		},
+		{
+			name:    "joining node does not take more than its share",
+			ltable:  map[string][]string{"a": {"d1", "d2"}, "b": {"d4", "d5"}},
+			members: 3,
+			node:    "c",
+			acquire: []string{"d3"},
+		},
+		{
+			name:    "nodes with an extra device keep it when a node joins",
+			ltable:  map[string][]string{"a": {"d1", "d2"}, "b": {"d4", "d5"}, "c": {"d3"}},
+			members: 3,
+			node:    "b",
+		},
+	}
+	for _, c := range cases {
+		if c.devs == nil {
+			c.devs = devs
+		}
+		if c.node == "" {
+			c.node = "a"
+		}
+		acquire, release := planRebalance(c.devs, c.ltable, c.members, c.node, c.cooldown)
+		if !reflect.DeepEqual(acquire, c.acquire) || !reflect.DeepEqual(release, c.release) {
+			t.Errorf("%s: expected acquire %v release %v, got %v %v", c.name, c.acquire, c.release, acquire, release)
+		}
+	}
+}
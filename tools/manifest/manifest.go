@@ -106,6 +106,9 @@ func GetLockTable(ctx context.Context, etcdClient *etcd.Client, prefix string) (
 	}
 	return ltable, nil
 }
+
+//ObtainDeviceLock takes the lock for a single device.
+//Deprecated: use a LockManager, which also balances devices across nodes
 func ObtainDeviceLock(ctx context.Context, etcdClient *etcd.Client, md *ManifestDevice, myid string, prefix string) (bool, error) {
 	lockkey := getEtcdLockKey(md.Descriptor, prefix)
 	lockval := myid
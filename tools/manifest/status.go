@@ -0,0 +1,333 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ugorji/go/codec"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+const manifeststatuspath = "manifeststatus/"
+
+//HeartbeatInterval is how often the ingress daemons write the status of
+//their devices
+const HeartbeatInterval = 10 * time.Second
+
+//StatusTTL is how many seconds a status survives after the daemon that
+//wrote it stops heartbeating
+const StatusTTL = 30
+
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+)
+
+//DeviceStatus is the liveness of a device as reported by the daemon that
+//holds its lock. All times are in nanoseconds since the epoch. LastReceived
+//is when data last arrived from the device, not the time of the data, so a
+//device replaying old data still looks live.
+type DeviceStatus struct {
+	Descriptor      string  `codec:"-" yaml:"-"`
+	Node            string  `codec:"node" yaml:"node"`
+	State           string  `codec:"state" yaml:"state"`
+	LastReceived    int64   `codec:"lastreceived,omitempty" yaml:"lastreceived"`
+	LastError       string  `codec:"lasterror,omitempty" yaml:"lasterror,omitempty"`
+	LastErrorTime   int64   `codec:"lasterrortime,omitempty" yaml:"lasterrortime,omitempty"`
+	PointsPerSecond float64 `codec:"pps" yaml:"pps"`
+	Updated         int64   `codec:"updated" yaml:"updated"`
+}
+
+func getEtcdStatusKey(name string) string {
+	return fmt.Sprintf("%s%s%s", etcdprefix, manifeststatuspath, name)
+}
+
+func getNameFromEtcdStatusKey(etcdKey string) string {
+	return etcdKey[len(etcdprefix)+len(manifeststatuspath):]
+}
+
+//NodeName is the name a daemon reports as the owner of its devices. It is
+//NODE_NAME if set, otherwise the hostname (the pod name under kubernetes)
+func NodeName() string {
+	if n := os.Getenv("NODE_NAME"); n != "" {
+		return n
+	}
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}
+
+//RetrieveDeviceStatus returns nil if no daemon is heartbeating the device
+func RetrieveDeviceStatus(ctx context.Context, etcdClient *etcd.Client, descriptor string) (*DeviceStatus, error) {
+	resp, err := etcdClient.Get(ctx, getEtcdStatusKey(descriptor))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	ds := &DeviceStatus{Descriptor: descriptor}
+	err = codec.NewDecoderBytes(resp.Kvs[0].Value, mp).Decode(ds)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+func RetrieveMultipleDeviceStatus(ctx context.Context, etcdClient *etcd.Client, descprefix string) ([]*DeviceStatus, error) {
+	resp, err := etcdClient.Get(ctx, getEtcdStatusKey(descprefix), etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*DeviceStatus, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		ds := &DeviceStatus{Descriptor: getNameFromEtcdStatusKey(string(kv.Key))}
+		err = codec.NewDecoderBytes(kv.Value, mp).Decode(ds)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt status for %q: %v", ds.Descriptor, err)
+		}
+		rv = append(rv, ds)
+	}
+	return rv, nil
+}
+
+//StatusReporter periodically writes the status of every device this
+//process handles. The entries share a lease, so if the process dies they
+//disappear after StatusTTL.
+type StatusReporter struct {
+	ec   *etcd.Client
+	node string
+
+	mu      sync.Mutex
+	devices map[string]*DeviceHeartbeat
+	lease   etcd.LeaseID
+
+	//Held while writing to etcd so that a removed device is not written
+	//back by a heartbeat that was already in flight
+	writemu sync.Mutex
+}
+
+func NewStatusReporter(etcdClient *etcd.Client, node string) *StatusReporter {
+	return &StatusReporter{
+		ec:      etcdClient,
+		node:    node,
+		devices: make(map[string]*DeviceHeartbeat),
+	}
+}
+
+//Start heartbeats in the background until ctx is cancelled, at which
+//point the lease is revoked and the statuses are removed
+func (r *StatusReporter) Start(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(HeartbeatInterval)
+		defer t.Stop()
+		for {
+			err := r.heartbeat(ctx)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("[status] could not write device status: %v\n", err)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				r.revoke()
+				return
+			}
+		}
+	}()
+}
+
+//Device returns the heartbeat for the given descriptor, creating it if
+//required. A nil reporter returns a nil heartbeat, which discards
+//everything.
+func (r *StatusReporter) Device(descriptor string) *DeviceHeartbeat {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[descriptor]
+	if !ok {
+		d = &DeviceHeartbeat{
+			r:     r,
+			since: time.Now(),
+			status: DeviceStatus{
+				Descriptor: descriptor,
+				Node:       r.node,
+				State:      StateConnecting,
+			},
+		}
+		r.devices[descriptor] = d
+	}
+	return d
+}
+
+func (r *StatusReporter) heartbeat(ctx context.Context) error {
+	r.writemu.Lock()
+	defer r.writemu.Unlock()
+	r.mu.Lock()
+	devs := make([]*DeviceHeartbeat, 0, len(r.devices))
+	for _, d := range r.devices {
+		devs = append(devs, d)
+	}
+	lease := r.lease
+	r.mu.Unlock()
+
+	if lease == 0 {
+		resp, err := r.ec.Grant(ctx, StatusTTL)
+		if err != nil {
+			return err
+		}
+		lease = resp.ID
+	} else {
+		_, err := r.ec.KeepAliveOnce(ctx, lease)
+		if err != nil {
+			//The lease has probably expired, get a new one next time
+			r.mu.Lock()
+			r.lease = 0
+			r.mu.Unlock()
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.lease = lease
+	r.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range devs {
+		st := d.snapshot(now)
+		var b []byte
+		err := codec.NewEncoderBytes(&b, mp).Encode(&st)
+		if err != nil {
+			return err
+		}
+		_, err = r.ec.Put(ctx, getEtcdStatusKey(st.Descriptor), string(b), etcd.WithLease(lease))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *StatusReporter) revoke() {
+	r.writemu.Lock()
+	defer r.writemu.Unlock()
+	r.mu.Lock()
+	lease := r.lease
+	r.lease = 0
+	r.mu.Unlock()
+	if lease == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.ec.Revoke(ctx, lease)
+	if err != nil {
+		fmt.Printf("[status] could not revoke status lease: %v\n", err)
+	}
+}
+
+//DeviceHeartbeat accumulates the status of a single device between
+//heartbeats. A nil *DeviceHeartbeat is a no-op.
+type DeviceHeartbeat struct {
+	r      *StatusReporter
+	mu     sync.Mutex
+	status DeviceStatus
+	points int64
+	since  time.Time
+}
+
+func (d *DeviceHeartbeat) setState(state string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.status.State = state
+	d.mu.Unlock()
+}
+
+func (d *DeviceHeartbeat) Connecting() {
+	d.setState(StateConnecting)
+}
+
+func (d *DeviceHeartbeat) Connected() {
+	d.setState(StateConnected)
+}
+
+//Disconnected marks the device disconnected and records err, if it is
+//not nil, as the last error
+func (d *DeviceHeartbeat) Disconnected(err error) {
+	d.setState(StateDisconnected)
+	if err != nil {
+		d.Error(err)
+	}
+}
+
+//Error records an error without changing the connection state
+func (d *DeviceHeartbeat) Error(err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.status.LastError = err.Error()
+	d.status.LastErrorTime = time.Now().UnixNano()
+	d.mu.Unlock()
+}
+
+//Data records that n points were just received from the device
+func (d *DeviceHeartbeat) Data(n int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.points += int64(n)
+	d.status.LastReceived = time.Now().UnixNano()
+	d.mu.Unlock()
+}
+
+//Remove stops heartbeating the device and deletes its status, for when
+//this process no longer handles it
+func (d *DeviceHeartbeat) Remove() {
+	if d == nil {
+		return
+	}
+	r := d.r
+	r.mu.Lock()
+	if r.devices[d.status.Descriptor] == d {
+		delete(r.devices, d.status.Descriptor)
+	}
+	r.mu.Unlock()
+	r.writemu.Lock()
+	defer r.writemu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.ec.Delete(ctx, getEtcdStatusKey(d.status.Descriptor))
+	if err != nil {
+		fmt.Printf("[status] could not remove status of %s: %v\n", d.status.Descriptor, err)
+	}
+}
+
+//snapshot returns the status to write and resets the rate
+func (d *DeviceHeartbeat) snapshot(now time.Time) DeviceStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elapsed := now.Sub(d.since).Seconds(); elapsed > 0 {
+		d.status.PointsPerSecond = float64(d.points) / elapsed
+	}
+	d.points = 0
+	d.since = now
+	d.status.Updated = now.UnixNano()
+	return d.status
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+//testEtcd connects to the etcd at ETCD_ENDPOINT, the tests are skipped if
+//it is not set. The keys are written under a prefix of their own, which is
+//deleted by the returned function.
+func testEtcd(t *testing.T) (*etcd.Client, context.Context, func()) {
+	endpoint := os.Getenv("ETCD_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("ETCD_ENDPOINT is not set")
+	}
+	ec, err := etcd.New(etcd.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("could not connect to etcd: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	prefix := fmt.Sprintf("test/%s/%d/", t.Name(), time.Now().UnixNano())
+	SetEtcdKeyPrefix(prefix)
+	return ec, ctx, func() {
+		ec.Delete(context.Background(), prefix, etcd.WithPrefix())
+		SetEtcdKeyPrefix("")
+		cancel()
+		ec.Close()
+	}
+}
+
+func expectStatus(t *testing.T, ctx context.Context, ec *etcd.Client, descriptor string) *DeviceStatus {
+	ds, err := RetrieveDeviceStatus(ctx, ec, descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds == nil {
+		t.Fatalf("expected a status for %s", descriptor)
+	}
+	return ds
+}
+
+func expectNoStatus(t *testing.T, ctx context.Context, ec *etcd.Client, descriptor string) {
+	ds, err := RetrieveDeviceStatus(ctx, ec, descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds != nil {
+		t.Fatalf("expected no status for %s, got %+v", descriptor, ds)
+	}
+}
+
+func TestStatusPublish(t *testing.T) {
+	ec, ctx, done := testEtcd(t)
+	defer done()
+	r := NewStatusReporter(ec, "node1")
+	r.Device("dev1").Connected()
+	r.Device("dev1").Data(10)
+	r.Device("dev2").Disconnected(fmt.Errorf("connection refused"))
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ds := expectStatus(t, ctx, ec, "dev1")
+	if ds.Node != "node1" || ds.State != StateConnected || ds.LastReceived == 0 || ds.Updated == 0 || ds.PointsPerSecond <= 0 {
+		t.Fatalf("unexpected status %+v", ds)
+	}
+	ds = expectStatus(t, ctx, ec, "dev2")
+	if ds.State != StateDisconnected || ds.LastError != "connection refused" || ds.LastErrorTime == 0 {
+		t.Fatalf("unexpected status %+v", ds)
+	}
+	all, err := RetrieveMultipleDeviceStatus(ctx, ec, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Descriptor != "dev1" || all[1].Descriptor != "dev2" {
+		t.Fatalf("unexpected statuses %v", all)
+	}
+}
+
+func TestStatusRefresh(t *testing.T) {
+	ec, ctx, done := testEtcd(t)
+	defer done()
+	r := NewStatusReporter(ec, "node1")
+	r.Device("dev1").Connected()
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := expectStatus(t, ctx, ec, "dev1")
+	lease := r.lease
+	r.Device("dev1").Data(5)
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r.lease != lease {
+		t.Fatalf("expected the lease to be kept alive, not replaced")
+	}
+	ttl, err := ec.TimeToLive(ctx, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl.TTL <= 0 || ttl.TTL > StatusTTL {
+		t.Fatalf("unexpected lease TTL %d", ttl.TTL)
+	}
+	second := expectStatus(t, ctx, ec, "dev1")
+	if second.Updated <= first.Updated || second.LastReceived == 0 {
+		t.Fatalf("status was not refreshed: %+v then %+v", first, second)
+	}
+}
+
+func TestStatusExpiry(t *testing.T) {
+	ec, ctx, done := testEtcd(t)
+	defer done()
+	r := NewStatusReporter(ec, "node1")
+	r.Device("dev1").Connected()
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ctx, ec, "dev1")
+	//The lease expiring takes the statuses with it
+	if _, err := ec.Revoke(ctx, r.lease); err != nil {
+		t.Fatal(err)
+	}
+	expectNoStatus(t, ctx, ec, "dev1")
+	//The next heartbeat notices, and the one after that publishes again
+	//under a new lease
+	if err := r.heartbeat(ctx); err == nil {
+		t.Fatalf("expected the heartbeat on an expired lease to fail")
+	}
+	if r.lease != 0 {
+		t.Fatalf("expected the expired lease to be forgotten")
+	}
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ctx, ec, "dev1")
+}
+
+func TestStatusRemove(t *testing.T) {
+	ec, ctx, done := testEtcd(t)
+	defer done()
+	r := NewStatusReporter(ec, "node1")
+	hb := r.Device("dev1")
+	hb.Connected()
+	r.Device("dev2").Connected()
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hb.Remove()
+	expectNoStatus(t, ctx, ec, "dev1")
+	//A removed device is not written back by later heartbeats
+	if err := r.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectNoStatus(t, ctx, ec, "dev1")
+	expectStatus(t, ctx, ec, "dev2")
+	//and a nil heartbeat is a no-op
+	var nilhb *DeviceHeartbeat
+	nilhb.Data(1)
+	nilhb.Remove()
+}
+
+func TestStatusShutdown(t *testing.T) {
+	ec, ctx, done := testEtcd(t)
+	defer done()
+	r := NewStatusReporter(ec, "node1")
+	r.Device("dev1").Connected()
+	rctx, cancel := context.WithCancel(ctx)
+	r.Start(rctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ds, err := RetrieveDeviceStatus(ctx, ec, "dev1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status was not published")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	//Stopping the reporter revokes the lease, removing the statuses
+	cancel()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		ds, err := RetrieveDeviceStatus(ctx, ec, "dev1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status was not removed on shutdown")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package metrics holds the prometheus metrics shared by all of the ingress
+//daemons. Per-device metrics are labelled with whatever name the daemon
+//uses for the device in its logs (a descriptor short form, a serial number
+//or a collection).
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//DefaultAddress is where /metrics is served if METRICS_ADDRESS is not set
+const DefaultAddress = ":2112"
+
+const namespace = "smartgridstore"
+const subsystem = "ingress"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	pointsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "points_received_total",
+		Help:      "Points received from the device",
+	}, []string{"device"})
+	pointsInserted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "points_inserted_total",
+		Help:      "Points inserted into the database",
+	}, []string{"device"})
+	pointsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "points_dropped_total",
+		Help:      "Points that were received but discarded, e.g. because a queue was full or an insert failed",
+	}, []string{"device"})
+	pointsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "points_rejected_total",
+		Help:      "Points or frames that were malformed or invalid",
+	}, []string{"device"})
+	reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "reconnects_total",
+		Help:      "Times the connection to the device was lost and re-established",
+	}, []string{"device"})
+	insertLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "insert_latency_seconds",
+		Help:      "Time taken by each stage of inserting a batch",
+		//1ms to about a minute
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 17),
+	}, []string{"stage"})
+	lastFrame = &lastFrameCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "seconds_since_last_frame"),
+			"Seconds since data was last received from the device",
+			[]string{"device"}, nil),
+		last: make(map[string]time.Time),
+	}
+	queues = &queueCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "queue_depth"),
+			"Number of items waiting in a queue",
+			[]string{"queue"}, nil),
+		depth: make(map[string]func() float64),
+	}
+)
+
+func init() {
+	registry.MustRegister(
+		pointsReceived,
+		pointsInserted,
+		pointsDropped,
+		pointsRejected,
+		reconnects,
+		insertLatency,
+		lastFrame,
+		queues,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+//Serve starts the /metrics endpoint in the background on METRICS_ADDRESS,
+//or DefaultAddress if it is not set. Setting METRICS_ADDRESS to "none"
+//disables the endpoint.
+func Serve() {
+	addr := os.Getenv("METRICS_ADDRESS")
+	if addr == "none" {
+		return
+	}
+	if addr == "" {
+		addr = DefaultAddress
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		fmt.Printf("WARNING: metrics endpoint on %s failed: %v\n", addr, err)
+	}()
+}
+
+//Handler returns the handler that serves the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+//ObserveLatency records how long a stage of inserting a batch took
+func ObserveLatency(stage string, d time.Duration) {
+	insertLatency.WithLabelValues(stage).Observe(d.Seconds())
+}
+
+//QueueDepth exposes the depth of a queue, f is called on every scrape.
+//Calling it again with the same queue name replaces f.
+func QueueDepth(queue string, f func() float64) {
+	queues.mu.Lock()
+	queues.depth[queue] = f
+	queues.mu.Unlock()
+}
+
+//Device holds the metrics for a single device. A nil *Device discards
+//everything, which is convenient for tests and for data that arrives
+//before the device is known.
+type Device struct {
+	name       string
+	received   prometheus.Counter
+	inserted   prometheus.Counter
+	dropped    prometheus.Counter
+	rejected   prometheus.Counter
+	reconnects prometheus.Counter
+}
+
+//ForDevice returns the metrics for the named device. It is cheap enough to
+//call for every batch, but callers with a long lived device should keep
+//the result.
+func ForDevice(name string) *Device {
+	return &Device{
+		name:       name,
+		received:   pointsReceived.WithLabelValues(name),
+		inserted:   pointsInserted.WithLabelValues(name),
+		dropped:    pointsDropped.WithLabelValues(name),
+		rejected:   pointsRejected.WithLabelValues(name),
+		reconnects: reconnects.WithLabelValues(name),
+	}
+}
+
+//Received counts points received from the device and marks the time of
+//the last frame
+func (d *Device) Received(n int) {
+	if d == nil {
+		return
+	}
+	d.received.Add(float64(n))
+	d.Frame()
+}
+
+//Frame marks that data was received from the device just now
+func (d *Device) Frame() {
+	if d == nil {
+		return
+	}
+	lastFrame.mark(d.name, time.Now())
+}
+
+func (d *Device) Inserted(n int) {
+	if d == nil {
+		return
+	}
+	d.inserted.Add(float64(n))
+}
+
+func (d *Device) Dropped(n int) {
+	if d == nil {
+		return
+	}
+	d.dropped.Add(float64(n))
+}
+
+func (d *Device) Rejected(n int) {
+	if d == nil {
+		return
+	}
+	d.rejected.Add(float64(n))
+}
+
+func (d *Device) Reconnected() {
+	if d == nil {
+		return
+	}
+	d.reconnects.Inc()
+}
+
+//Forget removes the metrics for a device that is no longer handled here,
+//so that it doesn't look like it stopped sending data
+func (d *Device) Forget() {
+	if d == nil {
+		return
+	}
+	for _, v := range []*prometheus.CounterVec{pointsReceived, pointsInserted, pointsDropped, pointsRejected, reconnects} {
+		v.DeleteLabelValues(d.name)
+	}
+	lastFrame.forget(d.name)
+}
+
+//The time since the last frame is computed at scrape time, a gauge would
+//only be as fresh as the last frame
+type lastFrameCollector struct {
+	desc *prometheus.Desc
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (c *lastFrameCollector) mark(device string, t time.Time) {
+	c.mu.Lock()
+	c.last[device] = t
+	c.mu.Unlock()
+}
+
+func (c *lastFrameCollector) forget(device string) {
+	c.mu.Lock()
+	delete(c.last, device)
+	c.mu.Unlock()
+}
+
+func (c *lastFrameCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lastFrameCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for device, t := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(t).Seconds(), device)
+	}
+}
+
+type queueCollector struct {
+	desc  *prometheus.Desc
+	mu    sync.Mutex
+	depth map[string]func() float64
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for queue, f := range c.depth {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, f(), queue)
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 	"github.com/BTrDB/smartgridstore/tools/upmuparser"
 	"github.com/pborman/uuid"
 
@@ -26,6 +27,7 @@ const UpmuSpaceString = "c9bbebff-ff40-4dbe-987e-f9e96afb7a57"
 var UpmuSpace = uuid.Parse(UpmuSpaceString)
 var bc *btrdb.BTrDB
 var ec *etcd.Client
+var status *manifest.StatusReporter
 
 func descriptorFromSerial(serial string) string {
 	return strings.ToLower(fmt.Sprintf("psl.pqube3.%s", serial))
@@ -36,10 +38,12 @@ func getUUID(serial string, streamname string) uuid.UUID {
 	return uuid.NewSHA1(UpmuSpace, []byte(streamid))
 }
 
-func processMessage(ctx context.Context, sernum string, data []byte) bool {
+func processMessage(ctx context.Context, sernum string, data []byte, dm *metrics.Device, hb *manifest.DeviceHeartbeat) bool {
 	parsed, err := upmuparser.ParseSyncOutArray(data)
 	if err != nil {
 		log.Printf("Could not parse data from %v: %v", sernum, err)
+		dm.Rejected(1)
+		hb.Error(err)
 		return false
 	}
 
@@ -103,10 +107,15 @@ func processMessage(ctx context.Context, sernum string, data []byte) bool {
 			}
 		}
 
+		dm.Received(len(dataset))
+		hb.Data(len(dataset))
+		insertStart := time.Now()
 		err = s.Insert(ctx, dataset)
 		if err != nil {
 			log.Fatalf("Could not insert stream %v of %v into BTrDB: %v", upmuparser.STREAMS[sid], descriptorFromSerial(sernum), err)
 		}
+		metrics.ObserveLatency("insert", time.Since(insertStart))
+		dm.Inserted(len(dataset))
 	}
 
 	return true
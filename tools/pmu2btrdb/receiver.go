@@ -24,6 +24,8 @@ import (
 
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/BTrDB/smartgridstore/tools"
+	"github.com/BTrDB/smartgridstore/tools/manifest"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 )
 
 const VersionMajor = tools.VersionMajor
@@ -48,6 +50,9 @@ var MaxConcurrentInserts int64 = 1024
 
 var insertionSemaphore chan struct{}
 
+//The number of messages waiting for a slot in insertionSemaphore
+var waitingInserts int64
+
 func roundUp4(x uint32) uint32 {
 	return (x + 3) & 0xFFFFFFFC
 }
@@ -65,6 +70,20 @@ var response insertstats
 
 var verbose bool
 
+//Devices connect to us, so a reconnect is any connection after the first
+var seenDevicesMu sync.Mutex
+var seenDevices = make(map[string]bool)
+
+func deviceConnected(sernum string) {
+	seenDevicesMu.Lock()
+	seen := seenDevices[sernum]
+	seenDevices[sernum] = true
+	seenDevicesMu.Unlock()
+	if seen {
+		metrics.ForDevice(sernum).Reconnected()
+	}
+}
+
 func resetStats(stats *insertstats) {
 	atomic.StoreUint64(&stats.minlatency, math.MaxUint64)
 	atomic.StoreUint64(&stats.maxlatency, 0)
@@ -159,6 +178,8 @@ func handlePMUConn(conn *net.TCPConn) {
 	var snindex uint32
 	var sernum string
 	var newsernum string
+	var dm *metrics.Device
+	var hb *manifest.DeviceHeartbeat
 
 	/* DTBUFFER stores the part of the uPMU data received so far.
 	   If a file is bigger than expected, we allocate a bigger buffer, specially for that file. */
@@ -243,6 +264,12 @@ func handlePMUConn(conn *net.TCPConn) {
 				if snindex == lenpsn {
 					newsernum = string(snbuffer[:lensn])
 					// we used to warn if the serial number changed from previous received frame
+					if dm == nil || newsernum != sernum {
+						deviceConnected(newsernum)
+						dm = metrics.ForDevice(newsernum)
+						hb = status.Device(descriptorFromSerial(newsernum))
+						hb.Connected()
+					}
 					sernum = newsernum
 				}
 			}
@@ -263,21 +290,26 @@ func handlePMUConn(conn *net.TCPConn) {
 						fmt.Printf("Received %s: serial number is %s, length is %v\n", filepath, sernum, lendt)
 					}
 
+					dm.Frame()
 					go func() {
 						queuestart := time.Now()
+						atomic.AddInt64(&waitingInserts, 1)
 						insertionSemaphore <- struct{}{}
+						atomic.AddInt64(&waitingInserts, -1)
 						defer func() {
 							<-insertionSemaphore
 						}()
 						updateStats(&queueing, uint64(time.Since(queuestart)))
+						metrics.ObserveLatency("queue", time.Since(queuestart))
 
 						processstart := time.Now()
-						success := processMessage(context.TODO(), sernum, dtbuffer[:lendt])
+						success := processMessage(context.TODO(), sernum, dtbuffer[:lendt], dm, hb)
 						resp := sendid
 						if !success {
 							resp = FAILUREMSG
 						}
 						updateStats(&processing, uint64(time.Since(processstart)))
+						metrics.ObserveLatency("process", time.Since(processstart))
 
 						respstart := time.Now()
 						outlock.Lock()
@@ -285,13 +317,16 @@ func handlePMUConn(conn *net.TCPConn) {
 						outlock.Unlock()
 						if erw != nil {
 							fmt.Printf("Connection lost: %v (write failed: %v)\n", conn.RemoteAddr().String(), erw)
+							hb.Disconnected(erw)
 						}
 						updateStats(&response, uint64(time.Since(respstart)))
+						metrics.ObserveLatency("response", time.Since(respstart))
 					}()
 				}
 			}
 			if err != nil {
 				fmt.Printf("Connection lost: %v (reason: %v)\n", conn.RemoteAddr().String(), err)
+				hb.Disconnected(err)
 				return
 			}
 		}
@@ -304,6 +339,7 @@ func main() {
 		os.Exit(0)
 	}
 	fmt.Printf("Booting pmu2btrdb version %d.%d.%d\n", VersionMajor, VersionMinor, VersionPatch)
+	metrics.Serve()
 	if len(os.Args) > 1 && os.Args[1] == "-verbose" {
 		verbose = true
 		fmt.Printf("Verbose mode is turned on")
@@ -336,6 +372,12 @@ func main() {
 	}
 
 	insertionSemaphore = make(chan struct{}, MaxConcurrentInserts)
+	metrics.QueueDepth("waiting", func() float64 {
+		return float64(atomic.LoadInt64(&waitingInserts))
+	})
+	metrics.QueueDepth("inserting", func() float64 {
+		return float64(len(insertionSemaphore))
+	})
 
 	bc, err = btrdb.Connect(context.TODO(), btrdb.EndpointsFromEnv()...)
 	if err != nil {
@@ -355,6 +397,8 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not connect to etcd: %v\n", err)
 	}
+	status = manifest.NewStatusReporter(ec, manifest.NodeName())
+	status.Start(context.Background())
 
 	bindaddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("0.0.0.0:%v", Port))
 	if err != nil {
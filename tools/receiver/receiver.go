@@ -19,6 +19,7 @@ import (
 
 	"github.com/ceph/go-ceph/rados"
 	"github.com/BTrDB/smartgridstore/tools"
+	"github.com/BTrDB/smartgridstore/tools/metrics"
 
 	logging "github.com/op/go-logging"
 )
@@ -46,6 +47,20 @@ var aliasCache map[string]cacheEntry
 
 var FAILUREMSG = make([]byte, 4, 4)
 
+//Devices connect to us, so a reconnect is any connection after the first
+var seenDevicesMu sync.Mutex
+var seenDevices = make(map[string]bool)
+
+func deviceConnected(sernum string) {
+	seenDevicesMu.Lock()
+	seen := seenDevices[sernum]
+	seenDevices[sernum] = true
+	seenDevicesMu.Unlock()
+	if seen {
+		metrics.ForDevice(sernum).Reconnected()
+	}
+}
+
 func lookupAlias(serial string) string {
 	//TODO maybe replace this with some etcd based alias from the manifest
 	return fmt.Sprintf("psl.pqube3.%s", serial)
@@ -149,6 +164,7 @@ func handlePMUConn(conn *net.TCPConn) {
 	var snindex uint32
 	var sernum string
 	var newsernum string
+	var dm *metrics.Device
 
 	/* DTBUFFER stores the part of the uPMU data received so far.
 	   If a file is bigger than expected, we allocate a bigger buffer, specially for that file. */
@@ -231,6 +247,10 @@ func handlePMUConn(conn *net.TCPConn) {
 				if snindex == lenpsn {
 					newsernum = string(snbuffer[:lensn])
 					// we used to warn if the serial number changed from previous received frame
+					if dm == nil || newsernum != sernum {
+						deviceConnected(newsernum)
+						dm = metrics.ForDevice(newsernum)
+					}
 					sernum = newsernum
 				}
 			}
@@ -249,7 +269,10 @@ func handlePMUConn(conn *net.TCPConn) {
 					alias := lookupAlias(sernum)
 					recvdfull = true
 					fmt.Printf("Received %s: serial number is %s (%s), length is %v\n", filepath, sernum, alias, lendt)
+					dm.Frame()
+					writeStart := time.Now()
 					resp = processMessage(sendid, conn.RemoteAddr().String(), sernum, filepath, dtbuffer[:lendt])
+					metrics.ObserveLatency("ceph_write", time.Since(writeStart))
 					_, erw = conn.Write(resp)
 					if erw != nil {
 						fmt.Printf("Connection lost: %v (write failed: %v)\n", conn.RemoteAddr().String(), erw)
@@ -271,6 +294,7 @@ func main() {
 		os.Exit(0)
 	}
 	fmt.Printf("Booting receiver version %d.%d.%d\n", VersionMajor, VersionMinor, VersionPatch)
+	metrics.Serve()
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -326,6 +350,9 @@ func main() {
 		}
 		rhPool <- h
 	}
+	metrics.QueueDepth("writing", func() float64 {
+		return float64(NUM_RHANDLES - len(rhPool))
+	})
 
 	var bindaddr *net.TCPAddr
 	var listener *net.TCPListener
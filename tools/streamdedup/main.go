@@ -0,0 +1,286 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	"github.com/pborman/uuid"
+	"github.com/urfave/cli"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+const insertBatch = 5000
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "streamdedup"
+	app.Usage = "merge the duplicate streams gen2ingress created before its stream UUIDs were deterministic"
+	app.ArgsUsage = "<collection prefix>"
+	app.Action = run
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "btrdb",
+			Value: "127.0.0.1:4410",
+			Usage: "btrdb API port",
+		},
+		cli.BoolFlag{
+			Name:  "apply",
+			Usage: "merge the duplicates, otherwise they are only listed",
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type streamInfo struct {
+	s           *btrdb.Stream
+	uu          uuid.UUID
+	collection  string
+	name        string
+	annotations map[string]string
+	count       uint64
+}
+
+func run(c *cli.Context) error {
+	if c.NArg() != 1 {
+		cli.ShowAppHelp(c)
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	db, err := btrdb.Connect(ctx, c.String("btrdb"))
+	if err != nil {
+		fmt.Printf("could not connect to btrdb: %v\n", err)
+		os.Exit(1)
+	}
+	sz, err := db.LookupStreams(ctx, c.Args().First(), true, nil, nil)
+	if err != nil {
+		fmt.Printf("could not list streams: %v\n", err)
+		os.Exit(1)
+	}
+
+	//Streams may be duplicates if they have the same name in the same
+	//collection, planMerge decides which of them really are
+	groups := make(map[[2]string][]*streamInfo)
+	for _, s := range sz {
+		si, err := describe(ctx, s)
+		if err != nil {
+			fmt.Printf("could not read stream %s: %v\n", s.UUID(), err)
+			os.Exit(1)
+		}
+		key := [2]string{si.collection, si.name}
+		groups[key] = append(groups[key], si)
+	}
+	keys := make([][2]string, 0, len(groups))
+	for k, g := range groups {
+		if len(g) > 1 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	failed := false
+	for _, k := range keys {
+		g := groups[k]
+		survivor, dups, err := planMerge(g)
+		if err != nil {
+			fmt.Printf("WARNING: %s name=%q has %d streams, skipping it: %v\n", k[0], k[1], len(g), err)
+			continue
+		}
+		fmt.Printf("%s name=%q has %d streams, keeping %s (%d points)\n", k[0], k[1], len(g), survivor.uu, survivor.count)
+		merging := make(map[*streamInfo]bool)
+		for _, dup := range dups {
+			merging[dup] = true
+		}
+		for _, si := range g {
+			if si != survivor && !merging[si] {
+				fmt.Printf("  leaving %s (%d points), it is a different signal\n", si.uu, si.count)
+			}
+		}
+		for _, dup := range dups {
+			fmt.Printf("  merging %s (%d points)\n", dup.uu, dup.count)
+			if !c.Bool("apply") {
+				continue
+			}
+			err := merge(ctx, survivor, dup)
+			if err != nil {
+				fmt.Printf("  FAILED: %v\n", err)
+				failed = true
+			}
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Printf("No duplicates found among %d streams\n", len(sz))
+	} else if !c.Bool("apply") {
+		fmt.Printf("Found %d duplicated streams, run with --apply to merge them\n", len(keys))
+	}
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func describe(ctx context.Context, s *btrdb.Stream) (*streamInfo, error) {
+	col, err := s.Collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := s.Tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	anns, _, err := s.Annotations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cnt, err := count(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return &streamInfo{s: s, uu: s.UUID(), collection: col, name: tags["name"], annotations: anns, count: cnt}, nil
+}
+
+func count(ctx context.Context, s *btrdb.Stream) (uint64, error) {
+	csp, _, cerr := s.Windows(ctx, btrdb.MinimumTime, btrdb.MaximumTime, uint64(btrdb.MaximumTime-btrdb.MinimumTime), 0, 0)
+	var total uint64
+	for sp := range csp {
+		total += sp.Count
+	}
+	return total, <-cerr
+}
+
+//identity returns the device and signal a stream was created for, or
+//false for streams created before gen2ingress annotated them
+func identity(si *streamInfo) ([2]string, bool) {
+	signal, ok := si.annotations["signal"]
+	if !ok {
+		return [2]string{}, false
+	}
+	desc, ok := si.annotations["descriptor"]
+	if !ok {
+		desc = "collection:" + si.collection
+	}
+	return [2]string{desc, signal}, true
+}
+
+//planMerge picks the stream to keep out of streams with the same name in
+//the same collection, and the ones to merge into it. Different devices can
+//publish the same name into a collection, each with its own deterministic
+//stream, so a group with more than one is refused. The stream that is kept
+//is the deterministic one if there is one, otherwise the one with the most
+//data so that the least is copied. Streams created before gen2ingress
+//annotated them can only be told apart by name and are merged, others only
+//if they have the same device and signal as the stream that is kept.
+func planMerge(g []*streamInfo) (*streamInfo, []*streamInfo, error) {
+	var survivor *streamInfo
+	for _, si := range g {
+		if !gen2ingress.Deterministic(si.uu, si.collection, si.annotations) {
+			continue
+		}
+		if survivor != nil {
+			return nil, nil, fmt.Errorf("%s and %s both have deterministic UUIDs, they belong to different devices or signals", survivor.uu, si.uu)
+		}
+		survivor = si
+	}
+	if survivor == nil {
+		sort.Slice(g, func(i, j int) bool {
+			if g[i].count != g[j].count {
+				return g[i].count > g[j].count
+			}
+			return g[i].uu.String() < g[j].uu.String()
+		})
+		survivor = g[0]
+	}
+	sid, sok := identity(survivor)
+	dups := []*streamInfo{}
+	for _, si := range g {
+		if si == survivor {
+			continue
+		}
+		id, ok := identity(si)
+		if ok && (!sok || id != sid) {
+			continue
+		}
+		dups = append(dups, si)
+	}
+	return survivor, dups, nil
+}
+
+//merge copies the data and any missing annotations of dup into survivor,
+//checks that everything arrived and then obliterates dup
+func merge(ctx context.Context, survivor *streamInfo, dup *streamInfo) error {
+	before, err := count(ctx, survivor.s)
+	if err != nil {
+		return err
+	}
+	pts, _, cerr := dup.s.RawValues(ctx, btrdb.MinimumTime, btrdb.MaximumTime, 0)
+	buf := make([]btrdb.RawPoint, 0, insertBatch)
+	var inserr error
+	for p := range pts {
+		if inserr != nil {
+			//Drain the channel so the query finishes
+			continue
+		}
+		buf = append(buf, p)
+		if len(buf) == insertBatch {
+			inserr = survivor.s.Insert(ctx, buf)
+			buf = buf[:0]
+		}
+	}
+	if err := <-cerr; err != nil {
+		return fmt.Errorf("could not read %s: %v", dup.s.UUID(), err)
+	}
+	if inserr == nil && len(buf) > 0 {
+		inserr = survivor.s.Insert(ctx, buf)
+	}
+	if inserr != nil {
+		return fmt.Errorf("could not insert into %s: %v", survivor.s.UUID(), inserr)
+	}
+	err = survivor.s.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	changes := make(map[string]*string)
+	for k, v := range dup.annotations {
+		if _, ok := survivor.annotations[k]; !ok {
+			vc := v
+			changes[k] = &vc
+		}
+	}
+	if len(changes) > 0 {
+		_, aver, err := survivor.s.Annotations(ctx)
+		if err != nil {
+			return err
+		}
+		err = survivor.s.CompareAndSetAnnotation(ctx, aver, changes)
+		if err != nil {
+			return fmt.Errorf("could not copy annotations: %v", err)
+		}
+	}
+
+	after, err := count(ctx, survivor.s)
+	if err != nil {
+		return err
+	}
+	if after < before+dup.count {
+		return fmt.Errorf("expected %d points in %s after the merge, found %d, leaving %s in place", before+dup.count, survivor.s.UUID(), after, dup.s.UUID())
+	}
+	survivor.count = after
+	return dup.s.Obliterate(ctx)
+}
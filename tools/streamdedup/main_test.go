@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/BTrDB/smartgridstore/tools/gen2ingress"
+	"github.com/pborman/uuid"
+)
+
+//deterministic is a stream as gen2ingress creates it today
+func deterministic(descriptor string, count uint64) *streamInfo {
+	return &streamInfo{
+		uu:          gen2ingress.StreamUUID(descriptor, "L1MAG"),
+		collection:  "sub1",
+		name:        "L1MAG",
+		annotations: map[string]string{"descriptor": descriptor, "signal": "L1MAG"},
+		count:       count,
+	}
+}
+
+//legacy is a stream created before the UUIDs were deterministic
+func legacy(count uint64) *streamInfo {
+	return &streamInfo{
+		uu:          uuid.NewRandom(),
+		collection:  "sub1",
+		name:        "L1MAG",
+		annotations: map[string]string{},
+		count:       count,
+	}
+}
+
+func TestPlanMergeTwoDevices(t *testing.T) {
+	a := deterministic("test.pmu.a", 10)
+	b := deterministic("test.pmu.b", 20)
+	_, _, err := planMerge([]*streamInfo{a, b, legacy(5)})
+	if err == nil {
+		t.Fatalf("streams of two devices with the same name were merged")
+	}
+}
+
+func TestPlanMerge(t *testing.T) {
+	det := deterministic("test.pmu.a", 10)
+	old := legacy(100)
+	//Annotated but not deterministic, e.g. created by another tool
+	same := legacy(1)
+	same.annotations = map[string]string{"descriptor": "test.pmu.a", "signal": "L1MAG"}
+	other := legacy(1)
+	other.annotations = map[string]string{"descriptor": "test.pmu.b", "signal": "L1MAG"}
+	survivor, dups, err := planMerge([]*streamInfo{old, other, det, same})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if survivor != det {
+		t.Fatalf("expected the deterministic stream to be kept")
+	}
+	if len(dups) != 2 {
+		t.Fatalf("expected two streams to be merged, got %d", len(dups))
+	}
+	for _, d := range dups {
+		if d == other {
+			t.Fatalf("the stream of another device was merged")
+		}
+	}
+
+	//Without a deterministic stream the biggest is kept
+	small := legacy(1)
+	survivor, dups, err = planMerge([]*streamInfo{small, old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if survivor != old || len(dups) != 1 || dups[0] != small {
+		t.Fatalf("expected the biggest stream to be kept")
+	}
+}
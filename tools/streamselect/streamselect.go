@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package streamselect chooses streams by collection and tag patterns, the
+//same way for every tool that reads streams out of BTrDB
+package streamselect
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	v4 "gopkg.in/BTrDB/btrdb.v4"
+)
+
+//Selected is a stream chosen by Lookup
+type Selected struct {
+	Stream     *v4.Stream
+	Collection string
+	Tags       map[string]string
+	//A readable name for the stream, see Describe
+	Desc string
+}
+
+//IsPattern returns true if the string has any path.Match special characters
+func IsPattern(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+//CheckPatterns returns an error if any of the tag patterns is malformed
+func CheckPatterns(patterns map[string]string) error {
+	for k, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q for tag %q", p, k)
+		}
+	}
+	return nil
+}
+
+//InTree returns true if the collection is the prefix or below it. A prefix
+//of "a/b" includes "a/b" and "a/b/c" but not "a/bc".
+func InTree(col string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return col == prefix || strings.HasPrefix(col, prefix+"/")
+}
+
+//Rewrite returns the collection with srcPrefix replaced by dstPrefix, or
+//false if the collection is not in the tree under srcPrefix
+func Rewrite(col string, srcPrefix string, dstPrefix string) (string, bool) {
+	if !InTree(col, srcPrefix) {
+		return "", false
+	}
+	srcPrefix = strings.TrimSuffix(srcPrefix, "/")
+	dstPrefix = strings.TrimSuffix(dstPrefix, "/")
+	return dstPrefix + col[len(srcPrefix):], true
+}
+
+//MatchTags returns true if every pattern matches the tag of the same name.
+//A stream without one of the tags does not match.
+func MatchTags(tags map[string]string, patterns map[string]string) bool {
+	for k, p := range patterns {
+		v, ok := tags[k]
+		if !ok {
+			return false
+		}
+		if m, _ := path.Match(p, v); !m {
+			return false
+		}
+	}
+	return true
+}
+
+//Describe returns a readable name for a stream
+func Describe(col string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tagstr := ""
+	for _, k := range keys {
+		tagstr = tagstr + fmt.Sprintf("%q=%q,", k, tags[k])
+	}
+	return fmt.Sprintf("%s/%s", col, tagstr)
+}
+
+//Lookup finds the streams in a collection, or in the collection and all the
+//collections below it if tree is true, whose tags match the patterns. The
+//patterns use path.Match syntax, e.g. "L?MAG" or "*". The streams are sorted
+//by collection and tags.
+func Lookup(ctx context.Context, bc *v4.BTrDB, collection string, tree bool, patterns map[string]string) ([]*Selected, error) {
+	//Tags without wildcards can be filtered by the server
+	tagopt := make(map[string]*string)
+	for k, p := range patterns {
+		if !IsPattern(p) {
+			pp := p
+			tagopt[k] = &pp
+		}
+	}
+	collection = strings.TrimSuffix(collection, "/")
+	sz, err := bc.LookupStreams(ctx, collection, tree, tagopt, nil)
+	if err != nil {
+		return nil, err
+	}
+	rv := []*Selected{}
+	for _, s := range sz {
+		col, err := s.Collection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		//The server matches the prefix as a string
+		if tree && !InTree(col, collection) {
+			continue
+		}
+		tags, err := s.Tags(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !MatchTags(tags, patterns) {
+			continue
+		}
+		rv = append(rv, &Selected{
+			Stream:     s,
+			Collection: col,
+			Tags:       tags,
+			Desc:       Describe(col, tags),
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Desc < rv[j].Desc
+	})
+	return rv, nil
+}
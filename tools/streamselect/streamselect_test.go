@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package streamselect
+
+import "testing"
+
+func TestRewrite(t *testing.T) {
+	for _, c := range []struct {
+		col string
+		src string
+		dst string
+		out string
+		ok  bool
+	}{
+		{"sub1", "sub1", "mirror/sub1", "mirror/sub1", true},
+		{"sub1/pmu1", "sub1", "mirror/sub1", "mirror/sub1/pmu1", true},
+		{"sub1/pmu1/a", "sub1/", "mirror/", "mirror/pmu1/a", true},
+		{"sub10/pmu1", "sub1", "mirror/sub1", "", false},
+		{"other/sub1", "sub1", "mirror/sub1", "", false},
+	} {
+		out, ok := Rewrite(c.col, c.src, c.dst)
+		if out != c.out || ok != c.ok {
+			t.Errorf("%q %q %q: expected %q %v got %q %v", c.col, c.src, c.dst, c.out, c.ok, out, ok)
+		}
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	tags := map[string]string{"name": "L1MAG", "unit": "volts"}
+	for _, c := range []struct {
+		patterns map[string]string
+		match    bool
+	}{
+		{nil, true},
+		{map[string]string{"name": "L?MAG"}, true},
+		{map[string]string{"name": "L[12]MAG", "unit": "*"}, true},
+		{map[string]string{"name": "C*"}, false},
+		{map[string]string{"phase": "*"}, false},
+	} {
+		if MatchTags(tags, c.patterns) != c.match {
+			t.Errorf("%v: expected %v", c.patterns, c.match)
+		}
+	}
+}
+
+func TestCheckPatterns(t *testing.T) {
+	if err := CheckPatterns(map[string]string{"name": "L*", "unit": "volts"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPatterns(map[string]string{"name": "L[1"}); err == nil {
+		t.Fatalf("bad pattern was accepted")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	d := Describe("sub1/pmu1", map[string]string{"unit": "volts", "name": "L1MAG"})
+	if d != `sub1/pmu1/"name"="L1MAG","unit"="volts",` {
+		t.Fatalf("unexpected description %s", d)
+	}
+}